@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidAccountToken covers every way an emailed link can be bad:
+// tampered, expired, already used or for a deleted account.
+var ErrInvalidAccountToken = errors.New("invalid or expired token")
+
+// accountTokenVersion prefixes every signed payload.
+const accountTokenVersion = "a1"
+
+// What an account token may be used for. A token for one purpose is never
+// accepted for another.
+const (
+	PurposePasswordReset = "password-reset"
+	PurposeVerifyEmail   = "verify-email"
+)
+
+// accountTokenKey derives the HMAC key for emailed tokens from the JWT
+// secret, separate from the key used for ticket credentials.
+func accountTokenKey() []byte {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("account tokens"))
+	return mac.Sum(nil)
+}
+
+// accountTokenState is the part of the user a token is bound to. It goes
+// into the signature but not the token, so a token stops verifying as soon
+// as it has done its job: resetting the password changes the hash, and
+// verifying or changing the email changes the email state. That makes the
+// tokens single use without storing them.
+func accountTokenState(purpose string, user User) string {
+	switch purpose {
+	case PurposePasswordReset:
+		return user.Password
+	case PurposeVerifyEmail:
+		return user.Email + "|" + strconv.FormatBool(user.IsVerified)
+	}
+	return ""
+}
+
+func accountTokenMAC(encoded, state string) []byte {
+	mac := hmac.New(sha256.New, accountTokenKey())
+	mac.Write([]byte(encoded))
+	mac.Write([]byte{0})
+	mac.Write([]byte(state))
+	return mac.Sum(nil)
+}
+
+// signAccountToken returns a token that lets its bearer act for user once,
+// for purpose, until ttl has passed.
+func signAccountToken(purpose string, user User, ttl time.Duration) string {
+	payload := strings.Join([]string{
+		accountTokenVersion,
+		purpose,
+		user.UserID,
+		strconv.FormatInt(time.Now().Add(ttl).Unix(), 10),
+	}, "|")
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(accountTokenMAC(encoded, accountTokenState(purpose, user)))
+}
+
+// verifyAccountToken checks a token for purpose and returns the user it
+// was issued to.
+func verifyAccountToken(ctx context.Context, token, purpose string) (User, error) {
+	encoded, sig, ok := strings.Cut(strings.TrimSpace(token), ".")
+	if !ok {
+		return User{}, ErrInvalidAccountToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return User{}, ErrInvalidAccountToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return User{}, ErrInvalidAccountToken
+	}
+	parts := strings.Split(string(payload), "|")
+	if len(parts) != 4 || parts[0] != accountTokenVersion || parts[1] != purpose {
+		return User{}, ErrInvalidAccountToken
+	}
+	expires, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil || time.Now().Unix() >= expires {
+		return User{}, ErrInvalidAccountToken
+	}
+
+	user, err := stores.Users.GetByUserID(ctx, parts[2])
+	if err == ErrNotFound {
+		return User{}, ErrInvalidAccountToken
+	}
+	if err != nil {
+		return User{}, err
+	}
+	if !hmac.Equal(got, accountTokenMAC(encoded, accountTokenState(purpose, user))) {
+		return User{}, ErrInvalidAccountToken
+	}
+	return user, nil
+}
+
+// accountLink builds the front-end URL an emailed token is delivered in.
+func accountLink(path, token string) string {
+	return strings.TrimRight(config.PublicURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// humanDuration renders a link lifetime for an email, e.g. "48 hours".
+func humanDuration(d time.Duration) string {
+	switch {
+	case d == time.Hour:
+		return "1 hour"
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%d hours", d/time.Hour)
+	case d == time.Minute:
+		return "1 minute"
+	case d == time.Second:
+		return "1 second"
+	case d < time.Minute:
+		return fmt.Sprintf("%d seconds", (d+time.Second-1)/time.Second)
+	default:
+		return fmt.Sprintf("%d minutes", (d+time.Minute-1)/time.Minute)
+	}
+}
+
+// sendVerificationEmail mails user a link that confirms their address.
+func sendVerificationEmail(user User) {
+	if user.Email == "" {
+		return
+	}
+	token := signAccountToken(PurposeVerifyEmail, user, config.EmailVerificationTTL)
+	sendMail(Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link:\n\n%s\n\nThe link expires in %s. If you didn't sign up, you can ignore this message.\n",
+			user.Username, accountLink("/verify-email", token), humanDuration(config.EmailVerificationTTL)),
+	})
+}
+
+// forgotPassword emails a reset link to the account with the given email.
+// The response is the same whether or not such an account exists, so the
+// endpoint can't be used to find out who is registered.
+func forgotPassword(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	user, err := stores.Users.GetByEmail(r.Context(), normalizeEmail(req.Email))
+	switch err {
+	case nil:
+		token := signAccountToken(PurposePasswordReset, user, config.PasswordResetTTL)
+		sendMail(Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. To choose a new password, open this link:\n\n%s\n\nThe link expires in %s and works once. If you didn't ask for this, you can ignore this message.\n",
+				user.Username, accountLink("/reset-password", token), humanDuration(config.PasswordResetTTL)),
+		})
+	case ErrNotFound:
+	default:
+		log.Printf("Failed to look up user for password reset: %v", err)
+		http.Error(w, "Failed to request password reset", http.StatusInternalServerError)
+		return
+	}
+
+	sendResponse(w, http.StatusAccepted, nil, "If an account uses that email, a reset link has been sent", nil)
+}
+
+// resetPassword sets a new password using an emailed reset token and signs
+// the account out everywhere.
+func resetPassword(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	user, err := verifyAccountToken(r.Context(), req.Token, PurposePasswordReset)
+	if err == ErrInvalidAccountToken {
+		http.Error(w, "Reset link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	if problem := passwordProblem(req.Password, user); problem != "" {
+		writeValidationErrors(w, FieldErrors{"password": problem})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+	user.Password = string(hashedPassword)
+	// The reset link reached the inbox, which proves the address too
+	user.IsVerified = true
+	user.UpdatedAt = time.Now()
+	if err := stores.Users.Update(r.Context(), user); err != nil {
+		http.Error(w, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+	// Proving control of the mailbox also lifts any sign-in lock
+	if err := stores.Users.ResetLoginFailures(r.Context(), user.UserID); err != nil {
+		log.Printf("Failed to reset failed sign-ins of %s: %v", user.UserID, err)
+	}
+
+	revokeUserSessions(r.Context(), user.UserID)
+	sendResponse(w, http.StatusOK, nil, "Password has been reset", nil)
+}
+
+// verifyEmail marks the address of the account as verified
+func verifyEmail(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	user, err := verifyAccountToken(r.Context(), req.Token, PurposeVerifyEmail)
+	if err == ErrInvalidAccountToken {
+		http.Error(w, "Verification link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+
+	user.IsVerified = true
+	user.UpdatedAt = time.Now()
+	if err := stores.Users.Update(r.Context(), user); err != nil {
+		http.Error(w, "Failed to verify email", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, map[string]string{"userid": user.UserID, "email": user.Email}, "Email verified", nil)
+}
+
+// resendVerification mails the caller a fresh verification link
+func resendVerification(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+	user, err := stores.Users.GetByUserID(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if user.IsVerified {
+		http.Error(w, "Email is already verified", http.StatusConflict)
+		return
+	}
+	if user.Email == "" {
+		http.Error(w, "Account has no email address", http.StatusBadRequest)
+		return
+	}
+
+	sendVerificationEmail(user)
+	sendResponse(w, http.StatusAccepted, nil, "Verification email sent", nil)
+}
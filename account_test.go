@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// seedAccount stores an unverified user u1 with password.
+func seedAccount(t *testing.T, password string) User {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := User{UserID: "u1", Username: "alice", Email: "alice@example.com", Password: string(hash), Role: RoleUser}
+	if err := stores.Users.Create(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestPasswordResetTokenIsSingleUse(t *testing.T) {
+	useMemoryStores(t)
+	user := seedAccount(t, "old password 1")
+	session := startTestSession(t, user)
+
+	reset := func(token, password string) int {
+		return serveAs(resetPassword, "", http.MethodPost, "/", `{"token": "`+token+`", "password": "`+password+`"}`).Code
+	}
+	token := signAccountToken(PurposePasswordReset, user, time.Hour)
+
+	// Tokens for another purpose, expired or tampered with don't work
+	for name, bad := range map[string]string{
+		"verify-email token": signAccountToken(PurposeVerifyEmail, user, time.Hour),
+		"expired token":      signAccountToken(PurposePasswordReset, user, -time.Second),
+		"tampered token":     token[:len(token)-2] + "xx",
+	} {
+		if code := reset(bad, "new password 2"); code != http.StatusBadRequest {
+			t.Errorf("reset with a %s = %d, want %d", name, code, http.StatusBadRequest)
+		}
+	}
+
+	if code := reset(token, "new password 2"); code != http.StatusOK {
+		t.Fatalf("reset = %d, want %d", code, http.StatusOK)
+	}
+	stored, err := stores.Users.GetByUserID(context.Background(), user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(stored.Password), []byte("new password 2")) != nil {
+		t.Error("the new password doesn't match")
+	}
+	if !stored.IsVerified {
+		t.Error("a reset didn't verify the address it was mailed to")
+	}
+
+	// The same link can't set the password again
+	if code := reset(token, "third password 3"); code != http.StatusBadRequest {
+		t.Errorf("second reset = %d, want %d", code, http.StatusBadRequest)
+	}
+	// and the reset signed the account out
+	if code := serveAs(refreshTokens, "", http.MethodPost, "/", `{"refresh_token": "`+session.RefreshToken+`"}`).Code; code != http.StatusUnauthorized {
+		t.Errorf("refresh after a reset = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestVerifyEmailTokenIsSingleUse(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	user := seedAccount(t, "old password 1")
+
+	verify := func(token string) int {
+		return serveAs(verifyEmail, "", http.MethodPost, "/", `{"token": "`+token+`"}`).Code
+	}
+	token := signAccountToken(PurposeVerifyEmail, user, time.Hour)
+	if code := verify(signAccountToken(PurposePasswordReset, user, time.Hour)); code != http.StatusBadRequest {
+		t.Errorf("verify with a reset token = %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := verify(token); code != http.StatusOK {
+		t.Fatalf("verify = %d, want %d", code, http.StatusOK)
+	}
+	if stored, _ := stores.Users.GetByUserID(ctx, user.UserID); !stored.IsVerified {
+		t.Error("the address isn't verified")
+	}
+	if code := verify(token); code != http.StatusBadRequest {
+		t.Errorf("second verify = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	// A link mailed to an old address stops working when the address
+	// changes
+	stored, _ := stores.Users.GetByUserID(ctx, user.UserID)
+	stored.IsVerified = false
+	old := signAccountToken(PurposeVerifyEmail, stored, time.Hour)
+	stored.Email = "alice@example.org"
+	if err := stores.Users.Update(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+	if code := verify(old); code != http.StatusBadRequest {
+		t.Errorf("verify for an old address = %d, want %d", code, http.StatusBadRequest)
+	}
+}
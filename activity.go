@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -9,7 +8,6 @@ import (
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/julienschmidt/httprouter"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 func logActivity(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -40,8 +38,7 @@ func logActivity(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	activity.Username = claims.Username
 	activity.Timestamp = time.Now()
 
-	activitiesCollection := client.Database("your_database").Collection("activities")
-	_, err = activitiesCollection.InsertOne(context.TODO(), activity)
+	err = stores.Activities.Log(r.Context(), activity)
 	if err != nil {
 		sendErrorResponse(w, http.StatusInternalServerError, "Failed to log activity")
 		log.Println("Failed to insert activity into database:", err)
@@ -71,19 +68,11 @@ func getActivityFeed(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 		return
 	}
 
-	activitiesCollection := client.Database("your_database").Collection("activities")
-	cursor, err := activitiesCollection.Find(context.TODO(), bson.M{"username": claims.Username})
+	activities, err := stores.Activities.ListByUsername(r.Context(), claims.Username)
 	if err != nil {
 		sendErrorResponse(w, http.StatusInternalServerError, "Failed to fetch activities")
 		return
 	}
-	defer cursor.Close(context.TODO())
-
-	var activities []Activity
-	if err := cursor.All(context.TODO(), &activities); err != nil {
-		sendErrorResponse(w, http.StatusInternalServerError, "Failed to decode activities")
-		return
-	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(activities)
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Scopes an API key can be given. A key only works on routes registered
+// through allowAPIKeys with one of its scopes; everything else, account
+// management included, still needs a user's login.
+const (
+	ScopeEventsRead   = "events:read"
+	ScopeEventsWrite  = "events:write"
+	ScopeTicketsRead  = "tickets:read"
+	ScopeTicketsWrite = "tickets:write"
+	ScopeMerchWrite   = "merch:write"
+	ScopeOrdersRead   = "orders:read"
+	ScopeOrdersWrite  = "orders:write"
+	ScopePlacesWrite  = "places:write"
+	ScopeMediaWrite   = "media:write"
+)
+
+var apiKeyScopes = []string{
+	ScopeEventsRead, ScopeEventsWrite,
+	ScopeTicketsRead, ScopeTicketsWrite,
+	ScopeMerchWrite,
+	ScopeOrdersRead, ScopeOrdersWrite,
+	ScopePlacesWrite,
+	ScopeMediaWrite,
+}
+
+// API keys look like "nv_<keyid>_<secret>". The key ID finds the stored
+// key and the whole string is checked against its hash.
+const apiKeyPrefix = "nv_"
+
+// apiKeyTouchInterval is how often a key's last use is written back.
+const apiKeyTouchInterval = time.Minute
+
+const (
+	apiScopeKey contextKey = "apiScope" // Scope an API key needs on this route
+	apiKeyKey   contextKey = "apiKey"   // The APIKey the request was made with
+)
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// allowAPIKeys lets API keys with scope call next. It goes outside
+// authenticate, which does the checking.
+func allowAPIKeys(scope string, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		next(w, r.WithContext(context.WithValue(r.Context(), apiScopeKey, scope)), ps)
+	}
+}
+
+// apiKeyFromRequest returns the API key sent with r, if any, either in
+// X-API-Key or as the bearer token.
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); strings.HasPrefix(token, apiKeyPrefix) {
+		return token
+	}
+	return ""
+}
+
+// authenticateAPIKey is authenticate for requests made with an API key.
+// The request runs as the key's owner, with the owner's current role.
+func authenticateAPIKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params, raw string, next httprouter.Handle) {
+	key, err := lookupAPIKey(r.Context(), raw)
+	if err == errInvalidAPIKey {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up API key: %v", err)
+		http.Error(w, "Failed to validate API key", http.StatusInternalServerError)
+		return
+	}
+
+	// Keys of deleted accounts stop working even if revoking them failed
+	user, err := stores.Users.GetByUserID(r.Context(), key.UserID)
+	if err == ErrNotFound {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load the owner of API key %s: %v", key.KeyID, err)
+		http.Error(w, "Failed to validate API key", http.StatusInternalServerError)
+		return
+	}
+
+	scope, _ := r.Context().Value(apiScopeKey).(string)
+	if scope == "" {
+		http.Error(w, "API keys can't be used for this endpoint", http.StatusForbidden)
+		return
+	}
+	if !contains(key.Scopes, scope) {
+		http.Error(w, fmt.Sprintf("API key lacks the %s scope", scope), http.StatusForbidden)
+		return
+	}
+	if len(key.EventIDs) > 0 && !contains(key.EventIDs, ps.ByName("eventid")) {
+		http.Error(w, "API key is limited to other events", http.StatusForbidden)
+		return
+	}
+	if !apiKeyLimiter(key).Allow() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	touchAPIKey(r, key)
+
+	ctx := context.WithValue(r.Context(), userIDKey, user.UserID)
+	ctx = context.WithValue(ctx, roleKey, normalizeRole(user.Role))
+	ctx = context.WithValue(ctx, apiKeyKey, key)
+	next(w, r.WithContext(ctx), ps)
+}
+
+// lookupAPIKey finds the live key raw belongs to.
+func lookupAPIKey(ctx context.Context, raw string) (APIKey, error) {
+	rest, ok := strings.CutPrefix(raw, apiKeyPrefix)
+	if !ok {
+		return APIKey{}, errInvalidAPIKey
+	}
+	keyID, _, ok := strings.Cut(rest, "_")
+	if !ok {
+		return APIKey{}, errInvalidAPIKey
+	}
+	key, err := stores.APIKeys.Get(ctx, keyID)
+	if err == ErrNotFound {
+		return APIKey{}, errInvalidAPIKey
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(raw)), []byte(key.Hash)) != 1 {
+		return APIKey{}, errInvalidAPIKey
+	}
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt)) {
+		return APIKey{}, errInvalidAPIKey
+	}
+	return key, nil
+}
+
+// touchAPIKey records the key's last use, at most once a minute.
+func touchAPIKey(r *http.Request, key APIKey) {
+	now := time.Now()
+	ip := clientIP(r)
+	if key.LastUsedAt != nil && now.Sub(*key.LastUsedAt) < apiKeyTouchInterval && key.LastUsedIP == ip {
+		return
+	}
+	if err := stores.APIKeys.Touch(r.Context(), key.KeyID, ip, now.UTC()); err != nil {
+		log.Printf("Failed to record use of API key %s: %v", key.KeyID, err)
+	}
+}
+
+// apiKeyRequest is the body of createAPIKey.
+type apiKeyRequest struct {
+	Name          string   `json:"name" validate:"required,max=100"`
+	Scopes        []string `json:"scopes" validate:"required,max=20"`
+	EventIDs      []string `json:"event_ids" validate:"max=50"`
+	RateLimit     float64  `json:"rate_limit" validate:"min=0"`
+	Burst         int      `json:"burst" validate:"min=0"`
+	ExpiresInDays int      `json:"expires_in_days" validate:"min=0,max=3650"`
+}
+
+func (req apiKeyRequest) checkFields(errs FieldErrors) {
+	for _, scope := range req.Scopes {
+		if !contains(apiKeyScopes, scope) {
+			errs.add("scopes", fmt.Sprintf("unknown scope %q; choose from %s", scope, strings.Join(apiKeyScopes, ", ")))
+		}
+	}
+	if req.RateLimit > config.APIKeys.MaxRateLimit {
+		errs.add("rate_limit", fmt.Sprintf("must be at most %g", config.APIKeys.MaxRateLimit))
+	}
+	if req.Burst > config.APIKeys.MaxBurst {
+		errs.add("burst", fmt.Sprintf("must be at most %d", config.APIKeys.MaxBurst))
+	}
+}
+
+// createAPIKey issues the caller a new API key. The key is in the
+// response and nowhere else.
+func createAPIKey(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+	var req apiKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if errs := validate(req); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	keys, err := stores.APIKeys.ListByUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	active := 0
+	for _, key := range keys {
+		if key.RevokedAt == nil && (key.ExpiresAt == nil || time.Now().Before(*key.ExpiresAt)) {
+			active++
+		}
+	}
+	if active >= config.APIKeys.MaxPerUser {
+		http.Error(w, fmt.Sprintf("You already have %d active API keys; revoke one first", active), http.StatusConflict)
+		return
+	}
+
+	keyID := hex.EncodeToString(randomBytes(6))
+	raw := apiKeyPrefix + keyID + "_" + randomToken(24)
+	key := APIKey{
+		KeyID:     keyID,
+		UserID:    userID,
+		Name:      strings.TrimSpace(req.Name),
+		Hash:      hashSecret(raw),
+		Hint:      raw[len(raw)-4:],
+		Scopes:    req.Scopes,
+		EventIDs:  req.EventIDs,
+		RateLimit: config.APIKeys.RateLimit,
+		Burst:     config.APIKeys.Burst,
+		CreatedAt: time.Now().UTC(),
+	}
+	if req.RateLimit > 0 {
+		key.RateLimit = req.RateLimit
+	}
+	if req.Burst > 0 {
+		key.Burst = req.Burst
+	}
+	if req.ExpiresInDays > 0 {
+		expires := key.CreatedAt.AddDate(0, 0, req.ExpiresInDays)
+		key.ExpiresAt = &expires
+	}
+	if err := stores.APIKeys.Create(r.Context(), key); err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	sendResponse(w, http.StatusCreated, map[string]interface{}{
+		"key":    raw,
+		"apikey": key,
+	}, "API key created; copy it now, it won't be shown again", nil)
+}
+
+// getAPIKeys lists the caller's API keys
+func getAPIKeys(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+	keys, err := stores.APIKeys.ListByUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch API keys", http.StatusInternalServerError)
+		return
+	}
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// revokeAPIKey revokes one of the caller's API keys for good
+func revokeAPIKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID, _ := r.Context().Value(userIDKey).(string)
+	key, err := stores.APIKeys.Get(r.Context(), ps.ByName("keyid"))
+	if err == ErrNotFound || (err == nil && key.UserID != userID) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	if err := stores.APIKeys.Revoke(r.Context(), key.KeyID, time.Now().UTC()); err != nil {
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	dropAPIKeyLimiter(key.KeyID)
+	sendResponse(w, http.StatusOK, map[string]string{"keyid": key.KeyID}, "API key revoked", nil)
+}
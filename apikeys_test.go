@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// createTestKey creates an API key through the API as the holder of auth.
+func createTestKey(t *testing.T, router *httprouter.Router, auth, body string) string {
+	t.Helper()
+	w := serveRoute(router, auth, http.MethodPost, "/api/keys", strings.NewReader(body), "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create key = %d %s, want %d", w.Code, w.Body, http.StatusCreated)
+	}
+	var data struct {
+		Key string `json:"key"`
+	}
+	responseData(t, w, &data)
+	return data.Key
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	useMemoryStores(t)
+	seedTicket(t, EventPublished, 5)
+	router := newRouter(nil)
+	auth := signIn(t, User{UserID: "organizer", Username: "organizer", Role: RoleOrganizer})
+	readOnly := createTestKey(t, router, auth, `{"name": "reader", "scopes": ["events:read"]}`)
+	otherEvent := createTestKey(t, router, auth, `{"name": "e2 only", "scopes": ["events:read", "tickets:write"], "event_ids": ["e2"]}`)
+
+	tests := []struct {
+		name     string
+		key      string
+		method   string
+		target   string
+		wantCode int
+	}{
+		{"a route the scope covers", readOnly, http.MethodGet, "/api/event/e1", http.StatusOK},
+		{"a write without the write scope", readOnly, http.MethodPost, "/api/event/e1/ticket", http.StatusForbidden},
+		{"account management", readOnly, http.MethodGet, "/api/profile", http.StatusForbidden},
+		{"creating keys", readOnly, http.MethodPost, "/api/keys", http.StatusForbidden},
+		{"an event the key isn't for", otherEvent, http.MethodGet, "/api/event/e1", http.StatusForbidden},
+		{"a forged key", readOnly[:len(readOnly)-1] + "x", http.MethodGet, "/api/event/e1", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.NewReader(`{"name": "x", "scopes": ["events:read"]}`)
+			if code := serveRoute(router, "Bearer "+tt.key, tt.method, tt.target, body, "").Code; code != tt.wantCode {
+				t.Errorf("%s %s = %d, want %d", tt.method, tt.target, code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestAPIKeysEndWithTheAccount(t *testing.T) {
+	useMemoryStores(t)
+	seedTicket(t, EventPublished, 5)
+	router := newRouter(nil)
+	user := User{UserID: "u1", Username: "u1", Role: RoleUser}
+	auth := signIn(t, user)
+	read := func(key string) int {
+		return serveRoute(router, "Bearer "+key, http.MethodGet, "/api/event/e1", nil, "").Code
+	}
+
+	key := createTestKey(t, router, auth, `{"name": "reader", "scopes": ["events:read"]}`)
+	if code := read(key); code != http.StatusOK {
+		t.Fatalf("key = %d, want %d", code, http.StatusOK)
+	}
+	if code := serveRoute(router, auth, http.MethodPost, "/api/logout/all", nil, "").Code; code != http.StatusOK {
+		t.Fatalf("logout everywhere = %d, want %d", code, http.StatusOK)
+	}
+	if code := read(key); code != http.StatusUnauthorized {
+		t.Errorf("key after logging out everywhere = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// A key whose owner is gone stops working, revoked or not
+	key = createTestKey(t, router, signIn(t, user), `{"name": "reader", "scopes": ["events:read"]}`)
+	if err := stores.Users.Delete(context.Background(), user.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if code := read(key); code != http.StatusUnauthorized {
+		t.Errorf("key of a deleted account = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
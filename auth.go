@@ -5,11 +5,11 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/julienschmidt/httprouter"
-	"go.mongodb.org/mongo-driver/bson"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -17,58 +17,148 @@ import (
 type Claims struct {
 	Username string `json:"username"`
 	UserID   string `json:"userId"`
+	Role     string `json:"role"`
+	// SessionID ties the token to the refresh token chain it came from
+	SessionID string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
 func login(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	var user User
+	// User.Password is hidden from JSON, so credentials get their own struct
+	var user struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
 	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
 
-	var storedUser User
-	err := userCollection.FindOne(context.TODO(), bson.M{"username": user.Username}).Decode(&storedUser)
+	storedUser, err := findLoginUser(r.Context(), user.Username)
 	if err != nil {
+		burnPasswordCheck(user.Password)
+		auditLoginFailure(r, "", normalizeUsername(user.Username), LoginFailureUnknownUser)
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
+	// Accounts with recent failures have to wait before the password is
+	// even looked at
+	storedUser, ok := claimLoginAttempt(w, r, storedUser)
+	if !ok {
+		return
+	}
+
 	// Verify password
 	if err := bcrypt.CompareHashAndPassword([]byte(storedUser.Password), []byte(user.Password)); err != nil {
+		recordLoginFailure(r, storedUser, LoginFailurePassword)
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
-	// Create JWT claims
-	claims := &Claims{
-		Username: storedUser.Username,
-		UserID:   storedUser.UserID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(72 * time.Hour)),
-		},
+	// Promote configured bootstrap admins on their first login
+	if bootstrapAdmin(&storedUser) {
+		if err := stores.Users.Update(r.Context(), storedUser); err != nil {
+			log.Printf("Failed to promote %s to admin: %v", storedUser.Username, err)
+		}
+	}
+
+	// With two-factor enabled the password only earns a pending token that
+	// has to be exchanged, together with a code, at /api/login/2fa; the
+	// attempt stays counted until it is
+	if storedUser.TOTPEnabled {
+		requireSecondFactor(w, storedUser)
+		return
+	}
+
+	finishLogin(w, r, storedUser)
+}
+
+// findLoginUser finds the account a typed username signs in to. Names are
+// matched in lowercase, except that an account whose mixed-case name
+// couldn't be lowercased because of a clash (see normalizeUserKeys) is
+// found by its exact name.
+func findLoginUser(ctx context.Context, typed string) (User, error) {
+	typed = strings.TrimSpace(typed)
+	username := normalizeUsername(typed)
+	if typed != username {
+		user, err := stores.Users.GetByUsername(ctx, typed)
+		if err != ErrNotFound {
+			return user, err
+		}
+	}
+	return stores.Users.GetByUsername(ctx, username)
+}
+
+// requireSecondFactor answers a login whose first factor checked out with
+// a pending token for /api/login/2fa.
+func requireSecondFactor(w http.ResponseWriter, user User) {
+	mfaToken, err := signMFAToken(user)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, map[string]interface{}{
+		"mfa_required": true,
+		"mfa_token":    mfaToken,
+		"expires_in":   int(mfaTokenTTL / time.Second),
+	}, "Two-factor code required", nil)
+}
+
+// finishLogin starts a new session with a short-lived access token and a
+// refresh token, and sends them to the client.
+func finishLogin(w http.ResponseWriter, r *http.Request, user User) {
+	session, err := startSession(r, user)
+	if err != nil {
+		log.Printf("Failed to start session for %s: %v", user.Username, err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret) // Ensure jwtSecret is a byte array
+	recordLoginSuccess(r.Context(), user)
+	pair, err := issueTokens(r.Context(), user, session.SessionID)
 	if err != nil {
+		log.Printf("Failed to issue tokens for %s: %v", user.Username, err)
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
 	// Send response
-	sendResponse(w, http.StatusOK, map[string]string{"token": tokenString, "userid": storedUser.UserID}, "Login successful", nil)
+	sendResponse(w, http.StatusOK, pair, "Login successful", nil)
 }
 
 // Handle user registration
 func register(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+	var req struct {
+		User
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid input", http.StatusBadRequest)
 		return
 	}
+	// Clients pick their profile fields; the role, verification and the
+	// rest of the account state are the server's
+	user := req.User
+	stripReadOnly(&user)
+	user.Username = normalizeUsername(user.Username)
+	user.Email = normalizeEmail(user.Email)
+	errs := validate(user)
+	if problem := passwordProblem(req.Password, user); problem != "" {
+		errs.add("password", problem)
+	}
+	if _, err := stores.Users.GetByUsername(r.Context(), user.Username); err == nil {
+		errs.add("username", "is already taken")
+	}
+	if _, err := stores.Users.GetByEmail(r.Context(), user.Email); err == nil {
+		errs.add("email", "is already registered")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
 	log.Printf("Registering user: %s", user.Username)
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
 		log.Printf("Failed to hash password for user %s: %v", user.Username, err)
 		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
@@ -76,12 +166,22 @@ func register(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	}
 	user.Password = string(hashedPassword)
 	user.UserID = "u" + GenerateName(10)
-	_, err = userCollection.InsertOne(context.TODO(), user)
-	if err != nil {
+	user.Role = RoleUser // Roles are granted by an admin, never self-assigned
+	user.CreatedAt = time.Now()
+	user.UpdatedAt = user.CreatedAt
+	bootstrapAdmin(&user)
+	err = stores.Users.Create(r.Context(), user)
+	if err == ErrDuplicate {
 		log.Printf("User already exists: %s", user.Username)
 		http.Error(w, "User already exists", http.StatusConflict)
 		return
 	}
+	if err != nil {
+		log.Printf("Failed to register user %s: %v", user.Username, err)
+		http.Error(w, "Failed to register user", http.StatusInternalServerError)
+		return
+	}
+	sendVerificationEmail(user)
 
 	w.WriteHeader(http.StatusCreated)
 	response := map[string]interface{}{
@@ -95,11 +195,20 @@ func register(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 type contextKey string
 
-const userIDKey contextKey = "userId"
+const (
+	userIDKey contextKey = "userId"
+	roleKey   contextKey = "role"
+	claimsKey contextKey = "claims"
+)
 
 // Authenticate middleware
 func authenticate(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if key := apiKeyFromRequest(r); key != "" {
+			authenticateAPIKey(w, r, ps, key, next)
+			return
+		}
+
 		tokenString := r.Header.Get("Authorization")
 		if tokenString == "" {
 			http.Error(w, "Missing token", http.StatusUnauthorized)
@@ -121,8 +230,70 @@ func authenticate(next httprouter.Handle) httprouter.Handle {
 			return
 		}
 
-		// Store UserID in context
+		// Reject tokens that were logged out
+		revoked, err := stores.Revocations.IsRevoked(r.Context(), "jti:"+claims.ID)
+		if err != nil {
+			log.Printf("Failed to check token revocation: %v", err)
+			http.Error(w, "Failed to validate token", http.StatusInternalServerError)
+			return
+		}
+		if revoked {
+			http.Error(w, "Token has been revoked", http.StatusUnauthorized)
+			return
+		}
+
+		// and tokens whose session was ended from another device. Every
+		// token names its session, so one without can't be ended and is
+		// refused
+		if claims.SessionID == "" {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+		session, err := stores.Sessions.Get(r.Context(), claims.SessionID)
+		if err != nil && err != ErrNotFound {
+			log.Printf("Failed to load session %s: %v", claims.SessionID, err)
+			http.Error(w, "Failed to validate token", http.StatusInternalServerError)
+			return
+		}
+		if err == ErrNotFound || session.EndedAt != nil || session.UserID != claims.UserID {
+			http.Error(w, "Session has ended", http.StatusUnauthorized)
+			return
+		}
+		touchSession(r, session)
+
+		// Store UserID and role in context
 		ctx := context.WithValue(r.Context(), userIDKey, claims.UserID)
+		ctx = context.WithValue(ctx, roleKey, normalizeRole(claims.Role))
+		ctx = context.WithValue(ctx, claimsKey, claims)
 		next(w, r.WithContext(ctx), ps) // Call the next handler with new context
 	}
 }
+
+// optionalAuthenticate is authenticate for endpoints anyone may call but
+// that show signed-in users more. Requests without credentials go through
+// as they are.
+func optionalAuthenticate(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if r.Header.Get("Authorization") == "" && apiKeyFromRequest(r) == "" {
+			next(w, r, ps)
+			return
+		}
+		authenticate(next)(w, r, ps)
+	}
+}
+
+// bootstrapAdmin gives the admin role to users listed in auth.admin_users,
+// so a fresh deployment has someone who can grant roles. It reports
+// whether user was changed.
+func bootstrapAdmin(user *User) bool {
+	if user.Role == RoleAdmin {
+		return false
+	}
+	for _, name := range config.AdminUsers {
+		if normalizeUsername(name) == user.Username {
+			user.Role = RoleAdmin
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLoginFindsUnnormalizedAccount(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	// "Bob" couldn't be lowercased because "bob" signed up since
+	for _, u := range []struct{ id, name, password string }{
+		{"legacy", "Bob", "legacy password 1"},
+		{"u1", "bob", "newer password 2"},
+	} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(u.password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stores.Users.Create(ctx, User{UserID: u.id, Username: u.name, Password: string(hash)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		username, password string
+		wantUser           string
+	}{
+		{"Bob", "legacy password 1", "legacy"},
+		{" Bob ", "legacy password 1", "legacy"},
+		{"bob", "newer password 2", "u1"},
+		{"BOB", "newer password 2", "u1"},
+		{"bob", "legacy password 1", ""},
+	}
+	for _, tt := range tests {
+		w := serveAs(login, "", http.MethodPost, "/", `{"username": "`+tt.username+`", "password": "`+tt.password+`"}`)
+		if tt.wantUser == "" {
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("login as %q with %q = %d, want %d", tt.username, tt.password, w.Code, http.StatusUnauthorized)
+			}
+			continue
+		}
+		if w.Code != http.StatusOK {
+			t.Errorf("login as %q = %d, want %d", tt.username, w.Code, http.StatusOK)
+			continue
+		}
+		var pair tokenPair
+		responseData(t, w, &pair)
+		if pair.UserID != tt.wantUser {
+			t.Errorf("login as %q signed in %s, want %s", tt.username, pair.UserID, tt.wantUser)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// errForbidden is returned by a policy that denies the request.
+var errForbidden = errors.New("forbidden")
+
+// policy decides whether user may act on the resource named by the route
+// parameters. It returns ErrNotFound if the resource doesn't exist and
+// errForbidden if the user isn't allowed.
+type policy func(ctx context.Context, user User, ps httprouter.Params) error
+
+// authorize wraps next so it only runs when p allows the requesting user.
+// It must sit inside authenticate.
+func authorize(p policy, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		userID, ok := r.Context().Value(userIDKey).(string)
+		if !ok {
+			http.Error(w, "Invalid user", http.StatusBadRequest)
+			return
+		}
+		user, err := stores.Users.GetByUserID(r.Context(), userID)
+		if err != nil {
+			http.Error(w, "Invalid user", http.StatusUnauthorized)
+			return
+		}
+
+		switch err := p(r.Context(), user, ps); err {
+		case nil:
+			next(w, r, ps)
+		case ErrNotFound:
+			http.Error(w, "Not found", http.StatusNotFound)
+		case errForbidden:
+			http.Error(w, "You are not allowed to do that", http.StatusForbidden)
+		default:
+			log.Printf("Authorization check failed for %s %s: %v", r.Method, r.URL.Path, err)
+			http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+		}
+	}
+}
+
+// eventCreator allows the creator of the :eventid event and admins.
+func eventCreator(ctx context.Context, user User, ps httprouter.Params) error {
+	event, err := stores.Events.Get(ctx, ps.ByName("eventid"))
+	if err != nil {
+		return err
+	}
+	if can(user.Role, PermManageAnyEvent) || event.CreatorID == user.UserID {
+		return nil
+	}
+	return errForbidden
+}
+
+// eventOrganizer allows the creator of the :eventid event, its
+// co-organizers and admins.
+func eventOrganizer(ctx context.Context, user User, ps httprouter.Params) error {
+	event, err := stores.Events.Get(ctx, ps.ByName("eventid"))
+	if err != nil {
+		return err
+	}
+	if isEventOrganizer(event, user) {
+		return nil
+	}
+	return errForbidden
+}
+
+// seriesCreator allows the creator of the :seriesid series and admins.
+func seriesCreator(ctx context.Context, user User, ps httprouter.Params) error {
+	series, err := stores.Series.Get(ctx, ps.ByName("seriesid"))
+	if err != nil {
+		return err
+	}
+	if can(user.Role, PermManageAnyEvent) || series.CreatorID == user.UserID {
+		return nil
+	}
+	return errForbidden
+}
+
+// placeManager allows the creator of the :placeid place and admins.
+func placeManager(ctx context.Context, user User, ps httprouter.Params) error {
+	place, err := stores.Places.Get(ctx, ps.ByName("placeid"))
+	if err != nil {
+		return err
+	}
+	if can(user.Role, PermManageAnyPlace) || place.CreatedBy == user.UserID {
+		return nil
+	}
+	return errForbidden
+}
+
+// mediaOwnerOrModerator allows whoever uploaded the :id media and
+// moderators.
+func mediaOwnerOrModerator(ctx context.Context, user User, ps httprouter.Params) error {
+	media, err := stores.Media.Get(ctx, ps.ByName("eventid"), ps.ByName("id"))
+	if err != nil {
+		return err
+	}
+	if media.CreatorID == user.UserID || can(user.Role, PermModerateMedia) {
+		return nil
+	}
+	return errForbidden
+}
+
+// reviewOwnerOrModerator allows the author of the :reviewid review on the
+// :eventid event and moderators.
+func reviewOwnerOrModerator(ctx context.Context, user User, ps httprouter.Params) error {
+	event, err := stores.Events.Get(ctx, ps.ByName("eventid"))
+	if err != nil {
+		return err
+	}
+	for _, review := range event.Reviews {
+		if review.ReviewID != ps.ByName("reviewid") {
+			continue
+		}
+		if review.UserID == user.UserID || can(user.Role, PermModerateReview) {
+			return nil
+		}
+		return errForbidden
+	}
+	return ErrNotFound
+}
+
+// isEventOrganizer reports whether user may manage event.
+func isEventOrganizer(event Event, user User) bool {
+	if can(user.Role, PermManageAnyEvent) || event.CreatorID == user.UserID {
+		return true
+	}
+	for _, id := range event.CoOrganizers {
+		if id == user.UserID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// signIn stores user, unless it exists, starts a session for it and
+// returns an Authorization header value for that session.
+func signIn(t *testing.T, user User) string {
+	t.Helper()
+	return "Bearer " + startTestSession(t, user).Token
+}
+
+// startTestSession stores user, unless it exists, and returns the tokens
+// of a new session for it.
+func startTestSession(t *testing.T, user User) tokenPair {
+	t.Helper()
+	ctx := context.Background()
+	if err := stores.Users.Create(ctx, user); err != nil && err != ErrDuplicate {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	session := Session{SessionID: randomToken(12), UserID: user.UserID, CreatedAt: now, LastSeenAt: now}
+	if err := stores.Sessions.Create(ctx, session); err != nil {
+		t.Fatal(err)
+	}
+	pair, err := issueTokens(ctx, user, session.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+// serveRoute sends a request through router with the given Authorization
+// header, if any.
+func serveRoute(router *httprouter.Router, auth, method, target string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestReviewAndMediaRoutes(t *testing.T) {
+	useMemoryStores(t)
+	config.Uploads.Media = t.TempDir()
+	seedTicket(t, EventDraft, 5)
+	router := newRouter(nil)
+	organizer := signIn(t, User{UserID: "organizer", Username: "organizer", Role: RoleOrganizer})
+	stranger := signIn(t, User{UserID: "stranger", Username: "stranger", Role: RoleUser})
+
+	review := func(auth string) int {
+		return serveRoute(router, auth, http.MethodPost, "/api/event/e1/review", strings.NewReader(`{"rating": 5}`), "").Code
+	}
+	media := func(auth string) int {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("media", "photo.jpg")
+		part.Write([]byte("jpeg"))
+		form.Close()
+		return serveRoute(router, auth, http.MethodPost, "/api/event/e1/media", &body, form.FormDataContentType()).Code
+	}
+
+	// A draft is hidden from everyone but its organizers
+	if code := review(stranger); code != http.StatusNotFound {
+		t.Errorf("review of someone else's draft = %d, want %d", code, http.StatusNotFound)
+	}
+	if code := review(organizer); code != http.StatusNoContent {
+		t.Errorf("review of one's own draft = %d, want %d", code, http.StatusNoContent)
+	}
+
+	// Only organizers add media, published or not
+	if code := media(stranger); code != http.StatusForbidden {
+		t.Errorf("media on someone else's event = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := media(organizer); code != http.StatusOK {
+		t.Errorf("media on one's own event = %d, want %d", code, http.StatusOK)
+	}
+	if _, err := stores.Events.Transition(context.Background(), "e1", EventDraft, EventPublished, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if code := review(stranger); code != http.StatusNoContent {
+		t.Errorf("review of a published event = %d, want %d", code, http.StatusNoContent)
+	}
+	if code := media(stranger); code != http.StatusForbidden {
+		t.Errorf("media on someone else's published event = %d, want %d", code, http.StatusForbidden)
+	}
+
+	// Deleting a place's reviews or media doesn't add any
+	for _, target := range []string{"/api/place/p1/review", "/api/place/p1/media"} {
+		if code := serveRoute(router, stranger, http.MethodDelete, target, nil, "").Code; code != http.StatusNotFound {
+			t.Errorf("DELETE %s = %d, want %d", target, code, http.StatusNotFound)
+		}
+	}
+}
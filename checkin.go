@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// maxCheckinBatch caps how many scans one batch upload may carry.
+const maxCheckinBatch = 500
+
+// Outcomes of a single door scan.
+const (
+	CheckinAdmitted   = "admitted"
+	CheckinDuplicate  = "already_checked_in"
+	CheckinInvalid    = "invalid"
+	CheckinWrongEvent = "wrong_event"
+	CheckinVoid       = "void"
+	CheckinError      = "error"
+)
+
+// checkinScan is one scanned code. Scanners that lost connectivity upload
+// their queued scans later with the time each was taken.
+type checkinScan struct {
+	Token     string     `json:"token"`
+	ScannedAt *time.Time `json:"scanned_at,omitempty"`
+	Device    string     `json:"device,omitempty"`
+}
+
+// checkinResult reports what happened to one scan.
+type checkinResult struct {
+	Token   string          `json:"token"`
+	Result  string          `json:"result"`
+	Message string          `json:"message"`
+	Ticket  *TicketInstance `json:"ticket,omitempty"`
+}
+
+// checkIn admits the holder of a scanned ticket. Each code is accepted
+// once; a replay is rejected with the time and scanner of the earliest
+// admission.
+func checkIn(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	eventID := ps.ByName("eventid")
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	var scan checkinScan
+	if err := json.NewDecoder(r.Body).Decode(&scan); err != nil || scan.Token == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	result := processScan(r.Context(), eventID, userID, scan, time.Now())
+	switch result.Result {
+	case CheckinAdmitted:
+		sendResponse(w, http.StatusOK, result, result.Message, nil)
+	case CheckinDuplicate:
+		sendResponse(w, http.StatusConflict, result, result.Message, nil)
+	case CheckinVoid:
+		sendResponse(w, http.StatusGone, result, result.Message, nil)
+	case CheckinError:
+		http.Error(w, "Failed to check in ticket", http.StatusInternalServerError)
+	default:
+		sendResponse(w, http.StatusUnprocessableEntity, result, result.Message, nil)
+	}
+}
+
+// checkInBatch applies scans collected while a scanner was offline. Scans
+// are applied in the order they were taken, so when two devices scanned
+// the same ticket the earlier scan is the one recorded whichever uploads
+// first. Every scan gets its own result, in the order they were sent.
+func checkInBatch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	eventID := ps.ByName("eventid")
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Scans []checkinScan `json:"scans"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Scans) == 0 {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scans) > maxCheckinBatch {
+		http.Error(w, fmt.Sprintf("At most %d scans may be uploaded at once", maxCheckinBatch), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	now := time.Now()
+	order := make([]int, len(req.Scans))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return scanTime(req.Scans[order[a]], now).Before(scanTime(req.Scans[order[b]], now))
+	})
+
+	results := make([]checkinResult, len(req.Scans))
+	counts := make(map[string]int)
+	for _, i := range order {
+		results[i] = processScan(r.Context(), eventID, userID, req.Scans[i], now)
+		counts[results[i].Result]++
+	}
+
+	sendResponse(w, http.StatusOK, map[string]interface{}{
+		"results":    results,
+		"admitted":   counts[CheckinAdmitted],
+		"duplicates": counts[CheckinDuplicate],
+		"rejected":   len(results) - counts[CheckinAdmitted] - counts[CheckinDuplicate],
+	}, "Scans processed", nil)
+}
+
+// getAttendance reports how many ticket holders have been admitted so far
+func getAttendance(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	eventID := ps.ByName("eventid")
+
+	issued, checkedIn, err := stores.TicketInstances.CountByEvent(r.Context(), eventID)
+	if err != nil {
+		log.Printf("Failed to count attendance for event %s: %v", eventID, err)
+		http.Error(w, "Failed to fetch attendance", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"eventid":    eventID,
+		"issued":     issued,
+		"checked_in": checkedIn,
+		"remaining":  issued - checkedIn,
+	})
+}
+
+// scanTime is when scan was taken. Scan times in the future are replaced
+// with now, so a scanner with a fast clock can't record admissions that
+// haven't happened yet.
+func scanTime(scan checkinScan, now time.Time) time.Time {
+	if scan.ScannedAt != nil && scan.ScannedAt.Before(now) {
+		return scan.ScannedAt.UTC()
+	}
+	return now.UTC()
+}
+
+// processScan validates and records one scan.
+func processScan(ctx context.Context, eventID, scannerID string, scan checkinScan, now time.Time) checkinResult {
+	result := checkinResult{Token: scan.Token}
+
+	instance, err := lookupTicketToken(ctx, eventID, scan.Token)
+	switch err {
+	case nil:
+	case ErrInvalidTicketToken:
+		result.Result, result.Message = CheckinInvalid, "Ticket code is not valid"
+		return result
+	case ErrWrongEvent:
+		result.Result, result.Message = CheckinWrongEvent, "Ticket is for a different event"
+		return result
+	case ErrTicketVoid:
+		result.Result, result.Message, result.Ticket = CheckinVoid, "Ticket has been voided", &instance
+		return result
+	default:
+		log.Printf("Failed to look up scanned ticket for event %s: %v", eventID, err)
+		result.Result, result.Message = CheckinError, "Failed to check in ticket"
+		return result
+	}
+
+	instance, err = stores.TicketInstances.CheckIn(ctx, instance.InstanceID, scannerID, scan.Device, scanTime(scan, now))
+	switch {
+	case err == nil:
+		result.Result, result.Message = CheckinAdmitted, "Ticket checked in"
+	case err == ErrConflict && instance.CheckedInAt != nil:
+		result.Result = CheckinDuplicate
+		result.Message = fmt.Sprintf("Ticket was already checked in at %s by %s", instance.CheckedInAt.UTC().Format(time.RFC3339), instance.CheckedInBy)
+	case err == ErrConflict:
+		// Voided between the lookup and the check-in
+		result.Result, result.Message = CheckinVoid, "Ticket has been voided"
+	default:
+		log.Printf("Failed to check in ticket %s: %v", instance.InstanceID, err)
+		result.Result, result.Message = CheckinError, "Failed to check in ticket"
+		return result
+	}
+	result.Ticket = &instance
+	return result
+}
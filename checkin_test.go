@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// issueTestTickets issues quantity tickets for event eventID to holderID
+// and returns their instances.
+func issueTestTickets(t *testing.T, eventID, holderID string, quantity int) []TicketInstance {
+	t.Helper()
+	order := buildOrder(holderID, eventID, OrderStatusCompleted, newOrderItem(OrderItemTicket, "t1", "GA", 10, quantity))
+	instances, err := issueTickets(context.Background(), order)
+	if err != nil || len(instances) != quantity {
+		t.Fatalf("issued %d tickets (%v), want %d", len(instances), err, quantity)
+	}
+	return instances
+}
+
+func TestCheckIn(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	tickets := issueTestTickets(t, "e1", "u1", 2)
+	other := issueTestTickets(t, "e2", "u1", 1)
+	order := buildOrder("u2", "e1", OrderStatusCompleted, newOrderItem(OrderItemTicket, "t1", "GA", 10, 1))
+	voided, err := issueTickets(ctx, order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.TicketInstances.VoidByOrder(ctx, order.OrderID); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		wantCode int
+		want     string
+	}{
+		{"admits a valid ticket", tickets[0].Token, http.StatusOK, CheckinAdmitted},
+		{"refuses the same ticket again", tickets[0].Token, http.StatusConflict, CheckinDuplicate},
+		{"admits another ticket of the order", tickets[1].Token, http.StatusOK, CheckinAdmitted},
+		{"refuses another event's ticket", other[0].Token, http.StatusUnprocessableEntity, CheckinWrongEvent},
+		{"refuses a voided ticket", voided[0].Token, http.StatusGone, CheckinVoid},
+		{"refuses a forged code", tickets[0].Token + "x", http.StatusUnprocessableEntity, CheckinInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(checkinScan{Token: tt.token, Device: "door-1"})
+			w := serveAs(checkIn, "organizer", http.MethodPost, "/", string(body), "eventid", "e1")
+			if w.Code != tt.wantCode {
+				t.Fatalf("check-in = %d %s, want %d", w.Code, w.Body, tt.wantCode)
+			}
+			var result checkinResult
+			responseData(t, w, &result)
+			if result.Result != tt.want {
+				t.Errorf("result = %s, want %s", result.Result, tt.want)
+			}
+		})
+	}
+
+	first, err := stores.TicketInstances.Get(ctx, tickets[0].InstanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.CheckedInAt == nil || first.CheckedInBy != "organizer" || first.CheckInDevice != "door-1" {
+		t.Errorf("checked in at %v by %q on %q, want a time, organizer and door-1", first.CheckedInAt, first.CheckedInBy, first.CheckInDevice)
+	}
+	issued, checkedIn, err := stores.TicketInstances.CountByEvent(ctx, "e1")
+	if err != nil || issued != 2 || checkedIn != 2 {
+		t.Errorf("attendance = %d of %d (%v), want 2 of 2", checkedIn, issued, err)
+	}
+}
+
+// batchCheckIn uploads scans for event e1 and returns their results.
+func batchCheckIn(t *testing.T, scans ...checkinScan) []checkinResult {
+	t.Helper()
+	body, _ := json.Marshal(map[string][]checkinScan{"scans": scans})
+	w := serveAs(checkInBatch, "organizer", http.MethodPost, "/", string(body), "eventid", "e1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("batch = %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	var data struct {
+		Results []checkinResult `json:"results"`
+	}
+	responseData(t, w, &data)
+	if len(data.Results) != len(scans) {
+		t.Fatalf("%d results for %d scans", len(data.Results), len(scans))
+	}
+	return data.Results
+}
+
+func TestCheckInBatchKeepsEarliestScan(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	tickets := issueTestTickets(t, "e1", "u1", 2)
+	base := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	at := func(minutes int) *time.Time {
+		t := base.Add(time.Duration(minutes) * time.Minute)
+		return &t
+	}
+
+	// Within a batch, scans apply in the order taken; results keep the
+	// order sent
+	results := batchCheckIn(t,
+		checkinScan{Token: tickets[0].Token, ScannedAt: at(5), Device: "door-1"},
+		checkinScan{Token: tickets[0].Token, ScannedAt: at(1), Device: "door-1"},
+	)
+	if results[0].Result != CheckinDuplicate || results[1].Result != CheckinAdmitted {
+		t.Errorf("results = %s, %s; want the later scan refused", results[0].Result, results[1].Result)
+	}
+
+	// Door 2 scanned the second ticket later but uploads first
+	results = batchCheckIn(t, checkinScan{Token: tickets[1].Token, ScannedAt: at(20), Device: "door-2"})
+	if results[0].Result != CheckinAdmitted {
+		t.Fatalf("door 2 = %s, want admitted", results[0].Result)
+	}
+	results = batchCheckIn(t, checkinScan{Token: tickets[1].Token, ScannedAt: at(10), Device: "door-1"})
+	if results[0].Result != CheckinAdmitted {
+		t.Errorf("earlier scan from door 1 = %s, want admitted", results[0].Result)
+	}
+	results = batchCheckIn(t, checkinScan{Token: tickets[1].Token, ScannedAt: at(15), Device: "door-3"})
+	if results[0].Result != CheckinDuplicate {
+		t.Errorf("scan between the two = %s, want a duplicate", results[0].Result)
+	}
+
+	for i, want := range []struct {
+		at     *time.Time
+		device string
+	}{{at(1), "door-1"}, {at(10), "door-1"}} {
+		got, err := stores.TicketInstances.Get(ctx, tickets[i].InstanceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.CheckedInAt == nil || !got.CheckedInAt.Equal(*want.at) || got.CheckInDevice != want.device {
+			t.Errorf("ticket %d checked in at %v on %q, want %v on %q", i, got.CheckedInAt, got.CheckInDevice, want.at, want.device)
+		}
+	}
+
+	// A scanner clock running ahead can't record a future admission
+	future := time.Now().Add(time.Hour)
+	more := issueTestTickets(t, "e1", "u2", 1)
+	batchCheckIn(t, checkinScan{Token: more[0].Token, ScannedAt: &future})
+	got, err := stores.TicketInstances.Get(ctx, more[0].InstanceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CheckedInAt == nil || got.CheckedInAt.After(time.Now()) {
+		t.Errorf("checked in at %v, want no later than now", got.CheckedInAt)
+	}
+}
@@ -0,0 +1,681 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// placeholderSecret is the JWT secret the project historically shipped with.
+// It is tolerated in development but refused in production.
+const placeholderSecret = "your_secret_key"
+
+// placeholderWebhookSecret is the default payments.webhook_secret; like
+// placeholderSecret it is refused in production.
+const placeholderWebhookSecret = "fake_webhook_secret"
+
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+
+	StoreMongo  = "mongo"
+	StoreMemory = "memory"
+)
+
+// Config holds every runtime setting. Values come from defaults, then an
+// optional TOML file, then NAEVIS_* environment variables (highest wins).
+type Config struct {
+	Env   string
+	Store string
+
+	MongoURI string
+	Database string
+
+	ListenAddr string
+	PublicURL  string // Address users reach the site at, for links in emails and OAuth redirects
+	Server     ServerConfig
+
+	JWTSecret            string
+	AccessTokenTTL       time.Duration
+	RefreshTokenTTL      time.Duration
+	PasswordResetTTL     time.Duration
+	EmailVerificationTTL time.Duration
+	PasswordMinLength    int      // Shortest password accepted, in characters
+	AdminUsers           []string // Usernames given the admin role when they log in
+
+	Uploads      UploadDirs
+	RateLimit    RateLimitConfig
+	Lockout      LockoutConfig
+	APIKeys      APIKeyConfig
+	Search       SearchConfig
+	Reservations ReservationConfig
+	Events       EventConfig
+	Series       SeriesConfig
+	Payments     PaymentConfig
+	Tickets      TicketConfig
+	Mail         MailConfig
+	OIDC         OIDCConfig
+}
+
+// ServerConfig holds the http.Server timeouts. Read and write timeouts are
+// generous because banner and media uploads arrive as large multipart bodies.
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ShutdownTimeout   time.Duration
+}
+
+// UploadDirs are the directories user uploaded files are written to and
+// served from.
+type UploadDirs struct {
+	UserPics  string
+	EventPics string
+	PlacePics string
+	MerchPics string
+	Media     string
+}
+
+// RateLimitConfig configures the per-client token bucket used by rateLimit.
+type RateLimitConfig struct {
+	PerSecond float64
+	Burst     int
+}
+
+// LockoutConfig controls how failed sign-ins slow down and then lock an
+// account.
+type LockoutConfig struct {
+	BackoffAfter int           // Failures allowed before delays start
+	BackoffBase  time.Duration // First delay; it doubles with each further failure
+	Threshold    int           // Failures that lock the account
+	Duration     time.Duration // How long a lock lasts
+}
+
+// APIKeyConfig sets the rate limits of API keys. Each key gets the
+// defaults unless it is created with its own, which may not exceed the
+// maximums.
+type APIKeyConfig struct {
+	RateLimit    float64 // Requests per second
+	Burst        int
+	MaxRateLimit float64
+	MaxBurst     int
+	MaxPerUser   int // Active keys a user may have
+}
+
+// SearchConfig picks the index behind GET /api/search: "mongo" for a
+// MongoDB text index or "memory" for one built in process at startup.
+// Empty means the same as the store.
+type SearchConfig struct {
+	Index string
+}
+
+// ReservationConfig controls checkout holds on tickets.
+type ReservationConfig struct {
+	HoldTTL       time.Duration // How long a hold lasts before it is released
+	SweepInterval time.Duration // How often expired holds are looked for
+}
+
+// EventConfig controls the scheduler that publishes, starts and ends
+// events on time.
+type EventConfig struct {
+	SchedulerInterval time.Duration // How often due events are looked for
+}
+
+// SeriesConfig controls how far ahead the occurrences of event series are
+// made.
+type SeriesConfig struct {
+	Horizon time.Duration
+}
+
+// PaymentConfig selects and configures the payment provider.
+type PaymentConfig struct {
+	Provider      string        // Only "fake" is built in
+	Currency      string        // ISO 4217 code charged for every order
+	Timeout       time.Duration // Deadline for a single charge
+	WebhookSecret string        // Shared secret for webhook signatures
+	FakeMode      string        // succeed, decline or timeout
+	PendingTTL    time.Duration // Orders still pending after this long are failed
+	SweepInterval time.Duration // How often pending orders are checked
+}
+
+// TicketConfig controls the credentials issued for purchased tickets.
+type TicketConfig struct {
+	// SigningKey is the HMAC key for ticket tokens. When empty a key is
+	// derived from the JWT secret.
+	SigningKey string
+}
+
+// MailConfig selects and configures how outgoing email is delivered.
+type MailConfig struct {
+	Provider     string // log, file or smtp
+	From         string // Sender address of every message
+	Dir          string // Where the file provider writes messages
+	SMTPAddr     string // host:port of the SMTP server
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// OIDCConfig lists the OpenID Connect providers users can sign in with.
+type OIDCConfig struct {
+	Names     []string // Providers to enable; each is configured under oidc.<name>
+	Providers map[string]*OIDCProviderConfig
+	// Mock serves a fake identity provider at /mock-oidc and enables it as
+	// the "mock" provider. Development only.
+	Mock bool
+}
+
+// OIDCProviderConfig configures one OpenID Connect provider.
+type OIDCProviderConfig struct {
+	Issuer       string // Discovery is fetched from <issuer>/.well-known/openid-configuration
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // Defaults to <public_url>/api/oidc/<name>/callback
+	Scopes       []string
+}
+
+// config is the active configuration. main replaces it with the result of
+// loadConfig before anything else runs.
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Env:        EnvDevelopment,
+		Store:      StoreMongo,
+		MongoURI:   "mongodb://localhost:27017",
+		Database:   "eventdb",
+		ListenAddr: "localhost:4000",
+		PublicURL:  "http://localhost:4000",
+		Server: ServerConfig{
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       5 * time.Minute,
+			WriteTimeout:      5 * time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		JWTSecret:       placeholderSecret,
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 30 * 24 * time.Hour,
+
+		PasswordResetTTL:     time.Hour,
+		EmailVerificationTTL: 48 * time.Hour,
+		PasswordMinLength:    10,
+		Uploads: UploadDirs{
+			UserPics:  "userpic",
+			EventPics: "eventpic",
+			PlacePics: "placepic",
+			MerchPics: "merchpic",
+			Media:     "uploads",
+		},
+		RateLimit: RateLimitConfig{PerSecond: 1, Burst: 3},
+		Lockout: LockoutConfig{
+			BackoffAfter: 3,
+			BackoffBase:  time.Second,
+			Threshold:    10,
+			Duration:     15 * time.Minute,
+		},
+		APIKeys: APIKeyConfig{
+			RateLimit:    5,
+			Burst:        10,
+			MaxRateLimit: 50,
+			MaxBurst:     100,
+			MaxPerUser:   20,
+		},
+		Reservations: ReservationConfig{
+			HoldTTL:       10 * time.Minute,
+			SweepInterval: 30 * time.Second,
+		},
+		Events: EventConfig{
+			SchedulerInterval: time.Minute,
+		},
+		Series: SeriesConfig{
+			Horizon: 90 * 24 * time.Hour,
+		},
+		Payments: PaymentConfig{
+			Provider:      "fake",
+			Currency:      "USD",
+			Timeout:       15 * time.Second,
+			WebhookSecret: placeholderWebhookSecret,
+			FakeMode:      FakePaymentSucceed,
+			PendingTTL:    time.Hour,
+			SweepInterval: time.Minute,
+		},
+		Mail: MailConfig{
+			Provider: MailProviderLog,
+			From:     "Naevis <no-reply@localhost>",
+			Dir:      "mail",
+		},
+	}
+}
+
+// setting binds a config field to its file key and environment variable.
+type setting struct {
+	key string
+	env string
+	set func(string) error
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"env", "NAEVIS_ENV", stringVar(&c.Env)},
+		{"store", "NAEVIS_STORE", stringVar(&c.Store)},
+		{"mongo.uri", "NAEVIS_MONGO_URI", stringVar(&c.MongoURI)},
+		{"mongo.database", "NAEVIS_DATABASE", stringVar(&c.Database)},
+		{"server.listen", "NAEVIS_LISTEN", stringVar(&c.ListenAddr)},
+		{"server.public_url", "NAEVIS_PUBLIC_URL", stringVar(&c.PublicURL)},
+		{"server.read_header_timeout", "NAEVIS_SERVER_READ_HEADER_TIMEOUT", durationVar(&c.Server.ReadHeaderTimeout)},
+		{"server.read_timeout", "NAEVIS_SERVER_READ_TIMEOUT", durationVar(&c.Server.ReadTimeout)},
+		{"server.write_timeout", "NAEVIS_SERVER_WRITE_TIMEOUT", durationVar(&c.Server.WriteTimeout)},
+		{"server.idle_timeout", "NAEVIS_SERVER_IDLE_TIMEOUT", durationVar(&c.Server.IdleTimeout)},
+		{"server.shutdown_timeout", "NAEVIS_SERVER_SHUTDOWN_TIMEOUT", durationVar(&c.Server.ShutdownTimeout)},
+		{"auth.jwt_secret", "NAEVIS_JWT_SECRET", stringVar(&c.JWTSecret)},
+		{"auth.access_token_ttl", "NAEVIS_ACCESS_TOKEN_TTL", durationVar(&c.AccessTokenTTL)},
+		{"auth.refresh_token_ttl", "NAEVIS_REFRESH_TOKEN_TTL", durationVar(&c.RefreshTokenTTL)},
+		{"auth.password_reset_ttl", "NAEVIS_PASSWORD_RESET_TTL", durationVar(&c.PasswordResetTTL)},
+		{"auth.email_verification_ttl", "NAEVIS_EMAIL_VERIFICATION_TTL", durationVar(&c.EmailVerificationTTL)},
+		{"auth.password_min_length", "NAEVIS_PASSWORD_MIN_LENGTH", intVar(&c.PasswordMinLength)},
+		{"auth.admin_users", "NAEVIS_ADMIN_USERS", listVar(&c.AdminUsers)},
+		{"uploads.user_pics", "NAEVIS_UPLOADS_USER_PICS", stringVar(&c.Uploads.UserPics)},
+		{"uploads.event_pics", "NAEVIS_UPLOADS_EVENT_PICS", stringVar(&c.Uploads.EventPics)},
+		{"uploads.place_pics", "NAEVIS_UPLOADS_PLACE_PICS", stringVar(&c.Uploads.PlacePics)},
+		{"uploads.merch_pics", "NAEVIS_UPLOADS_MERCH_PICS", stringVar(&c.Uploads.MerchPics)},
+		{"uploads.media", "NAEVIS_UPLOADS_MEDIA", stringVar(&c.Uploads.Media)},
+		{"ratelimit.per_second", "NAEVIS_RATELIMIT_PER_SECOND", floatVar(&c.RateLimit.PerSecond)},
+		{"ratelimit.burst", "NAEVIS_RATELIMIT_BURST", intVar(&c.RateLimit.Burst)},
+		{"lockout.backoff_after", "NAEVIS_LOCKOUT_BACKOFF_AFTER", intVar(&c.Lockout.BackoffAfter)},
+		{"lockout.backoff_base", "NAEVIS_LOCKOUT_BACKOFF_BASE", durationVar(&c.Lockout.BackoffBase)},
+		{"lockout.threshold", "NAEVIS_LOCKOUT_THRESHOLD", intVar(&c.Lockout.Threshold)},
+		{"lockout.duration", "NAEVIS_LOCKOUT_DURATION", durationVar(&c.Lockout.Duration)},
+		{"apikeys.rate_limit", "NAEVIS_APIKEYS_RATE_LIMIT", floatVar(&c.APIKeys.RateLimit)},
+		{"apikeys.burst", "NAEVIS_APIKEYS_BURST", intVar(&c.APIKeys.Burst)},
+		{"apikeys.max_rate_limit", "NAEVIS_APIKEYS_MAX_RATE_LIMIT", floatVar(&c.APIKeys.MaxRateLimit)},
+		{"apikeys.max_burst", "NAEVIS_APIKEYS_MAX_BURST", intVar(&c.APIKeys.MaxBurst)},
+		{"apikeys.max_per_user", "NAEVIS_APIKEYS_MAX_PER_USER", intVar(&c.APIKeys.MaxPerUser)},
+		{"search.index", "NAEVIS_SEARCH_INDEX", stringVar(&c.Search.Index)},
+		{"reservations.hold_ttl", "NAEVIS_RESERVATIONS_HOLD_TTL", durationVar(&c.Reservations.HoldTTL)},
+		{"reservations.sweep_interval", "NAEVIS_RESERVATIONS_SWEEP_INTERVAL", durationVar(&c.Reservations.SweepInterval)},
+		{"events.scheduler_interval", "NAEVIS_EVENTS_SCHEDULER_INTERVAL", durationVar(&c.Events.SchedulerInterval)},
+		{"series.horizon", "NAEVIS_SERIES_HORIZON", durationVar(&c.Series.Horizon)},
+		{"payments.provider", "NAEVIS_PAYMENTS_PROVIDER", stringVar(&c.Payments.Provider)},
+		{"payments.currency", "NAEVIS_PAYMENTS_CURRENCY", stringVar(&c.Payments.Currency)},
+		{"payments.timeout", "NAEVIS_PAYMENTS_TIMEOUT", durationVar(&c.Payments.Timeout)},
+		{"payments.webhook_secret", "NAEVIS_PAYMENTS_WEBHOOK_SECRET", stringVar(&c.Payments.WebhookSecret)},
+		{"payments.fake_mode", "NAEVIS_PAYMENTS_FAKE_MODE", stringVar(&c.Payments.FakeMode)},
+		{"payments.pending_ttl", "NAEVIS_PAYMENTS_PENDING_TTL", durationVar(&c.Payments.PendingTTL)},
+		{"payments.sweep_interval", "NAEVIS_PAYMENTS_SWEEP_INTERVAL", durationVar(&c.Payments.SweepInterval)},
+		{"tickets.signing_key", "NAEVIS_TICKETS_SIGNING_KEY", stringVar(&c.Tickets.SigningKey)},
+		{"mail.provider", "NAEVIS_MAIL_PROVIDER", stringVar(&c.Mail.Provider)},
+		{"mail.from", "NAEVIS_MAIL_FROM", stringVar(&c.Mail.From)},
+		{"mail.dir", "NAEVIS_MAIL_DIR", stringVar(&c.Mail.Dir)},
+		{"mail.smtp_addr", "NAEVIS_MAIL_SMTP_ADDR", stringVar(&c.Mail.SMTPAddr)},
+		{"mail.smtp_username", "NAEVIS_MAIL_SMTP_USERNAME", stringVar(&c.Mail.SMTPUsername)},
+		{"mail.smtp_password", "NAEVIS_MAIL_SMTP_PASSWORD", stringVar(&c.Mail.SMTPPassword)},
+		{"oidc.providers", "NAEVIS_OIDC_PROVIDERS", listVar(&c.OIDC.Names)},
+		{"oidc.mock", "NAEVIS_OIDC_MOCK", boolVar(&c.OIDC.Mock)},
+	}
+}
+
+// providerSettings binds the settings of the OIDC provider called name,
+// which live under oidc.<name> and NAEVIS_OIDC_<NAME>_*. They can only be
+// built once oidc.providers is known.
+func (c *Config) providerSettings(name string) []setting {
+	if c.OIDC.Providers == nil {
+		c.OIDC.Providers = make(map[string]*OIDCProviderConfig)
+	}
+	p := &OIDCProviderConfig{Scopes: []string{"openid", "email", "profile"}}
+	c.OIDC.Providers[name] = p
+
+	key := "oidc." + name + "."
+	env := "NAEVIS_OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+	return []setting{
+		{key + "issuer", env + "ISSUER", stringVar(&p.Issuer)},
+		{key + "client_id", env + "CLIENT_ID", stringVar(&p.ClientID)},
+		{key + "client_secret", env + "CLIENT_SECRET", stringVar(&p.ClientSecret)},
+		{key + "redirect_url", env + "REDIRECT_URL", stringVar(&p.RedirectURL)},
+		{key + "scopes", env + "SCOPES", listVar(&p.Scopes)},
+	}
+}
+
+func stringVar(p *string) func(string) error {
+	return func(v string) error {
+		*p = v
+		return nil
+	}
+}
+
+func intVar(p *int) func(string) error {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*p = n
+		return nil
+	}
+}
+
+func floatVar(p *float64) func(string) error {
+	return func(v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		*p = f
+		return nil
+	}
+}
+
+func boolVar(p *bool) func(string) error {
+	return func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*p = b
+		return nil
+	}
+}
+
+// listVar parses a comma separated list, dropping empty entries.
+func listVar(p *[]string) func(string) error {
+	return func(v string) error {
+		*p = nil
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*p = append(*p, item)
+			}
+		}
+		return nil
+	}
+}
+
+func durationVar(p *time.Duration) func(string) error {
+	return func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*p = d
+		return nil
+	}
+}
+
+// loadConfig builds the configuration from defaults, the optional file at
+// path (or $NAEVIS_CONFIG) and the environment, then validates it.
+func loadConfig(path string) (Config, error) {
+	cfg := defaultConfig()
+
+	if path == "" {
+		path = os.Getenv("NAEVIS_CONFIG")
+	}
+	var values map[string]string
+	if path != "" {
+		var err error
+		if values, err = readConfigFile(path); err != nil {
+			return cfg, err
+		}
+	}
+
+	known := make(map[string]bool)
+	apply := func(settings []setting) error {
+		for _, s := range settings {
+			known[s.key] = true
+			if v, ok := values[s.key]; ok {
+				if err := s.set(v); err != nil {
+					return fmt.Errorf("%s: %s: %v", path, s.key, err)
+				}
+			}
+		}
+		for _, s := range settings {
+			if v, ok := os.LookupEnv(s.env); ok {
+				if err := s.set(v); err != nil {
+					return fmt.Errorf("%s: %v", s.env, err)
+				}
+			}
+		}
+		return nil
+	}
+	if err := apply(cfg.settings()); err != nil {
+		return cfg, err
+	}
+	for _, name := range cfg.OIDC.Names {
+		if err := apply(cfg.providerSettings(name)); err != nil {
+			return cfg, err
+		}
+	}
+	for key := range values {
+		if !known[key] {
+			return cfg, fmt.Errorf("%s: unknown setting %q", path, key)
+		}
+	}
+	// Honour the variable the old .env based setup used.
+	if v := os.Getenv("MONGODB_URI"); v != "" && os.Getenv("NAEVIS_MONGO_URI") == "" {
+		cfg.MongoURI = v
+	}
+
+	return cfg, cfg.validate()
+}
+
+func (c *Config) validate() error {
+	switch c.Env {
+	case EnvDevelopment, EnvProduction:
+	default:
+		return fmt.Errorf("env must be %q or %q, got %q", EnvDevelopment, EnvProduction, c.Env)
+	}
+	switch c.Store {
+	case StoreMongo, StoreMemory:
+	default:
+		return fmt.Errorf("store must be %q or %q, got %q", StoreMongo, StoreMemory, c.Store)
+	}
+	if c.Store == StoreMongo && (c.MongoURI == "" || c.Database == "") {
+		return fmt.Errorf("mongo.uri and mongo.database are required for the mongo store")
+	}
+	if c.ListenAddr == "" {
+		return fmt.Errorf("server.listen must not be empty")
+	}
+	if u, err := url.Parse(c.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("server.public_url must be an absolute http or https URL")
+	}
+	if c.Server.ReadHeaderTimeout <= 0 || c.Server.ReadTimeout <= 0 || c.Server.WriteTimeout <= 0 ||
+		c.Server.IdleTimeout <= 0 || c.Server.ShutdownTimeout <= 0 {
+		return fmt.Errorf("server timeouts must be positive")
+	}
+	if c.JWTSecret == "" {
+		return fmt.Errorf("auth.jwt_secret must not be empty")
+	}
+	if c.Env == EnvProduction {
+		if c.JWTSecret == placeholderSecret {
+			return fmt.Errorf("auth.jwt_secret is still the placeholder value; refusing to start in production")
+		}
+		if len(c.JWTSecret) < 32 {
+			return fmt.Errorf("auth.jwt_secret must be at least 32 characters in production")
+		}
+		if c.Payments.Provider == "fake" {
+			return fmt.Errorf("payments.provider is the fake provider; refusing to start in production")
+		}
+		if c.Payments.WebhookSecret == placeholderWebhookSecret {
+			return fmt.Errorf("payments.webhook_secret is still the placeholder value; refusing to start in production")
+		}
+	}
+	if c.AccessTokenTTL <= 0 || c.RefreshTokenTTL <= 0 {
+		return fmt.Errorf("auth.access_token_ttl and auth.refresh_token_ttl must be positive")
+	}
+	if c.PasswordResetTTL <= 0 || c.EmailVerificationTTL <= 0 {
+		return fmt.Errorf("auth.password_reset_ttl and auth.email_verification_ttl must be positive")
+	}
+	if c.PasswordMinLength < 8 || c.PasswordMinLength > maxPasswordBytes {
+		return fmt.Errorf("auth.password_min_length must be between 8 and %d", maxPasswordBytes)
+	}
+	if c.RateLimit.PerSecond <= 0 || c.RateLimit.Burst <= 0 {
+		return fmt.Errorf("ratelimit.per_second and ratelimit.burst must be positive")
+	}
+	if c.Lockout.BackoffAfter < 0 || c.Lockout.BackoffBase <= 0 || c.Lockout.Duration <= 0 {
+		return fmt.Errorf("lockout.backoff_after must not be negative; lockout.backoff_base and lockout.duration must be positive")
+	}
+	if c.Lockout.Threshold <= c.Lockout.BackoffAfter {
+		return fmt.Errorf("lockout.threshold must be greater than lockout.backoff_after")
+	}
+	if c.APIKeys.RateLimit <= 0 || c.APIKeys.Burst <= 0 || c.APIKeys.MaxPerUser <= 0 {
+		return fmt.Errorf("apikeys.rate_limit, apikeys.burst and apikeys.max_per_user must be positive")
+	}
+	if c.APIKeys.MaxRateLimit < c.APIKeys.RateLimit || c.APIKeys.MaxBurst < c.APIKeys.Burst {
+		return fmt.Errorf("apikeys.max_rate_limit and apikeys.max_burst must be at least the defaults")
+	}
+	switch c.Search.Index {
+	case "", StoreMemory:
+	case StoreMongo:
+		if c.Store != StoreMongo {
+			return fmt.Errorf("search.index %q needs the mongo store", c.Search.Index)
+		}
+	default:
+		return fmt.Errorf("search.index must be %q or %q, got %q", StoreMongo, StoreMemory, c.Search.Index)
+	}
+	if c.Reservations.HoldTTL <= 0 || c.Reservations.SweepInterval <= 0 {
+		return fmt.Errorf("reservations.hold_ttl and reservations.sweep_interval must be positive")
+	}
+	if c.Events.SchedulerInterval <= 0 {
+		return fmt.Errorf("events.scheduler_interval must be positive")
+	}
+	if c.Series.Horizon <= 0 {
+		return fmt.Errorf("series.horizon must be positive")
+	}
+	if c.Payments.Provider != "fake" {
+		return fmt.Errorf("payments.provider %q is not supported", c.Payments.Provider)
+	}
+	switch c.Payments.FakeMode {
+	case FakePaymentSucceed, FakePaymentDecline, FakePaymentTimeout:
+	default:
+		return fmt.Errorf("payments.fake_mode must be succeed, decline or timeout, got %q", c.Payments.FakeMode)
+	}
+	if len(c.Payments.Currency) != 3 {
+		return fmt.Errorf("payments.currency must be a three letter currency code")
+	}
+	if c.Payments.Timeout <= 0 {
+		return fmt.Errorf("payments.timeout must be positive")
+	}
+	if c.Payments.PendingTTL <= c.Payments.Timeout || c.Payments.SweepInterval <= 0 {
+		return fmt.Errorf("payments.pending_ttl must be longer than payments.timeout and payments.sweep_interval positive")
+	}
+	if c.Payments.WebhookSecret == "" {
+		return fmt.Errorf("payments.webhook_secret must not be empty")
+	}
+	switch c.Mail.Provider {
+	case MailProviderLog:
+	case MailProviderFile:
+		if c.Mail.Dir == "" {
+			return fmt.Errorf("mail.dir is required for the file mail provider")
+		}
+	case MailProviderSMTP:
+		if c.Mail.SMTPAddr == "" {
+			return fmt.Errorf("mail.smtp_addr is required for the smtp mail provider")
+		}
+	default:
+		return fmt.Errorf("mail.provider must be log, file or smtp, got %q", c.Mail.Provider)
+	}
+	if c.Mail.From == "" {
+		return fmt.Errorf("mail.from must not be empty")
+	}
+	if c.OIDC.Mock && c.Env == EnvProduction {
+		return fmt.Errorf("oidc.mock must not be enabled in production")
+	}
+	for _, name := range c.OIDC.Names {
+		p := c.OIDC.Providers[name]
+		if name == mockOIDCProvider && c.OIDC.Mock {
+			return fmt.Errorf("oidc.providers: %q is reserved for the mock provider", name)
+		}
+		if !validProviderName(name) {
+			return fmt.Errorf("oidc.providers: %q is not a valid name; use lowercase letters, digits and dashes", name)
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			return fmt.Errorf("oidc.%s.issuer and oidc.%s.client_id are required", name, name)
+		}
+		if !contains(p.Scopes, "openid") {
+			return fmt.Errorf("oidc.%s.scopes must include openid", name)
+		}
+	}
+	for name, dir := range map[string]string{
+		"uploads.user_pics":  c.Uploads.UserPics,
+		"uploads.event_pics": c.Uploads.EventPics,
+		"uploads.place_pics": c.Uploads.PlacePics,
+		"uploads.merch_pics": c.Uploads.MerchPics,
+		"uploads.media":      c.Uploads.Media,
+	} {
+		if dir == "" {
+			return fmt.Errorf("%s must not be empty", name)
+		}
+	}
+	return nil
+}
+
+// readConfigFile parses the small subset of TOML the config file uses:
+// [section] headers, key = value pairs, quoted or bare scalar values and
+// # comments. Keys are returned flattened as "section.key".
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("%s:%d: malformed section header", path, lineNo)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNo)
+		}
+		key = strings.TrimSpace(key)
+		raw = strings.TrimSpace(raw)
+		value := raw
+		if strings.HasPrefix(raw, `"`) {
+			if value, err = strconv.Unquote(raw); err != nil {
+				return nil, fmt.Errorf("%s:%d: bad string value: %v", path, lineNo, err)
+			}
+		} else if strings.HasPrefix(raw, "'") && strings.HasSuffix(raw, "'") && len(raw) >= 2 {
+			value = raw[1 : len(raw)-1]
+		}
+		if section != "" {
+			key = section + "." + key
+		}
+		values[key] = value
+	}
+	return values, scanner.Err()
+}
+
+// stripComment removes a trailing # comment that is not inside quotes.
+func stripComment(line string) string {
+	inQuote := rune(0)
+	for i, r := range line {
+		switch {
+		case inQuote != 0 && r == inQuote:
+			inQuote = 0
+		case inQuote == 0 && (r == '"' || r == '\''):
+			inQuote = r
+		case inQuote == 0 && r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// uploadPath returns the path of name inside the upload directory dir.
+func uploadPath(dir, name string) string {
+	return filepath.Join(dir, name)
+}
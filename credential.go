@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Errors returned when checking a scanned ticket token.
+var (
+	ErrInvalidTicketToken = errors.New("invalid ticket token")
+	ErrWrongEvent         = errors.New("ticket is for a different event")
+	ErrTicketVoid         = errors.New("ticket has been voided")
+)
+
+// ticketTokenVersion prefixes every signed payload so the format can change
+// without old codes being misread.
+const ticketTokenVersion = "t1"
+
+// TicketClaims is what a ticket token vouches for.
+type TicketClaims struct {
+	InstanceID string    `json:"instanceid"`
+	EventID    string    `json:"eventid"`
+	TicketID   string    `json:"ticketid"`
+	HolderID   string    `json:"holderid"`
+	IssuedAt   time.Time `json:"issued_at"`
+}
+
+// ticketSigningKey returns the configured HMAC key, or one derived from the
+// JWT secret so development setups work without extra configuration.
+func ticketSigningKey() []byte {
+	if config.Tickets.SigningKey != "" {
+		return []byte(config.Tickets.SigningKey)
+	}
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("ticket credentials"))
+	return mac.Sum(nil)
+}
+
+// signTicketToken encodes claims as base64url(payload).base64url(HMAC). The
+// payload is a short | separated list to keep QR codes small.
+func signTicketToken(claims TicketClaims) string {
+	payload := strings.Join([]string{
+		ticketTokenVersion,
+		claims.InstanceID,
+		claims.EventID,
+		claims.TicketID,
+		claims.HolderID,
+		strconv.FormatInt(claims.IssuedAt.Unix(), 10),
+	}, "|")
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+
+	mac := hmac.New(sha256.New, ticketSigningKey())
+	mac.Write([]byte(encoded))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyTicketToken checks a token's signature and decodes its claims.
+func verifyTicketToken(token string) (TicketClaims, error) {
+	encoded, sig, ok := strings.Cut(strings.TrimSpace(token), ".")
+	if !ok {
+		return TicketClaims{}, ErrInvalidTicketToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return TicketClaims{}, ErrInvalidTicketToken
+	}
+	mac := hmac.New(sha256.New, ticketSigningKey())
+	mac.Write([]byte(encoded))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return TicketClaims{}, ErrInvalidTicketToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return TicketClaims{}, ErrInvalidTicketToken
+	}
+	parts := strings.Split(string(payload), "|")
+	if len(parts) != 6 || parts[0] != ticketTokenVersion {
+		return TicketClaims{}, ErrInvalidTicketToken
+	}
+	issued, err := strconv.ParseInt(parts[5], 10, 64)
+	if err != nil {
+		return TicketClaims{}, ErrInvalidTicketToken
+	}
+	return TicketClaims{
+		InstanceID: parts[1],
+		EventID:    parts[2],
+		TicketID:   parts[3],
+		HolderID:   parts[4],
+		IssuedAt:   time.Unix(issued, 0).UTC(),
+	}, nil
+}
+
+// issueTickets creates one signed instance per ticket unit in a completed
+// order and returns all of the order's instances. Instance IDs are derived
+// from the order, so issuing twice (say from a webhook racing the checkout
+// handler) yields the same tickets.
+func issueTickets(ctx context.Context, order Order) ([]TicketInstance, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	n := 0
+	for _, item := range order.Items {
+		if item.Type != OrderItemTicket {
+			continue
+		}
+		for i := 0; i < item.Quantity; i++ {
+			n++
+			instance := TicketInstance{
+				InstanceID: fmt.Sprintf("%s-%02d", order.OrderID, n),
+				OrderID:    order.OrderID,
+				EventID:    order.EventID,
+				TicketID:   item.ItemID,
+				TicketName: item.Name,
+				HolderID:   order.UserID,
+				Status:     TicketInstanceValid,
+				IssuedAt:   now,
+			}
+			instance.Token = signTicketToken(TicketClaims{
+				InstanceID: instance.InstanceID,
+				EventID:    instance.EventID,
+				TicketID:   instance.TicketID,
+				HolderID:   instance.HolderID,
+				IssuedAt:   instance.IssuedAt,
+			})
+			if err := stores.TicketInstances.Issue(ctx, instance); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if n == 0 {
+		return []TicketInstance{}, nil
+	}
+	return stores.TicketInstances.ListByOrder(ctx, order.OrderID)
+}
+
+// issueOrderTickets issues the tickets for an order that has just completed,
+// logging rather than failing: the buyer has paid, and the tickets can be
+// issued again later from the order.
+func issueOrderTickets(ctx context.Context, order Order) []TicketInstance {
+	instances, err := issueTickets(ctx, order)
+	if err != nil {
+		log.Printf("Failed to issue tickets for order %s: %v", order.OrderID, err)
+		return []TicketInstance{}
+	}
+	return instances
+}
+
+// voidOrderTickets cancels the tickets issued for a refunded order.
+func voidOrderTickets(ctx context.Context, order Order) {
+	if err := stores.TicketInstances.VoidByOrder(ctx, order.OrderID); err != nil {
+		log.Printf("Failed to void tickets for order %s: %v", order.OrderID, err)
+	}
+}
+
+// getMyTickets lists the ticket instances held by the requesting user
+func getMyTickets(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	instances, err := stores.TicketInstances.ListByHolder(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch tickets", http.StatusInternalServerError)
+		return
+	}
+	if len(instances) == 0 {
+		instances = []TicketInstance{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(instances)
+}
+
+// getMyTicket returns a ticket instance with its signed token
+func getMyTicket(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	instance, ok := loadOwnTicket(w, r, ps)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(instance)
+}
+
+// getTicketQR renders a ticket instance's token as a PNG QR code
+func getTicketQR(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	instance, ok := loadOwnTicket(w, r, ps)
+	if !ok {
+		return
+	}
+	if instance.Status != TicketInstanceValid {
+		http.Error(w, "Ticket is no longer valid", http.StatusGone)
+		return
+	}
+
+	qr, err := encodeQR([]byte(instance.Token), qrLevelM)
+	if err != nil {
+		http.Error(w, "Failed to render QR code", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeQRPNG(&buf, qr, 8); err != nil {
+		http.Error(w, "Failed to render QR code", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(buf.Bytes())
+}
+
+// verifyTicket checks a scanned token for an event without admitting its
+// holder. Only the event's organizers may verify tickets.
+func verifyTicket(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	eventID := ps.ByName("eventid")
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	instance, err := lookupTicketToken(r.Context(), eventID, req.Token)
+	if err != nil {
+		writeTicketError(w, instance, err)
+		return
+	}
+	sendResponse(w, http.StatusOK, instance, "Ticket is valid", nil)
+}
+
+// lookupTicketToken verifies a token's signature and that it names a live
+// instance of eventID. A voided ticket is returned with ErrTicketVoid.
+func lookupTicketToken(ctx context.Context, eventID, token string) (TicketInstance, error) {
+	claims, err := verifyTicketToken(token)
+	if err != nil {
+		return TicketInstance{}, err
+	}
+	if claims.EventID != eventID {
+		return TicketInstance{}, ErrWrongEvent
+	}
+
+	instance, err := stores.TicketInstances.Get(ctx, claims.InstanceID)
+	if err == ErrNotFound {
+		return TicketInstance{}, ErrInvalidTicketToken
+	}
+	if err != nil {
+		return TicketInstance{}, err
+	}
+	// The stored token must match too, so a code from a reissued ticket is
+	// refused even though its signature is good
+	if instance.Token != strings.TrimSpace(token) {
+		return TicketInstance{}, ErrInvalidTicketToken
+	}
+	if instance.Status != TicketInstanceValid {
+		return instance, ErrTicketVoid
+	}
+	return instance, nil
+}
+
+// writeTicketError responds to a failed lookupTicketToken.
+func writeTicketError(w http.ResponseWriter, instance TicketInstance, err error) {
+	switch err {
+	case ErrInvalidTicketToken:
+		sendResponse(w, http.StatusUnprocessableEntity, nil, "Ticket code is not valid", err)
+	case ErrWrongEvent:
+		sendResponse(w, http.StatusUnprocessableEntity, nil, "Ticket is for a different event", err)
+	case ErrTicketVoid:
+		sendResponse(w, http.StatusGone, instance, "Ticket has been voided", err)
+	default:
+		http.Error(w, "Failed to fetch ticket", http.StatusInternalServerError)
+	}
+}
+
+// loadOwnTicket fetches the :instanceid ticket and checks it belongs to the
+// requesting user, writing an error response if not.
+func loadOwnTicket(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (TicketInstance, bool) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return TicketInstance{}, false
+	}
+
+	instance, err := stores.TicketInstances.Get(r.Context(), ps.ByName("instanceid"))
+	if err == ErrNotFound || (err == nil && instance.HolderID != userID) {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return TicketInstance{}, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch ticket", http.StatusInternalServerError)
+		return TicketInstance{}, false
+	}
+	return instance, true
+}
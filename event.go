@@ -9,8 +9,6 @@ import (
 	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func createEvent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -34,10 +32,32 @@ func createEvent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		http.Error(w, "Invalid user", http.StatusBadRequest)
 		return
 	}
+	// Tickets, merch, reviews and the like have their own endpoints
+	stripReadOnly(&event)
 	event.CreatorID = requestingUserID
+	if event.Status == "" {
+		event.Status = EventPublished
+	}
+	errs := validate(event)
+	if event.Status != EventDraft && event.Status != EventPublished {
+		errs.add("status", "must be draft or published")
+	}
+	if event.PublishAt != nil && event.Status != EventDraft {
+		errs.add("publish_at", "only drafts can be published later")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
 
 	// Generate a unique EventID
 	event.EventID = generateID(14)
+	event.CreatedAt = time.Now()
+	event.UpdatedAt = event.CreatedAt
+	event.StatusChangedAt = event.CreatedAt
+	if event.Status == EventPublished {
+		event.PublishedAt = &event.CreatedAt
+	}
 
 	// Handle the banner image upload (if present)
 	bannerFile, _, err := r.FormFile("banner")
@@ -49,13 +69,13 @@ func createEvent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	// If a banner file is provided, process it
 	if bannerFile != nil {
 		// Ensure the directory exists
-		if err := os.MkdirAll("./eventpic", os.ModePerm); err != nil {
+		if err := os.MkdirAll(config.Uploads.EventPics, os.ModePerm); err != nil {
 			http.Error(w, "Error creating directory for banner", http.StatusInternalServerError)
 			return
 		}
 
 		// Save the banner image
-		out, err := os.Create("./eventpic/" + event.EventID + ".jpg")
+		out, err := os.Create(uploadPath(config.Uploads.EventPics, event.EventID+".jpg"))
 		if err != nil {
 			http.Error(w, "Error saving banner", http.StatusInternalServerError)
 			return
@@ -72,9 +92,8 @@ func createEvent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		event.BannerImage = event.EventID + ".jpg"
 	}
 
-	// Insert the event into MongoDB
-	collection := client.Database("eventdb").Collection("events")
-	_, err = collection.InsertOne(context.TODO(), event)
+	// Save the event
+	err = stores.Events.Create(r.Context(), event)
 	if err != nil {
 		http.Error(w, "Error saving event", http.StatusInternalServerError)
 		return
@@ -87,38 +106,76 @@ func createEvent(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	}
 }
 
+// getEvents lists events matching the query string (see parseEventQuery
+// and, for events at places in an area, parseGeoQuery) a page at a time.
+// The total count and the cursor of the next page are sent in the
+// X-Total-Count and X-Next-Cursor headers.
 func getEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	// Set the response header to indicate JSON content type
-	w.Header().Set("Content-Type", "application/json")
-
-	collection := client.Database("eventdb").Collection("events")
-
-	// Find all events
-	cursor, err := collection.Find(context.TODO(), bson.M{})
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	values := r.URL.Query()
+	q, errs := parseEventQuery(values)
+	geo := parseGeoQuery(values, errs)
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
 		return
 	}
-	defer cursor.Close(context.TODO())
+
+	// Signed in organizers see their drafts among the rest
+	q.Viewer, _ = r.Context().Value(userIDKey).(string)
 
 	var events []Event
-	if err = cursor.All(context.TODO(), &events); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var total int
+	var err error
+	// Ask for one more than a page to learn whether there is another
+	limit := q.Limit
+	q.Limit++
+	if geo != nil {
+		q.PlaceIDs, err = placeIDsWithin(r.Context(), *geo, q.PlaceIDs)
+	}
+	if err == nil && (geo == nil || len(q.PlaceIDs) > 0) {
+		events, total, err = stores.Events.Search(r.Context(), q)
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch events", http.StatusInternalServerError)
 		return
 	}
+	next := ""
+	if len(events) > limit {
+		events = events[:limit]
+		next = encodeEventCursor(q.Sort, events[limit-1])
+	}
+	if events == nil {
+		events = []Event{}
+	}
 
-	// Encode the list of events as JSON and write to the response
+	setPageHeaders(w, r, total, next)
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(events)
 }
 
+// placeIDsWithin returns the IDs of the places geo selects, keeping only
+// those in placeIDs if it isn't empty.
+func placeIDsWithin(ctx context.Context, geo GeoQuery, placeIDs []string) ([]string, error) {
+	geo.Limit = maxGeoPlaces
+	places, err := stores.Places.Search(ctx, geo)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, place := range places {
+		if len(placeIDs) == 0 || contains(placeIDs, place.PlaceID) {
+			ids = append(ids, place.PlaceID)
+		}
+	}
+	return ids, nil
+}
+
 func getEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	id := ps.ByName("eventid")
 
-	// Fetch event data from the "events" collection
-	eventsCollection := client.Database("eventdb").Collection("events")
-	var event Event
-	err := eventsCollection.FindOne(context.TODO(), bson.M{"eventid": id}).Decode(&event)
-	if err != nil {
+	// Fetch event data; drafts are only for their organizers
+	viewerID, _ := r.Context().Value(userIDKey).(string)
+	event, err := stores.Events.Get(r.Context(), id)
+	if err != nil || !eventVisibleTo(r.Context(), event, viewerID) {
 		http.Error(w, "Event not found", http.StatusNotFound)
 		return
 	}
@@ -135,42 +192,18 @@ func getEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	}
 
 	// Fetch tickets data
-	ticketsCollection := client.Database("eventdb").Collection("ticks")
-	ticketsCursor, err := ticketsCollection.Find(context.TODO(), bson.M{"eventid": id})
-	if err == nil {
-		defer ticketsCursor.Close(context.TODO())
-		for ticketsCursor.Next(context.TODO()) {
-			var ticket Ticket
-			if err := ticketsCursor.Decode(&ticket); err == nil {
-				event.Tickets = append(event.Tickets, ticket)
-			}
-		}
+	if tickets, err := stores.Tickets.ListByEvent(r.Context(), id); err == nil {
+		event.Tickets = append(event.Tickets, tickets...)
 	}
 
 	// Fetch media data
-	mediaCollection := client.Database("eventdb").Collection("media")
-	mediaCursor, err := mediaCollection.Find(context.TODO(), bson.M{"eventid": id})
-	if err == nil {
-		defer mediaCursor.Close(context.TODO())
-		for mediaCursor.Next(context.TODO()) {
-			var media Media
-			if err := mediaCursor.Decode(&media); err == nil {
-				event.Media = append(event.Media, media)
-			}
-		}
+	if medias, err := stores.Media.ListByEvent(r.Context(), id); err == nil {
+		event.Media = append(event.Media, medias...)
 	}
 
 	// Fetch merch data
-	merchCollection := client.Database("eventdb").Collection("merch")
-	merchCursor, err := merchCollection.Find(context.TODO(), bson.M{"eventid": id})
-	if err == nil {
-		defer merchCursor.Close(context.TODO())
-		for merchCursor.Next(context.TODO()) {
-			var merch Merch
-			if err := merchCursor.Decode(&merch); err == nil {
-				event.Merch = append(event.Merch, merch)
-			}
-		}
+	if merch, err := stores.Merch.ListByEvent(r.Context(), id); err == nil {
+		event.Merch = append(event.Merch, merch...)
 	}
 
 	// Send the combined event data with tickets, media, and merch
@@ -190,7 +223,7 @@ func editEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	}
 
 	// Prepare a map for updating fields
-	updateFields := bson.M{}
+	updateFields := map[string]interface{}{}
 
 	// Only set the fields that are provided in the form
 	if title := r.FormValue("title"); title != "" {
@@ -213,9 +246,84 @@ func editEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		updateFields["description"] = description
 	}
 
-	// Validate required fields
-	if updateFields["title"] == "" || updateFields["location"] == "" || updateFields["description"] == "" {
-		http.Error(w, "Title, Location, and Description are required", http.StatusBadRequest)
+	if reason := r.FormValue("status_reason"); reason != "" {
+		updateFields["status_reason"] = reason
+	}
+
+	// Times are RFC 3339; publish_at may be sent empty to clear it
+	errs := FieldErrors{}
+	for _, key := range []string{"start_date_time", "end_date_time", "publish_at"} {
+		value, ok := r.MultipartForm.Value[key]
+		if !ok {
+			continue
+		}
+		if value[0] == "" && key == "publish_at" {
+			updateFields[key] = nil
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value[0])
+		if err != nil {
+			errs.add(key, "must be an RFC 3339 time")
+			continue
+		}
+		updateFields[key] = t.UTC()
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	// Load the stored event so only the provided fields change
+	event, err := stores.Events.Get(r.Context(), eventID)
+	if err != nil {
+		if err == ErrNotFound {
+			http.Error(w, "Event not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error retrieving event", http.StatusInternalServerError)
+		}
+		return
+	}
+	now := time.Now().UTC()
+	updateFields["updated_at"] = now // Update the timestamp for the update
+	// On an occurrence of a series these now differ from the series
+	if event.SeriesID != "" {
+		for field := range updateFields {
+			overrideSeriesFields(&event, field)
+		}
+		updateFields["series_overrides"] = event.SeriesOverrides
+	}
+
+	// The status only changes through Transition, so an edit can't undo
+	// what the scheduler did meanwhile
+	from, status := event.Status, r.FormValue("status")
+	if status == "" {
+		status = from
+	}
+	if problem := checkStatusChange(from, status); problem != "" {
+		http.Error(w, "Can't change the status: "+problem, http.StatusConflict)
+		return
+	}
+	applyEventFields(&event, updateFields)
+	if status == EventPublished && from != EventPublished {
+		delete(updateFields, "publish_at") // Publishing clears it
+		event.PublishAt = nil
+	}
+	event.Status = status
+	// Only what this edit changes is checked, so events stored before a
+	// rule was added can still be edited
+	changed := map[string]bool{"status": true}
+	for field := range updateFields {
+		changed[field] = true
+	}
+	if changed["start_date_time"] {
+		changed["end_date_time"] = true // Checked against the start
+	}
+	errs = validate(event).only(changed)
+	if event.PublishAt != nil && event.Status != EventDraft {
+		errs.add("publish_at", "only drafts can be published later")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
 		return
 	}
 
@@ -236,13 +344,13 @@ func editEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	// If a new banner is uploaded, save it and update the field
 	if bannerFile != nil {
 		// Ensure the directory exists
-		if err := os.MkdirAll("./eventpic", os.ModePerm); err != nil {
+		if err := os.MkdirAll(config.Uploads.EventPics, os.ModePerm); err != nil {
 			http.Error(w, "Error creating directory for banner", http.StatusInternalServerError)
 			return
 		}
 
 		// Save the banner image
-		out, err := os.Create("./eventpic/" + eventID + ".jpg")
+		out, err := os.Create(uploadPath(config.Uploads.EventPics, eventID+".jpg"))
 		if err != nil {
 			http.Error(w, "Error saving banner", http.StatusInternalServerError)
 			return
@@ -255,48 +363,31 @@ func editEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 			return
 		}
 
-		// Update the banner image path in the updateFields map
 		updateFields["banner_image"] = eventID + ".jpg"
 	}
 
-	// Update the event in MongoDB (only the fields that have changed)
-	collection := client.Database("eventdb").Collection("events")
-	updateFields["updated_at"] = time.Now() // Update the timestamp for the update
+	if status != from {
+		_, err := stores.Events.Transition(r.Context(), eventID, from, status, now)
+		if err == ErrConflict {
+			http.Error(w, "The event's status changed meanwhile; reload it and try again", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error updating event", http.StatusInternalServerError)
+			return
+		}
+	}
 
-	// Perform the update query
-	_, err = collection.UpdateOne(
-		context.TODO(),
-		bson.M{"eventid": eventID},
-		bson.M{"$set": updateFields},
-	)
+	// Save only the provided fields
+	event, err = stores.Events.Set(r.Context(), eventID, updateFields)
 	if err != nil {
 		http.Error(w, "Error updating event", http.StatusInternalServerError)
 		return
 	}
 
-	// Respond with the updated fields
-	w.WriteHeader(http.StatusOK) // 200 OK
-	updatedEvent := Event{EventID: eventID}
-	for key, value := range updateFields {
-		// Assign updated values back to the Event struct
-		switch key {
-		case "title":
-			updatedEvent.Title = value.(string)
-		case "description":
-			updatedEvent.Description = value.(string)
-		case "place":
-			updatedEvent.Place = value.(string)
-		case "date":
-			updatedEvent.Date = value.(string)
-		case "location":
-			updatedEvent.Location = value.(string)
-			// case "banner_image":
-			// 	updatedEvent.BannerImage = value.(string)
-		}
-	}
-
 	// Send the updated event as the response
-	if err := json.NewEncoder(w).Encode(updatedEvent); err != nil {
+	w.WriteHeader(http.StatusOK) // 200 OK
+	if err := json.NewEncoder(w).Encode(event); err != nil {
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
@@ -304,45 +395,31 @@ func editEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 func deleteEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 
-	// Get the ID of the requesting user from the context
-	requestingUserID, ok := r.Context().Value(userIDKey).(string)
-	if !ok {
-		http.Error(w, "Invalid user", http.StatusBadRequest)
-		return
-	}
-
-	// Get the event details to verify the creator
-	collection := client.Database("eventdb").Collection("events")
-	var event Event
-	err := collection.FindOne(context.TODO(), bson.M{"eventid": eventID}).Decode(&event)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Event not found", http.StatusNotFound)
-		} else {
-			http.Error(w, "Error retrieving event", http.StatusInternalServerError)
+	// Deleting an occurrence of a series makes it an exception, so the
+	// series doesn't make it again
+	event, err := stores.Events.Get(r.Context(), eventID)
+	if err == nil && event.SeriesID != "" && event.OccurrenceStart != nil {
+		err = addSeriesException(r.Context(), event.SeriesID, *event.OccurrenceStart)
+		if err == ErrNotFound {
+			err = nil // The series is gone
 		}
+	}
+	if err != nil && err != ErrNotFound {
+		http.Error(w, "Error deleting event", http.StatusInternalServerError)
 		return
 	}
 
-	// Check if the requesting user is the creator of the event
-	if event.CreatorID != requestingUserID {
-		http.Error(w, "Unauthorized to delete this event", http.StatusForbidden)
+	// Delete the event; the route only lets its creator get here
+	err = stores.Events.Delete(r.Context(), eventID)
+	if err == ErrNotFound {
+		http.Error(w, "Event not found", http.StatusNotFound)
 		return
 	}
-
-	// Delete the event from MongoDB
-	result, err := collection.DeleteOne(context.TODO(), bson.M{"eventid": eventID})
 	if err != nil {
 		http.Error(w, "Error deleting event", http.StatusInternalServerError)
 		return
 	}
 
-	// Check if the event was found and deleted
-	if result.DeletedCount == 0 {
-		http.Error(w, "Event not found", http.StatusNotFound)
-		return
-	}
-
 	// Send success response
 	w.WriteHeader(http.StatusOK) // 200 OK
 	response := map[string]string{"message": "Event deleted successfully"}
@@ -356,12 +433,129 @@ func addReview(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	var review Review
 	json.NewDecoder(r.Body).Decode(&review)
 
-	// Add review to MongoDB
-	collection := client.Database("eventdb").Collection("events")
-	_, err := collection.UpdateOne(context.TODO(), bson.M{"reviewid": eventID}, bson.M{"$push": bson.M{"reviews": review}})
+	// The author and IDs come from the server, not the client
+	review.ReviewID = generateID(12)
+	review.EventID = eventID
+	review.UserID, _ = r.Context().Value(userIDKey).(string)
+	review.CreatedAt = time.Now()
+
+	// Add review to the event
+	err := stores.Events.AddReview(r.Context(), eventID, review)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// deleteReview removes a review from an event. Authors may remove their own
+// reviews; moderators may remove anyone's.
+func deleteReview(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := stores.Events.RemoveReview(r.Context(), ps.ByName("eventid"), ps.ByName("reviewid"))
+	if err == ErrNotFound {
+		http.Error(w, "Review not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete review", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, nil, "Review deleted", nil)
+}
+
+// applyEventFields copies the values collected by editEvent onto event.
+func applyEventFields(event *Event, fields map[string]interface{}) {
+	for key, value := range fields {
+		switch key {
+		case "title":
+			event.Title = value.(string)
+		case "description":
+			event.Description = value.(string)
+		case "place":
+			event.Place = value.(string)
+		case "date":
+			event.Date = value.(string)
+		case "location":
+			event.Location = value.(string)
+		case "banner_image":
+			event.BannerImage = value.(string)
+		case "status_reason":
+			event.StatusReason = value.(string)
+		case "start_date_time":
+			event.StartDateTime = value.(time.Time)
+		case "end_date_time":
+			event.EndDateTime = value.(time.Time)
+		case "publish_at":
+			if t, ok := value.(time.Time); ok {
+				event.PublishAt = &t
+			} else {
+				event.PublishAt = nil
+			}
+		case "updated_at":
+			event.UpdatedAt = value.(time.Time)
+		}
+	}
+}
+
+// addCoOrganizer lets another user manage the event. Only the event's
+// creator (or an admin) may add co-organizers.
+func addCoOrganizer(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	eventID := ps.ByName("eventid")
+
+	var req struct {
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	user, err := stores.Users.GetByUsername(r.Context(), normalizeUsername(req.Username))
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	event, err := stores.Events.Get(r.Context(), eventID)
+	if err != nil {
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return
+	}
+	if user.UserID != event.CreatorID && !contains(event.CoOrganizers, user.UserID) {
+		fields := map[string]interface{}{
+			"co_organizers": append(event.CoOrganizers, user.UserID),
+			"updated_at":    time.Now(),
+		}
+		if event, err = stores.Events.Set(r.Context(), eventID, fields); err != nil {
+			http.Error(w, "Error updating event", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	sendResponse(w, http.StatusOK, event.CoOrganizers, "Co-organizer added", nil)
+}
+
+// removeCoOrganizer revokes a co-organizer's access to the event
+func removeCoOrganizer(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	event, err := stores.Events.Get(r.Context(), ps.ByName("eventid"))
+	if err != nil {
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return
+	}
+
+	userID := ps.ByName("userid")
+	if !contains(event.CoOrganizers, userID) {
+		http.Error(w, "User is not a co-organizer of this event", http.StatusNotFound)
+		return
+	}
+	fields := map[string]interface{}{
+		"co_organizers": removeString(event.CoOrganizers, userID),
+		"updated_at":    time.Now(),
+	}
+	if event, err = stores.Events.Set(r.Context(), event.EventID, fields); err != nil {
+		http.Error(w, "Error updating event", http.StatusInternalServerError)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, event.CoOrganizers, "Co-organizer removed", nil)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// serveForm runs handler as userID with a multipart form of fields and
+// the route parameters given as name, value pairs.
+func serveForm(handler httprouter.Handle, userID string, fields map[string]string, params ...string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPut, "/", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r = r.WithContext(context.WithValue(r.Context(), userIDKey, userID))
+	var ps httprouter.Params
+	for i := 0; i+1 < len(params); i += 2 {
+		ps = append(ps, httprouter.Param{Key: params[i], Value: params[i+1]})
+	}
+	w := httptest.NewRecorder()
+	handler(w, r, ps)
+	return w
+}
+
+func TestEditEventChecksOnlyChangedFields(t *testing.T) {
+	useMemoryStores(t)
+	// Stored before descriptions were required
+	if err := stores.Events.Create(context.Background(), Event{EventID: "e1", Title: "Show", Location: "Hall", CreatorID: "organizer", Status: EventDraft}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		fields   map[string]string
+		wantCode int
+		wantErr  string
+	}{
+		{"an untouched missing description", map[string]string{"title": "New show"}, http.StatusOK, ""},
+		{"a bad new title", map[string]string{"title": strings.Repeat("x", 201)}, http.StatusUnprocessableEntity, "title"},
+		{"an end before the new start", map[string]string{"start_date_time": "2030-01-02T00:00:00Z", "end_date_time": "2030-01-01T00:00:00Z"}, http.StatusUnprocessableEntity, "end_date_time"},
+		{"new times", map[string]string{"start_date_time": "2030-01-01T00:00:00Z", "end_date_time": "2030-01-02T00:00:00Z"}, http.StatusOK, ""},
+		{"a start after the stored end", map[string]string{"start_date_time": "2030-01-03T00:00:00Z"}, http.StatusUnprocessableEntity, "end_date_time"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveForm(editEvent, "organizer", tt.fields, "eventid", "e1")
+			if w.Code != tt.wantCode {
+				t.Fatalf("edit = %d %s, want %d", w.Code, w.Body, tt.wantCode)
+			}
+			if tt.wantErr != "" && !strings.Contains(w.Body.String(), tt.wantErr) {
+				t.Errorf("errors = %s, want one for %s", w.Body, tt.wantErr)
+			}
+		})
+	}
+}
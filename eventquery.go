@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes of GET /api/events
+const (
+	defaultEventPageSize = 20
+	maxEventPageSize     = 100
+)
+
+// maxSearchWords caps how many words of a text search are matched.
+const maxSearchWords = 10
+
+// EventQuery selects, orders and pages events. Empty fields don't filter.
+type EventQuery struct {
+	Text       string   // Every word must appear in the title, description or tags
+	Categories []string // Any of these
+	Statuses   []string
+	PlaceIDs   []string
+	From, To   time.Time // Events running at some point between the two
+	MinPrice   *float64  // Events with a ticket priced within the range
+	MaxPrice   *float64
+	Sort       string // A key of eventSorts; "" means "start"
+	After      *eventCursor
+	Limit      int
+	Viewer     string // Drafts are left out unless this user organizes them
+}
+
+// eventSort is an order events can be listed in. Ties are broken by event
+// ID, which makes every order total and so usable for cursors.
+type eventSort struct {
+	field string // Stored field sorted on
+	desc  bool
+	key   func(e Event) interface{} // The field's value: time.Time, float64 or string
+}
+
+var eventSorts = map[string]eventSort{
+	"start":    {"start_date_time", false, func(e Event) interface{} { return e.StartDateTime }},
+	"-start":   {"start_date_time", true, func(e Event) interface{} { return e.StartDateTime }},
+	"created":  {"created_at", false, func(e Event) interface{} { return e.CreatedAt }},
+	"-created": {"created_at", true, func(e Event) interface{} { return e.CreatedAt }},
+	"price":    {"min_price", false, func(e Event) interface{} { return e.MinPrice }},
+	"-price":   {"min_price", true, func(e Event) interface{} { return e.MinPrice }},
+	"title":    {"title", false, func(e Event) interface{} { return e.Title }},
+	"-title":   {"title", true, func(e Event) interface{} { return e.Title }},
+}
+
+// eventSortNames lists eventSorts for error messages.
+const eventSortNames = "start, -start, created, -created, price, -price, title, -title"
+
+// eventCursor marks the last event of a page: the value it was sorted on
+// and its ID.
+type eventCursor struct {
+	Value   interface{}
+	EventID string
+}
+
+// wireCursor is how a cursor travels, base64 encoded so clients treat it
+// as opaque.
+type wireCursor struct {
+	Sort    string          `json:"s"`
+	Value   json.RawMessage `json:"v"`
+	EventID string          `json:"id"`
+}
+
+var errBadCursor = errors.New("bad cursor")
+
+// encodeEventCursor returns the cursor of the page following e.
+func encodeEventCursor(sortName string, e Event) string {
+	value, _ := json.Marshal(eventSorts[sortName].key(e))
+	raw, _ := json.Marshal(wireCursor{Sort: sortName, Value: value, EventID: e.EventID})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeEventCursor reads a cursor made by encodeEventCursor for the same
+// sort order.
+func decodeEventCursor(sortName, s string) (*eventCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	var c wireCursor
+	if err := json.Unmarshal(raw, &c); err != nil || c.EventID == "" {
+		return nil, errBadCursor
+	}
+	if c.Sort != sortName {
+		return nil, fmt.Errorf("cursor is for sort %q", c.Sort)
+	}
+
+	var value interface{}
+	switch eventSorts[sortName].key(Event{}).(type) {
+	case time.Time:
+		var t time.Time
+		err = json.Unmarshal(c.Value, &t)
+		value = t
+	case float64:
+		var f float64
+		err = json.Unmarshal(c.Value, &f)
+		value = f
+	case string:
+		var s string
+		err = json.Unmarshal(c.Value, &s)
+		value = s
+	}
+	if err != nil {
+		return nil, errBadCursor
+	}
+	return &eventCursor{Value: value, EventID: c.EventID}, nil
+}
+
+// compareSortValues orders two values of the same eventSort key.
+func compareSortValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case float64:
+		b := b.(float64)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(a, b.(string))
+	}
+	panic(fmt.Sprintf("compareSortValues: unexpected %T", a))
+}
+
+// searchWords splits a text search into the lowercase words to look for.
+func searchWords(text string) []string {
+	words := strings.Fields(strings.ToLower(text))
+	if len(words) > maxSearchWords {
+		words = words[:maxSearchWords]
+	}
+	return words
+}
+
+// parseEventQuery reads the query string of GET /api/events:
+//
+//	q                      text to search for
+//	category, status, place
+//	                       comma separated values to match
+//	from, to               dates (2006-01-02) or times (RFC 3339)
+//	price_min, price_max   ticket price range
+//	sort                   one of eventSortNames
+//	cursor, limit          paging
+func parseEventQuery(values url.Values) (EventQuery, FieldErrors) {
+	errs := FieldErrors{}
+	q := EventQuery{
+		Text:       strings.TrimSpace(values.Get("q")),
+		Categories: splitList(values.Get("category")),
+		Statuses:   splitList(values.Get("status")),
+		PlaceIDs:   splitList(values.Get("place")),
+		Sort:       values.Get("sort"),
+		Limit:      defaultEventPageSize,
+	}
+	if len(q.Text) > 200 {
+		errs.add("q", "must be at most 200 characters")
+	}
+
+	var err error
+	if s := values.Get("from"); s != "" {
+		if q.From, err = parseDateParam(s, false); err != nil {
+			errs.add("from", "must be a date (2006-01-02) or an RFC 3339 time")
+		}
+	}
+	if s := values.Get("to"); s != "" {
+		if q.To, err = parseDateParam(s, true); err != nil {
+			errs.add("to", "must be a date (2006-01-02) or an RFC 3339 time")
+		}
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && q.To.Before(q.From) {
+		errs.add("to", "must not be before from")
+	}
+
+	for name, dst := range map[string]**float64{"price_min": &q.MinPrice, "price_max": &q.MaxPrice} {
+		s := values.Get(name)
+		if s == "" {
+			continue
+		}
+		price, err := strconv.ParseFloat(s, 64)
+		if err != nil || price < 0 {
+			errs.add(name, "must be a number no less than 0")
+			continue
+		}
+		*dst = &price
+	}
+	if q.MinPrice != nil && q.MaxPrice != nil && *q.MaxPrice < *q.MinPrice {
+		errs.add("price_max", "must not be less than price_min")
+	}
+
+	if q.Sort == "" {
+		q.Sort = "start"
+	}
+	if _, ok := eventSorts[q.Sort]; !ok {
+		errs.add("sort", "must be one of "+eventSortNames)
+	} else if s := values.Get("cursor"); s != "" {
+		if q.After, err = decodeEventCursor(q.Sort, s); err != nil {
+			errs.add("cursor", err.Error())
+		}
+	}
+
+	if s := values.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxEventPageSize {
+			errs.add("limit", fmt.Sprintf("must be a whole number from 1 to %d", maxEventPageSize))
+		} else {
+			q.Limit = limit
+		}
+	}
+	return q, errs
+}
+
+// parseDateParam reads a date or RFC 3339 time. A bare date means the
+// start of that day, or its end if endOfDay is set, in UTC.
+func parseDateParam(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// splitList splits a comma separated parameter, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// setPageHeaders tells the client how many results there are in all and,
+// if there are more, where the next page is.
+func setPageHeaders(w http.ResponseWriter, r *http.Request, total int, next string) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if next == "" {
+		return
+	}
+	w.Header().Set("X-Next-Cursor", next)
+	u := *r.URL
+	values := u.Query()
+	values.Set("cursor", next)
+	u.RawQuery = values.Encode()
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", u.RequestURI()))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listEvents calls GET /api/events with query and returns the event IDs
+// and the next cursor.
+func listEvents(t *testing.T, userID, query string) ([]string, string) {
+	t.Helper()
+	w := serveAs(getEvents, userID, http.MethodGet, "/api/events?"+query, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/events?%s = %d %s", query, w.Code, w.Body)
+	}
+	var events []Event
+	if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]string, len(events))
+	for i, e := range events {
+		ids[i] = e.EventID
+	}
+	return ids, w.Header().Get("X-Next-Cursor")
+}
+
+// listAllEvents follows the cursors of GET /api/events from the first page.
+func listAllEvents(t *testing.T, query string) []string {
+	t.Helper()
+	var all []string
+	cursor := ""
+	for page := 0; page < 20; page++ {
+		ids, next := listEvents(t, "", query+"&cursor="+cursor)
+		all = append(all, ids...)
+		if next == "" {
+			return all
+		}
+		cursor = next
+	}
+	t.Fatal("paging didn't end")
+	return nil
+}
+
+func TestEventCursorPaging(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 18, 0, 0, 0, time.UTC)
+	// Pairs share a start time, price and creation time, so the event ID
+	// has to break the ties
+	var want []Event
+	for i := 0; i < 7; i++ {
+		e := Event{
+			EventID:       fmt.Sprintf("e%d", 7-i),
+			Title:         fmt.Sprintf("Show %d", i%3),
+			Status:        EventPublished,
+			StartDateTime: base.Add(time.Duration(i/2) * time.Hour),
+			CreatedAt:     base.Add(-time.Duration(i/2) * time.Hour),
+			MinPrice:      float64(10 * (i / 2)),
+		}
+		if err := stores.Events.Create(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, e)
+	}
+
+	for name, s := range eventSorts {
+		t.Run(name, func(t *testing.T) {
+			expected := append([]Event(nil), want...)
+			sort.Slice(expected, func(i, j int) bool {
+				c := compareSortValues(s.key(expected[i]), s.key(expected[j]))
+				if c == 0 {
+					c = strings.Compare(expected[i].EventID, expected[j].EventID)
+				}
+				if s.desc {
+					return c > 0
+				}
+				return c < 0
+			})
+			var ids []string
+			for _, e := range expected {
+				ids = append(ids, e.EventID)
+			}
+			for _, limit := range []int{1, 2, 3, 7} {
+				got := listAllEvents(t, fmt.Sprintf("sort=%s&limit=%d", name, limit))
+				if strings.Join(got, " ") != strings.Join(ids, " ") {
+					t.Errorf("pages of %d = %v, want %v", limit, got, ids)
+				}
+			}
+		})
+	}
+}
+
+func TestEventCursorStability(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	base := time.Date(2030, 1, 1, 18, 0, 0, 0, time.UTC)
+	create := func(id string, hour int) {
+		if err := stores.Events.Create(ctx, Event{EventID: id, Title: id, Status: EventPublished, StartDateTime: base.Add(time.Duration(hour) * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, id := range []string{"a", "b", "c", "d"} {
+		create(id, i)
+	}
+
+	first, cursor := listEvents(t, "", "sort=start&limit=2")
+	if strings.Join(first, " ") != "a b" || cursor == "" {
+		t.Fatalf("first page = %v with cursor %q, want a b and a cursor", first, cursor)
+	}
+	// Events added before and after the cursor while paging: the earlier
+	// one is not seen and nothing repeats or goes missing
+	create("early", 0)
+	create("late", 10)
+	if err := stores.Events.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	rest, next := listEvents(t, "", "sort=start&limit=10&cursor="+cursor)
+	if strings.Join(rest, " ") != "c d late" || next != "" {
+		t.Errorf("next page = %v with cursor %q, want c d late and no cursor", rest, next)
+	}
+
+	// A cursor is tied to its order and can't be made up
+	for _, query := range []string{"sort=-start&cursor=" + cursor, "cursor=nonsense"} {
+		if code := serveAs(getEvents, "", http.MethodGet, "/api/events?"+query, "").Code; code != http.StatusUnprocessableEntity {
+			t.Errorf("GET /api/events?%s = %d, want %d", query, code, http.StatusUnprocessableEntity)
+		}
+	}
+}
@@ -1,14 +1,12 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"log"
 	"net/http"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/julienschmidt/httprouter"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 // Handle retrieving followers
@@ -19,8 +17,7 @@ func getFollowers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		return jwtSecret, nil
 	})
 
-	var user User
-	err := userCollection.FindOne(context.TODO(), bson.M{"username": claims.Username}).Decode(&user)
+	user, err := stores.Users.GetByUsername(r.Context(), claims.Username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		log.Printf("User not found: %s", claims.Username)
@@ -29,8 +26,7 @@ func getFollowers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 	followers := []User{}
 	for _, followerID := range user.Follows {
-		var follower User
-		if err := userCollection.FindOne(context.TODO(), bson.M{"userid": followerID}).Decode(&follower); err == nil {
+		if follower, err := stores.Users.GetByUserID(r.Context(), followerID); err == nil {
 			followers = append(followers, follower)
 		}
 	}
@@ -46,8 +42,7 @@ func getFollowing(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		return jwtSecret, nil
 	})
 
-	var user User
-	err := userCollection.FindOne(context.TODO(), bson.M{"username": claims.Username}).Decode(&user)
+	user, err := stores.Users.GetByUsername(r.Context(), claims.Username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		log.Printf("User not found: %s", claims.Username)
@@ -56,8 +51,7 @@ func getFollowing(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 	following := []User{}
 	for _, followingID := range user.Follows {
-		var followUser User
-		if err := userCollection.FindOne(context.TODO(), bson.M{"userid": followingID}).Decode(&followUser); err == nil {
+		if followUser, err := stores.Users.GetByUserID(r.Context(), followingID); err == nil {
 			following = append(following, followUser)
 		}
 	}
@@ -73,8 +67,7 @@ func suggestFollowers(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 		return jwtSecret, nil
 	})
 
-	var user User
-	err := userCollection.FindOne(context.TODO(), bson.M{"username": claims.Username}).Decode(&user)
+	user, err := stores.Users.GetByUsername(r.Context(), claims.Username)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		log.Printf("User not found: %s", claims.Username)
@@ -83,16 +76,14 @@ func suggestFollowers(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 
 	// Suggest users excluding the current user and already followed users
 	suggestedUsers := []User{}
-	cursor, err := userCollection.Find(context.TODO(), bson.M{"username": bson.M{"$ne": user.Username}})
+	allUsers, err := stores.Users.List(r.Context())
 	if err != nil {
 		http.Error(w, "Failed to fetch suggestions", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.TODO())
 
-	for cursor.Next(context.TODO()) {
-		var suggestedUser User
-		if err := cursor.Decode(&suggestedUser); err == nil && !contains(user.Follows, suggestedUser.Username) {
+	for _, suggestedUser := range allUsers {
+		if suggestedUser.Username != user.Username && !contains(user.Follows, suggestedUser.Username) {
 			suggestedUser.Password = ""
 			suggestedUsers = append(suggestedUsers, suggestedUser)
 		}
@@ -118,8 +109,7 @@ func toggleFollow(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	log.Printf("User %s is trying to toggle follow for user %s", userId, followedUserId)
 
 	// Retrieve the current user
-	var currentUser User
-	err := userCollection.FindOne(context.TODO(), bson.M{"userid": userId}).Decode(&currentUser)
+	currentUser, err := stores.Users.GetByUserID(r.Context(), userId)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -139,9 +129,7 @@ func toggleFollow(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		currentUser.Follows = removeString(currentUser.Follows, followedUserId)
 
 		// Remove currentUser.UserID from followed user's Followers
-		_, err = userCollection.UpdateOne(context.TODO(), bson.M{"userid": followedUserId}, bson.M{
-			"$pull": bson.M{"followers": userId},
-		})
+		err = stores.Users.RemoveFollower(r.Context(), followedUserId, userId)
 		if err != nil {
 			log.Printf("Error updating followers: %v", err)
 			http.Error(w, "Failed to update followers", http.StatusInternalServerError)
@@ -152,9 +140,7 @@ func toggleFollow(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		currentUser.Follows = append(currentUser.Follows, followedUserId)
 
 		// Add currentUser.UserID to followed user's Followers
-		_, err = userCollection.UpdateOne(context.TODO(), bson.M{"userid": followedUserId}, bson.M{
-			"$addToSet": bson.M{"followers": userId},
-		})
+		err = stores.Users.AddFollower(r.Context(), followedUserId, userId)
 		if err != nil {
 			log.Printf("Error updating followers: %v", err)
 			http.Error(w, "Failed to update followers", http.StatusInternalServerError)
@@ -163,9 +149,7 @@ func toggleFollow(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 	}
 
 	// Update the current user's follows array
-	_, err = userCollection.UpdateOne(context.TODO(), bson.M{"userid": userId}, bson.M{
-		"$set": bson.M{"follows": currentUser.Follows},
-	})
+	err = stores.Users.SetFollows(r.Context(), userId, currentUser.Follows)
 	if err != nil {
 		log.Printf("Error updating follows: %v", err)
 		http.Error(w, "Failed to update follows", http.StatusInternalServerError)
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Limits of geo queries
+const (
+	defaultGeoRadius   = 10000   // Metres
+	maxGeoRadius       = 1000000 // Metres
+	defaultGeoPageSize = 50
+	maxGeoPageSize     = 200
+	maxGeoPlaces       = 1000 // Places an event search by area looks at
+)
+
+// earthRadius is the mean radius of the earth in metres, as MongoDB uses.
+const earthRadius = 6378100
+
+// GeoQuery selects places by where they are. Places without coordinates
+// never match.
+type GeoQuery struct {
+	Near   *GeoPoint // Only places within Radius, nearest first
+	Radius float64   // Metres
+	Box    *GeoBox   // Only places inside the box
+	Limit  int
+}
+
+// GeoBox is a bounding box, such as the part of a map on screen. West may
+// be greater than East when the box crosses the antimeridian.
+type GeoBox struct {
+	West, South, East, North float64
+}
+
+// newGeoPoint returns the GeoJSON point at lat, lng.
+func newGeoPoint(lat, lng float64) *GeoPoint {
+	return &GeoPoint{Type: "Point", Coordinates: []float64{lng, lat}}
+}
+
+func (p GeoPoint) lat() float64 { return p.Coordinates[1] }
+func (p GeoPoint) lng() float64 { return p.Coordinates[0] }
+
+// setCoordinates places p at lat, lng.
+func (p *Place) setCoordinates(lat, lng float64) {
+	p.Coordinates = Coordinates{Latitude: lat, Longitude: lng}
+	p.Location = newGeoPoint(lat, lng)
+}
+
+// contains reports whether p is inside b.
+func (b GeoBox) contains(p GeoPoint) bool {
+	if p.lat() < b.South || p.lat() > b.North {
+		return false
+	}
+	if b.West <= b.East {
+		return p.lng() >= b.West && p.lng() <= b.East
+	}
+	return p.lng() >= b.West || p.lng() <= b.East
+}
+
+// polygons returns b as GeoJSON polygons, two if it crosses the
+// antimeridian. Edges are great circles, so the long sides get extra
+// vertices to keep close to the lines of latitude a map draws.
+func (b GeoBox) polygons() [][][]float64 {
+	if b.West > b.East {
+		return append(GeoBox{b.West, b.South, 180, b.North}.polygons(), GeoBox{-180, b.South, b.East, b.North}.polygons()...)
+	}
+	// A polygon wider than a hemisphere is ambiguous
+	if b.East-b.West > 180 {
+		mid := (b.West + b.East) / 2
+		return append(GeoBox{b.West, b.South, mid, b.North}.polygons(), GeoBox{mid, b.South, b.East, b.North}.polygons()...)
+	}
+	const step = 10 // Degrees of longitude between vertices
+	var ring [][]float64
+	for lng := b.West; lng < b.East; lng += step {
+		ring = append(ring, []float64{lng, b.South})
+	}
+	ring = append(ring, []float64{b.East, b.South})
+	for lng := b.East; lng > b.West; lng -= step {
+		ring = append(ring, []float64{lng, b.North})
+	}
+	ring = append(ring, []float64{b.West, b.North}, []float64{b.West, b.South})
+	return [][][]float64{ring}
+}
+
+// geoDistance is the great circle distance between a and b in metres.
+func geoDistance(a, b GeoPoint) float64 {
+	lat1, lat2 := a.lat()*math.Pi/180, b.lat()*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.lng() - a.lng()) * math.Pi / 180
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLng/2), 2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// placesWithin filters places by q the way MongoDB would, for the memory
+// store.
+func placesWithin(places []Place, q GeoQuery) []Place {
+	var out []Place
+	for _, p := range places {
+		if p.Location == nil || (q.Box != nil && !q.Box.contains(*p.Location)) {
+			continue
+		}
+		if q.Near != nil {
+			p.Distance = geoDistance(*q.Near, *p.Location)
+			if p.Distance > q.Radius {
+				continue
+			}
+		}
+		out = append(out, p)
+	}
+	if q.Near != nil {
+		sort.SliceStable(out, func(i, j int) bool { return out[i].Distance < out[j].Distance })
+	}
+	if len(out) > q.Limit {
+		out = out[:q.Limit]
+	}
+	return out
+}
+
+// parseGeoQuery reads the geo parameters of a query string:
+//
+//	near     lat,lng to search around
+//	radius   metres from near
+//	bbox     west,south,east,north in degrees
+//
+// It returns nil if neither near nor bbox is given.
+func parseGeoQuery(values url.Values, errs FieldErrors) *GeoQuery {
+	near, bbox := values.Get("near"), values.Get("bbox")
+	if near == "" && bbox == "" {
+		if values.Get("radius") != "" {
+			errs.add("radius", "needs near")
+		}
+		return nil
+	}
+	q := &GeoQuery{Radius: defaultGeoRadius}
+
+	if near != "" {
+		n, err := parseFloats(near, 2)
+		if err != nil || !validLatLng(n[0], n[1]) {
+			errs.add("near", "must be latitude,longitude in degrees")
+		} else {
+			q.Near = newGeoPoint(n[0], n[1])
+		}
+	}
+	if s := values.Get("radius"); s != "" {
+		radius, err := strconv.ParseFloat(s, 64)
+		switch {
+		case near == "":
+			errs.add("radius", "needs near")
+		case err != nil || math.IsNaN(radius) || radius <= 0 || radius > maxGeoRadius:
+			errs.add("radius", fmt.Sprintf("must be a number of metres up to %d", maxGeoRadius))
+		default:
+			q.Radius = radius
+		}
+	}
+	if bbox != "" {
+		b, err := parseFloats(bbox, 4)
+		if err != nil || !validLatLng(b[1], b[0]) || !validLatLng(b[3], b[2]) || b[1] > b[3] {
+			errs.add("bbox", "must be west,south,east,north in degrees")
+		} else {
+			q.Box = &GeoBox{West: b[0], South: b[1], East: b[2], North: b[3]}
+		}
+	}
+	return q
+}
+
+// parseFloats reads exactly n comma separated numbers.
+func parseFloats(s string, n int) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != n {
+		return nil, fmt.Errorf("want %d numbers", n)
+	}
+	out := make([]float64, n)
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("bad number %q", part)
+		}
+		out[i] = f
+	}
+	return out, nil
+}
+
+func validLatLng(lat, lng float64) bool {
+	return lat >= -90 && lat <= 90 && lng >= -180 && lng <= 180
+}
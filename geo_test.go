@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// seedPlaces creates places around central London (near about 1km north,
+// edge about 4.9km north, far about 11km north), two either side of the
+// antimeridian and one with no coordinates.
+func seedPlaces(t *testing.T) {
+	t.Helper()
+	for _, p := range []struct {
+		id       string
+		lat, lng float64
+	}{
+		{"near", 51.5164, -0.1278},
+		{"edge", 51.5514, -0.1278},
+		{"far", 51.6074, -0.1278},
+		{"east of the antimeridian", 0, 179.5},
+		{"west of the antimeridian", 0, -179.5},
+	} {
+		place := Place{PlaceID: p.id, Name: p.id}
+		place.setCoordinates(p.lat, p.lng)
+		if err := stores.Places.Create(context.Background(), place); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stores.Places.Create(context.Background(), Place{PlaceID: "nowhere", Name: "nowhere"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlacesWithinRadius(t *testing.T) {
+	useMemoryStores(t)
+	seedPlaces(t)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"near=51.5074,-0.1278&radius=500", nil},
+		{"near=51.5074,-0.1278&radius=5000", []string{"near", "edge"}},
+		{"near=51.5074,-0.1278", []string{"near", "edge"}},
+		{"near=51.5074,-0.1278&radius=20000", []string{"near", "edge", "far"}},
+		{"near=51.6074,-0.1278&radius=20000", []string{"far", "edge", "near"}},
+		{"near=51.5074,-0.1278&radius=20000&limit=1", []string{"near"}},
+		{"bbox=179,-1,-179,1", []string{"east of the antimeridian", "west of the antimeridian"}},
+		{"near=0,179.9&radius=100000&bbox=179,-1,-179,1", []string{"east of the antimeridian", "west of the antimeridian"}},
+	}
+	for _, tt := range tests {
+		w := serveAs(getPlaces, "", http.MethodGet, "/api/places?"+tt.query, "")
+		if w.Code != http.StatusOK {
+			t.Errorf("GET /api/places?%s = %d %s", tt.query, w.Code, w.Body)
+			continue
+		}
+		var places []Place
+		if err := json.Unmarshal(w.Body.Bytes(), &places); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, p := range places {
+			got = append(got, p.PlaceID)
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("GET /api/places?%s = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestPlaceDistances(t *testing.T) {
+	useMemoryStores(t)
+	seedPlaces(t)
+	w := serveAs(getPlaces, "", http.MethodGet, "/api/places?near=51.5074,-0.1278&radius=5000", "")
+	var places []Place
+	if err := json.Unmarshal(w.Body.Bytes(), &places); err != nil {
+		t.Fatal(err)
+	}
+	// A thousandth of a degree of latitude is about 111 metres
+	want := map[string]float64{"near": 1002, "edge": 4898}
+	for _, p := range places {
+		if math.Abs(p.Distance-want[p.PlaceID]) > 5 {
+			t.Errorf("distance to %s = %.0fm, want about %.0fm", p.PlaceID, p.Distance, want[p.PlaceID])
+		}
+	}
+}
+
+func TestBadGeoQueries(t *testing.T) {
+	useMemoryStores(t)
+	for _, query := range []string{
+		"radius=5000",
+		"bbox=-1,-1,1,1&radius=5000",
+		"near=51.5,-0.1&radius=0",
+		"near=51.5,-0.1&radius=-5",
+		"near=51.5,-0.1&radius=1000001",
+		"near=51.5,-0.1&radius=NaN",
+		"near=91,0",
+		"near=0,181",
+		"near=51.5",
+		"bbox=-1,1,1,-1",
+		"bbox=-1,-1,1",
+		"near=51.5,-0.1&limit=0",
+	} {
+		for name, handler := range map[string]func(string) int{
+			"places": func(q string) int { return serveAs(getPlaces, "", http.MethodGet, "/api/places?"+q, "").Code },
+			"events": func(q string) int { return serveAs(getEvents, "", http.MethodGet, "/api/events?"+q, "").Code },
+		} {
+			if code := handler(query); code != http.StatusUnprocessableEntity {
+				t.Errorf("GET /api/%s?%s = %d, want %d", name, query, code, http.StatusUnprocessableEntity)
+			}
+		}
+	}
+}
+
+func TestEventsWithinRadius(t *testing.T) {
+	useMemoryStores(t)
+	seedPlaces(t)
+	ctx := context.Background()
+	for _, e := range []Event{
+		{EventID: "e1", Title: "Near", Place: "near", Status: EventPublished},
+		{EventID: "e2", Title: "Far", Place: "far", Status: EventPublished},
+		{EventID: "e3", Title: "Nowhere", Place: "nowhere", Status: EventPublished},
+		{EventID: "e4", Title: "Online", Status: EventPublished},
+	} {
+		if err := stores.Events.Create(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"near=51.5074,-0.1278&radius=5000", "e1"},
+		{"near=51.5074,-0.1278&radius=5000&place=far", ""},
+		{"near=51.5074,-0.1278&radius=5000&place=near", "e1"},
+		{"near=40.7128,-74.0060&radius=5000", ""},
+	}
+	for _, tt := range tests {
+		ids, _ := listEvents(t, "", tt.query)
+		if strings.Join(ids, " ") != tt.want {
+			t.Errorf("GET /api/events?%s = %v, want %q", tt.query, ids, tt.want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The event lifecycle:
+//
+//	draft ──▶ published ──▶ live ──▶ ended
+//	              │  ▲         │
+//	              ▼  │         ▼
+//	           postponed ──▶ cancelled ◀── published
+//
+// Organizers publish, postpone and cancel through editEvent; the
+// scheduler publishes drafts at their publish_at time and takes events
+// live and to their end as StartDateTime and EndDateTime pass.
+
+// eventTransitions lists the statuses each status may move to.
+var eventTransitions = map[string][]string{
+	EventDraft:     {EventPublished},
+	EventPublished: {EventLive, EventEnded, EventPostponed, EventCancelled},
+	EventLive:      {EventEnded, EventCancelled},
+	EventPostponed: {EventPublished, EventCancelled},
+}
+
+// assumedEventLength is how long an event without an end time runs.
+const assumedEventLength = 24 * time.Hour
+
+func canTransition(from, to string) bool {
+	return contains(eventTransitions[from], to)
+}
+
+// scheduledStatus is the status the scheduler should move e to at now, or
+// "" if it should stay as it is.
+func scheduledStatus(e Event, now time.Time) string {
+	end := e.EndDateTime
+	if end.IsZero() && !e.StartDateTime.IsZero() {
+		end = e.StartDateTime.Add(assumedEventLength)
+	}
+	switch e.Status {
+	case EventDraft:
+		if e.PublishAt != nil && !e.PublishAt.After(now) {
+			return EventPublished
+		}
+	case EventPublished:
+		if !e.StartDateTime.IsZero() && !e.StartDateTime.After(now) {
+			return EventLive
+		}
+	case EventLive:
+		if !end.IsZero() && !end.After(now) {
+			return EventEnded
+		}
+	}
+	return ""
+}
+
+// runEventScheduler makes the upcoming occurrences of event series and
+// moves events on every interval until ctx is done.
+func runEventScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n, err := extendAllSeries(ctx, now); err != nil {
+				log.Printf("Making occurrences of event series failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Made %d occurrences of event series", n)
+			}
+			if n, err := advanceEvents(ctx, now); err != nil {
+				log.Printf("Event scheduler failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Moved %d events on to their next status", n)
+			}
+		}
+	}
+}
+
+// advanceEvents makes every transition that is due at now, as many per
+// event as are due, and returns how many it made.
+func advanceEvents(ctx context.Context, now time.Time) (int, error) {
+	const batch = 100
+	moved := 0
+	for {
+		due, err := stores.Events.ListDue(ctx, now, batch)
+		if err != nil {
+			return moved, err
+		}
+		for _, event := range due {
+			for to := scheduledStatus(event, now); to != ""; to = scheduledStatus(event, now) {
+				// Losing the race to an organizer's edit is fine; skip it
+				event, err = stores.Events.Transition(ctx, event.EventID, event.Status, to, now.UTC())
+				if err == ErrConflict || err == ErrNotFound {
+					break
+				}
+				if err != nil {
+					return moved, err
+				}
+				moved++
+			}
+		}
+		if len(due) < batch {
+			return moved, nil
+		}
+	}
+}
+
+// checkStatusChange returns what is wrong with an organizer moving an
+// event from one status to another, or "". The change itself is made with
+// stores.Events.Transition.
+func checkStatusChange(from, to string) string {
+	if to == from || canTransition(from, to) {
+		return ""
+	}
+	return fmt.Sprintf("a %s event can't become %s", from, to)
+}
+
+// eventVisibleTo reports whether the user viewerID (empty if signed out)
+// may see event. Drafts are seen only by their organizers.
+func eventVisibleTo(ctx context.Context, event Event, viewerID string) bool {
+	if event.Status != EventDraft {
+		return true
+	}
+	if viewerID == "" {
+		return false
+	}
+	if event.CreatorID == viewerID || contains(event.CoOrganizers, viewerID) {
+		return true
+	}
+	viewer, err := stores.Users.GetByUserID(ctx, viewerID)
+	return err == nil && isEventOrganizer(event, viewer)
+}
+
+// requireVisible runs next only if the caller may see the :eventid event,
+// and answers 404 as for a missing event otherwise.
+func requireVisible(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		viewerID, _ := r.Context().Value(userIDKey).(string)
+		event, err := stores.Events.Get(r.Context(), ps.ByName("eventid"))
+		if err == ErrNotFound || (err == nil && !eventVisibleTo(r.Context(), event, viewerID)) {
+			http.Error(w, "Event not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch event", http.StatusInternalServerError)
+			return
+		}
+		next(w, r, ps)
+	}
+}
+
+// checkOnSale returns why tickets and merch of the event can't be bought
+// now, or "".
+func checkOnSale(ctx context.Context, eventID string) (string, error) {
+	event, err := stores.Events.Get(ctx, eventID)
+	if err != nil {
+		return "", err
+	}
+	switch event.Status {
+	case EventPublished, EventLive:
+		return "", nil
+	case EventDraft:
+		return "", ErrNotFound
+	}
+	return fmt.Sprintf("This event is %s; nothing can be bought for it now", event.Status), nil
+}
+
+// requireOnSale runs next only while the :eventid event is selling.
+func requireOnSale(next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		problem, err := checkOnSale(r.Context(), ps.ByName("eventid"))
+		if err == ErrNotFound {
+			http.Error(w, "Event not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to fetch event", http.StatusInternalServerError)
+			return
+		}
+		if problem != "" {
+			http.Error(w, problem, http.StatusConflict)
+			return
+		}
+		next(w, r, ps)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var eventStatuses = []string{EventDraft, EventPublished, EventLive, EventEnded, EventPostponed, EventCancelled}
+
+func TestEventStatusChanges(t *testing.T) {
+	allowed := map[string]bool{
+		"draft>published":     true,
+		"published>live":      true,
+		"published>ended":     true,
+		"published>postponed": true,
+		"published>cancelled": true,
+		"live>ended":          true,
+		"live>cancelled":      true,
+		"postponed>published": true,
+		"postponed>cancelled": true,
+	}
+	for _, from := range eventStatuses {
+		for _, to := range append(eventStatuses, "archived") {
+			if got := canTransition(from, to); got != allowed[from+">"+to] {
+				t.Errorf("canTransition(%s, %s) = %v", from, to, got)
+			}
+			// Organizers may also leave the status as it is
+			if problem := checkStatusChange(from, to); (problem == "") != (allowed[from+">"+to] || from == to) {
+				t.Errorf("checkStatusChange(%s, %s) = %q", from, to, problem)
+			}
+		}
+	}
+}
+
+func TestEditEventRefusesIllegalStatus(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	tests := []struct {
+		from, to string
+		wantCode int
+	}{
+		{EventDraft, EventPublished, http.StatusOK},
+		{EventDraft, EventLive, http.StatusConflict},
+		{EventDraft, EventCancelled, http.StatusConflict},
+		{EventPublished, EventDraft, http.StatusConflict},
+		{EventPublished, EventPostponed, http.StatusOK},
+		{EventPostponed, EventPublished, http.StatusOK},
+		{EventLive, EventPublished, http.StatusConflict},
+		{EventEnded, EventLive, http.StatusConflict},
+		{EventEnded, EventEnded, http.StatusOK},
+		{EventCancelled, EventPublished, http.StatusConflict},
+		{EventPublished, "archived", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.from+" to "+tt.to, func(t *testing.T) {
+			event := Event{EventID: "e-" + tt.from + "-" + tt.to, Title: "Show", Description: "A show", Location: "Hall", CreatorID: "organizer", Status: tt.from}
+			if err := stores.Events.Create(ctx, event); err != nil {
+				t.Fatal(err)
+			}
+			w := serveForm(editEvent, "organizer", map[string]string{"status": tt.to}, "eventid", event.EventID)
+			if w.Code != tt.wantCode {
+				t.Fatalf("edit = %d %s, want %d", w.Code, w.Body, tt.wantCode)
+			}
+			stored, err := stores.Events.Get(ctx, event.EventID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.from
+			if tt.wantCode == http.StatusOK {
+				want = tt.to
+			}
+			if stored.Status != want {
+				t.Errorf("status after the edit = %s, want %s", stored.Status, want)
+			}
+		})
+	}
+}
+
+func TestTransitionNeedsTheStatusItLeaves(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	if err := stores.Events.Create(ctx, Event{EventID: "e1", Status: EventPublished}); err != nil {
+		t.Fatal(err)
+	}
+	// Another change got there first
+	if _, err := stores.Events.Transition(ctx, "e1", EventDraft, EventPublished, time.Now()); err != ErrConflict {
+		t.Errorf("Transition from a stale status = %v, want ErrConflict", err)
+	}
+	if _, err := stores.Events.Transition(ctx, "missing", EventDraft, EventPublished, time.Now()); err != ErrNotFound {
+		t.Errorf("Transition of a missing event = %v, want ErrNotFound", err)
+	}
+}
+
+func TestAdvanceEvents(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	now := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	hour := time.Hour
+	publishAt := now.Add(-3 * hour)
+	for _, e := range []Event{
+		{EventID: "due", Status: EventDraft, PublishAt: &publishAt, StartDateTime: now.Add(-2 * hour), EndDateTime: now.Add(-hour)},
+		{EventID: "starting", Status: EventPublished, StartDateTime: now.Add(-hour), EndDateTime: now.Add(hour)},
+		{EventID: "unscheduled", Status: EventDraft, StartDateTime: now.Add(-2 * hour)},
+		{EventID: "postponed", Status: EventPostponed, StartDateTime: now.Add(-2 * hour)},
+		{EventID: "cancelled", Status: EventCancelled, StartDateTime: now.Add(-2 * hour)},
+		{EventID: "later", Status: EventPublished, StartDateTime: now.Add(hour)},
+	} {
+		if err := stores.Events.Create(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moved, err := advanceEvents(ctx, now)
+	if err != nil || moved != 4 {
+		t.Errorf("advanceEvents() = %d, %v; want 4 moves", moved, err)
+	}
+	want := map[string]string{
+		"due":         EventEnded,
+		"starting":    EventLive,
+		"unscheduled": EventDraft,
+		"postponed":   EventPostponed,
+		"cancelled":   EventCancelled,
+		"later":       EventPublished,
+	}
+	for id, status := range want {
+		e, err := stores.Events.Get(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Status != status {
+			t.Errorf("%s is %s, want %s", id, e.Status, status)
+		}
+	}
+	if moved, err := advanceEvents(ctx, now); err != nil || moved != 0 {
+		t.Errorf("advanceEvents() again = %d, %v; want nothing to do", moved, err)
+	}
+}
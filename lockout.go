@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxLoginFailuresListed caps the audit entries returned at once.
+const maxLoginFailuresListed = 100
+
+// maxClaimTries bounds how often claimLoginAttempt retries after losing a
+// race to a parallel attempt.
+const maxClaimTries = 3
+
+// loginBlockedUntil is when user may next try to sign in. The first
+// lockout.backoff_after failures are free; after that each failure doubles
+// the wait, and lockout.threshold failures lock the account for
+// lockout.duration. Attempts made while blocked aren't checked or counted.
+//
+// Every attempt is counted as a failure before the password or code is
+// looked at, and stays counted unless the sign-in completes, so parallel
+// guesses can't all get in under the limit.
+func loginBlockedUntil(user User) time.Time {
+	cfg := config.Lockout
+	n := user.FailedLogins
+	switch {
+	case n >= cfg.Threshold:
+		return user.LastFailedLogin.Add(cfg.Duration)
+	case n > cfg.BackoffAfter:
+		delay := cfg.Duration
+		if shift := n - cfg.BackoffAfter - 1; shift < 30 && cfg.BackoffBase<<shift < delay {
+			delay = cfg.BackoffBase << shift
+		}
+		return user.LastFailedLogin.Add(delay)
+	}
+	return time.Time{}
+}
+
+// claimLoginAttempt counts an attempt to sign in as user, answering 429 and
+// returning false if user must wait first. It returns user as counted.
+func claimLoginAttempt(w http.ResponseWriter, r *http.Request, user User) (User, bool) {
+	for try := 0; try < maxClaimTries; try++ {
+		if try > 0 {
+			// Another attempt got in first; judge this one by the new count
+			fresh, err := stores.Users.GetByUserID(r.Context(), user.UserID)
+			if err != nil {
+				http.Error(w, "Failed to log in", http.StatusInternalServerError)
+				return user, false
+			}
+			user = fresh
+		}
+		if !checkLoginThrottle(w, r, user) {
+			return user, false
+		}
+
+		at := time.Now().UTC()
+		count, err := stores.Users.ClaimLoginAttempt(r.Context(), user.UserID, user.FailedLogins, at)
+		if err == ErrConflict {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to count sign-in attempt of %s: %v", user.UserID, err)
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			return user, false
+		}
+		user.FailedLogins, user.LastFailedLogin = count, at
+		return user, true
+	}
+
+	auditLoginFailure(r, user.UserID, user.Username, LoginFailureThrottled)
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Too many sign-in attempts at once; try again shortly", http.StatusTooManyRequests)
+	return user, false
+}
+
+// checkLoginThrottle answers 429 and returns false if user must wait before
+// trying again.
+func checkLoginThrottle(w http.ResponseWriter, r *http.Request, user User) bool {
+	until := loginBlockedUntil(user)
+	wait := time.Until(until)
+	if wait <= 0 {
+		return true
+	}
+
+	auditLoginFailure(r, user.UserID, user.Username, LoginFailureThrottled)
+	seconds := int(wait.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	retry := humanDuration(time.Duration(seconds) * time.Second)
+	if user.FailedLogins >= config.Lockout.Threshold {
+		http.Error(w, "Account is temporarily locked after too many failed sign-ins; try again in "+retry, http.StatusTooManyRequests)
+		return false
+	}
+	http.Error(w, "Too many failed sign-ins; try again in "+retry, http.StatusTooManyRequests)
+	return false
+}
+
+// recordLoginFailure audits a failed attempt by user, as returned by
+// claimLoginAttempt. The owner is emailed whenever the failure locks the
+// account.
+func recordLoginFailure(r *http.Request, user User, reason string) {
+	auditLoginFailure(r, user.UserID, user.Username, reason)
+
+	count := user.FailedLogins
+	if count < config.Lockout.Threshold {
+		return
+	}
+	log.Printf("Locked %s for %s after %d failed sign-ins", user.Username, config.Lockout.Duration, count)
+	if user.Email != "" {
+		sendMail(Message{
+			To:      user.Email,
+			Subject: "Your account was locked after failed sign-ins",
+			Body: fmt.Sprintf("Hi %s,\n\nThere have been %d failed attempts to sign in to your account, the last from %s, so sign-ins are blocked for %s.\n\nIf this wasn't you, someone may be guessing your password. You can choose a new one at any time with the \"forgot password\" link, which also lifts the lock.\n",
+				user.Username, count, clientIP(r), humanDuration(config.Lockout.Duration)),
+		})
+	}
+}
+
+// recordLoginSuccess clears the failure count once the user is in.
+func recordLoginSuccess(ctx context.Context, user User) {
+	if user.FailedLogins == 0 {
+		return
+	}
+	if err := stores.Users.ResetLoginFailures(ctx, user.UserID); err != nil {
+		log.Printf("Failed to reset failed sign-ins of %s: %v", user.UserID, err)
+	}
+}
+
+// auditLoginFailure writes the audit record of a rejected attempt.
+func auditLoginFailure(r *http.Request, userID, username, reason string) {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	failure := LoginFailure{
+		FailureID: randomToken(12),
+		UserID:    userID,
+		Username:  username,
+		Reason:    reason,
+		IP:        clientIP(r),
+		UserAgent: userAgent,
+		At:        time.Now().UTC(),
+	}
+	if err := stores.LoginFailures.Record(r.Context(), failure); err != nil {
+		log.Printf("Failed to audit failed sign-in of %q: %v", username, err)
+	}
+}
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// burnPasswordCheck spends as long as a real password check, so a wrong
+// username answers no faster than a wrong password.
+func burnPasswordCheck(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword(randomBytes(16), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// getMyLoginFailures lists recent failed sign-ins to the caller's account
+func getMyLoginFailures(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+	sendLoginFailures(w, r, userID)
+}
+
+// getUserLoginFailures lets an admin see the failed sign-ins of :userid
+func getUserLoginFailures(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	sendLoginFailures(w, r, ps.ByName("userid"))
+}
+
+func sendLoginFailures(w http.ResponseWriter, r *http.Request, userID string) {
+	failures, err := stores.LoginFailures.ListByUser(r.Context(), userID, maxLoginFailuresListed)
+	if err != nil {
+		http.Error(w, "Failed to fetch sign-in history", http.StatusInternalServerError)
+		return
+	}
+	if failures == nil {
+		failures = []LoginFailure{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(failures)
+}
+
+// unlockUser lets an admin lift the sign-in lock on :userid
+func unlockUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := stores.Users.ResetLoginFailures(r.Context(), ps.ByName("userid"))
+	if err == ErrNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to unlock user", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, map[string]string{"userid": ps.ByName("userid")}, "User unlocked", nil)
+}
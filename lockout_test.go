@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// chanMailer hands sent messages to the test.
+type chanMailer chan Message
+
+func (m chanMailer) Send(_ context.Context, msg Message) error {
+	m <- msg
+	return nil
+}
+
+func TestLoginLockout(t *testing.T) {
+	useMemoryStores(t)
+	config.Lockout.BackoffAfter = 100 // Only the lock itself
+	config.Lockout.Threshold = 3
+	config.Lockout.Duration = time.Hour
+	outbox := make(chanMailer, 10)
+	mailer = outbox
+	ctx := context.Background()
+	user := seedAccount(t, "old password 1")
+
+	tryLogin := func(password string) int {
+		return serveAs(login, "", http.MethodPost, "/", `{"username": "Alice", "password": "`+password+`"}`).Code
+	}
+	for i := 1; i <= config.Lockout.Threshold; i++ {
+		if code := tryLogin("wrong password"); code != http.StatusUnauthorized {
+			t.Fatalf("failure %d = %d, want %d", i, code, http.StatusUnauthorized)
+		}
+	}
+
+	// Once locked, even the right password is turned away unchecked
+	w := serveAs(login, "", http.MethodPost, "/", `{"username": "alice", "password": "old password 1"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("locked login = %d with Retry-After %q, want %d with a wait", w.Code, w.Header().Get("Retry-After"), http.StatusTooManyRequests)
+	}
+	stored, err := stores.Users.GetByUserID(ctx, user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.FailedLogins != config.Lockout.Threshold {
+		t.Errorf("%d failures counted, want %d; locked attempts don't count", stored.FailedLogins, config.Lockout.Threshold)
+	}
+	select {
+	case msg := <-outbox:
+		if msg.To != user.Email {
+			t.Errorf("lock notice went to %s, want %s", msg.To, user.Email)
+		}
+	case <-time.After(time.Second):
+		t.Error("no lock notice was sent")
+	}
+	failures, err := stores.LoginFailures.ListByUser(ctx, user.UserID, 10)
+	if err != nil || len(failures) != config.Lockout.Threshold+1 {
+		t.Errorf("%d failures audited (%v), want %d", len(failures), err, config.Lockout.Threshold+1)
+	}
+
+	// An admin can lift the lock; a success clears the count
+	if code := serveAs(unlockUser, "admin", http.MethodDelete, "/", "", "userid", user.UserID).Code; code != http.StatusOK {
+		t.Fatalf("unlock = %d, want %d", code, http.StatusOK)
+	}
+	if code := tryLogin("wrong password"); code != http.StatusUnauthorized {
+		t.Errorf("after unlocking, a wrong password = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := tryLogin("old password 1"); code != http.StatusOK {
+		t.Fatalf("after unlocking = %d, want %d", code, http.StatusOK)
+	}
+	if stored, _ := stores.Users.GetByUserID(ctx, user.UserID); stored.FailedLogins != 0 {
+		t.Errorf("%d failures left after a success, want 0", stored.FailedLogins)
+	}
+}
+
+func TestLoginLockoutExpires(t *testing.T) {
+	useMemoryStores(t)
+	config.Lockout.BackoffAfter = 1
+	config.Lockout.BackoffBase = time.Hour
+	config.Lockout.Threshold = 3
+	config.Lockout.Duration = 50 * time.Millisecond
+	seedAccount(t, "old password 1")
+
+	tryLogin := func(password string) int {
+		return serveAs(login, "", http.MethodPost, "/", `{"username": "alice", "password": "`+password+`"}`).Code
+	}
+	// The first failure is free; the second starts a delay, capped at the
+	// lock duration
+	tryLogin("wrong password")
+	tryLogin("wrong password")
+	if code := tryLogin("old password 1"); code != http.StatusTooManyRequests {
+		t.Fatalf("during the delay = %d, want %d", code, http.StatusTooManyRequests)
+	}
+	time.Sleep(config.Lockout.Duration + 10*time.Millisecond)
+	if code := tryLogin("old password 1"); code != http.StatusOK {
+		t.Errorf("after the delay = %d, want %d", code, http.StatusOK)
+	}
+}
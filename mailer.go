@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mail providers selectable with mail.provider.
+const (
+	MailProviderLog  = "log"
+	MailProviderFile = "file"
+	MailProviderSMTP = "smtp"
+)
+
+// mailTimeout bounds how long sendMail waits for one message to go out.
+const mailTimeout = 30 * time.Second
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers email. Implementations must be safe for concurrent use.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// mailer is the Mailer used by the handlers; set in main.
+var mailer Mailer
+
+// newMailer builds the mailer selected in the configuration.
+func newMailer(cfg MailConfig) (Mailer, error) {
+	switch cfg.Provider {
+	case MailProviderLog:
+		return &FileMailer{From: cfg.From}, nil
+	case MailProviderFile:
+		if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			return nil, err
+		}
+		return &FileMailer{From: cfg.From, Dir: cfg.Dir}, nil
+	case MailProviderSMTP:
+		return &SMTPMailer{Addr: cfg.SMTPAddr, Username: cfg.SMTPUsername, Password: cfg.SMTPPassword, From: cfg.From}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail provider %q", cfg.Provider)
+	}
+}
+
+// sendMail delivers msg in the background so handlers neither wait on the
+// mail server nor reveal through their timing whether a message was sent.
+func sendMail(msg Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+		if err := mailer.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send %q to %s: %v", msg.Subject, msg.To, err)
+		}
+	}()
+}
+
+// formatMessage renders msg as an RFC 5322 message.
+func formatMessage(from string, msg Message, now time.Time) []byte {
+	var b bytes.Buffer
+	header := func(k, v string) {
+		// Strip line breaks so values can't inject extra headers
+		v = strings.NewReplacer("\r", "", "\n", "").Replace(v)
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	header("From", from)
+	header("To", msg.To)
+	header("Subject", msg.Subject)
+	header("Date", now.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// FileMailer is the development mailer. It writes each message to an .eml
+// file in Dir, or to the log when Dir is empty, instead of sending it.
+type FileMailer struct {
+	From string
+	Dir  string
+}
+
+func (m *FileMailer) Send(_ context.Context, msg Message) error {
+	now := time.Now()
+	raw := formatMessage(m.From, msg, now)
+	if m.Dir == "" {
+		log.Printf("Outgoing mail (not sent):\n%s", raw)
+		return nil
+	}
+	name := fmt.Sprintf("%s-%s.eml", now.UTC().Format("20060102T150405.000"), randomToken(4))
+	return os.WriteFile(filepath.Join(m.Dir, name), raw, 0o644)
+}
+
+// SMTPMailer sends mail through an SMTP server, authenticating with PLAIN
+// when a username is set. net/smtp upgrades to TLS when the server offers
+// STARTTLS and refuses to send credentials over a plain remote connection.
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address: %v", err)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address: %v", err)
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	// smtp.SendMail has no context, so give up waiting when ctx ends
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.Addr, auth, from.Address, []string{to.Address}, formatMessage(m.From, msg, time.Now()))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
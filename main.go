@@ -2,8 +2,15 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -11,6 +18,92 @@ import (
 )
 
 func main() {
+	configPath := flag.String("config", "", "path to a TOML config file (default $NAEVIS_CONFIG)")
+	memory := flag.Bool("memory", false, "keep all data in memory instead of MongoDB")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *memory {
+		cfg.Store = StoreMemory
+	}
+	config = cfg
+	jwtSecret = []byte(config.JWTSecret)
+	if config.JWTSecret == placeholderSecret {
+		log.Println("WARNING: using the placeholder JWT secret; set NAEVIS_JWT_SECRET before deploying")
+	}
+
+	if config.Store == StoreMemory {
+		log.Println("Using in-memory storage; data will not survive a restart")
+		stores = NewMemoryStores()
+	} else {
+		stores = connectMongo()
+	}
+	searchIndex = newSearchIndex()
+	indexStores(stores)
+
+	payments, err = newPaymentProvider(config.Payments)
+	if err != nil {
+		log.Fatalf("Failed to set up payments: %v", err)
+	}
+	if config.Payments.Provider == "fake" {
+		log.Printf("Using the fake payment provider (mode %q); no real money will move", config.Payments.FakeMode)
+	}
+
+	mailer, err = newMailer(config.Mail)
+	if err != nil {
+		log.Fatalf("Failed to set up mail: %v", err)
+	}
+
+	var mockIssuer *MockOIDCIssuer
+	if config.OIDC.Mock {
+		mockIssuer, err = NewMockOIDCIssuer(strings.TrimRight(config.PublicURL, "/") + mockOIDCPath)
+		if err != nil {
+			log.Fatalf("Failed to set up the mock identity provider: %v", err)
+		}
+		if config.OIDC.Providers == nil {
+			config.OIDC.Providers = make(map[string]*OIDCProviderConfig)
+		}
+		config.OIDC.Providers[mockOIDCProvider] = mockIssuer.ProviderConfig()
+		log.Printf("Serving a mock identity provider at %s; anyone can sign in as anyone", mockIssuer.Issuer)
+	}
+	oidcProviders = newOIDCProviders(config.OIDC, config.PublicURL)
+
+	// Stop on SIGINT/SIGTERM; in-flight requests are drained by serve
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Background jobs stop with the server and are waited for before the
+	// database connection closes
+	var jobs sync.WaitGroup
+	runJob(&jobs, func() { sweepReservations(ctx, config.Reservations.SweepInterval) })
+	runJob(&jobs, func() { sweepPendingOrders(ctx, config.Payments.SweepInterval) })
+	runJob(&jobs, func() { runEventScheduler(ctx, config.Events.SchedulerInterval) })
+	runJob(&jobs, func() { fillSearchIndex(ctx) })
+
+	router := newRouter(mockIssuer)
+
+	server := &http.Server{
+		Addr:              config.ListenAddr,
+		Handler:           router,
+		ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+		ReadTimeout:       config.Server.ReadTimeout,
+		WriteTimeout:      config.Server.WriteTimeout,
+		IdleTimeout:       config.Server.IdleTimeout,
+	}
+	if err := serve(ctx, server, config.Server.ShutdownTimeout); err != nil {
+		log.Printf("Server error: %v", err)
+	}
+	stop() // The server may have failed without a signal
+	jobs.Wait()
+	disconnectMongo()
+	log.Println("Server stopped")
+}
+
+// newRouter registers the pages, the API and the static files.
+func newRouter(mockIssuer *MockOIDCIssuer) *httprouter.Router {
 	router := httprouter.New()
 	router.GET("/", Index)
 	router.GET("/about", Index)
@@ -29,6 +122,33 @@ func main() {
 
 	router.POST("/api/register", rateLimit(register))
 	router.POST("/api/login", rateLimit(login))
+	router.POST("/api/login/2fa", rateLimit(loginMFA))
+	router.POST("/api/token/refresh", rateLimit(refreshTokens))
+	router.POST("/api/logout", authenticate(logout))
+	router.POST("/api/logout/all", authenticate(logoutAll))
+	router.POST("/api/password/forgot", rateLimit(forgotPassword))
+	router.POST("/api/password/reset", rateLimit(resetPassword))
+	router.POST("/api/verify-email", rateLimit(verifyEmail))
+	router.POST("/api/verify-email/resend", authenticate(resendVerification))
+	router.POST("/api/2fa/enroll", authenticate(enrollTOTP))
+	router.POST("/api/2fa/confirm", authenticate(confirmTOTP))
+	router.POST("/api/2fa/recovery-codes", authenticate(regenerateRecoveryCodes))
+	router.POST("/api/2fa/disable", authenticate(disableTOTP))
+	router.GET("/api/oidc", getOIDCProviders)
+	router.GET("/api/oidc/:provider/login", rateLimit(oidcLogin))
+	router.GET("/api/oidc/:provider/callback", rateLimit(oidcCallback))
+	router.POST("/api/oidc/:provider/link", authenticate(oidcLink))
+	router.GET("/api/identities", authenticate(getIdentities))
+	router.DELETE("/api/identities/:provider", authenticate(unlinkIdentity))
+	if mockIssuer != nil {
+		mockIssuer.Routes(router)
+	}
+	router.GET("/api/sessions", authenticate(getSessions))
+	router.DELETE("/api/sessions/:id", authenticate(deleteSession))
+	router.GET("/api/login/failures", authenticate(getMyLoginFailures))
+	router.POST("/api/keys", authenticate(createAPIKey))
+	router.GET("/api/keys", authenticate(getAPIKeys))
+	router.DELETE("/api/keys/:keyid", authenticate(revokeAPIKey))
 	router.GET("/api/profile", authenticate(getProfile))
 	router.PUT("/api/profile", authenticate(editProfile))
 	router.DELETE("/api/profile", authenticate(deleteProfile))
@@ -41,43 +161,77 @@ func main() {
 	router.GET("/api/activity", authenticate(getActivityFeed))
 	router.GET("/api/user/:username", getUserProfile)
 
-	router.GET("/api/events", getEvents)
-	router.POST("/api/event", authenticate(createEvent))
-	router.GET("/api/event/:eventid", getEvent)
-	router.PUT("/api/event/:eventid", authenticate(editEvent))
-	router.DELETE("/api/event/:eventid", authenticate(deleteEvent))
-
-	router.POST("/api/event/:eventid/review", authenticate(addReview))
-
-	router.POST("/api/event/:eventid/media", authenticate(addMedia))
-	router.GET("/api/event/:eventid/media/:id", getMedia)
-	router.GET("/api/event/:eventid/media", getMedias)
-	router.DELETE("/api/event/:eventid/media/:id", authenticate(deleteMedia))
-
-	router.POST("/api/event/:eventid/merch", authenticate(createMerch))
-	router.POST("/api/event/:eventid/merch/:merchid/buy", authenticate(buyMerch))
-	router.GET("/api/event/:eventid/merch", getMerchs)
-	router.GET("/api/event/:eventid/merch/:merchid", getMerch)
-	router.PUT("/api/event/:eventid/merch/:merchid", authenticate(editMerch))
-	router.DELETE("/api/event/:eventid/merch/:merchid", authenticate(deleteMerch))
-
-	router.POST("/api/event/:eventid/ticket", authenticate(createTick))
-	router.GET("/api/event/:eventid/ticket", getTicks)
-	router.POST("/api/event/:eventid/tickets/:ticketid/buy", authenticate(buyTicket))
-	router.PUT("/api/event/:eventid/ticket/:ticketid", authenticate(editTick))
-	router.DELETE("/api/event/:eventid/ticket/:ticketid", authenticate(deleteTick))
+	router.GET("/api/admin/roles", authenticate(requirePermission(PermManageRoles, getRoles)))
+	router.PUT("/api/admin/users/:userid/role", authenticate(requirePermission(PermManageRoles, grantRole)))
+	router.DELETE("/api/admin/users/:userid/role", authenticate(requirePermission(PermManageRoles, revokeRole)))
+	router.DELETE("/api/admin/users/:userid/2fa", authenticate(requirePermission(PermManageUsers, resetUserTOTP)))
+	router.GET("/api/admin/users/:userid/login-failures", authenticate(requirePermission(PermManageUsers, getUserLoginFailures)))
+	router.DELETE("/api/admin/users/:userid/lockout", authenticate(requirePermission(PermManageUsers, unlockUser)))
+	router.POST("/api/admin/search/reindex", authenticate(requirePermission(PermManageUsers, reindexSearch)))
+
+	router.GET("/api/orders", allowAPIKeys(ScopeOrdersRead, authenticate(getOrders)))
+	router.GET("/api/orders/:orderid", allowAPIKeys(ScopeOrdersRead, authenticate(getOrder)))
+	router.POST("/api/payments/webhook", handlePaymentWebhook)
+	router.GET("/api/reservations", allowAPIKeys(ScopeTicketsRead, authenticate(getReservations)))
+	router.GET("/api/reservations/:reservationid", allowAPIKeys(ScopeTicketsRead, authenticate(getReservation)))
+	router.POST("/api/reservations/:reservationid/confirm", allowAPIKeys(ScopeTicketsWrite, authenticate(confirmReservation)))
+	router.DELETE("/api/reservations/:reservationid", allowAPIKeys(ScopeTicketsWrite, authenticate(releaseReservation)))
+	router.GET("/api/tickets", allowAPIKeys(ScopeTicketsRead, authenticate(getMyTickets)))
+	router.GET("/api/tickets/:instanceid", allowAPIKeys(ScopeTicketsRead, authenticate(getMyTicket)))
+	router.GET("/api/tickets/:instanceid/qr", allowAPIKeys(ScopeTicketsRead, authenticate(getTicketQR)))
+
+	router.GET("/api/events", allowAPIKeys(ScopeEventsRead, optionalAuthenticate(getEvents)))
+	router.GET("/api/search", search)
+	router.POST("/api/event", allowAPIKeys(ScopeEventsWrite, authenticate(requirePermission(PermCreateEvent, createEvent))))
+	router.GET("/api/event/:eventid", allowAPIKeys(ScopeEventsRead, optionalAuthenticate(getEvent)))
+	router.PUT("/api/event/:eventid", allowAPIKeys(ScopeEventsWrite, authenticate(authorize(eventOrganizer, editEvent))))
+	router.DELETE("/api/event/:eventid", allowAPIKeys(ScopeEventsWrite, authenticate(authorize(eventCreator, deleteEvent))))
+	router.GET("/api/event/:eventid/orders", allowAPIKeys(ScopeOrdersRead, authenticate(authorize(eventOrganizer, getEventOrders))))
+	router.POST("/api/event/:eventid/orders/:orderid/refund", allowAPIKeys(ScopeOrdersWrite, authenticate(authorize(eventOrganizer, refundOrder))))
+	router.POST("/api/event/:eventid/verify", allowAPIKeys(ScopeTicketsWrite, authenticate(authorize(eventOrganizer, verifyTicket))))
+	router.POST("/api/event/:eventid/checkin", allowAPIKeys(ScopeTicketsWrite, authenticate(authorize(eventOrganizer, checkIn))))
+	router.POST("/api/event/:eventid/checkin/batch", allowAPIKeys(ScopeTicketsWrite, authenticate(authorize(eventOrganizer, checkInBatch))))
+	router.GET("/api/event/:eventid/attendance", allowAPIKeys(ScopeEventsRead, authenticate(authorize(eventOrganizer, getAttendance))))
+	router.POST("/api/event/:eventid/organizers", allowAPIKeys(ScopeEventsWrite, authenticate(authorize(eventCreator, addCoOrganizer))))
+	router.POST("/api/series", allowAPIKeys(ScopeEventsWrite, authenticate(requirePermission(PermCreateEvent, createSeries))))
+	router.GET("/api/series/:seriesid", allowAPIKeys(ScopeEventsRead, optionalAuthenticate(getSeries)))
+	router.DELETE("/api/series/:seriesid", allowAPIKeys(ScopeEventsWrite, authenticate(authorize(seriesCreator, deleteSeries))))
+	router.GET("/api/series/:seriesid/events", allowAPIKeys(ScopeEventsRead, optionalAuthenticate(getSeriesEvents)))
+	router.PUT("/api/series/:seriesid/events/:eventid", allowAPIKeys(ScopeEventsWrite, authenticate(authorize(seriesCreator, editSeriesEvent))))
+	router.DELETE("/api/series/:seriesid/events/:eventid", allowAPIKeys(ScopeEventsWrite, authenticate(authorize(seriesCreator, deleteSeriesEvent))))
+	router.DELETE("/api/event/:eventid/organizers/:userid", allowAPIKeys(ScopeEventsWrite, authenticate(authorize(eventCreator, removeCoOrganizer))))
+
+	router.POST("/api/event/:eventid/review", authenticate(requireVisible(addReview)))
+	router.DELETE("/api/event/:eventid/review/:reviewid", authenticate(authorize(reviewOwnerOrModerator, deleteReview)))
+
+	router.POST("/api/event/:eventid/media", allowAPIKeys(ScopeMediaWrite, authenticate(authorize(eventOrganizer, addMedia))))
+	router.GET("/api/event/:eventid/media/:id", allowAPIKeys(ScopeEventsRead, optionalAuthenticate(requireVisible(getMedia))))
+	router.GET("/api/event/:eventid/media", allowAPIKeys(ScopeEventsRead, optionalAuthenticate(requireVisible(getMedias))))
+	router.DELETE("/api/event/:eventid/media/:id", allowAPIKeys(ScopeMediaWrite, authenticate(authorize(mediaOwnerOrModerator, deleteMedia))))
+
+	router.POST("/api/event/:eventid/merch", allowAPIKeys(ScopeMerchWrite, authenticate(authorize(eventOrganizer, createMerch))))
+	router.POST("/api/event/:eventid/merch/:merchid/buy", allowAPIKeys(ScopeMerchWrite, authenticate(requireOnSale(buyMerch))))
+	router.GET("/api/event/:eventid/merch", allowAPIKeys(ScopeEventsRead, optionalAuthenticate(requireVisible(getMerchs))))
+	router.GET("/api/event/:eventid/merch/:merchid", allowAPIKeys(ScopeEventsRead, optionalAuthenticate(requireVisible(getMerch))))
+	router.PUT("/api/event/:eventid/merch/:merchid", allowAPIKeys(ScopeMerchWrite, authenticate(authorize(eventOrganizer, editMerch))))
+	router.DELETE("/api/event/:eventid/merch/:merchid", allowAPIKeys(ScopeMerchWrite, authenticate(authorize(eventOrganizer, deleteMerch))))
+
+	router.POST("/api/event/:eventid/ticket", allowAPIKeys(ScopeTicketsWrite, authenticate(authorize(eventOrganizer, createTick))))
+	router.GET("/api/event/:eventid/ticket", allowAPIKeys(ScopeEventsRead, optionalAuthenticate(requireVisible(getTicks))))
+	router.POST("/api/event/:eventid/tickets/:ticketid/buy", allowAPIKeys(ScopeTicketsWrite, authenticate(requireOnSale(buyTicket))))
+	router.POST("/api/event/:eventid/tickets/:ticketid/reserve", allowAPIKeys(ScopeTicketsWrite, authenticate(requireOnSale(reserveTicket))))
+	router.PUT("/api/event/:eventid/ticket/:ticketid", allowAPIKeys(ScopeTicketsWrite, authenticate(authorize(eventOrganizer, editTick))))
+	router.DELETE("/api/event/:eventid/ticket/:ticketid", allowAPIKeys(ScopeTicketsWrite, authenticate(authorize(eventOrganizer, deleteTick))))
 
 	router.GET("/api/places", getPlaces)
-	router.POST("/api/place", authenticate(createPlace))
+	router.POST("/api/place", allowAPIKeys(ScopePlacesWrite, authenticate(requirePermission(PermCreatePlace, createPlace))))
 	router.GET("/api/place/:placeid", getPlace)
-	router.PUT("/api/place/:placeid", authenticate(editPlace))
-	router.DELETE("/api/place/:placeid", authenticate(deletePlace))
-	router.DELETE("/api/place/:placeid/review", authenticate(addReview))
-	router.DELETE("/api/place/:placeid/media", authenticate(addMedia))
-	router.POST("/api/place/:placeid/merch", authenticate(createMerch))
+	router.PUT("/api/place/:placeid", allowAPIKeys(ScopePlacesWrite, authenticate(authorize(placeManager, editPlace))))
+	router.DELETE("/api/place/:placeid", allowAPIKeys(ScopePlacesWrite, authenticate(authorize(placeManager, deletePlace))))
+	router.POST("/api/place/:placeid/merch", allowAPIKeys(ScopePlacesWrite, authenticate(authorize(placeManager, createMerch))))
 	router.GET("/api/place/:placeid/merch/:merchid", getMerch)
-	router.PUT("/api/place/:placeid/merch/:merchid", authenticate(editMerch))
-	router.DELETE("/api/place/:placeid/merch/:merchid", authenticate(deleteMerch))
+	router.PUT("/api/place/:placeid/merch/:merchid", allowAPIKeys(ScopePlacesWrite, authenticate(authorize(placeManager, editMerch))))
+	router.DELETE("/api/place/:placeid/merch/:merchid", allowAPIKeys(ScopePlacesWrite, authenticate(authorize(placeManager, deleteMerch))))
 
 	// // CORS setup
 	// c := cors.New(cors.Options{
@@ -89,59 +243,48 @@ func main() {
 	// Serve static files (HTML, CSS, JS)
 	router.ServeFiles("/css/*filepath", http.Dir("css"))
 	router.ServeFiles("/js/*filepath", http.Dir("js"))
-	router.ServeFiles("/uploads/*filepath", http.Dir("uploads"))
-	router.ServeFiles("/userpic/*filepath", http.Dir("userpic"))
-	router.ServeFiles("/merchpic/*filepath", http.Dir("merchpic"))
-	router.ServeFiles("/eventpic/*filepath", http.Dir("eventpic"))
-	router.ServeFiles("/placepic/*filepath", http.Dir("placepic"))
-	http.ListenAndServe("localhost:4000", router)
-	// Initialize the HTTP server
-	// server := &http.Server{
-	// 	Addr:    ":4000",
-	// 	Handler: c.Handler(router),
-	// }
-
-	// // Start server in a goroutine to handle graceful shutdown
-	// go func() {
-	// 	log.Println("Server started on port 4000")
-	// 	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-	// 		log.Fatalf("Could not listen on port 4000: %v", err)
-	// 	}
-	// }()
-
-	// // Graceful shutdown listener
-	// shutdownChan := make(chan os.Signal, 1)
-	// signal.Notify(shutdownChan, os.Interrupt, syscall.SIGTERM)
-
-	// // Wait for termination signal
-	// <-shutdownChan
-	// log.Println("Shutting down gracefully...")
-
-	// // Log active connections before shutdown
-	// // log.Println("Active connections:", len(http.DefaultServeMux))
-
-	// // Attempt to gracefully shut down the server
-	// if err := server.Shutdown(context.Background()); err != nil {
-	// 	log.Fatalf("Server shutdown failed: %v", err)
-	// }
-	// log.Println("Server stopped")
+	router.ServeFiles("/uploads/*filepath", http.Dir(config.Uploads.Media))
+	router.ServeFiles("/userpic/*filepath", http.Dir(config.Uploads.UserPics))
+	router.ServeFiles("/merchpic/*filepath", http.Dir(config.Uploads.MerchPics))
+	router.ServeFiles("/eventpic/*filepath", http.Dir(config.Uploads.EventPics))
+	router.ServeFiles("/placepic/*filepath", http.Dir(config.Uploads.PlacePics))
+
+	return router
 }
 
 var (
-	client         *mongo.Client
-	userCollection *mongo.Collection
-	jwtSecret      = []byte("your_secret_key") // Replace with your secret key
+	client    *mongo.Client
+	jwtSecret = []byte(placeholderSecret) // Set from config in main
 )
 
-// Initialize MongoDB connection
-func init() {
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
+// Initialize MongoDB connection and the stores backed by it
+func connectMongo() *Stores {
+	clientOptions := options.Client().ApplyURI(config.MongoURI)
 	var err error
 	client, err = mongo.Connect(context.TODO(), clientOptions)
 	if err != nil {
 		log.Fatalf("Failed to connect to MongoDB: %v", err)
 	}
-	userCollection = client.Database("eventdb").Collection("users")
+	db := client.Database(config.Database)
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+	if err := migrateMongo(ctx, db); err != nil {
+		log.Fatalf("Failed to migrate the database: %v", err)
+	}
+	return NewMongoStores(db)
+}
+
+// disconnectMongo closes the MongoDB connection pool, if one was opened.
+func disconnectMongo() {
+	if client == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Disconnect(ctx); err != nil {
+		log.Printf("Failed to disconnect from MongoDB: %v", err)
+	}
 }
 
 // // Initialize MongoDB connection
@@ -1,14 +1,12 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"os"
 
 	"github.com/julienschmidt/httprouter"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 func addMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -48,7 +46,7 @@ func addMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 	if bannerFile != nil {
 		// Save the banner image logic here
-		out, err := os.Create("./uploads/" + media.ID + ".jpg")
+		out, err := os.Create(uploadPath(config.Uploads.Media, media.ID+".jpg"))
 		if err != nil {
 			http.Error(w, "Error saving banner", http.StatusInternalServerError)
 			return
@@ -63,9 +61,8 @@ func addMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 	media.URL = media.ID + ".jpg"
 
-	// Insert merch into MongoDB
-	collection := client.Database("eventdb").Collection("media")
-	_, err = collection.InsertOne(context.TODO(), media)
+	// Save the media record
+	err = stores.Media.Create(r.Context(), media)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -81,10 +78,8 @@ func getMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid") // Extract the event ID from the URL parameters
 	mediaID := ps.ByName("id")      // Extract the media ID from the URL parameters
 
-	// Query the database for the media document using both eventID and mediaID
-	collection := client.Database("eventdb").Collection("media")
-	var media Media
-	err := collection.FindOne(context.TODO(), bson.M{"eventid": eventID, "id": mediaID}).Decode(&media)
+	// Look up the media document using both eventID and mediaID
+	media, err := stores.Media.Get(r.Context(), eventID, mediaID)
 	if err != nil {
 		// If there's an error (e.g., no matching media found), send a 404 response
 		http.Error(w, "Media not found", http.StatusNotFound)
@@ -99,23 +94,11 @@ func getMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 func getMedias(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 
-	collection := client.Database("eventdb").Collection("media")
-	cursor, err := collection.Find(context.TODO(), bson.M{"eventid": eventID})
+	medias, err := stores.Media.ListByEvent(r.Context(), eventID)
 	if err != nil {
 		http.Error(w, "Failed to retrieve media", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.TODO())
-
-	var medias []Media
-	for cursor.Next(context.TODO()) {
-		var media Media
-		if err := cursor.Decode(&media); err != nil {
-			http.Error(w, "Failed to decode media", http.StatusInternalServerError)
-			return
-		}
-		medias = append(medias, media)
-	}
 	if len(medias) == 0 {
 		medias = []Media{}
 	}
@@ -128,23 +111,21 @@ func deleteMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 	mediaID := ps.ByName("id")
 
-	collection := client.Database("eventdb").Collection("media")
-	var media Media
-	err := collection.FindOne(context.TODO(), bson.M{"eventid": eventID, "id": mediaID}).Decode(&media)
+	media, err := stores.Media.Get(r.Context(), eventID, mediaID)
 	if err != nil {
 		http.Error(w, "Media not found", http.StatusNotFound)
 		return
 	}
 
 	// Remove the media entry from the database
-	_, err = collection.DeleteOne(context.TODO(), bson.M{"eventid": eventID, "id": mediaID})
+	err = stores.Media.Delete(r.Context(), eventID, mediaID)
 	if err != nil {
 		http.Error(w, "Failed to delete media from database", http.StatusInternalServerError)
 		return
 	}
 
 	// Optionally, remove the file from the filesystem
-	os.Remove(media.URL)
+	os.Remove(uploadPath(config.Uploads.Media, media.URL))
 
 	// w.WriteHeader(http.StatusNoContent)
 	sendResponse(w, http.StatusNoContent, map[string]string{"": ""}, "Delete successful", nil)
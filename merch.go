@@ -1,15 +1,14 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
 
 	"github.com/julienschmidt/httprouter"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 func createMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -42,6 +41,10 @@ func createMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		Price:   price,
 		Stock:   quantity,
 	}
+	if errs := validate(merch); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
 
 	merch.MerchID = generateID(14)
 
@@ -51,11 +54,11 @@ func createMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		http.Error(w, "Error retrieving banner file", http.StatusBadRequest)
 		return
 	}
-	defer bannerFile.Close()
-
 	if bannerFile != nil {
+		defer bannerFile.Close()
+
 		// Save the banner image logic here
-		out, err := os.Create("./merchpic/" + merch.MerchID + ".jpg")
+		out, err := os.Create(uploadPath(config.Uploads.MerchPics, merch.MerchID+".jpg"))
 		if err != nil {
 			http.Error(w, "Error saving banner", http.StatusInternalServerError)
 			return
@@ -68,9 +71,8 @@ func createMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		merch.MerchPhoto = merch.MerchID + ".jpg"
 	}
 
-	// Insert merch into MongoDB
-	collection := client.Database("eventdb").Collection("merch")
-	_, err = collection.InsertOne(context.TODO(), merch)
+	// Save the merch
+	err = stores.Merch.Create(r.Context(), merch)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -85,9 +87,7 @@ func getMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 	merchID := ps.ByName("merchid")
 
-	collection := client.Database("eventdb").Collection("merch")
-	var merch Merch
-	err := collection.FindOne(context.TODO(), bson.M{"eventid": eventID, "merchid": merchID}).Decode(&merch)
+	merch, err := stores.Merch.Get(r.Context(), eventID, merchID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -98,34 +98,12 @@ func getMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 func getMerchs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 
-	collection := client.Database("eventdb").Collection("merch")
-
-	var merchList []Merch                // Use your Merch struct here
-	filter := bson.M{"eventid": eventID} // Ensure this matches your BSON field name
-
-	// Query the database
-	cursor, err := collection.Find(context.Background(), filter)
+	// Query the merchandise for the event
+	merchList, err := stores.Merch.ListByEvent(r.Context(), eventID)
 	if err != nil {
 		http.Error(w, "Failed to fetch merchandise", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.Background())
-
-	// Iterate through the cursor and decode each document into the merchList
-	for cursor.Next(context.Background()) {
-		var merch Merch
-		if err := cursor.Decode(&merch); err != nil {
-			http.Error(w, "Failed to decode merchandise", http.StatusInternalServerError)
-			return
-		}
-		merchList = append(merchList, merch)
-	}
-
-	// Check for cursor errors
-	if err := cursor.Err(); err != nil {
-		http.Error(w, "Cursor error", http.StatusInternalServerError)
-		return
-	}
 	if len(merchList) == 0 {
 		merchList = []Merch{}
 	}
@@ -140,11 +118,35 @@ func editMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 	merchID := ps.ByName("merchid")
 	var merch Merch
-	json.NewDecoder(r.Body).Decode(&merch)
+	if err := json.NewDecoder(r.Body).Decode(&merch); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if errs := validate(merch); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
 
-	// Update the merch in MongoDB
-	collection := client.Database("eventdb").Collection("merch")
-	_, err := collection.UpdateOne(context.TODO(), bson.M{"eventid": eventID, "merchid": merchID}, bson.M{"$set": merch})
+	// Keep the stored photo; clients can't point it at another file
+	stored, err := stores.Merch.Get(r.Context(), eventID, merchID)
+	if err == ErrNotFound {
+		http.Error(w, "Merch not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	merch.EventID = eventID
+	merch.MerchID = merchID
+	merch.MerchPhoto = stored.MerchPhoto
+
+	// Update the merch
+	err = stores.Merch.Update(r.Context(), merch)
+	if err == ErrNotFound {
+		http.Error(w, "Merch not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -156,10 +158,9 @@ func deleteMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 	merchID := ps.ByName("merchid")
 
-	// Delete the merch from MongoDB
-	collection := client.Database("eventdb").Collection("merch")
-	_, err := collection.DeleteOne(context.TODO(), bson.M{"eventid": eventID, "merchid": merchID})
-	if err != nil {
+	// Delete the merch
+	err := stores.Merch.Delete(r.Context(), eventID, merchID)
+	if err != nil && err != ErrNotFound {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -172,34 +173,55 @@ func buyMerch(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 	merchID := ps.ByName("merchid")
 
-	// Find the merch in the database
-	collection := client.Database("eventdb").Collection("merch")
-	var merch Merch // Define the Merch struct based on your schema
-	err := collection.FindOne(context.TODO(), bson.M{"eventid": eventID, "merchid": merchID}).Decode(&merch)
-	if err != nil {
-		http.Error(w, "Merch not found or other error", http.StatusNotFound)
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
 		return
 	}
 
-	// Check if there are merchs available
-	if merch.Stock <= 0 {
-		http.Error(w, "No merchs available for purchase", http.StatusBadRequest)
+	// Read the requested quantity; an empty body buys a single item
+	req := purchaseRequest{Quantity: 1}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if req.Quantity < 1 {
+		http.Error(w, "Quantity must be at least 1", http.StatusBadRequest)
 		return
 	}
 
-	// Decrease the merch quantity
-	update := bson.M{"$inc": bson.M{"stock": -1}}
-	_, err = collection.UpdateOne(context.TODO(), bson.M{"eventid": eventID, "merchid": merchID}, update)
-	if err != nil {
+	// Take the stock in a single conditional update
+	merch, err := stores.Merch.Purchase(r.Context(), eventID, merchID, req.Quantity)
+	switch {
+	case err == ErrNotFound:
+		http.Error(w, "Merch not found", http.StatusNotFound)
+		return
+	case err == ErrSoldOut:
+		sendResponse(w, http.StatusConflict, nil, "Not enough merch in stock", err)
+		return
+	case err != nil:
 		http.Error(w, "Failed to update merch quantity", http.StatusInternalServerError)
 		return
 	}
 
+	// Record the purchase and take payment
+	item := newOrderItem(OrderItemMerch, merch.MerchID, merch.Name, merch.Price, req.Quantity)
+	order, err := chargeOrder(r.Context(), buildOrder(userID, eventID, OrderStatusPending, item))
+	if err != nil {
+		log.Printf("Failed to complete order for merch %s: %v", merchID, err)
+		if ownsStock(err) {
+			releaseOrderStock(r.Context(), order)
+		}
+		writePaymentError(w, err)
+		return
+	}
+
 	// Respond with success
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"success": true,
 		"message": "Merch purchased successfully",
+		"order":   order,
 	})
 }
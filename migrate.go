@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Startup schema management for MongoDB. Before serving, main applies the
+// data migrations the database hasn't seen yet, in order, and then makes
+// sure every index below exists. Applied migrations are recorded in the
+// migrations collection, and a lock document there keeps two instances
+// starting together from migrating at the same time. The memory store
+// needs none of this.
+
+const (
+	migrationsCollection = "migrations"
+	migrationLockID      = "lock"
+	migrationLockTTL     = 10 * time.Minute // How long a crashed instance can hold the lock
+	migrationTimeout     = 10 * time.Minute
+
+	// duplicateUsersCollection holds the accounts setAsideDuplicateUsers
+	// took out of users.
+	duplicateUsersCollection = "users_duplicates"
+	// userKeyClashesCollection lists the accounts normalizeUserKeys
+	// couldn't lowercase, and whom they clash with.
+	userKeyClashesCollection = "users_key_clashes"
+)
+
+// Migration is a one-off change to stored data. Versions are applied in
+// ascending order and never reused; a migration must cope with documents
+// it has already changed, in case it was interrupted.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, db *mongo.Database) error
+}
+
+// migrations must stay sorted by version. Append new ones; never edit or
+// remove one that has shipped.
+var migrations = []Migration{
+	{1, "lowercase usernames and emails", normalizeUserKeys},
+	{2, "backfill event and place creation times", backfillCreatedAt},
+	{3, "summarize event tickets", backfillTicketSummaries},
+	{4, "store place coordinates as GeoJSON", backfillPlaceLocations},
+	{5, "publish events with a status from before the lifecycle", normalizeEventStatuses},
+	{6, "set aside users whose userid, username or email is taken", setAsideDuplicateUsers},
+}
+
+// collectionIndexes are the indexes every collection needs. Lookups by the
+// public IDs are unique, and so are usernames and (non-empty) emails, which
+// is what makes Create report ErrDuplicate.
+var collectionIndexes = map[string][]mongo.IndexModel{
+	"users": {
+		{Keys: bson.D{{Key: "userid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.M{"email": bson.M{"$type": "string", "$gt": ""}})},
+		{Keys: bson.D{{Key: "identities.issuer", Value: 1}, {Key: "identities.subject", Value: 1}}},
+	},
+	"events": {
+		{Keys: bson.D{{Key: "eventid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "creatorid", Value: 1}}},
+		// The orders GET /api/events can list in
+		{Keys: bson.D{{Key: "start_date_time", Value: 1}, {Key: "eventid", Value: 1}}},
+		{Keys: bson.D{{Key: "created_at", Value: 1}, {Key: "eventid", Value: 1}}},
+		{Keys: bson.D{{Key: "min_price", Value: 1}, {Key: "eventid", Value: 1}}},
+		{Keys: bson.D{{Key: "title", Value: 1}, {Key: "eventid", Value: 1}}},
+		{Keys: bson.D{{Key: "category", Value: 1}, {Key: "start_date_time", Value: 1}}},
+		{Keys: bson.D{{Key: "place", Value: 1}, {Key: "start_date_time", Value: 1}}},
+		// Also what the event scheduler looks up due events by
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "start_date_time", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "end_date_time", Value: 1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "publish_at", Value: 1}}},
+		{Keys: bson.D{{Key: "seriesid", Value: 1}, {Key: "start_date_time", Value: 1}}, Options: options.Index().SetSparse(true)},
+	},
+	"series": {
+		{Keys: bson.D{{Key: "seriesid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "finished", Value: 1}, {Key: "generated_until", Value: 1}}},
+	},
+	"places": {
+		{Keys: bson.D{{Key: "placeid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "createdBy", Value: 1}}},
+		{Keys: bson.D{{Key: "location", Value: "2dsphere"}}},
+	},
+	"ticks": {
+		{Keys: bson.D{{Key: "eventid", Value: 1}, {Key: "ticketid", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"merch": {
+		{Keys: bson.D{{Key: "eventid", Value: 1}, {Key: "merchid", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"media": {
+		{Keys: bson.D{{Key: "eventid", Value: 1}, {Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"activities": {
+		{Keys: bson.D{{Key: "username", Value: 1}}},
+	},
+	"orders": {
+		{Keys: bson.D{{Key: "orderid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "eventid", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+	},
+	"reservations": {
+		{Keys: bson.D{{Key: "reservationid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "expires_at", Value: 1}}},
+	},
+	"ticket_instances": {
+		{Keys: bson.D{{Key: "instanceid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "holderid", Value: 1}, {Key: "issued_at", Value: -1}}},
+		{Keys: bson.D{{Key: "orderid", Value: 1}}},
+		{Keys: bson.D{{Key: "eventid", Value: 1}, {Key: "status", Value: 1}}},
+	},
+	"refresh_tokens": {
+		{Keys: bson.D{{Key: "tokenid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "sessionid", Value: 1}}},
+		{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "status", Value: 1}}},
+		// Expired tokens are useless, so let MongoDB delete them
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"revocations": {
+		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"sessions": {
+		{Keys: bson.D{{Key: "sessionid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "last_seen_at", Value: -1}}},
+	},
+	"login_failures": {
+		{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "at", Value: -1}}},
+	},
+	"search": {
+		{Keys: bson.D{{Key: "title", Value: "text"}, {Key: "keywords", Value: "text"}, {Key: "body", Value: "text"}},
+			Options: options.Index().SetName("search_text").SetDefaultLanguage("none").
+				SetWeights(bson.M{"title": 10, "keywords": 5, "body": 1})},
+		{Keys: bson.D{{Key: "terms", Value: 1}}},
+	},
+	"api_keys": {
+		{Keys: bson.D{{Key: "keyid", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userid", Value: 1}, {Key: "created_at", Value: -1}}},
+	},
+}
+
+// migrateMongo brings db up to date: pending migrations, then indexes.
+func migrateMongo(ctx context.Context, db *mongo.Database) error {
+	coll := db.Collection(migrationsCollection)
+	release, err := lockMigrations(ctx, coll)
+	if err != nil {
+		return fmt.Errorf("taking the migration lock: %w", err)
+	}
+	defer release()
+
+	if err := applyMigrations(ctx, db, coll); err != nil {
+		return err
+	}
+	return ensureIndexes(ctx, db)
+}
+
+// lockMigrations waits until this instance holds the migration lock.
+func lockMigrations(ctx context.Context, coll *mongo.Collection) (release func(), err error) {
+	owner := randomToken(12)
+	waiting := false
+	for {
+		now := time.Now()
+		filter := bson.M{"_id": migrationLockID, "locked_until": bson.M{"$lt": now}}
+		update := bson.M{"$set": bson.M{"owner": owner, "locked_until": now.Add(migrationLockTTL)}}
+		_, err := coll.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		if err == nil {
+			break
+		}
+		// The upsert collides with a lock somebody else holds
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		if !waiting {
+			log.Println("Waiting for another instance to finish migrating the database")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := coll.DeleteOne(ctx, bson.M{"_id": migrationLockID, "owner": owner}); err != nil {
+			log.Printf("Failed to release the migration lock: %v", err)
+		}
+	}, nil
+}
+
+// applyMigrations runs the migrations that aren't recorded in coll yet.
+func applyMigrations(ctx context.Context, db *mongo.Database, coll *mongo.Collection) error {
+	var applied []struct {
+		Version int `bson:"_id"`
+	}
+	if err := findAll(ctx, coll, bson.M{"_id": bson.M{"$type": "number"}}, &applied); err != nil {
+		return fmt.Errorf("reading applied migrations: %w", err)
+	}
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+
+	for _, m := range migrations {
+		if done[m.Version] {
+			continue
+		}
+		log.Printf("Applying migration %d: %s", m.Version, m.Name)
+		start := time.Now()
+		if err := m.Up(ctx, db); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		record := bson.M{"_id": m.Version, "name": m.Name, "applied_at": time.Now().UTC()}
+		if _, err := coll.InsertOne(ctx, record); err != nil {
+			return fmt.Errorf("recording migration %d: %w", m.Version, err)
+		}
+		log.Printf("Applied migration %d in %s", m.Version, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// ensureIndexes creates any missing index. Creating an index that already
+// exists with the same options does nothing, so this runs on every start.
+// A unique index the data breaks is logged and skipped rather than keeping
+// the server from starting, since restarting won't fix the data.
+func ensureIndexes(ctx context.Context, db *mongo.Database) error {
+	for name, models := range collectionIndexes {
+		for _, model := range models {
+			_, err := db.Collection(name).Indexes().CreateOne(ctx, model)
+			if mongo.IsDuplicateKeyError(err) {
+				log.Printf("Not creating the unique index %v on %s: some documents share a key (%v); remove the duplicates and restart", model.Keys, name, err)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("creating indexes on %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeUserKeys lowercases usernames and emails stored before they
+// were normalized on the way in. An account whose lowercased name or email
+// belongs to someone else keeps its own, since the unique indexes would
+// otherwise fail to build, and is recorded in users_key_clashes for an
+// admin to rename. Until then it signs in by its exact name (see
+// findLoginUser).
+func normalizeUserKeys(ctx context.Context, db *mongo.Database) error {
+	coll := db.Collection("users")
+	var users []User
+	if err := findAll(ctx, coll, bson.M{}, &users); err != nil {
+		return err
+	}
+	for _, user := range users {
+		set := bson.M{}
+		if username := normalizeUsername(user.Username); username != user.Username {
+			set["username"] = username
+		}
+		if email := normalizeEmail(user.Email); email != user.Email {
+			set["email"] = email
+		}
+		if len(set) == 0 {
+			continue
+		}
+
+		var clash []bson.M
+		for field, value := range set {
+			clash = append(clash, bson.M{field: value})
+		}
+		var others []User
+		if err := findAll(ctx, coll, bson.M{"userid": bson.M{"$ne": user.UserID}, "$or": clash}, &others); err != nil {
+			return err
+		}
+		if len(others) > 0 {
+			if err := recordUserKeyClash(ctx, db, user, others); err != nil {
+				return err
+			}
+			log.Printf("Not normalizing user %s (%q, %q): another account already uses the lowercased name or email; see %s", user.UserID, user.Username, user.Email, userKeyClashesCollection)
+			continue
+		}
+		if _, err := coll.UpdateOne(ctx, bson.M{"userid": user.UserID}, bson.M{"$set": set}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordUserKeyClash notes in users_key_clashes that user couldn't be
+// normalized because of others.
+func recordUserKeyClash(ctx context.Context, db *mongo.Database, user User, others []User) error {
+	ids := make([]string, 0, len(others))
+	for _, other := range others {
+		ids = append(ids, other.UserID)
+	}
+	_, err := db.Collection(userKeyClashesCollection).UpdateOne(ctx,
+		bson.M{"userid": user.UserID},
+		bson.M{"$set": bson.M{
+			"userid":       user.UserID,
+			"username":     user.Username,
+			"email":        user.Email,
+			"clashes_with": ids,
+			"found_at":     time.Now().UTC(),
+		}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// backfillCreatedAt sets the creation time of events and places that were
+// saved without one to the time in their ObjectID.
+func backfillCreatedAt(ctx context.Context, db *mongo.Database) error {
+	for coll, field := range map[string]string{"events": "created_at", "places": "created"} {
+		filter := bson.M{"$or": bson.A{
+			bson.M{field: bson.M{"$exists": false}},
+			bson.M{field: time.Time{}},
+		}}
+		var docs []struct {
+			ID interface{} `bson:"_id"`
+		}
+		if err := findAll(ctx, db.Collection(coll), filter, &docs); err != nil {
+			return err
+		}
+		for _, doc := range docs {
+			id, ok := doc.ID.(primitive.ObjectID)
+			if !ok {
+				continue // No creation time to recover
+			}
+			update := bson.M{"$set": bson.M{field: id.Timestamp().UTC()}}
+			if _, err := db.Collection(coll).UpdateOne(ctx, bson.M{"_id": id}, update); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// backfillTicketSummaries stores the ticket count and price range of every
+// event, which used to be worked out from the tickets each time.
+func backfillTicketSummaries(ctx context.Context, db *mongo.Database) error {
+	var events []struct {
+		EventID string `bson:"eventid"`
+	}
+	if err := findAll(ctx, db.Collection("events"), bson.M{}, &events); err != nil {
+		return err
+	}
+	for _, event := range events {
+		var tickets []Ticket
+		if err := findAll(ctx, db.Collection("ticks"), bson.M{"eventid": event.EventID}, &tickets); err != nil {
+			return err
+		}
+		minPrice, maxPrice := priceRange(tickets)
+		update := bson.M{"$set": bson.M{"ticket_types": len(tickets), "min_price": minPrice, "max_price": maxPrice}}
+		if _, err := db.Collection("events").UpdateOne(ctx, bson.M{"eventid": event.EventID}, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillPlaceLocations gives places saved with coordinates the GeoJSON
+// location geo queries use.
+func backfillPlaceLocations(ctx context.Context, db *mongo.Database) error {
+	coll := db.Collection("places")
+	filter := bson.M{"location": bson.M{"$exists": false}, "coordinates": bson.M{"$exists": true}}
+	var places []Place
+	if err := findAll(ctx, coll, filter, &places); err != nil {
+		return err
+	}
+	for _, place := range places {
+		c := place.Coordinates
+		if c == (Coordinates{}) || !validLatLng(c.Latitude, c.Longitude) {
+			continue
+		}
+		update := bson.M{"$set": bson.M{"location": newGeoPoint(c.Latitude, c.Longitude)}}
+		if _, err := coll.UpdateOne(ctx, bson.M{"placeid": place.PlaceID}, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeEventStatuses publishes events whose status was free text, or
+// missing, before events had a lifecycle. The scheduler then takes those
+// that have already started on to live or ended.
+func normalizeEventStatuses(ctx context.Context, db *mongo.Database) error {
+	var known []string
+	for status := range eventTransitions {
+		known = append(known, status)
+	}
+	known = append(known, EventEnded, EventCancelled)
+	filter := bson.M{"status": bson.M{"$nin": known}}
+	update := bson.A{bson.M{"$set": bson.M{
+		"status":            EventPublished,
+		"published_at":      "$created_at",
+		"status_changed_at": "$created_at",
+	}}}
+	_, err := db.Collection("events").UpdateMany(ctx, filter, update)
+	return err
+}
+
+// setAsideDuplicateUsers moves every account that shares its userid,
+// username or email with an older one into users_duplicates, so the unique
+// indexes on users can be built. Each is logged for an admin to merge by
+// hand; normalizeUserKeys never makes such clashes, but older data can
+// have them.
+func setAsideDuplicateUsers(ctx context.Context, db *mongo.Database) error {
+	coll := db.Collection("users")
+	aside := db.Collection(duplicateUsersCollection)
+	keys := []struct {
+		field string
+		match bson.M
+	}{
+		{"userid", bson.M{}},
+		{"username", bson.M{}},
+		// Only non-empty emails have to be unique
+		{"email", bson.M{"email": bson.M{"$type": "string", "$gt": ""}}},
+	}
+	for _, key := range keys {
+		// ObjectIDs grow with time, so the first of each group is the oldest
+		pipeline := mongo.Pipeline{
+			bson.D{{Key: "$match", Value: key.match}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+			bson.D{{Key: "$group", Value: bson.M{"_id": "$" + key.field, "ids": bson.M{"$push": "$_id"}}}},
+			bson.D{{Key: "$match", Value: bson.M{"ids.1": bson.M{"$exists": true}}}},
+		}
+		cursor, err := coll.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+		if err != nil {
+			return err
+		}
+		var groups []struct {
+			Value interface{}   `bson:"_id"`
+			IDs   []interface{} `bson:"ids"`
+		}
+		if err := cursor.All(ctx, &groups); err != nil {
+			return err
+		}
+		for _, group := range groups {
+			for _, id := range group.IDs[1:] {
+				if err := setAsideUser(ctx, coll, aside, id, key.field); err != nil {
+					return err
+				}
+				log.Printf("Set aside user %v: its %s %v is also used by an older account; it is in %s until merged", id, key.field, group.Value, duplicateUsersCollection)
+			}
+		}
+	}
+	return nil
+}
+
+// setAsideUser moves the user with _id id from coll to aside.
+func setAsideUser(ctx context.Context, coll, aside *mongo.Collection, id interface{}, field string) error {
+	var doc bson.M
+	if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&doc); err != nil {
+		return mongoErr(err)
+	}
+	doc["duplicate_key"] = field
+	doc["set_aside_at"] = time.Now().UTC()
+	// A run that was interrupted may have copied it already
+	if _, err := aside.InsertOne(ctx, doc); err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	_, err := coll.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
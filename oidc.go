@@ -0,0 +1,718 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
+)
+
+// oidcStateCookie carries the state, nonce and PKCE verifier of a sign-in
+// between the redirect to the provider and the callback.
+const (
+	oidcStateCookie = "naevis_oidc"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+// jwksRefreshInterval limits how often an unknown key ID makes us refetch
+// a provider's keys.
+const jwksRefreshInterval = time.Minute
+
+var (
+	errOIDCState     = errors.New("sign-in state is missing, expired or does not match")
+	errIdentityTaken = errors.New("identity is linked to another account")
+)
+
+var providerNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+func validProviderName(name string) bool {
+	return providerNamePattern.MatchString(name)
+}
+
+// oidcHTTPClient talks to identity providers.
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcProviders holds the configured providers by name; set in main.
+var oidcProviders = map[string]*oidcProvider{}
+
+// oidcDiscovery is the part of a provider's discovery document we use.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider is a client for one OpenID Connect provider. Discovery and
+// signing keys are fetched on first use and cached.
+type oidcProvider struct {
+	name string
+	cfg  OIDCProviderConfig
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// newOIDCProviders builds a client for each configured provider.
+func newOIDCProviders(cfg OIDCConfig, publicURL string) map[string]*oidcProvider {
+	providers := make(map[string]*oidcProvider, len(cfg.Providers))
+	for name, p := range cfg.Providers {
+		pc := *p
+		if pc.RedirectURL == "" {
+			pc.RedirectURL = strings.TrimRight(publicURL, "/") + "/api/oidc/" + name + "/callback"
+		}
+		providers[name] = &oidcProvider{name: name, cfg: pc}
+	}
+	return providers
+}
+
+// getJSON fetches url and decodes the JSON body into out.
+func getJSON(ctx context.Context, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+func (p *oidcProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	issuer := strings.TrimRight(p.cfg.Issuer, "/")
+	if err := getJSON(ctx, issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	// The document must be about the issuer we asked, or ID tokens from
+	// some other issuer could be passed off as this one's
+	if strings.TrimRight(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document of %s is incomplete", p.cfg.Issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// jwk is one key of a JSON Web Key Set. Only signature keys of the RSA and
+// EC types are understood.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("EC key is not on its curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// key returns the provider's signing key with ID kid. Providers rotate
+// keys, so an unknown ID triggers a refetch, at most once a minute.
+func (p *oidcProvider) key(ctx context.Context, d *oidcDiscovery, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("no signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keysFetched = time.Now()
+	p.keys = make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping key %q of %s: %v", k.Kid, p.name, err)
+			continue
+		}
+		p.keys[k.Kid] = key
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no signing key %q", kid)
+}
+
+// authCodeURL is where the browser is sent to sign in.
+func (p *oidcProvider) authCodeURL(d *oidcDiscovery, state, nonce, verifier, loginHint string) string {
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.cfg.ClientID)
+	v.Set("redirect_uri", p.cfg.RedirectURL)
+	v.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", pkceChallenge(verifier))
+	v.Set("code_challenge_method", "S256")
+	if loginHint != "" {
+		v.Set("login_hint", loginHint)
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode()
+}
+
+// pkceChallenge is the S256 code challenge for verifier (RFC 7636).
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// exchange trades an authorization code for the provider's ID token.
+func (p *oidcProvider) exchange(ctx context.Context, d *oidcDiscovery, code, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.cfg.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %s: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s: %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("token endpoint returned no ID token")
+	}
+	return body.IDToken, nil
+}
+
+// flexBool accepts both true and "true"; some providers send
+// email_verified as a string.
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	*b = flexBool(strings.Trim(string(data), `"`) == "true")
+	return nil
+}
+
+// idTokenClaims is what we read from a verified ID token.
+type idTokenClaims struct {
+	Nonce             string   `json:"nonce"`
+	AuthorizedParty   string   `json:"azp"`
+	Email             string   `json:"email"`
+	EmailVerified     flexBool `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+	jwt.RegisteredClaims
+}
+
+// verifyIDToken checks the signature and claims of an ID token as OpenID
+// Connect Core 3.1.3.7 requires.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, d *oidcDiscovery, raw, nonce string) (*idTokenClaims, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, d, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("ID token has no subject")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.cfg.ClientID {
+		return nil, fmt.Errorf("ID token was issued to %q", claims.AuthorizedParty)
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+// oidcState is kept in a signed cookie for the length of one sign-in.
+type oidcState struct {
+	Provider   string    `json:"p"`
+	State      string    `json:"s"`
+	Nonce      string    `json:"n"`
+	Verifier   string    `json:"v"`
+	LinkUserID string    `json:"l,omitempty"` // Set when an existing account is linking a new identity
+	Expires    time.Time `json:"e"`
+}
+
+func oidcStateKey() []byte {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("oidc state"))
+	return mac.Sum(nil)
+}
+
+// startOIDC sets the state cookie for a sign-in with p and returns the URL
+// to send the browser to.
+func startOIDC(w http.ResponseWriter, r *http.Request, p *oidcProvider, linkUserID string) (string, error) {
+	d, err := p.discover(r.Context())
+	if err != nil {
+		return "", err
+	}
+	st := oidcState{
+		Provider:   p.name,
+		State:      randomToken(16),
+		Nonce:      randomToken(16),
+		Verifier:   randomToken(32),
+		LinkUserID: linkUserID,
+		Expires:    time.Now().Add(oidcStateTTL),
+	}
+	raw, _ := json.Marshal(st)
+	encoded := base64.RawURLEncoding.EncodeToString(raw)
+	mac := hmac.New(sha256.New, oidcStateKey())
+	mac.Write([]byte(encoded))
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    encoded + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)),
+		Path:     "/api/oidc/",
+		MaxAge:   int(oidcStateTTL / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.PublicURL, "https://"),
+		SameSite: http.SameSiteLaxMode, // The callback arrives as a cross-site top-level navigation
+	})
+	return p.authCodeURL(d, st.State, st.Nonce, st.Verifier, r.URL.Query().Get("login_hint")), nil
+}
+
+// readOIDCState checks the state cookie against the callback's state
+// parameter and clears it, so each sign-in completes at most once.
+func readOIDCState(w http.ResponseWriter, r *http.Request, provider string) (oidcState, error) {
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/api/oidc/", MaxAge: -1, HttpOnly: true})
+
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		return oidcState{}, errOIDCState
+	}
+	encoded, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return oidcState{}, errOIDCState
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return oidcState{}, errOIDCState
+	}
+	mac := hmac.New(sha256.New, oidcStateKey())
+	mac.Write([]byte(encoded))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return oidcState{}, errOIDCState
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return oidcState{}, errOIDCState
+	}
+	var st oidcState
+	if err := json.Unmarshal(raw, &st); err != nil {
+		return oidcState{}, errOIDCState
+	}
+	if st.Provider != provider || time.Now().After(st.Expires) ||
+		subtle.ConstantTimeCompare([]byte(st.State), []byte(r.URL.Query().Get("state"))) != 1 {
+		return oidcState{}, errOIDCState
+	}
+	return st, nil
+}
+
+// getOIDCProviders lists the providers users can sign in with
+func getOIDCProviders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	names := make([]string, 0, len(oidcProviders))
+	for name := range oidcProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	providers := make([]map[string]string, 0, len(names))
+	for _, name := range names {
+		providers = append(providers, map[string]string{
+			"name":      name,
+			"login_url": "/api/oidc/" + name + "/login",
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(providers)
+}
+
+// oidcLogin redirects the browser to the provider to sign in
+func oidcLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	p, ok := oidcProviders[ps.ByName("provider")]
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+	authURL, err := startOIDC(w, r, p, "")
+	if err != nil {
+		log.Printf("Failed to start sign-in with %s: %v", p.name, err)
+		http.Error(w, "Identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcLink starts linking a provider account to the caller's account. It
+// returns the URL to open, since a redirect can't carry the bearer token.
+func oidcLink(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+	p, ok := oidcProviders[ps.ByName("provider")]
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+	authURL, err := startOIDC(w, r, p, userID)
+	if err != nil {
+		log.Printf("Failed to start linking with %s: %v", p.name, err)
+		http.Error(w, "Identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	sendResponse(w, http.StatusOK, map[string]string{"url": authURL}, "Open the URL to link your account", nil)
+}
+
+// oidcCallback finishes a sign-in or link started by oidcLogin or oidcLink.
+// A sign-in answers like login does.
+func oidcCallback(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	p, ok := oidcProviders[ps.ByName("provider")]
+	if !ok {
+		http.Error(w, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+	st, err := readOIDCState(w, r, p.name)
+	if err != nil {
+		http.Error(w, "Sign-in has expired, please start again", http.StatusBadRequest)
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "Sign-in was not completed: "+e, http.StatusUnauthorized)
+		return
+	}
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	d, err := p.discover(r.Context())
+	if err != nil {
+		log.Printf("Discovery for %s failed: %v", p.name, err)
+		http.Error(w, "Identity provider is unavailable", http.StatusBadGateway)
+		return
+	}
+	rawIDToken, err := p.exchange(r.Context(), d, code, st.Verifier)
+	if err != nil {
+		log.Printf("Code exchange with %s failed: %v", p.name, err)
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+	claims, err := p.verifyIDToken(r.Context(), d, rawIDToken, st.Nonce)
+	if err != nil {
+		log.Printf("Rejected ID token from %s: %v", p.name, err)
+		http.Error(w, "Sign-in failed", http.StatusUnauthorized)
+		return
+	}
+	identity := Identity{
+		Provider: p.name,
+		Issuer:   d.Issuer,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+		LinkedAt: time.Now().UTC(),
+	}
+
+	if st.LinkUserID != "" {
+		user, err := linkIdentity(r.Context(), st.LinkUserID, identity)
+		switch err {
+		case nil:
+			sendResponse(w, http.StatusOK, map[string]interface{}{"identities": user.Identities}, "Account linked", nil)
+		case errIdentityTaken:
+			http.Error(w, "That account is already linked to another user", http.StatusConflict)
+		case ErrNotFound:
+			http.Error(w, "User not found", http.StatusNotFound)
+		default:
+			http.Error(w, "Failed to link account", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	user, err := oidcUser(r.Context(), identity, claims)
+	if err != nil {
+		log.Printf("Failed to sign in %s identity %s: %v", p.name, claims.Subject, err)
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+	if user.TOTPEnabled {
+		requireSecondFactor(w, user)
+		return
+	}
+	finishLogin(w, r, user)
+}
+
+// oidcUser finds the user an identity belongs to. An unknown identity is
+// linked to the account with the same email if both the provider and we
+// have verified that address, and otherwise gets a new account.
+func oidcUser(ctx context.Context, identity Identity, claims *idTokenClaims) (User, error) {
+	user, err := stores.Users.GetByIdentity(ctx, identity.Issuer, identity.Subject)
+	if err != ErrNotFound {
+		return user, err
+	}
+
+	email := normalizeEmail(claims.Email)
+	if email != "" && bool(claims.EmailVerified) {
+		user, err := stores.Users.GetByEmail(ctx, email)
+		if err == nil && user.IsVerified {
+			return linkIdentity(ctx, user.UserID, identity)
+		}
+		if err != nil && err != ErrNotFound {
+			return User{}, err
+		}
+	}
+
+	now := time.Now()
+	user = User{
+		UserID:     "u" + GenerateName(10),
+		Name:       claims.Name,
+		Email:      email,
+		Role:       RoleUser,
+		IsVerified: email != "" && bool(claims.EmailVerified),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Identities: []Identity{identity},
+	}
+	// The email may belong to an unverified local account; leave it off
+	// rather than fail the sign-in
+	if _, err := stores.Users.GetByEmail(ctx, user.Email); err == nil {
+		user.Email, user.IsVerified = "", false
+	}
+	base := usernameFor(claims)
+	for i := 0; i < 5; i++ {
+		user.Username = base
+		if i > 0 {
+			user.Username = base + "_" + strings.ToLower(GenerateName(4))
+		}
+		bootstrapAdmin(&user)
+		err = stores.Users.Create(ctx, user)
+		if err != ErrDuplicate {
+			break
+		}
+	}
+	if err != nil {
+		return User{}, err
+	}
+	log.Printf("Created user %s for %s identity %s", user.Username, identity.Provider, identity.Subject)
+	if !user.IsVerified {
+		sendVerificationEmail(user)
+	}
+	return user, nil
+}
+
+// usernameFor suggests a username from an ID token.
+func usernameFor(claims *idTokenClaims) string {
+	candidate := claims.PreferredUsername
+	if candidate == "" {
+		candidate, _, _ = strings.Cut(claims.Email, "@")
+	}
+	var b strings.Builder
+	for _, r := range strings.ToLower(candidate) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' || r == '.' || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	// Leave room for the suffix added when the name is taken
+	username := strings.TrimLeft(b.String(), "_.-")
+	if len(username) > 24 {
+		username = username[:24]
+	}
+	if !validUsername(username) {
+		return "user" + strings.ToLower(GenerateName(6))
+	}
+	return username
+}
+
+// linkIdentity adds identity to the user's account. Linking an identity
+// the user already has is a no-op.
+func linkIdentity(ctx context.Context, userID string, identity Identity) (User, error) {
+	owner, err := stores.Users.GetByIdentity(ctx, identity.Issuer, identity.Subject)
+	if err == nil && owner.UserID != userID {
+		return User{}, errIdentityTaken
+	}
+	if err == nil {
+		return owner, nil
+	}
+	if err != ErrNotFound {
+		return User{}, err
+	}
+
+	user, err := stores.Users.GetByUserID(ctx, userID)
+	if err != nil {
+		return User{}, err
+	}
+	user.Identities = append(user.Identities, identity)
+	user.UpdatedAt = time.Now()
+	if err := stores.Users.Update(ctx, user); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// getIdentities lists the external accounts linked to the caller
+func getIdentities(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, ok := loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	identities := user.Identities
+	if identities == nil {
+		identities = []Identity{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(identities)
+}
+
+// unlinkIdentity removes the caller's identities at :provider. The last
+// way to sign in can't be removed.
+func unlinkIdentity(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, ok := loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	var kept []Identity
+	for _, id := range user.Identities {
+		if id.Provider != ps.ByName("provider") {
+			kept = append(kept, id)
+		}
+	}
+	if len(kept) == len(user.Identities) {
+		http.Error(w, "No linked account for that provider", http.StatusNotFound)
+		return
+	}
+	if len(kept) == 0 && user.Password == "" {
+		http.Error(w, "Set a password before removing your last linked account", http.StatusConflict)
+		return
+	}
+
+	user.Identities = kept
+	user.UpdatedAt = time.Now()
+	if err := stores.Users.Update(r.Context(), user); err != nil {
+		http.Error(w, "Failed to unlink account", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, map[string]interface{}{"identities": kept}, "Account unlinked", nil)
+}
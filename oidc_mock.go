@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
+)
+
+// mockOIDCProvider is the name the mock issuer is enabled under.
+const mockOIDCProvider = "mock"
+
+// mockOIDCPath is where the mock issuer is served.
+const mockOIDCPath = "/mock-oidc"
+
+// mockOIDCDefaultEmail signs in when the login URL has no login_hint.
+const mockOIDCDefaultEmail = "alice@example.com"
+
+// MockOIDCIssuer is a minimal OpenID Connect provider for development and
+// tests, much like FakePaymentProvider is for payments. It has no login
+// page: /authorize approves straight away as whoever login_hint names.
+// Everything else (discovery, PKCE, signed ID tokens, JWKS) behaves like a
+// real provider, so the client is exercised end to end.
+type MockOIDCIssuer struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	key *rsa.PrivateKey
+	kid string
+
+	mu    sync.Mutex
+	codes map[string]mockAuthCode
+}
+
+type mockAuthCode struct {
+	clientID    string
+	redirectURI string
+	nonce       string
+	challenge   string
+	email       string
+	expires     time.Time
+}
+
+// NewMockOIDCIssuer creates an issuer with a fresh signing key and client
+// credentials.
+func NewMockOIDCIssuer(issuer string) (*MockOIDCIssuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return &MockOIDCIssuer{
+		Issuer:       issuer,
+		ClientID:     "naevis-dev",
+		ClientSecret: randomToken(24),
+		key:          key,
+		kid:          randomToken(8),
+		codes:        make(map[string]mockAuthCode),
+	}, nil
+}
+
+// Routes mounts the issuer's endpoints under mockOIDCPath.
+func (m *MockOIDCIssuer) Routes(router *httprouter.Router) {
+	router.GET(mockOIDCPath+"/.well-known/openid-configuration", m.discovery)
+	router.GET(mockOIDCPath+"/authorize", m.authorize)
+	router.POST(mockOIDCPath+"/token", m.token)
+	router.GET(mockOIDCPath+"/jwks", m.jwks)
+}
+
+// ProviderConfig is the client configuration that talks to this issuer.
+func (m *MockOIDCIssuer) ProviderConfig() *OIDCProviderConfig {
+	return &OIDCProviderConfig{
+		Issuer:       m.Issuer,
+		ClientID:     m.ClientID,
+		ClientSecret: m.ClientSecret,
+		Scopes:       []string{"openid", "email", "profile"},
+	}
+}
+
+func (m *MockOIDCIssuer) discovery(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                m.Issuer,
+		"authorization_endpoint":                m.Issuer + "/authorize",
+		"token_endpoint":                        m.Issuer + "/token",
+		"jwks_uri":                              m.Issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (m *MockOIDCIssuer) authorize(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if q.Get("client_id") != m.ClientID || q.Get("response_type") != "code" {
+		http.Error(w, "unauthorized_client", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+
+	email := q.Get("login_hint")
+	if email == "" {
+		email = mockOIDCDefaultEmail
+	}
+	code := randomToken(24)
+	m.mu.Lock()
+	m.codes[code] = mockAuthCode{
+		clientID:    m.ClientID,
+		redirectURI: redirectURI.String(),
+		nonce:       q.Get("nonce"),
+		challenge:   q.Get("code_challenge"),
+		email:       email,
+		expires:     time.Now().Add(time.Minute),
+	}
+	m.mu.Unlock()
+
+	v := redirectURI.Query()
+	v.Set("code", code)
+	v.Set("state", q.Get("state"))
+	redirectURI.RawQuery = v.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (m *MockOIDCIssuer) token(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tokenError := func(code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError("unsupported_grant_type")
+		return
+	}
+
+	clientID, secret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != m.ClientID || subtle.ConstantTimeCompare([]byte(secret), []byte(m.ClientSecret)) != 1 {
+		tokenError("invalid_client")
+		return
+	}
+
+	// Codes are single use, found or not
+	m.mu.Lock()
+	grant, found := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+	if !found || time.Now().After(grant.expires) || grant.clientID != clientID ||
+		grant.redirectURI != r.PostForm.Get("redirect_uri") ||
+		pkceChallenge(r.PostForm.Get("code_verifier")) != grant.challenge {
+		tokenError("invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	local, _, _ := strings.Cut(grant.email, "@")
+	claims := idTokenClaims{
+		Nonce:             grant.nonce,
+		Email:             grant.email,
+		EmailVerified:     true,
+		Name:              local,
+		PreferredUsername: local,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.Issuer,
+			Subject:   "mock-" + hashSecret(grant.email)[:16],
+			Audience:  jwt.ClaimStrings{clientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = m.kid
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		http.Error(w, "server_error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": randomToken(24),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (m *MockOIDCIssuer) jwks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	pub := m.key.PublicKey
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": m.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
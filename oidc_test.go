@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// useMockOIDC serves the OIDC routes and a MockOIDCIssuer from one test
+// server, enabled as the "mock" provider, and returns the server.
+func useMockOIDC(t *testing.T) *httptest.Server {
+	t.Helper()
+	useMemoryStores(t)
+	oldProviders := oidcProviders
+	t.Cleanup(func() { oidcProviders = oldProviders })
+
+	router := httprouter.New()
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+
+	issuer, err := NewMockOIDCIssuer(srv.URL + mockOIDCPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.Routes(router)
+	router.GET("/api/oidc/:provider/login", oidcLogin)
+	router.GET("/api/oidc/:provider/callback", oidcCallback)
+
+	config.PublicURL = srv.URL
+	config.OIDC.Providers = map[string]*OIDCProviderConfig{mockOIDCProvider: issuer.ProviderConfig()}
+	oidcProviders = newOIDCProviders(config.OIDC, config.PublicURL)
+	return srv
+}
+
+// oidcSignIn follows a whole sign-in as email, from the login redirect to
+// the callback, and returns the callback's response code and tokens.
+func oidcSignIn(t *testing.T, srv *httptest.Server, email string) (int, tokenPair) {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	resp, err := client.Get(srv.URL + "/api/oidc/" + mockOIDCProvider + "/login?login_hint=" + url.QueryEscape(email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data tokenPair `json:"data"`
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode, body.Data
+}
+
+func TestOIDCMockSignIn(t *testing.T) {
+	srv := useMockOIDC(t)
+	ctx := context.Background()
+	if err := stores.Users.Create(ctx, User{UserID: "u-local", Username: "carol", Email: "carol@example.com", Role: RoleUser, IsVerified: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Users.Create(ctx, User{UserID: "u-unverified", Username: "dave", Email: "dave@example.com", Role: RoleUser}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		email      string
+		wantUserID string // Empty for a new account
+		wantEmail  string
+	}{
+		{"creates an account for a new identity", "alice@example.com", "", "alice@example.com"},
+		{"links a verified account with the same email", "carol@example.com", "u-local", "carol@example.com"},
+		{"leaves an unverified account alone", "dave@example.com", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, pair := oidcSignIn(t, srv, tt.email)
+			if code != http.StatusOK {
+				t.Fatalf("sign-in = %d, want %d", code, http.StatusOK)
+			}
+			if pair.Token == "" || pair.RefreshToken == "" {
+				t.Errorf("sign-in issued no tokens: %+v", pair)
+			}
+			if tt.wantUserID != "" && pair.UserID != tt.wantUserID {
+				t.Errorf("signed in as %s, want %s", pair.UserID, tt.wantUserID)
+			}
+			if tt.wantUserID == "" && (pair.UserID == "u-local" || pair.UserID == "u-unverified") {
+				t.Errorf("signed in as existing user %s, want a new account", pair.UserID)
+			}
+
+			user, err := stores.Users.GetByUserID(ctx, pair.UserID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Email != tt.wantEmail {
+				t.Errorf("email = %q, want %q", user.Email, tt.wantEmail)
+			}
+			if len(user.Identities) != 1 || user.Identities[0].Provider != mockOIDCProvider {
+				t.Errorf("identities = %+v, want one from %s", user.Identities, mockOIDCProvider)
+			}
+
+			// Signing in again finds the same account
+			code, again := oidcSignIn(t, srv, tt.email)
+			if code != http.StatusOK || again.UserID != pair.UserID {
+				t.Errorf("second sign-in = %d as %s, want %d as %s", code, again.UserID, http.StatusOK, pair.UserID)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackNeedsState(t *testing.T) {
+	srv := useMockOIDC(t)
+
+	// A callback without the state cookie from the login is refused
+	resp, err := http.Get(srv.URL + "/api/oidc/" + mockOIDCProvider + "/callback?code=x&state=y")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	resp, err = http.Get(srv.URL + "/api/oidc/nope/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("login with an unknown provider = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
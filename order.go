@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// newOrderItem builds an order line and its subtotal.
+func newOrderItem(itemType, itemID, name string, unitPrice float64, quantity int) OrderItem {
+	return OrderItem{
+		Type:      itemType,
+		ItemID:    itemID,
+		Name:      name,
+		UnitPrice: unitPrice,
+		Quantity:  quantity,
+		Subtotal:  unitPrice * float64(quantity),
+	}
+}
+
+// buildOrder assembles a new order for the given items, totalling them.
+func buildOrder(userID, eventID, status string, items ...OrderItem) Order {
+	now := time.Now()
+	order := Order{
+		OrderID:   generateID(16),
+		UserID:    userID,
+		EventID:   eventID,
+		Items:     items,
+		Status:    status,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	for _, item := range items {
+		order.Total += item.Subtotal
+	}
+	return order
+}
+
+// getOrders lists the requesting user's orders, newest first
+func getOrders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	orders, err := stores.Orders.ListByUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
+		return
+	}
+	if len(orders) == 0 {
+		orders = []Order{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+// getOrder returns a single order belonging to the requesting user
+func getOrder(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	order, err := stores.Orders.Get(r.Context(), ps.ByName("orderid"))
+	// Someone else's order is reported as missing rather than forbidden so
+	// order IDs can't be probed
+	if err == ErrNotFound || (err == nil && order.UserID != userID) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+// getEventOrders lists every order placed for an event. Only the event's
+// organizers may see them.
+func getEventOrders(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	eventID := ps.ByName("eventid")
+
+	orders, err := stores.Orders.ListByEvent(r.Context(), eventID)
+	if err != nil {
+		log.Printf("Failed to list orders for event %s: %v", eventID, err)
+		http.Error(w, "Failed to fetch orders", http.StatusInternalServerError)
+		return
+	}
+	if len(orders) == 0 {
+		orders = []Order{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+// refundOrder refunds a completed order for an event and returns its items
+// to sale. Only the event's organizers may issue refunds.
+func refundOrder(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	eventID := ps.ByName("eventid")
+
+	order, err := stores.Orders.Get(r.Context(), ps.ByName("orderid"))
+	if err == ErrNotFound || (err == nil && order.EventID != eventID) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch order", http.StatusInternalServerError)
+		return
+	}
+
+	// Claim the order first so two refunds can't both go through
+	err = stores.Orders.UpdateStatus(r.Context(), order.OrderID, OrderStatusCompleted, OrderStatusRefunded)
+	if err == ErrConflict {
+		http.Error(w, "Only completed orders can be refunded", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to refund order", http.StatusInternalServerError)
+		return
+	}
+
+	if order.PaymentID != "" {
+		if err := payments.Refund(r.Context(), order.PaymentID, 0); err != nil {
+			log.Printf("Refund of order %s failed: %v", order.OrderID, err)
+			stores.Orders.UpdateStatus(r.Context(), order.OrderID, OrderStatusRefunded, OrderStatusCompleted)
+			http.Error(w, "Payment provider refused the refund", http.StatusBadGateway)
+			return
+		}
+	}
+	voidOrderTickets(r.Context(), order)
+	releaseOrderStock(r.Context(), order)
+
+	order.Status = OrderStatusRefunded
+	sendResponse(w, http.StatusOK, order, "Order refunded", nil)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Errors a PaymentProvider reports for failed charges.
+var (
+	ErrPaymentDeclined  = errors.New("payment declined")
+	ErrPaymentTimeout   = errors.New("payment provider timed out")
+	ErrPaymentPending   = errors.New("payment outcome unknown; order left pending")
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+)
+
+const (
+	PaymentRequiresCapture = "requires_capture"
+	PaymentSucceeded       = "succeeded"
+	PaymentRefunded        = "refunded"
+)
+
+// Webhook event types understood by handlePaymentWebhook.
+const (
+	PaymentEventSucceeded = "payment.succeeded"
+	PaymentEventFailed    = "payment.failed"
+	PaymentEventRefunded  = "payment.refunded"
+)
+
+// PaymentIntent is a provider-side record of an amount we intend to charge.
+type PaymentIntent struct {
+	ID       string            `json:"id"`
+	Amount   float64           `json:"amount"`
+	Currency string            `json:"currency"`
+	Status   string            `json:"status"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// PaymentEvent is a verified notification sent by the provider.
+type PaymentEvent struct {
+	Type     string `json:"type"`
+	IntentID string `json:"intent_id"`
+	OrderID  string `json:"order_id"`
+}
+
+// PaymentProvider is implemented by each payment gateway integration.
+type PaymentProvider interface {
+	// CreateIntent reserves an amount to be charged; metadata is echoed
+	// back in webhook events.
+	CreateIntent(ctx context.Context, amount float64, currency string, metadata map[string]string) (PaymentIntent, error)
+	// Capture charges a previously created intent.
+	Capture(ctx context.Context, intentID string) (PaymentIntent, error)
+	// Refund returns amount of a captured intent to the buyer; an amount
+	// of 0 refunds the whole charge.
+	Refund(ctx context.Context, intentID string, amount float64) error
+	// VerifyWebhook checks signature against payload and decodes the event.
+	VerifyWebhook(payload []byte, signature string) (PaymentEvent, error)
+}
+
+// payments is the provider used by the purchase handlers; set in main.
+var payments PaymentProvider
+
+// newPaymentProvider builds the provider selected in the configuration.
+func newPaymentProvider(cfg PaymentConfig) (PaymentProvider, error) {
+	switch cfg.Provider {
+	case "fake":
+		return NewFakePaymentProvider(cfg.FakeMode, cfg.WebhookSecret), nil
+	default:
+		return nil, fmt.Errorf("unknown payment provider %q", cfg.Provider)
+	}
+}
+
+// chargeOrder takes payment for a pending order. The order is saved before
+// the charge so a webhook can always find it, and is marked completed once
+// the capture succeeds. A failed capture marks it failed, and the caller
+// must give back any held stock unless ownsStock says otherwise: a capture
+// that timed out leaves the order pending (ErrPaymentPending) for the
+// webhook or sweepPendingOrders, and an order a webhook failed first
+// returns ErrConflict, with any captured money refunded.
+func chargeOrder(ctx context.Context, order Order) (Order, error) {
+	order.Status = OrderStatusPending
+	order.Currency = config.Payments.Currency
+
+	// Free orders don't need a payment step
+	if order.Total == 0 {
+		order.Status = OrderStatusCompleted
+		return order, stores.Orders.Create(ctx, order)
+	}
+
+	payCtx, cancel := context.WithTimeout(ctx, config.Payments.Timeout)
+	defer cancel()
+
+	intent, err := payments.CreateIntent(payCtx, order.Total, order.Currency, map[string]string{
+		"orderid": order.OrderID,
+		"userid":  order.UserID,
+		"eventid": order.EventID,
+	})
+	if err != nil {
+		return order, paymentError(payCtx, err)
+	}
+	order.PaymentID = intent.ID
+
+	// Nothing has been captured yet, so a failed save costs the buyer nothing
+	if err := stores.Orders.Create(ctx, order); err != nil {
+		return order, err
+	}
+
+	if _, err := payments.Capture(payCtx, intent.ID); err != nil {
+		// The capture may yet go through; the provider's webhook decides
+		if err = paymentError(payCtx, err); err == ErrPaymentTimeout {
+			return order, ErrPaymentPending
+		}
+		// Only the side that fails the order gives back its stock
+		switch uerr := stores.Orders.UpdateStatus(ctx, order.OrderID, OrderStatusPending, OrderStatusFailed); uerr {
+		case nil:
+			order.Status = OrderStatusFailed
+			return order, err
+		case ErrConflict:
+			return order, ErrConflict
+		default:
+			log.Printf("Failed to mark order %s failed: %v", order.OrderID, uerr)
+			return order, ErrPaymentPending
+		}
+	}
+
+	// The money is taken; from here on the stock is never the caller's to
+	// give back
+	err = stores.Orders.UpdateStatus(ctx, order.OrderID, OrderStatusPending, OrderStatusCompleted)
+	if err == ErrConflict {
+		// A webhook settled the order first. If it failed the order, its
+		// stock is already back on sale, so the charge must go back too
+		stored, err := stores.Orders.Get(ctx, order.OrderID)
+		if err != nil {
+			log.Printf("Failed to reload order %s after capture: %v", order.OrderID, err)
+			return order, ErrPaymentPending
+		}
+		if stored.Status == OrderStatusCompleted {
+			order.Status = OrderStatusCompleted
+			return order, nil
+		}
+		refundFailedCharge(ctx, stored)
+		order.Status = stored.Status
+		return order, ErrConflict
+	}
+	if err != nil {
+		log.Printf("Failed to mark order %s completed: %v", order.OrderID, err)
+		return order, ErrPaymentPending
+	}
+	order.Status = OrderStatusCompleted
+	return order, nil
+}
+
+// refundFailedCharge returns money captured for an order that has already
+// failed and given back its stock. Moving the order on to refunded first
+// means only one caller sends the refund.
+func refundFailedCharge(ctx context.Context, order Order) {
+	if err := stores.Orders.UpdateStatus(ctx, order.OrderID, OrderStatusFailed, OrderStatusRefunded); err != nil {
+		if err != ErrConflict {
+			log.Printf("Failed to mark order %s refunded: %v", order.OrderID, err)
+		}
+		return
+	}
+	if err := payments.Refund(ctx, order.PaymentID, 0); err != nil {
+		log.Printf("Failed to refund payment %s of failed order %s; refund it by hand: %v", order.PaymentID, order.OrderID, err)
+	}
+}
+
+// sweepPendingOrders fails orders whose payment never settled, every
+// interval until ctx is done.
+func sweepPendingOrders(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n, err := expirePendingOrders(ctx, now.Add(-config.Payments.PendingTTL)); err != nil {
+				log.Printf("Pending order sweep failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Failed %d orders whose payment never settled", n)
+			}
+		}
+	}
+}
+
+// expirePendingOrders marks orders still pending since before cutoff as
+// failed and puts their stock back on sale. A capture that settles later
+// is refunded by the webhook. It returns how many orders were failed.
+func expirePendingOrders(ctx context.Context, cutoff time.Time) (int, error) {
+	const batch = 100
+	failed := 0
+	for {
+		stale, err := stores.Orders.ListPending(ctx, cutoff, batch)
+		if err != nil {
+			return failed, err
+		}
+		for _, order := range stale {
+			// Losing the race to a webhook is fine; skip it
+			err := stores.Orders.UpdateStatus(ctx, order.OrderID, OrderStatusPending, OrderStatusFailed)
+			if err == ErrConflict || err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return failed, err
+			}
+			releaseOrderStock(ctx, order)
+			failed++
+		}
+		if len(stale) < batch {
+			return failed, nil
+		}
+	}
+}
+
+// ownsStock reports whether the caller of chargeOrder still holds the
+// order's stock after it failed with err, and so must give it back.
+func ownsStock(err error) bool {
+	return err != ErrPaymentPending && err != ErrConflict
+}
+
+// releaseOrderStock puts every item of an order back on sale.
+func releaseOrderStock(ctx context.Context, order Order) {
+	for _, item := range order.Items {
+		switch item.Type {
+		case OrderItemTicket:
+			restoreTickets(ctx, order.EventID, item.ItemID, item.Quantity)
+		case OrderItemMerch:
+			if err := stores.Merch.AdjustStock(ctx, order.EventID, item.ItemID, item.Quantity); err != nil && err != ErrNotFound {
+				log.Printf("Failed to restore %d units of merch %s: %v", item.Quantity, item.ItemID, err)
+			}
+		}
+	}
+}
+
+// writePaymentError responds to a failed charge.
+func writePaymentError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrPaymentDeclined:
+		sendResponse(w, http.StatusPaymentRequired, nil, "Payment was declined", err)
+	case ErrPaymentTimeout:
+		sendResponse(w, http.StatusGatewayTimeout, nil, "Payment provider did not respond", err)
+	case ErrPaymentPending:
+		sendResponse(w, http.StatusGatewayTimeout, nil, "Payment provider did not respond; the order stays pending until it does", err)
+	case ErrConflict:
+		sendResponse(w, http.StatusConflict, nil, "The payment provider settled the order first", err)
+	default:
+		log.Printf("Payment failed: %v", err)
+		http.Error(w, "Payment failed", http.StatusInternalServerError)
+	}
+}
+
+// handlePaymentWebhook applies asynchronous payment outcomes reported by
+// the provider. Status changes are conditional, so replays are harmless.
+func handlePaymentWebhook(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+	event, err := payments.VerifyWebhook(payload, r.Header.Get("X-Payment-Signature"))
+	if err != nil {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	order, err := stores.Orders.Get(r.Context(), event.OrderID)
+	if err != nil || order.PaymentID != event.IntentID {
+		http.Error(w, "Unknown order", http.StatusNotFound)
+		return
+	}
+
+	switch event.Type {
+	case PaymentEventSucceeded:
+		err = stores.Orders.UpdateStatus(r.Context(), order.OrderID, OrderStatusPending, OrderStatusCompleted)
+		if err == nil {
+			issueOrderTickets(r.Context(), order)
+		}
+		// The order failed before the charge landed; give the money back
+		if err == ErrConflict {
+			if current, gerr := stores.Orders.Get(r.Context(), order.OrderID); gerr == nil && current.Status == OrderStatusFailed {
+				refundFailedCharge(r.Context(), current)
+			}
+		}
+	case PaymentEventFailed:
+		err = stores.Orders.UpdateStatus(r.Context(), order.OrderID, OrderStatusPending, OrderStatusFailed)
+		if err == nil {
+			releaseOrderStock(r.Context(), order)
+		}
+	case PaymentEventRefunded:
+		err = stores.Orders.UpdateStatus(r.Context(), order.OrderID, OrderStatusCompleted, OrderStatusRefunded)
+		if err == nil {
+			voidOrderTickets(r.Context(), order)
+			releaseOrderStock(r.Context(), order)
+		}
+	default:
+		log.Printf("Ignoring payment event %q", event.Type)
+	}
+	if err != nil && err != ErrConflict {
+		http.Error(w, "Failed to apply payment event", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// paymentError maps a context deadline into ErrPaymentTimeout.
+func paymentError(ctx context.Context, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrPaymentTimeout
+	}
+	return err
+}
+
+// signWebhook returns the signature a provider using secret would attach to
+// payload: hex encoded HMAC-SHA256.
+func signWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Modes for FakePaymentProvider.
+const (
+	FakePaymentSucceed = "succeed"
+	FakePaymentDecline = "decline"
+	FakePaymentTimeout = "timeout"
+)
+
+// FakePaymentProvider is an offline, deterministic provider. In "succeed"
+// mode every charge goes through, "decline" rejects every capture and
+// "timeout" blocks captures until the caller's deadline passes. Intent IDs are
+// sequential so runs are reproducible.
+type FakePaymentProvider struct {
+	mode   string
+	secret string
+
+	mu      sync.Mutex
+	next    int
+	intents map[string]*PaymentIntent
+}
+
+func NewFakePaymentProvider(mode, webhookSecret string) *FakePaymentProvider {
+	return &FakePaymentProvider{mode: mode, secret: webhookSecret, intents: make(map[string]*PaymentIntent)}
+}
+
+func (p *FakePaymentProvider) CreateIntent(ctx context.Context, amount float64, currency string, metadata map[string]string) (PaymentIntent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.next++
+	intent := &PaymentIntent{
+		ID:       fmt.Sprintf("pi_fake_%06d", p.next),
+		Amount:   amount,
+		Currency: currency,
+		Status:   PaymentRequiresCapture,
+		Metadata: metadata,
+	}
+	p.intents[intent.ID] = intent
+	return *intent, nil
+}
+
+func (p *FakePaymentProvider) Capture(ctx context.Context, intentID string) (PaymentIntent, error) {
+	if err := p.maybeHang(ctx); err != nil {
+		return PaymentIntent{}, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return PaymentIntent{}, fmt.Errorf("unknown payment intent %s", intentID)
+	}
+	if p.mode == FakePaymentDecline {
+		return *intent, ErrPaymentDeclined
+	}
+	intent.Status = PaymentSucceeded
+	return *intent, nil
+}
+
+func (p *FakePaymentProvider) Refund(ctx context.Context, intentID string, amount float64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return fmt.Errorf("unknown payment intent %s", intentID)
+	}
+	intent.Status = PaymentRefunded
+	return nil
+}
+
+func (p *FakePaymentProvider) VerifyWebhook(payload []byte, signature string) (PaymentEvent, error) {
+	expected := signWebhook(p.secret, payload)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return PaymentEvent{}, ErrInvalidSignature
+	}
+	var event PaymentEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return PaymentEvent{}, err
+	}
+	return event, nil
+}
+
+// maybeHang simulates an unresponsive gateway in timeout mode.
+func (p *FakePaymentProvider) maybeHang(ctx context.Context) error {
+	if p.mode != FakePaymentTimeout {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Hour):
+		return ErrPaymentTimeout
+	}
+}
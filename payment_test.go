@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// usePaymentMode swaps in a fake provider in mode, with a short timeout.
+func usePaymentMode(mode string) {
+	config.Payments.Timeout = 50 * time.Millisecond
+	payments = NewFakePaymentProvider(mode, config.Payments.WebhookSecret)
+}
+
+// sendPaymentEvent delivers a signed webhook and returns the response code.
+func sendPaymentEvent(t *testing.T, event PaymentEvent) int {
+	t.Helper()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/payments/webhook", bytes.NewReader(payload))
+	r.Header.Set("X-Payment-Signature", signWebhook(config.Payments.WebhookSecret, payload))
+	w := httptest.NewRecorder()
+	handlePaymentWebhook(w, r, nil)
+	return w.Code
+}
+
+// stockOf returns the quantity left of ticket t1 of event e1.
+func stockOf(t *testing.T) int {
+	t.Helper()
+	ticket, err := stores.Tickets.Get(context.Background(), "e1", "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ticket.Quantity
+}
+
+func TestChargeOrder(t *testing.T) {
+	tests := []struct {
+		mode       string
+		wantErr    error
+		wantStatus string
+		ownsStock  bool
+	}{
+		{FakePaymentSucceed, nil, OrderStatusCompleted, false},
+		{FakePaymentDecline, ErrPaymentDeclined, OrderStatusFailed, true},
+		{FakePaymentTimeout, ErrPaymentPending, OrderStatusPending, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			useMemoryStores(t)
+			usePaymentMode(tt.mode)
+			ctx := context.Background()
+
+			item := newOrderItem(OrderItemTicket, "t1", "GA", 10, 2)
+			order, err := chargeOrder(ctx, buildOrder("u1", "e1", OrderStatusPending, item))
+			if err != tt.wantErr {
+				t.Fatalf("chargeOrder() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && ownsStock(err) != tt.ownsStock {
+				t.Errorf("ownsStock(%v) = %v, want %v", err, !tt.ownsStock, tt.ownsStock)
+			}
+			stored, err := stores.Orders.Get(ctx, order.OrderID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Status != tt.wantStatus {
+				t.Errorf("stored order is %s, want %s", stored.Status, tt.wantStatus)
+			}
+			if stored.PaymentID == "" {
+				t.Error("stored order has no payment ID")
+			}
+		})
+	}
+}
+
+func TestBuyTicketPaymentFailures(t *testing.T) {
+	const stock = 5
+	setup := func(t *testing.T, mode string) {
+		useMemoryStores(t)
+		usePaymentMode(mode)
+		ctx := context.Background()
+		if err := stores.Events.Create(ctx, Event{EventID: "e1", Title: "Show", Status: EventPublished}); err != nil {
+			t.Fatal(err)
+		}
+		if err := stores.Tickets.Create(ctx, Ticket{TicketID: "t1", EventID: "e1", Name: "GA", Price: 10, Quantity: stock}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	onlyOrder := func(t *testing.T) Order {
+		t.Helper()
+		orders, err := stores.Orders.ListByEvent(context.Background(), "e1")
+		if err != nil || len(orders) != 1 {
+			t.Fatalf("orders = %v, %v; want one", orders, err)
+		}
+		return orders[0]
+	}
+
+	t.Run("decline gives the tickets back", func(t *testing.T) {
+		setup(t, FakePaymentDecline)
+		if code := buyTicketAs("u1", "e1", "t1", 2); code != http.StatusPaymentRequired {
+			t.Fatalf("buy = %d, want %d", code, http.StatusPaymentRequired)
+		}
+		if got := stockOf(t); got != stock {
+			t.Errorf("stock = %d, want %d", got, stock)
+		}
+		order := onlyOrder(t)
+		if order.Status != OrderStatusFailed {
+			t.Errorf("order is %s, want failed", order.Status)
+		}
+
+		// A late failure webhook must not give them back again
+		if code := sendPaymentEvent(t, PaymentEvent{Type: PaymentEventFailed, IntentID: order.PaymentID, OrderID: order.OrderID}); code != http.StatusNoContent {
+			t.Errorf("webhook = %d, want %d", code, http.StatusNoContent)
+		}
+		if got := stockOf(t); got != stock {
+			t.Errorf("stock after webhook = %d, want %d", got, stock)
+		}
+	})
+
+	t.Run("timeout leaves the order to the webhook", func(t *testing.T) {
+		setup(t, FakePaymentTimeout)
+		if code := buyTicketAs("u1", "e1", "t1", 2); code != http.StatusGatewayTimeout {
+			t.Fatalf("buy = %d, want %d", code, http.StatusGatewayTimeout)
+		}
+		if got := stockOf(t); got != stock-2 {
+			t.Errorf("stock = %d, want %d while the payment is pending", got, stock-2)
+		}
+		order := onlyOrder(t)
+		if order.Status != OrderStatusPending {
+			t.Fatalf("order is %s, want pending", order.Status)
+		}
+
+		// The provider reports the failure; replays change nothing
+		event := PaymentEvent{Type: PaymentEventFailed, IntentID: order.PaymentID, OrderID: order.OrderID}
+		for i := 0; i < 2; i++ {
+			if code := sendPaymentEvent(t, event); code != http.StatusNoContent {
+				t.Errorf("webhook = %d, want %d", code, http.StatusNoContent)
+			}
+			if got := stockOf(t); got != stock {
+				t.Errorf("stock after webhook %d = %d, want %d", i+1, got, stock)
+			}
+		}
+	})
+
+	t.Run("webhook that fails a declined order first", func(t *testing.T) {
+		setup(t, FakePaymentDecline)
+		payments = &webhookFirstProvider{FakePaymentProvider: payments.(*FakePaymentProvider), t: t}
+		if code := buyTicketAs("u1", "e1", "t1", 2); code != http.StatusConflict {
+			t.Fatalf("buy = %d, want %d", code, http.StatusConflict)
+		}
+		if got := stockOf(t); got != stock {
+			t.Errorf("stock = %d, want %d, given back once", got, stock)
+		}
+		if order := onlyOrder(t); order.Status != OrderStatusFailed {
+			t.Errorf("order is %s, want failed", order.Status)
+		}
+	})
+
+	t.Run("webhook that fails a captured order first", func(t *testing.T) {
+		setup(t, FakePaymentSucceed)
+		fake := payments.(*FakePaymentProvider)
+		payments = &webhookFirstProvider{FakePaymentProvider: fake, t: t}
+		if code := buyTicketAs("u1", "e1", "t1", 2); code != http.StatusConflict {
+			t.Fatalf("buy = %d, want %d", code, http.StatusConflict)
+		}
+		if got := stockOf(t); got != stock {
+			t.Errorf("stock = %d, want %d, given back once", got, stock)
+		}
+		order := onlyOrder(t)
+		if order.Status != OrderStatusRefunded {
+			t.Errorf("order is %s, want refunded", order.Status)
+		}
+		if status := fake.intents[order.PaymentID].Status; status != PaymentRefunded {
+			t.Errorf("payment is %s, want refunded", status)
+		}
+		instances, err := stores.TicketInstances.ListByHolder(context.Background(), "u1")
+		if err != nil || len(instances) != 0 {
+			t.Errorf("issued %d tickets (%v) for a failed order, want none", len(instances), err)
+		}
+	})
+
+	t.Run("pending orders expire", func(t *testing.T) {
+		setup(t, FakePaymentTimeout)
+		fake := payments.(*FakePaymentProvider)
+		if code := buyTicketAs("u1", "e1", "t1", 2); code != http.StatusGatewayTimeout {
+			t.Fatalf("buy = %d, want %d", code, http.StatusGatewayTimeout)
+		}
+		ctx := context.Background()
+		if n, err := expirePendingOrders(ctx, time.Now().Add(-config.Payments.PendingTTL)); err != nil || n != 0 {
+			t.Errorf("early sweep failed %d orders (%v), want none", n, err)
+		}
+		if n, err := expirePendingOrders(ctx, time.Now().Add(time.Second)); err != nil || n != 1 {
+			t.Fatalf("sweep failed %d orders (%v), want 1", n, err)
+		}
+		if got := stockOf(t); got != stock {
+			t.Errorf("stock after the sweep = %d, want %d", got, stock)
+		}
+		order := onlyOrder(t)
+		if order.Status != OrderStatusFailed {
+			t.Fatalf("order is %s, want failed", order.Status)
+		}
+
+		// The capture lands after all; the money goes back and the stock stays
+		event := PaymentEvent{Type: PaymentEventSucceeded, IntentID: order.PaymentID, OrderID: order.OrderID}
+		if code := sendPaymentEvent(t, event); code != http.StatusNoContent {
+			t.Errorf("webhook = %d, want %d", code, http.StatusNoContent)
+		}
+		if order := onlyOrder(t); order.Status != OrderStatusRefunded {
+			t.Errorf("order after a late capture is %s, want refunded", order.Status)
+		}
+		if status := fake.intents[order.PaymentID].Status; status != PaymentRefunded {
+			t.Errorf("payment is %s, want refunded", status)
+		}
+		if got := stockOf(t); got != stock {
+			t.Errorf("stock after the late capture = %d, want %d", got, stock)
+		}
+	})
+}
+
+// webhookFirstProvider delivers the payment.failed webhook for an intent
+// before its capture returns, as a fast provider might.
+type webhookFirstProvider struct {
+	*FakePaymentProvider
+	t *testing.T
+}
+
+func (p *webhookFirstProvider) Capture(ctx context.Context, intentID string) (PaymentIntent, error) {
+	intent, err := p.FakePaymentProvider.Capture(ctx, intentID)
+	event := PaymentEvent{Type: PaymentEventFailed, IntentID: intentID, OrderID: intent.Metadata["orderid"]}
+	if code := sendPaymentEvent(p.t, event); code != http.StatusNoContent {
+		p.t.Errorf("webhook = %d, want %d", code, http.StatusNoContent)
+	}
+	return intent, err
+}
@@ -1,16 +1,16 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func createPlace(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -26,19 +26,26 @@ func createPlace(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	address := r.FormValue("address")
 	description := r.FormValue("description")
 
-	// Validate that required fields are not empty
-	if name == "" || address == "" || description == "" {
-		http.Error(w, "All fields are required", http.StatusBadRequest)
-		return
-	}
-
 	// Create a new Place instance
 	place := Place{
 		Name:        name,
 		Address:     address,
 		Description: description,
-		PlaceID:     generateID(14), // Assuming you have a function to generate a unique ID
 	}
+	coords, problem := formCoordinates(r)
+	if problem != "" {
+		writeValidationErrors(w, FieldErrors{"coordinates": problem})
+		return
+	}
+	if coords != nil {
+		place.setCoordinates(coords.Latitude, coords.Longitude)
+	}
+	if errs := validate(place); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	place.PlaceID = generateID(14)
+	place.CreatedAt = time.Now()
 
 	// Get the ID of the requesting user from the context
 	requestingUserID, ok := r.Context().Value(userIDKey).(string)
@@ -58,13 +65,13 @@ func createPlace(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	// Check if the file exists and is valid
 	if bannerFile != nil {
 		// Ensure the directory exists
-		if err := os.MkdirAll("./placepic", os.ModePerm); err != nil {
+		if err := os.MkdirAll(config.Uploads.PlacePics, os.ModePerm); err != nil {
 			http.Error(w, "Error creating directory for banner", http.StatusInternalServerError)
 			return
 		}
 
 		// Save the banner image
-		out, err := os.Create("./placepic/" + place.PlaceID + ".jpg")
+		out, err := os.Create(uploadPath(config.Uploads.PlacePics, place.PlaceID+".jpg"))
 		if err != nil {
 			http.Error(w, "Error saving banner", http.StatusInternalServerError)
 			return
@@ -81,9 +88,8 @@ func createPlace(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		place.Banner = place.PlaceID + ".jpg"
 	}
 
-	// Insert the new place into MongoDB
-	collection := client.Database("eventdb").Collection("places")
-	_, err = collection.InsertOne(context.TODO(), place)
+	// Save the new place
+	err = stores.Places.Create(r.Context(), place)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -96,63 +102,84 @@ func createPlace(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	}
 }
 
+// getPlaces lists places. Given near or bbox (see parseGeoQuery) it lists
+// only the places there, nearest first with their distance in metres.
 func getPlaces(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	// Set the response header to indicate JSON content type
-	w.Header().Set("Content-Type", "application/json")
-
-	collection := client.Database("eventdb").Collection("places")
-
-	// Find all places
-	cursor, err := collection.Find(context.TODO(), bson.M{})
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	values := r.URL.Query()
+	errs := FieldErrors{}
+	geo := parseGeoQuery(values, errs)
+	if geo != nil {
+		geo.Limit = defaultGeoPageSize
+		if s := values.Get("limit"); s != "" {
+			limit, err := strconv.Atoi(s)
+			if err != nil || limit < 1 || limit > maxGeoPageSize {
+				errs.add("limit", fmt.Sprintf("must be a whole number from 1 to %d", maxGeoPageSize))
+			}
+			geo.Limit = limit
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
 		return
 	}
-	defer cursor.Close(context.TODO())
 
 	var places []Place
-	if err = cursor.All(context.TODO(), &places); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var err error
+	if geo != nil {
+		places, err = stores.Places.Search(r.Context(), *geo)
+	} else {
+		places, err = stores.Places.List(r.Context())
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch places", http.StatusInternalServerError)
 		return
 	}
+	if places == nil {
+		places = []Place{}
+	}
 
-	// Encode the list of places as JSON and write to the response
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(places)
 }
 
+// formCoordinates reads the latitude and longitude form values, which
+// come together or not at all.
+func formCoordinates(r *http.Request) (coords *Coordinates, problem string) {
+	lat, lng := r.FormValue("latitude"), r.FormValue("longitude")
+	if lat == "" && lng == "" {
+		return nil, ""
+	}
+	if lat == "" || lng == "" {
+		return nil, "latitude and longitude must be given together"
+	}
+	c, err := parseFloats(lat+","+lng, 2)
+	if err != nil || !validLatLng(c[0], c[1]) {
+		return nil, "latitude must be -90 to 90 and longitude -180 to 180"
+	}
+	return &Coordinates{Latitude: c[0], Longitude: c[1]}, ""
+}
+
 func getPlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	placeID := ps.ByName("placeid")
-	collection := client.Database("eventdb").Collection("places")
-	var place Place
-	if place.Merch == nil {
-		place.Merch = []Merch{}
-	}
-	err := collection.FindOne(context.TODO(), bson.M{"placeid": placeID}).Decode(&place)
+	place, err := stores.Places.Get(r.Context(), placeID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	if place.Merch == nil {
+		place.Merch = []Merch{}
+	}
 	log.Println("\n\n\n\n\n", place)
 	json.NewEncoder(w).Encode(place)
 }
 
 func editPlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	placeID := ps.ByName("placeid")
-	var place Place
-
-	// Retrieve the ID of the requesting user from the context
-	requestingUserID, ok := r.Context().Value(userIDKey).(string)
-	if !ok {
-		http.Error(w, "Invalid user", http.StatusUnauthorized)
-		return
-	}
-	log.Println("Requesting User ID:", requestingUserID)
 
-	// Get the existing place from the database to check ownership
-	collection := client.Database("eventdb").Collection("places")
-	err := collection.FindOne(context.TODO(), bson.M{"placeid": placeID}).Decode(&place)
+	// Get the existing place
+	place, err := stores.Places.Get(r.Context(), placeID)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if err == ErrNotFound {
 			http.Error(w, "Place not found", http.StatusNotFound)
 		} else {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -160,10 +187,8 @@ func editPlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		return
 	}
 
-	// Ensure the place was created by the requesting user
-	if place.CreatedBy != requestingUserID {
-		http.Error(w, "You are not authorized to edit this place", http.StatusForbidden)
-		return
+	if requestingUserID, ok := r.Context().Value(userIDKey).(string); ok {
+		place.UpdatedBy = requestingUserID
 	}
 
 	// Parse the multipart form
@@ -178,12 +203,20 @@ func editPlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	place.Address = r.FormValue("address")
 	place.Description = r.FormValue("description")
 	place.PlaceID = placeID // Ensure we keep the same ID
+	coords, problem := formCoordinates(r)
+	if problem != "" {
+		writeValidationErrors(w, FieldErrors{"coordinates": problem})
+		return
+	}
+	if coords != nil {
+		place.setCoordinates(coords.Latitude, coords.Longitude)
+	}
 
-	// Check if required fields are not empty
-	if place.Name == "" || place.Address == "" || place.Description == "" {
-		http.Error(w, "All fields are required", http.StatusBadRequest)
+	if errs := validate(place); len(errs) > 0 {
+		writeValidationErrors(w, errs)
 		return
 	}
+	place.UpdatedAt = time.Now()
 
 	// Handle the banner file upload
 	bannerFile, _, err := r.FormFile("banner")
@@ -199,14 +232,14 @@ func editPlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 	if bannerFile != nil {
 		// Ensure the directory exists
-		err := os.MkdirAll("./placepic", os.ModePerm)
+		err := os.MkdirAll(config.Uploads.PlacePics, os.ModePerm)
 		if err != nil {
 			http.Error(w, "Error creating directory for banner", http.StatusInternalServerError)
 			return
 		}
 
 		// Save the banner file
-		out, err := os.Create("./placepic/" + place.PlaceID + ".jpg")
+		out, err := os.Create(uploadPath(config.Uploads.PlacePics, place.PlaceID+".jpg"))
 		if err != nil {
 			http.Error(w, "Error saving banner", http.StatusInternalServerError)
 			return
@@ -220,8 +253,8 @@ func editPlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		place.Banner = place.PlaceID + ".jpg" // Set the path to the banner
 	}
 
-	// Update the place in MongoDB
-	_, err = collection.UpdateOne(context.TODO(), bson.M{"placeid": placeID}, bson.M{"$set": place})
+	// Save the updated place
+	err = stores.Places.Update(r.Context(), place)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -237,36 +270,13 @@ func editPlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 func deletePlace(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	placeID := ps.ByName("placeid")
-	var place Place
-
-	// Get the ID of the requesting user from the context
-	requestingUserID, ok := r.Context().Value(userIDKey).(string)
-	if !ok {
-		http.Error(w, "Invalid user", http.StatusBadRequest)
-		return
-	}
-	// log.Println("Requesting User ID:", requestingUserID)
-
-	// Get the place from the database using placeID
-	collection := client.Database("eventdb").Collection("places")
-	err := collection.FindOne(context.TODO(), bson.M{"placeid": placeID}).Decode(&place)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "Place not found", http.StatusNotFound)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return
-	}
 
-	// Check if the place was created by the requesting user
-	if place.CreatedBy != requestingUserID {
-		http.Error(w, "You are not authorized to delete this place", http.StatusForbidden)
+	// Delete the place
+	err := stores.Places.Delete(r.Context(), placeID)
+	if err == ErrNotFound {
+		http.Error(w, "Place not found", http.StatusNotFound)
 		return
 	}
-
-	// Delete the place from MongoDB
-	_, err = collection.DeleteOne(context.TODO(), bson.M{"placeid": placeID})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
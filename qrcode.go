@@ -0,0 +1,504 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// A minimal QR code encoder (ISO/IEC 18004) supporting byte mode at every
+// version and error correction level. It exists so ticket credentials can
+// be rendered as scannable PNGs without pulling in another dependency.
+
+// QR error correction levels.
+const (
+	qrLevelL = iota
+	qrLevelM
+	qrLevelQ
+	qrLevelH
+)
+
+var errQRTooLong = errors.New("qrcode: data too long")
+
+// Error correction codewords per block, indexed by [level][version].
+var qrECCPerBlock = [4][41]int{
+	{-1, 7, 10, 15, 20, 26, 18, 20, 24, 30, 18, 20, 24, 26, 30, 22, 24, 28, 30, 28, 28, 28, 28, 30, 30, 26, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28},
+	{-1, 13, 22, 18, 26, 18, 24, 18, 22, 20, 24, 28, 26, 24, 20, 30, 24, 28, 28, 26, 30, 28, 30, 30, 30, 30, 28, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+	{-1, 17, 28, 22, 16, 22, 28, 26, 26, 24, 28, 24, 28, 22, 24, 24, 30, 28, 28, 26, 28, 30, 24, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+}
+
+// Number of error correction blocks, indexed by [level][version].
+var qrNumBlocks = [4][41]int{
+	{-1, 1, 1, 1, 1, 1, 2, 2, 2, 2, 4, 4, 4, 4, 4, 6, 6, 6, 6, 7, 8, 8, 9, 9, 10, 12, 12, 12, 13, 14, 15, 16, 17, 18, 19, 19, 20, 21, 22, 24, 25},
+	{-1, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49},
+	{-1, 1, 1, 2, 2, 4, 4, 6, 6, 8, 8, 8, 10, 12, 16, 12, 17, 16, 18, 21, 20, 23, 23, 25, 27, 29, 34, 34, 35, 38, 40, 43, 45, 48, 51, 53, 56, 59, 62, 65, 68},
+	{-1, 1, 1, 2, 4, 4, 4, 5, 6, 8, 8, 11, 11, 16, 16, 18, 16, 19, 21, 25, 25, 25, 34, 30, 32, 35, 37, 40, 42, 45, 48, 51, 54, 57, 60, 63, 66, 70, 74, 77, 81},
+}
+
+// Format bits identify levels in the order L, M, Q, H.
+var qrFormatBits = [4]int{1, 0, 3, 2}
+
+// qrCode is an encoded symbol; modules[y][x] is true for dark modules.
+type qrCode struct {
+	size    int
+	modules [][]bool
+	isFunc  [][]bool
+}
+
+// encodeQR encodes data in byte mode at the smallest version that fits.
+func encodeQR(data []byte, level int) (*qrCode, error) {
+	version := 0
+	for v := 1; v <= 40; v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= qrNumDataCodewords(v, level)*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+
+	// Segment header and payload
+	var bits qrBitBuffer
+	bits.append(0x4, 4) // Byte mode
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+
+	// Terminator, byte alignment and pad codewords
+	capacity := qrNumDataCodewords(version, level) * 8
+	bits.append(0, min(4, capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	codewords := make([]byte, len(bits)/8)
+	for i, bit := range bits {
+		codewords[i>>3] |= byte(bit) << (7 - uint(i&7))
+	}
+
+	qr := newQRCode(version)
+	qr.drawFunctionPatterns(version, level)
+	qr.drawCodewords(qrAddECCAndInterleave(codewords, version, level))
+
+	// Pick the mask with the lowest penalty
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormatBits(level, mask)
+		if p := qr.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		qr.applyMask(mask) // XOR again to undo
+	}
+	qr.applyMask(best)
+	qr.drawFormatBits(level, best)
+	return qr, nil
+}
+
+// writeQRPNG renders qr as a PNG with the given module size in pixels and
+// the standard four module quiet zone.
+func writeQRPNG(w io.Writer, qr *qrCode, scale int) error {
+	const border = 4
+	dim := (qr.size + 2*border) * scale
+	img := image.NewPaletted(image.Rect(0, 0, dim, dim), color.Palette{color.White, color.Black})
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if !qr.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+border)*scale+dx, (y+border)*scale+dy, 1)
+				}
+			}
+		}
+	}
+	return png.Encode(w, img)
+}
+
+type qrBitBuffer []byte
+
+func (b *qrBitBuffer) append(val, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, byte(val>>uint(i)&1))
+	}
+}
+
+func newQRCode(version int) *qrCode {
+	size := version*4 + 17
+	qr := &qrCode{size: size, modules: make([][]bool, size), isFunc: make([][]bool, size)}
+	for i := range qr.modules {
+		qr.modules[i] = make([]bool, size)
+		qr.isFunc[i] = make([]bool, size)
+	}
+	return qr
+}
+
+func (qr *qrCode) setFunc(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.isFunc[y][x] = true
+}
+
+func (qr *qrCode) drawFunctionPatterns(version, level int) {
+	// Timing patterns
+	for i := 0; i < qr.size; i++ {
+		qr.setFunc(6, i, i%2 == 0)
+		qr.setFunc(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns in three corners
+	qr.drawFinder(3, 3)
+	qr.drawFinder(qr.size-4, 3)
+	qr.drawFinder(3, qr.size-4)
+
+	// Alignment patterns, skipping those overlapping the finders
+	pos := qrAlignmentPositions(version)
+	n := len(pos)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if (i == 0 && j == 0) || (i == 0 && j == n-1) || (i == n-1 && j == 0) {
+				continue
+			}
+			qr.drawAlignment(pos[i], pos[j])
+		}
+	}
+
+	// Reserve the format areas with dummy bits; real ones come later
+	qr.drawFormatBits(level, 0)
+	qr.drawVersion(version)
+}
+
+func (qr *qrCode) drawFinder(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || x >= qr.size || y < 0 || y >= qr.size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			qr.setFunc(x, y, dist != 2 && dist != 4)
+		}
+	}
+}
+
+func (qr *qrCode) drawAlignment(cx, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			qr.setFunc(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+func (qr *qrCode) drawFormatBits(level, mask int) {
+	data := qrFormatBits[level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	bit := func(i int) bool { return bits>>uint(i)&1 != 0 }
+
+	// First copy, around the top left finder
+	for i := 0; i <= 5; i++ {
+		qr.setFunc(8, i, bit(i))
+	}
+	qr.setFunc(8, 7, bit(6))
+	qr.setFunc(8, 8, bit(7))
+	qr.setFunc(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.setFunc(14-i, 8, bit(i))
+	}
+
+	// Second copy, split between the other two finders
+	for i := 0; i < 8; i++ {
+		qr.setFunc(qr.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.setFunc(8, qr.size-15+i, bit(i))
+	}
+	qr.setFunc(8, qr.size-8, true) // Always dark
+}
+
+func (qr *qrCode) drawVersion(version int) {
+	if version < 7 {
+		return
+	}
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := version<<12 | rem
+	for i := 0; i < 18; i++ {
+		dark := bits>>uint(i)&1 != 0
+		a, b := qr.size-11+i%3, i/3
+		qr.setFunc(a, b, dark)
+		qr.setFunc(b, a, dark)
+	}
+}
+
+// drawCodewords places data in the zigzag order over non-function modules.
+func (qr *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < qr.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				upward := (right+1)&2 == 0
+				y := vert
+				if upward {
+					y = qr.size - 1 - vert
+				}
+				if !qr.isFunc[y][x] && i < len(data)*8 {
+					qr.modules[y][x] = data[i>>3]>>(7-uint(i&7))&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !qr.isFunc[y][x] {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol using the four rules from the specification.
+func (qr *qrCode) penalty() int {
+	const n1, n2, n3, n4 = 3, 3, 40, 10
+	result := 0
+	line := func(get func(i int) bool) {
+		runColor, runLen := false, 0
+		history := [7]int{}
+		push := func(l int) {
+			copy(history[1:], history[:6])
+			history[0] = l
+		}
+		finderLike := func() bool {
+			n := history[1]
+			core := n > 0 && history[2] == n && history[3] == n*3 && history[4] == n && history[5] == n
+			return core && (history[0] >= n*4 || history[6] >= n*4)
+		}
+		count := 0
+		for i := 0; i < qr.size; i++ {
+			if get(i) == runColor {
+				runLen++
+				if runLen == 5 {
+					result += n1
+				} else if runLen > 5 {
+					result++
+				}
+				continue
+			}
+			if runLen > 0 || i > 0 {
+				if count == 0 {
+					runLen += qr.size // Treat the edge as light quiet zone
+				}
+				push(runLen)
+				count++
+				if !runColor && finderLike() {
+					result += n3
+				}
+			}
+			runColor = get(i)
+			runLen = 1
+		}
+		// Terminate the line against the light border
+		if runColor {
+			push(runLen)
+			runLen = 0
+		}
+		runLen += qr.size
+		push(runLen)
+		if finderLike() {
+			result += n3
+		}
+	}
+	for y := 0; y < qr.size; y++ {
+		line(func(x int) bool { return qr.modules[y][x] })
+	}
+	for x := 0; x < qr.size; x++ {
+		line(func(y int) bool { return qr.modules[y][x] })
+	}
+
+	// 2x2 blocks of one colour
+	for y := 0; y < qr.size-1; y++ {
+		for x := 0; x < qr.size-1; x++ {
+			c := qr.modules[y][x]
+			if c == qr.modules[y][x+1] && c == qr.modules[y+1][x] && c == qr.modules[y+1][x+1] {
+				result += n2
+			}
+		}
+	}
+
+	// Balance of dark and light modules
+	dark := 0
+	for y := range qr.modules {
+		for _, m := range qr.modules[y] {
+			if m {
+				dark++
+			}
+		}
+	}
+	total := qr.size * qr.size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return result + k*n4
+}
+
+// qrAlignmentPositions returns the centre coordinates of alignment patterns.
+func qrAlignmentPositions(version int) []int {
+	if version == 1 {
+		return nil
+	}
+	num := version/7 + 2
+	step := (version*8 + num*3 + 5) / (num*4 - 4) * 2
+	size := version*4 + 17
+	pos := make([]int, num)
+	pos[0] = 6
+	for i, p := num-1, size-7; i >= 1; i, p = i-1, p-step {
+		pos[i] = p
+	}
+	return pos
+}
+
+// qrNumRawDataModules counts modules available for data and ECC.
+func qrNumRawDataModules(version int) int {
+	result := (16*version+128)*version + 64
+	if version >= 2 {
+		numAlign := version/7 + 2
+		result -= (25*numAlign-10)*numAlign - 55
+		if version >= 7 {
+			result -= 36
+		}
+	}
+	return result
+}
+
+func qrNumDataCodewords(version, level int) int {
+	return qrNumRawDataModules(version)/8 - qrECCPerBlock[level][version]*qrNumBlocks[level][version]
+}
+
+// qrAddECCAndInterleave splits data into blocks, appends Reed-Solomon
+// codewords to each and interleaves the result.
+func qrAddECCAndInterleave(data []byte, version, level int) []byte {
+	numBlocks := qrNumBlocks[level][version]
+	eccLen := qrECCPerBlock[level][version]
+	rawCodewords := qrNumRawDataModules(version) / 8
+	numShort := numBlocks - rawCodewords%numBlocks
+	shortLen := rawCodewords / numBlocks
+
+	divisor := qrRSDivisor(eccLen)
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i < numBlocks; i++ {
+		datLen := shortLen - eccLen
+		if i >= numShort {
+			datLen++
+		}
+		dat := data[k : k+datLen]
+		k += datLen
+		block := make([]byte, 0, shortLen+1)
+		block = append(block, dat...)
+		if i < numShort {
+			block = append(block, 0) // Padding, skipped when interleaving
+		}
+		block = append(block, qrRSRemainder(dat, divisor)...)
+		blocks[i] = block
+	}
+
+	result := make([]byte, 0, rawCodewords)
+	for i := 0; i < len(blocks[0]); i++ {
+		for j, block := range blocks {
+			if i != shortLen-eccLen || j >= numShort {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+func qrRSDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = qrGFMul(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrGFMul(root, 0x02)
+	}
+	return result
+}
+
+func qrRSRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= qrGFMul(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// qrGFMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func qrGFMul(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int(y>>uint(i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"testing"
+)
+
+// The expected values below come from ISO/IEC 18004 and its worked
+// examples, not from this encoder: the Reed-Solomon codewords of two
+// published symbols, the format and version information tables, the
+// alignment pattern positions and the byte mode capacities. Every symbol is
+// also read back by qrDecode, which finds the function patterns and the
+// data path on its own.
+
+func TestQRReedSolomon(t *testing.T) {
+	tests := []struct {
+		name       string
+		data, want []byte
+	}{
+		{
+			// ISO/IEC 18004 Annex I: "01234567" as 1-M
+			"01234567 1-M",
+			[]byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11},
+			[]byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55},
+		},
+		{
+			// "HELLO WORLD" as 1-M
+			"HELLO WORLD 1-M",
+			[]byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17},
+			[]byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := qrRSRemainder(tt.data, qrRSDivisor(len(tt.want)))
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("ECC = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// qrFormatTable is the format information after masking, by level and mask.
+var qrFormatTable = [4][8]int{
+	{0x77C4, 0x72F3, 0x7DAA, 0x789D, 0x662F, 0x6318, 0x6C41, 0x6976}, // L
+	{0x5412, 0x5125, 0x5E7C, 0x5B4B, 0x45F9, 0x40CE, 0x4F97, 0x4AA0}, // M
+	{0x355F, 0x3068, 0x3F31, 0x3A06, 0x24B4, 0x2183, 0x2EDA, 0x2BED}, // Q
+	{0x1689, 0x13BE, 0x1CE7, 0x19D0, 0x0762, 0x0255, 0x0D0C, 0x083B}, // H
+}
+
+// qrVersionTable is the version information of some versions.
+var qrVersionTable = map[int]int{7: 0x07C94, 8: 0x085BC, 9: 0x09A99, 10: 0x0A4D3, 40: 0x28C69}
+
+func TestQRFormatAndVersionBits(t *testing.T) {
+	for level := qrLevelL; level <= qrLevelH; level++ {
+		for mask := 0; mask < 8; mask++ {
+			qr := newQRCode(1)
+			qr.drawFormatBits(level, mask)
+			first, second := qrReadFormat(qr)
+			if first != qrFormatTable[level][mask] || second != first {
+				t.Errorf("level %d mask %d: format bits %015b and %015b, want %015b", level, mask, first, second, qrFormatTable[level][mask])
+			}
+		}
+	}
+	for version, want := range qrVersionTable {
+		qr := newQRCode(version)
+		qr.drawVersion(version)
+		first, second := qrReadVersion(qr)
+		if first != want || second != want {
+			t.Errorf("version %d: version bits %018b and %018b, want %018b", version, first, second, want)
+		}
+	}
+}
+
+func TestQRAlignmentPositions(t *testing.T) {
+	tests := map[int][]int{
+		1:  nil,
+		2:  {6, 18},
+		6:  {6, 34},
+		7:  {6, 22, 38},
+		10: {6, 28, 50},
+		15: {6, 26, 48, 70},
+		32: {6, 34, 60, 86, 112, 138},
+		36: {6, 24, 50, 76, 102, 128, 154},
+		40: {6, 30, 58, 86, 114, 142, 170},
+	}
+	for version, want := range tests {
+		if got := qrAlignmentPositions(version); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("version %d: alignment at %v, want %v", version, got, want)
+		}
+	}
+}
+
+// qrByteCapacity is how many bytes fit, by version and level (L, M, Q, H).
+var qrByteCapacity = map[int][4]int{
+	1:  {17, 14, 11, 7},
+	2:  {32, 26, 20, 14},
+	3:  {53, 42, 32, 24},
+	4:  {78, 62, 46, 34},
+	5:  {106, 84, 60, 44},
+	6:  {134, 106, 74, 58},
+	7:  {154, 122, 86, 64},
+	8:  {192, 152, 108, 84},
+	9:  {230, 180, 130, 98},
+	10: {271, 213, 151, 119},
+	40: {2953, 2331, 1663, 1273},
+}
+
+func TestQREncodeRoundTrip(t *testing.T) {
+	for version, capacity := range qrByteCapacity {
+		for level := qrLevelL; level <= qrLevelH; level++ {
+			n := capacity[level]
+			for _, extra := range []int{0, 1} {
+				data := make([]byte, n+extra)
+				for i := range data {
+					data[i] = byte(i*7 + version + level)
+				}
+				name := fmt.Sprintf("%d-%c/%d bytes", version, "LMQH"[level], len(data))
+				t.Run(name, func(t *testing.T) {
+					qr, err := encodeQR(data, level)
+					if version == 40 && extra == 1 {
+						if err != errQRTooLong {
+							t.Fatalf("encodeQR() error = %v, want errQRTooLong", err)
+						}
+						return
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					wantVersion := version + extra
+					if got := (qr.size - 17) / 4; got != wantVersion {
+						t.Fatalf("version = %d, want %d", got, wantVersion)
+					}
+					gotLevel, got, err := qrDecode(qr)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if gotLevel != level || !bytes.Equal(got, data) {
+						t.Errorf("decoded level %d and %x, want level %d and %x", gotLevel, got, level, data)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestQRTicketCredential(t *testing.T) {
+	token := []byte("naevis:t1:ev_0123456789abcdef:inst_0123456789abcdef.c2lnbmF0dXJlLWJ5dGVzLWdvLWhlcmU")
+	qr, err := encodeQR(token, qrLevelM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, got, err := qrDecode(qr); err != nil || !bytes.Equal(got, token) {
+		t.Fatalf("decoded %q, %v; want %q", got, err, token)
+	}
+
+	var buf bytes.Buffer
+	if err := writeQRPNG(&buf, qr, 8); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each module is 8 pixels, inside a 4 module quiet zone
+	if want := (qr.size + 8) * 8; img.Bounds().Dx() != want || img.Bounds().Dy() != want {
+		t.Errorf("image is %v, want %dx%d", img.Bounds(), want, want)
+	}
+	for _, m := range []struct {
+		x, y int
+		dark bool
+	}{{0, 0, false}, {31, 31, false}, {32, 32, true}, {32 + 8*qr.size - 1, 32, true}, {32 + 8*qr.size, 32, false}} {
+		r, _, _, _ := img.At(m.x, m.y).RGBA()
+		if dark := r == 0; dark != m.dark {
+			t.Errorf("pixel (%d, %d) dark = %v, want %v", m.x, m.y, dark, m.dark)
+		}
+	}
+}
+
+// qrReadFormat returns the two copies of the format information, most
+// significant bit first as laid out in ISO/IEC 18004 figure 25.
+func qrReadFormat(qr *qrCode) (int, int) {
+	n := qr.size
+	bit := func(v int, x, y int) int {
+		v <<= 1
+		if qr.modules[y][x] {
+			v |= 1
+		}
+		return v
+	}
+	first := 0
+	for _, x := range []int{0, 1, 2, 3, 4, 5, 7} {
+		first = bit(first, x, 8)
+	}
+	for _, y := range []int{8, 7, 5, 4, 3, 2, 1, 0} {
+		first = bit(first, 8, y)
+	}
+	second := 0
+	for y := n - 1; y >= n-7; y-- {
+		second = bit(second, 8, y)
+	}
+	for x := n - 8; x < n; x++ {
+		second = bit(second, x, 8)
+	}
+	return first, second
+}
+
+// qrReadVersion returns the two copies of the version information, most
+// significant bit first.
+func qrReadVersion(qr *qrCode) (int, int) {
+	n := qr.size
+	first, second := 0, 0
+	for i := 17; i >= 0; i-- {
+		col, row := i/3, n-11+i%3
+		first <<= 1
+		second <<= 1
+		if qr.modules[row][col] { // Bottom left
+			first |= 1
+		}
+		if qr.modules[col][row] { // Top right
+			second |= 1
+		}
+	}
+	return first, second
+}
+
+// qrDecode reads a symbol the way a scanner would once it has sampled the
+// modules: it checks the finder, timing and dark modules, reads the format
+// and version information, unmasks and reads the codewords, checks the
+// error correction of every block and decodes the byte mode segment.
+func qrDecode(qr *qrCode) (int, []byte, error) {
+	n := qr.size
+	version := (n - 17) / 4
+	m := qr.modules
+
+	// Function patterns, marked as they are checked
+	reserved := make([][]bool, n)
+	for i := range reserved {
+		reserved[i] = make([]bool, n)
+	}
+	expect := func(x, y int, dark bool) error {
+		reserved[y][x] = true
+		if m[y][x] != dark {
+			return fmt.Errorf("module (%d, %d) should be dark=%v", x, y, dark)
+		}
+		return nil
+	}
+	for _, c := range [][2]int{{0, 0}, {n - 7, 0}, {0, n - 7}} {
+		for dy := -1; dy <= 7; dy++ {
+			for dx := -1; dx <= 7; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x < 0 || y < 0 || x >= n || y >= n {
+					continue
+				}
+				ring := max(abs(dx-3), abs(dy-3))
+				if err := expect(x, y, ring != 2 && ring != 4); err != nil {
+					return 0, nil, fmt.Errorf("finder: %v", err)
+				}
+			}
+		}
+	}
+	for i := 8; i < n-8; i++ {
+		if err := expect(i, 6, i%2 == 0); err != nil {
+			return 0, nil, fmt.Errorf("timing: %v", err)
+		}
+		if err := expect(6, i, i%2 == 0); err != nil {
+			return 0, nil, fmt.Errorf("timing: %v", err)
+		}
+	}
+	if err := expect(8, n-8, true); err != nil {
+		return 0, nil, fmt.Errorf("dark module: %v", err)
+	}
+	pos := qrAlignmentPositions(version)
+	for _, cy := range pos {
+		for _, cx := range pos {
+			if (cx < 9 || cx > n-9) && cy < 9 || cx < 9 && cy > n-9 {
+				continue // Would cover a finder
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					if err := expect(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1); err != nil {
+						return 0, nil, fmt.Errorf("alignment: %v", err)
+					}
+				}
+			}
+		}
+	}
+
+	// Format and version information
+	first, second := qrReadFormat(qr)
+	if first != second {
+		return 0, nil, fmt.Errorf("format copies differ: %015b, %015b", first, second)
+	}
+	level, mask := -1, -1
+	for l := range qrFormatTable {
+		for k, f := range qrFormatTable[l] {
+			if f == first {
+				level, mask = l, k
+			}
+		}
+	}
+	if level < 0 {
+		return 0, nil, fmt.Errorf("unknown format %015b", first)
+	}
+	for i := 0; i < 9; i++ {
+		reserved[8][i], reserved[i][8] = true, true
+		if i < 8 {
+			reserved[8][n-1-i], reserved[n-1-i][8] = true, true
+		}
+	}
+	if version >= 7 {
+		a, b := qrReadVersion(qr)
+		if want, ok := qrVersionTable[version]; ok && (a != want || b != want) {
+			return 0, nil, fmt.Errorf("version bits %018b, %018b, want %018b", a, b, want)
+		}
+		if a != b || a>>12 != version {
+			return 0, nil, fmt.Errorf("version bits %018b, %018b for version %d", a, b, version)
+		}
+		for i := 0; i < 18; i++ {
+			reserved[n-11+i%3][i/3], reserved[i/3][n-11+i%3] = true, true
+		}
+	}
+
+	// Unmask and read the codewords: two module wide columns from the
+	// right, alternately upwards and downwards, skipping the timing column
+	masked := func(row, col int) bool {
+		switch mask {
+		case 0:
+			return (row+col)%2 == 0
+		case 1:
+			return row%2 == 0
+		case 2:
+			return col%3 == 0
+		case 3:
+			return (row+col)%3 == 0
+		case 4:
+			return (row/2+col/3)%2 == 0
+		case 5:
+			return (row*col)%2+(row*col)%3 == 0
+		case 6:
+			return ((row*col)%2+(row*col)%3)%2 == 0
+		default:
+			return ((row+col)%2+(row*col)%3)%2 == 0
+		}
+	}
+	var raw []byte
+	var cur byte
+	bits := 0
+	upward := true
+	for col := n - 1; col > 0; col -= 2 {
+		if col == 6 {
+			col--
+		}
+		for i := 0; i < n; i++ {
+			row := i
+			if upward {
+				row = n - 1 - i
+			}
+			for _, c := range []int{col, col - 1} {
+				if reserved[row][c] {
+					continue
+				}
+				cur <<= 1
+				if m[row][c] != masked(row, c) {
+					cur |= 1
+				}
+				if bits++; bits%8 == 0 {
+					raw = append(raw, cur)
+					cur = 0
+				}
+			}
+		}
+		upward = !upward
+	}
+
+	// Undo the interleaving and check each block
+	numBlocks := qrNumBlocks[level][version]
+	eccLen := qrECCPerBlock[level][version]
+	total := len(raw)
+	if total != qrNumRawDataModules(version)/8 {
+		return 0, nil, fmt.Errorf("read %d codewords, want %d", total, qrNumRawDataModules(version)/8)
+	}
+	long := total % numBlocks
+	shortData := total/numBlocks - eccLen
+	blocks := make([][]byte, numBlocks)
+	k := 0
+	for i := 0; i < shortData+1; i++ {
+		for b := range blocks {
+			if i == shortData && b < numBlocks-long {
+				continue
+			}
+			blocks[b] = append(blocks[b], raw[k])
+			k++
+		}
+	}
+	for i := 0; i < eccLen; i++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], raw[k])
+			k++
+		}
+	}
+	var data []byte
+	for b, block := range blocks {
+		dat, ecc := block[:len(block)-eccLen], block[len(block)-eccLen:]
+		if !bytes.Equal(qrRSRemainder(dat, qrRSDivisor(eccLen)), ecc) {
+			return 0, nil, fmt.Errorf("block %d fails error correction", b)
+		}
+		data = append(data, dat...)
+	}
+
+	// Byte mode segment, terminator and padding
+	var stream qrBitBuffer
+	for _, b := range data {
+		stream.append(int(b), 8)
+	}
+	read := func(n int) int {
+		v := 0
+		for i := 0; i < n; i++ {
+			v = v<<1 | int(stream[0])
+			stream = stream[1:]
+		}
+		return v
+	}
+	if mode := read(4); mode != 0x4 {
+		return 0, nil, fmt.Errorf("mode %04b, want byte mode", mode)
+	}
+	countBits := 8
+	if version >= 10 {
+		countBits = 16
+	}
+	out := make([]byte, read(countBits))
+	for i := range out {
+		out[i] = byte(read(8))
+	}
+	if t := min(4, len(stream)); read(t) != 0 {
+		return 0, nil, fmt.Errorf("missing terminator")
+	}
+	read(len(stream) % 8)
+	for pad := 0xEC; len(stream) > 0; pad ^= 0xEC ^ 0x11 {
+		if got := read(8); got != pad {
+			return 0, nil, fmt.Errorf("pad codeword %#x, want %#x", got, pad)
+		}
+	}
+	return level, out, nil
+}
@@ -24,14 +24,14 @@ func getLimiter(ip string) *rate.Limiter {
 	}
 
 	// Create a new limiter for this IP
-	limiter := rate.NewLimiter(1, 3)
+	limiter := rate.NewLimiter(rate.Limit(config.RateLimit.PerSecond), config.RateLimit.Burst)
 	limiters[ip] = limiter
 	return limiter
 }
 
 func rateLimit(next httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		ip := r.RemoteAddr // Get the user's IP address
+		ip := clientIP(r) // Per address, not per connection, so new source ports don't get a fresh bucket
 		limiter := getLimiter(ip)
 
 		if !limiter.Allow() {
@@ -42,3 +42,28 @@ func rateLimit(next httprouter.Handle) httprouter.Handle {
 		next(w, r, ps) // Call the next handler
 	}
 }
+
+// API keys get a bucket each, sized when the key was created.
+var (
+	keyLimiters   = make(map[string]*rate.Limiter)
+	keyLimitersMu sync.Mutex
+)
+
+func apiKeyLimiter(key APIKey) *rate.Limiter {
+	keyLimitersMu.Lock()
+	defer keyLimitersMu.Unlock()
+
+	if limiter, exists := keyLimiters[key.KeyID]; exists {
+		return limiter
+	}
+	limiter := rate.NewLimiter(rate.Limit(key.RateLimit), key.Burst)
+	keyLimiters[key.KeyID] = limiter
+	return limiter
+}
+
+// dropAPIKeyLimiter forgets the bucket of a revoked key.
+func dropAPIKeyLimiter(keyID string) {
+	keyLimitersMu.Lock()
+	defer keyLimitersMu.Unlock()
+	delete(keyLimiters, keyID)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Roles a user can hold. Every account has exactly one; an empty
+// User.Role is treated as RoleUser.
+const (
+	RoleUser         = "user"
+	RoleOrganizer    = "organizer"
+	RoleVenueManager = "venue-manager"
+	RoleModerator    = "moderator"
+	RoleAdmin        = "admin"
+)
+
+// Permissions checked by requirePermission and the resource policies.
+const (
+	PermCreateEvent    = "events:create"
+	PermCreatePlace    = "places:create"
+	PermManageAnyEvent = "events:manage-any"
+	PermManageAnyPlace = "places:manage-any"
+	PermModerateMedia  = "media:moderate"
+	PermModerateReview = "reviews:moderate"
+	PermManageRoles    = "roles:manage"
+	PermManageUsers    = "users:manage"
+)
+
+// rolePermissions is the permission matrix. Plain users can still buy,
+// review and upload media; those routes only need a login.
+var rolePermissions = map[string][]string{
+	RoleUser:         {},
+	RoleOrganizer:    {PermCreateEvent},
+	RoleVenueManager: {PermCreatePlace},
+	RoleModerator:    {PermModerateMedia, PermModerateReview},
+	RoleAdmin: {
+		PermCreateEvent, PermCreatePlace,
+		PermManageAnyEvent, PermManageAnyPlace,
+		PermModerateMedia, PermModerateReview,
+		PermManageRoles, PermManageUsers,
+	},
+}
+
+// normalizeRole maps the empty role of older accounts to RoleUser.
+func normalizeRole(role string) string {
+	if role == "" {
+		return RoleUser
+	}
+	return role
+}
+
+// isValidRole reports whether role appears in the permission matrix.
+func isValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// can reports whether role grants perm.
+func can(role, perm string) bool {
+	for _, p := range rolePermissions[normalizeRole(role)] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// requirePermission wraps next so it only runs when the caller's current
+// role grants perm. The role is read from the stored user rather than the
+// token, so grants and revocations apply at once. It must sit inside
+// authenticate.
+func requirePermission(perm string, next httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		userID, ok := r.Context().Value(userIDKey).(string)
+		if !ok {
+			http.Error(w, "Invalid user", http.StatusBadRequest)
+			return
+		}
+		user, err := stores.Users.GetByUserID(r.Context(), userID)
+		if err == ErrNotFound {
+			http.Error(w, "Invalid user", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to load user %s: %v", userID, err)
+			http.Error(w, "Failed to check permissions", http.StatusInternalServerError)
+			return
+		}
+		if !can(user.Role, perm) {
+			http.Error(w, "Your role does not allow this", http.StatusForbidden)
+			return
+		}
+		next(w, r, ps)
+	}
+}
+
+// getRoles lists every role with the permissions it grants
+func getRoles(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	roles := make([]string, 0, len(rolePermissions))
+	for role := range rolePermissions {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	matrix := make([]map[string]interface{}, 0, len(roles))
+	for _, role := range roles {
+		matrix = append(matrix, map[string]interface{}{
+			"role":        role,
+			"permissions": rolePermissions[role],
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matrix)
+}
+
+// grantRole sets the role of the :userid user. The change applies to
+// the user's next request.
+func grantRole(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !isValidRole(req.Role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	setRole(w, r, ps.ByName("userid"), req.Role)
+}
+
+// revokeRole returns the :userid user to the plain user role
+func revokeRole(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	setRole(w, r, ps.ByName("userid"), RoleUser)
+}
+
+func setRole(w http.ResponseWriter, r *http.Request, userID, role string) {
+	// Admins can't change their own role, so there is always one left
+	if requestingUserID, _ := r.Context().Value(userIDKey).(string); requestingUserID == userID {
+		http.Error(w, "You cannot change your own role", http.StatusBadRequest)
+		return
+	}
+
+	user, err := stores.Users.GetByUserID(r.Context(), userID)
+	if err == ErrNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	user.Role = role
+	user.UpdatedAt = time.Now()
+	if err := stores.Users.Update(r.Context(), user); err != nil {
+		http.Error(w, "Failed to update role", http.StatusInternalServerError)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, map[string]string{"userid": user.UserID, "username": user.Username, "role": role}, "Role updated", nil)
+}
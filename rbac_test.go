@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRoleChangesApplyAtOnce(t *testing.T) {
+	useMemoryStores(t)
+	router := newRouter(nil)
+	admin := signIn(t, User{UserID: "admin", Username: "admin", Role: RoleAdmin})
+	user := signIn(t, User{UserID: "u1", Username: "u1", Role: RoleUser})
+
+	listRoles := func() int {
+		return serveRoute(router, user, http.MethodGet, "/api/admin/roles", nil, "").Code
+	}
+	if code := listRoles(); code != http.StatusForbidden {
+		t.Fatalf("roles as a user = %d, want %d", code, http.StatusForbidden)
+	}
+
+	// The token still says user; the grant counts anyway
+	w := serveRoute(router, admin, http.MethodPut, "/api/admin/users/u1/role", strings.NewReader(`{"role": "admin"}`), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("grant = %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	if code := listRoles(); code != http.StatusOK {
+		t.Errorf("roles after the grant = %d, want %d", code, http.StatusOK)
+	}
+
+	// and so does the revocation, though the token is the same
+	if code := serveRoute(router, admin, http.MethodDelete, "/api/admin/users/u1/role", nil, "").Code; code != http.StatusOK {
+		t.Fatalf("revoke = %d, want %d", code, http.StatusOK)
+	}
+	if code := listRoles(); code != http.StatusForbidden {
+		t.Errorf("roles after the revocation = %d, want %d", code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// reserveTicket places a time-limited hold on tickets. The held units are
+// taken from the ticket's quantity immediately, so other buyers can't claim
+// them while the user checks out.
+func reserveTicket(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	eventID := ps.ByName("eventid")
+	ticketID := ps.ByName("ticketid")
+
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	req := purchaseRequest{Quantity: 1}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if req.Quantity < 1 || req.Quantity > maxTicketsPerPurchase {
+		http.Error(w, fmt.Sprintf("Quantity must be between 1 and %d", maxTicketsPerPurchase), http.StatusBadRequest)
+		return
+	}
+
+	// Hold the units with the same conditional decrement used for purchases
+	_, err := stores.Tickets.Purchase(r.Context(), eventID, ticketID, req.Quantity)
+	switch {
+	case err == ErrNotFound:
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	case err == ErrSoldOut:
+		sendResponse(w, http.StatusConflict, nil, "Not enough tickets available", err)
+		return
+	case err != nil:
+		http.Error(w, "Failed to reserve tickets", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	reservation := Reservation{
+		ReservationID: generateID(16),
+		UserID:        userID,
+		EventID:       eventID,
+		TicketID:      ticketID,
+		Quantity:      req.Quantity,
+		Status:        ReservationHeld,
+		ExpiresAt:     now.Add(config.Reservations.HoldTTL),
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := stores.Reservations.Create(r.Context(), reservation); err != nil {
+		log.Printf("Failed to save reservation for ticket %s: %v", ticketID, err)
+		restoreTickets(r.Context(), eventID, ticketID, req.Quantity)
+		http.Error(w, "Failed to reserve tickets", http.StatusInternalServerError)
+		return
+	}
+
+	sendResponse(w, http.StatusCreated, reservation, "Tickets reserved", nil)
+}
+
+// getReservations lists the requesting user's reservations
+func getReservations(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	reservations, err := stores.Reservations.ListByUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch reservations", http.StatusInternalServerError)
+		return
+	}
+	if len(reservations) == 0 {
+		reservations = []Reservation{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reservations)
+}
+
+// getReservation returns one of the requesting user's reservations
+func getReservation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	reservation, ok := loadOwnReservation(w, r, ps)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reservation)
+}
+
+// confirmReservation turns a live hold into an order
+func confirmReservation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	reservation, ok := loadOwnReservation(w, r, ps)
+	if !ok {
+		return
+	}
+	if reservation.Status == ReservationHeld && !time.Now().Before(reservation.ExpiresAt) {
+		http.Error(w, "Reservation has expired", http.StatusGone)
+		return
+	}
+
+	ticket, err := stores.Tickets.Get(r.Context(), reservation.EventID, reservation.TicketID)
+	if err != nil {
+		http.Error(w, "Ticket no longer exists", http.StatusGone)
+		return
+	}
+	// The event may have been cancelled or postponed since the hold
+	if problem, err := checkOnSale(r.Context(), reservation.EventID); err != nil || problem != "" {
+		if problem == "" {
+			problem = "Event no longer exists"
+		}
+		http.Error(w, problem, http.StatusConflict)
+		return
+	}
+
+	// Claim the reservation first so it can't also be expired or released
+	orderID := generateID(16)
+	reservation, err = stores.Reservations.Transition(r.Context(), reservation.ReservationID, ReservationHeld, ReservationConfirmed, orderID)
+	if err == ErrConflict {
+		http.Error(w, "Reservation is no longer held", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to confirm reservation", http.StatusInternalServerError)
+		return
+	}
+
+	item := newOrderItem(OrderItemTicket, ticket.TicketID, ticket.Name, ticket.Price, reservation.Quantity)
+	order := buildOrder(reservation.UserID, reservation.EventID, OrderStatusPending, item)
+	order.OrderID = orderID
+	order, err = chargeOrder(r.Context(), order)
+	if err != nil {
+		log.Printf("Failed to complete order for reservation %s: %v", reservation.ReservationID, err)
+		// Hand the hold back so the user can retry before it expires, unless
+		// the order still has the tickets
+		if ownsStock(err) {
+			if _, err := stores.Reservations.Transition(r.Context(), reservation.ReservationID, ReservationConfirmed, ReservationHeld, ""); err != nil {
+				log.Printf("Failed to reopen reservation %s: %v", reservation.ReservationID, err)
+			}
+		}
+		writePaymentError(w, err)
+		return
+	}
+	issueOrderTickets(r.Context(), order)
+
+	sendResponse(w, http.StatusOK, order, "Reservation confirmed", nil)
+}
+
+// releaseReservation cancels a hold and returns the tickets to sale
+func releaseReservation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	reservation, ok := loadOwnReservation(w, r, ps)
+	if !ok {
+		return
+	}
+
+	_, err := stores.Reservations.Transition(r.Context(), reservation.ReservationID, ReservationHeld, ReservationReleased, "")
+	if err == ErrConflict {
+		http.Error(w, "Reservation is no longer held", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to release reservation", http.StatusInternalServerError)
+		return
+	}
+	restoreTickets(r.Context(), reservation.EventID, reservation.TicketID, reservation.Quantity)
+
+	sendResponse(w, http.StatusOK, nil, "Reservation released", nil)
+}
+
+// loadOwnReservation fetches the :reservationid reservation and checks it
+// belongs to the requesting user, writing an error response if not.
+func loadOwnReservation(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (Reservation, bool) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return Reservation{}, false
+	}
+
+	reservation, err := stores.Reservations.Get(r.Context(), ps.ByName("reservationid"))
+	if err == ErrNotFound || (err == nil && reservation.UserID != userID) {
+		http.Error(w, "Reservation not found", http.StatusNotFound)
+		return Reservation{}, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch reservation", http.StatusInternalServerError)
+		return Reservation{}, false
+	}
+	return reservation, true
+}
+
+// restoreTickets puts held or bought units back on sale.
+func restoreTickets(ctx context.Context, eventID, ticketID string, quantity int) {
+	if err := stores.Tickets.AdjustQuantity(ctx, eventID, ticketID, quantity); err != nil && err != ErrNotFound {
+		log.Printf("Failed to restore %d tickets for %s: %v", quantity, ticketID, err)
+	}
+}
+
+// sweepReservations releases expired holds every interval until ctx is done.
+func sweepReservations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n, err := expireReservations(ctx, now); err != nil {
+				log.Printf("Reservation sweep failed: %v", err)
+			} else if n > 0 {
+				log.Printf("Released %d expired reservations", n)
+			}
+		}
+	}
+}
+
+// expireReservations marks holds that ended before now as expired and
+// returns their tickets to sale. It returns how many holds were released.
+func expireReservations(ctx context.Context, now time.Time) (int, error) {
+	const batch = 100
+	released := 0
+	for {
+		expired, err := stores.Reservations.ListExpired(ctx, now, batch)
+		if err != nil {
+			return released, err
+		}
+		for _, reservation := range expired {
+			// Losing the race to a confirm or release is fine; skip it
+			_, err := stores.Reservations.Transition(ctx, reservation.ReservationID, ReservationHeld, ReservationExpired, "")
+			if err == ErrConflict || err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return released, err
+			}
+			restoreTickets(ctx, reservation.EventID, reservation.TicketID, reservation.Quantity)
+			released++
+		}
+		if len(expired) < batch {
+			return released, nil
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// reserveAs holds quantity of ticket t1 for userID and returns the
+// response code and the hold.
+func reserveAs(t *testing.T, userID string, quantity int) (int, Reservation) {
+	t.Helper()
+	w := serveAs(reserveTicket, userID, http.MethodPost, "/api/event/e1/tickets/t1/reserve",
+		fmt.Sprintf(`{"quantity": %d}`, quantity), "eventid", "e1", "ticketid", "t1")
+	var reservation Reservation
+	if w.Code == http.StatusCreated {
+		responseData(t, w, &reservation)
+	}
+	return w.Code, reservation
+}
+
+func TestReservationHoldAndConfirm(t *testing.T) {
+	useMemoryStores(t)
+	seedTicket(t, EventPublished, 5)
+	ctx := context.Background()
+
+	code, held := reserveAs(t, "u1", 3)
+	if code != http.StatusCreated || held.Status != ReservationHeld {
+		t.Fatalf("reserve = %d %+v, want a hold", code, held)
+	}
+	if got := stockOf(t); got != 2 {
+		t.Errorf("stock while held = %d, want 2", got)
+	}
+	if code, _ := reserveAs(t, "u2", 3); code != http.StatusConflict {
+		t.Errorf("reserving more than is left = %d, want %d", code, http.StatusConflict)
+	}
+
+	// Only the holder can see or confirm the hold
+	confirm := func(userID string) int {
+		return serveAs(confirmReservation, userID, http.MethodPost, "/", "", "reservationid", held.ReservationID).Code
+	}
+	if code := confirm("u2"); code != http.StatusNotFound {
+		t.Errorf("confirm by someone else = %d, want %d", code, http.StatusNotFound)
+	}
+	if code := confirm("u1"); code != http.StatusOK {
+		t.Fatalf("confirm = %d, want %d", code, http.StatusOK)
+	}
+	if code := confirm("u1"); code != http.StatusConflict {
+		t.Errorf("second confirm = %d, want %d", code, http.StatusConflict)
+	}
+
+	got, err := stores.Reservations.Get(ctx, held.ReservationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != ReservationConfirmed || got.OrderID == "" {
+		t.Errorf("reservation = %s with order %q, want confirmed with an order", got.Status, got.OrderID)
+	}
+	order, err := stores.Orders.Get(ctx, got.OrderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Status != OrderStatusCompleted || order.Total != 30 {
+		t.Errorf("order = %s for %v, want completed for 30", order.Status, order.Total)
+	}
+	if got := stockOf(t); got != 2 {
+		t.Errorf("stock after confirming = %d, want 2", got)
+	}
+}
+
+func TestReservationExpiry(t *testing.T) {
+	useMemoryStores(t)
+	seedTicket(t, EventPublished, 5)
+	ctx := context.Background()
+
+	_, first := reserveAs(t, "u1", 2)
+	_, second := reserveAs(t, "u2", 1)
+	if got := stockOf(t); got != 2 {
+		t.Fatalf("stock while held = %d, want 2", got)
+	}
+
+	// Confirming a hold past its end fails even before the sweeper runs
+	if _, err := stores.Tickets.Purchase(ctx, "e1", "t1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Reservations.Create(ctx, Reservation{
+		ReservationID: "stale", UserID: "u3", EventID: "e1", TicketID: "t1", Quantity: 1,
+		Status: ReservationHeld, ExpiresAt: time.Now().Add(-time.Second),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if code := serveAs(confirmReservation, "u3", http.MethodPost, "/", "", "reservationid", "stale").Code; code != http.StatusGone {
+		t.Errorf("confirming an expired hold = %d, want %d", code, http.StatusGone)
+	}
+
+	// Only the stale hold is due yet
+	if n, err := expireReservations(ctx, time.Now()); err != nil || n != 1 {
+		t.Errorf("early sweep released %d, %v; want only the stale hold", n, err)
+	}
+	if got := stockOf(t); got != 2 {
+		t.Errorf("stock after the early sweep = %d, want 2", got)
+	}
+
+	later := time.Now().Add(config.Reservations.HoldTTL + time.Minute)
+	if n, err := expireReservations(ctx, later); err != nil || n != 2 {
+		t.Fatalf("sweep released %d, %v; want 2", n, err)
+	}
+	if got := stockOf(t); got != 5 {
+		t.Errorf("stock after the sweep = %d, want 5", got)
+	}
+	for _, id := range []string{first.ReservationID, second.ReservationID} {
+		if got, _ := stores.Reservations.Get(ctx, id); got.Status != ReservationExpired {
+			t.Errorf("reservation %s is %s, want expired", id, got.Status)
+		}
+	}
+
+	// A second sweep and a late confirm change nothing
+	if n, err := expireReservations(ctx, later); err != nil || n != 0 {
+		t.Errorf("second sweep released %d, %v; want 0", n, err)
+	}
+	if code := serveAs(confirmReservation, "u1", http.MethodPost, "/", "", "reservationid", first.ReservationID).Code; code != http.StatusConflict {
+		t.Errorf("confirming an expired hold = %d, want %d", code, http.StatusConflict)
+	}
+	if got := stockOf(t); got != 5 {
+		t.Errorf("stock after the late confirm = %d, want 5", got)
+	}
+}
+
+func TestReservationReleaseAndDecline(t *testing.T) {
+	useMemoryStores(t)
+	seedTicket(t, EventPublished, 5)
+	ctx := context.Background()
+
+	_, held := reserveAs(t, "u1", 2)
+	usePaymentMode(FakePaymentDecline)
+	if code := serveAs(confirmReservation, "u1", http.MethodPost, "/", "", "reservationid", held.ReservationID).Code; code != http.StatusPaymentRequired {
+		t.Fatalf("confirm with a declined card = %d, want %d", code, http.StatusPaymentRequired)
+	}
+	// The hold is handed back so the buyer can retry
+	if got, _ := stores.Reservations.Get(ctx, held.ReservationID); got.Status != ReservationHeld {
+		t.Errorf("reservation after a decline is %s, want held", got.Status)
+	}
+	if got := stockOf(t); got != 3 {
+		t.Errorf("stock after a decline = %d, want 3", got)
+	}
+
+	release := func() int {
+		return serveAs(releaseReservation, "u1", http.MethodDelete, "/", "", "reservationid", held.ReservationID).Code
+	}
+	if code := release(); code != http.StatusOK {
+		t.Fatalf("release = %d, want %d", code, http.StatusOK)
+	}
+	if code := release(); code != http.StatusConflict {
+		t.Errorf("second release = %d, want %d", code, http.StatusConflict)
+	}
+	if got := stockOf(t); got != 5 {
+		t.Errorf("stock after release = %d, want 5", got)
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RRule is the part of an RFC 5545 recurrence rule event series support:
+//
+//	FREQ        DAILY, WEEKLY, MONTHLY or YEARLY
+//	INTERVAL    every how many of those
+//	COUNT       how many occurrences in all, or
+//	UNTIL       the last time one may start, as 20060102 or 20060102T150405Z
+//	BYDAY       weekdays (MO to SU); in MONTHLY and YEARLY rules they may
+//	            be numbered within the month, as in 2TU or -1FR
+//	BYMONTHDAY  days of the month, negative counting from its end
+//	BYMONTH     months, 1 to 12
+//	WKST        only MO, the default
+//
+// Occurrences fall at the time of day of the first, in the series' time
+// zone, so they keep their local time across daylight saving changes.
+type RRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      time.Time
+	ByDay      []rruleDay
+	ByMonthDay []int
+	ByMonth    []time.Month
+}
+
+// rruleDay is a BYDAY entry: a weekday, or with N set the Nth one of the
+// month (counting from the end if N is negative).
+type rruleDay struct {
+	N   int
+	Day time.Weekday
+}
+
+var rruleWeekdays = map[string]time.Weekday{
+	"MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+	"FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+// maxRRulePeriods bounds how many days, weeks, months or years a rule is
+// followed for, so rules that (almost) never match still end.
+const maxRRulePeriods = 50000
+
+// parseRRule reads a rule, with or without the "RRULE:" prefix. A date-only
+// UNTIL means the end of that day in loc.
+func parseRRule(s string, loc *time.Location) (RRule, error) {
+	r := RRule{Interval: 1}
+	s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "RRULE:")
+	if s == "" {
+		return r, fmt.Errorf("is empty")
+	}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return r, fmt.Errorf("%q isn't NAME=VALUE", part)
+		}
+		if seen[key] {
+			return r, fmt.Errorf("has %s twice", key)
+		}
+		seen[key] = true
+
+		var err error
+		switch key {
+		case "FREQ":
+			r.Freq = value
+			if value != "DAILY" && value != "WEEKLY" && value != "MONTHLY" && value != "YEARLY" {
+				err = fmt.Errorf("FREQ must be DAILY, WEEKLY, MONTHLY or YEARLY")
+			}
+		case "INTERVAL":
+			r.Interval, err = rrulePositive(key, value, 1000)
+		case "COUNT":
+			r.Count, err = rrulePositive(key, value, 10000)
+		case "UNTIL":
+			r.Until, err = parseRRuleUntil(value, loc)
+		case "BYDAY":
+			for _, v := range strings.Split(value, ",") {
+				day, ok := rruleWeekdays[v[max(0, len(v)-2):]]
+				n := 0
+				if ok && len(v) > 2 {
+					n, err = strconv.Atoi(v[:len(v)-2])
+					ok = err == nil && n != 0 && n >= -5 && n <= 5
+				}
+				if !ok {
+					return r, fmt.Errorf("BYDAY has a bad day %q", v)
+				}
+				r.ByDay = append(r.ByDay, rruleDay{N: n, Day: day})
+			}
+		case "BYMONTHDAY":
+			for _, v := range strings.Split(value, ",") {
+				d, err := strconv.Atoi(v)
+				if err != nil || d == 0 || d < -31 || d > 31 {
+					return r, fmt.Errorf("BYMONTHDAY has a bad day %q", v)
+				}
+				r.ByMonthDay = append(r.ByMonthDay, d)
+			}
+		case "BYMONTH":
+			for _, v := range strings.Split(value, ",") {
+				m, err := strconv.Atoi(v)
+				if err != nil || m < 1 || m > 12 {
+					return r, fmt.Errorf("BYMONTH has a bad month %q", v)
+				}
+				r.ByMonth = append(r.ByMonth, time.Month(m))
+			}
+		case "WKST":
+			if value != "MO" {
+				err = fmt.Errorf("only WKST=MO is supported")
+			}
+		default:
+			err = fmt.Errorf("%s isn't supported", key)
+		}
+		if err != nil {
+			return r, err
+		}
+	}
+
+	switch {
+	case r.Freq == "":
+		return r, fmt.Errorf("needs FREQ")
+	case r.Count > 0 && !r.Until.IsZero():
+		return r, fmt.Errorf("can't have both COUNT and UNTIL")
+	case (r.Freq == "DAILY" || r.Freq == "WEEKLY") && r.numberedDays():
+		return r, fmt.Errorf("numbered BYDAY days need FREQ=MONTHLY or YEARLY")
+	case r.Freq == "WEEKLY" && len(r.ByMonthDay) > 0:
+		return r, fmt.Errorf("BYMONTHDAY doesn't go with FREQ=WEEKLY")
+	case r.Freq == "YEARLY" && len(r.ByDay) > 0 && len(r.ByMonth) == 0:
+		return r, fmt.Errorf("BYDAY in a YEARLY rule needs BYMONTH")
+	}
+	return r, nil
+}
+
+func rrulePositive(key, value string, limit int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 || n > limit {
+		return 0, fmt.Errorf("%s must be a number from 1 to %d", key, limit)
+	}
+	return n, nil
+}
+
+func parseRRuleUntil(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("20060102", value, loc); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Second), nil
+	}
+	return time.Time{}, fmt.Errorf("UNTIL must be a date (20060102) or a UTC time (20060102T150405Z)")
+}
+
+func (r RRule) numberedDays() bool {
+	for _, d := range r.ByDay {
+		if d.N != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// String writes r back out in RFC 5545 form, without the prefix.
+func (r RRule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	if len(r.ByDay) > 0 {
+		var days []string
+		for _, d := range r.ByDay {
+			day := strings.ToUpper(d.Day.String()[:2])
+			if d.N != 0 {
+				day = strconv.Itoa(d.N) + day
+			}
+			days = append(days, day)
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		var days []string
+		for _, d := range r.ByMonthDay {
+			days = append(days, strconv.Itoa(d))
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonth) > 0 {
+		var months []string
+		for _, m := range r.ByMonth {
+			months = append(months, strconv.Itoa(int(m)))
+		}
+		parts = append(parts, "BYMONTH="+strings.Join(months, ","))
+	}
+	return strings.Join(parts, ";")
+}
+
+// each calls fn with every occurrence of r starting from start, in order,
+// until fn returns false or the rule runs out. start must be in the time
+// zone the rule is followed in.
+func (r RRule) each(start time.Time, fn func(time.Time) bool) {
+	y, m, d := start.Date()
+	loc := start.Location()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, start.Hour(), start.Minute(), start.Second(), 0, loc)
+	}
+	// Monday of the week of start
+	weekStart := time.Date(y, m, d-(int(start.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+
+	count := 0
+	for p := 0; p < maxRRulePeriods; p++ {
+		var days []time.Time // Candidates in this period, in order
+		switch r.Freq {
+		case "DAILY":
+			day := time.Date(y, m, d+p*r.Interval, 0, 0, 0, 0, time.UTC)
+			if r.dayMatches(day) {
+				days = append(days, day)
+			}
+		case "WEEKLY":
+			week := weekStart.AddDate(0, 0, 7*p*r.Interval)
+			for i := 0; i < 7; i++ {
+				day := week.AddDate(0, 0, i)
+				if r.weekdayMatches(day.Weekday(), start.Weekday()) && (len(r.ByMonth) == 0 || containsMonth(r.ByMonth, day.Month())) {
+					days = append(days, day)
+				}
+			}
+		case "MONTHLY":
+			month := time.Date(y, m+time.Month(p*r.Interval), 1, 0, 0, 0, 0, time.UTC)
+			if len(r.ByMonth) == 0 || containsMonth(r.ByMonth, month.Month()) {
+				days = r.monthDays(month.Year(), month.Month(), d)
+			}
+		case "YEARLY":
+			months := r.ByMonth
+			if len(months) == 0 {
+				months = []time.Month{m}
+			}
+			months = append([]time.Month(nil), months...)
+			sort.Slice(months, func(i, j int) bool { return months[i] < months[j] })
+			for _, month := range months {
+				days = append(days, r.monthDays(y+p*r.Interval, month, d)...)
+			}
+		}
+
+		for _, day := range days {
+			t := at(day.Year(), day.Month(), day.Day())
+			if t.Before(start) {
+				continue
+			}
+			if !r.Until.IsZero() && t.After(r.Until) {
+				return
+			}
+			count++
+			if !fn(t) || (r.Count > 0 && count == r.Count) {
+				return
+			}
+		}
+	}
+}
+
+// weekdayMatches reports whether day is in BYDAY, or is the weekday of the
+// start of the series if there is no BYDAY.
+func (r RRule) weekdayMatches(day, startDay time.Weekday) bool {
+	if len(r.ByDay) == 0 {
+		return day == startDay
+	}
+	for _, d := range r.ByDay {
+		if d.Day == day {
+			return true
+		}
+	}
+	return false
+}
+
+// dayMatches applies the BY parts of a DAILY rule to day.
+func (r RRule) dayMatches(day time.Time) bool {
+	if len(r.ByMonth) > 0 && !containsMonth(r.ByMonth, day.Month()) {
+		return false
+	}
+	if len(r.ByDay) > 0 && !r.weekdayMatches(day.Weekday(), day.Weekday()) {
+		return false
+	}
+	if len(r.ByMonthDay) > 0 {
+		last := daysIn(day.Year(), day.Month())
+		for _, md := range r.ByMonthDay {
+			if md == day.Day() || last+md+1 == day.Day() {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// monthDays returns the days of a month a MONTHLY or YEARLY rule picks,
+// in order: those in both BYMONTHDAY and BYDAY when both are given, or
+// else the day of the month the series started on, if the month has it.
+func (r RRule) monthDays(year int, month time.Month, startDay int) []time.Time {
+	last := daysIn(year, month)
+	picked := make([]bool, last+1)
+	switch {
+	case len(r.ByMonthDay) == 0 && len(r.ByDay) == 0:
+		if startDay <= last {
+			picked[startDay] = true
+		}
+	case len(r.ByDay) == 0:
+		for _, md := range r.ByMonthDay {
+			if md < 0 {
+				md = last + md + 1
+			}
+			if md >= 1 && md <= last {
+				picked[md] = true
+			}
+		}
+	default:
+		first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC).Weekday()
+		for _, bd := range r.ByDay {
+			// Days of the month falling on bd.Day
+			var matches []int
+			for day := 1 + (int(bd.Day)-int(first)+7)%7; day <= last; day += 7 {
+				matches = append(matches, day)
+			}
+			switch {
+			case bd.N == 0:
+				for _, day := range matches {
+					picked[day] = true
+				}
+			case bd.N > 0 && bd.N <= len(matches):
+				picked[matches[bd.N-1]] = true
+			case bd.N < 0 && -bd.N <= len(matches):
+				picked[matches[len(matches)+bd.N]] = true
+			}
+		}
+		if len(r.ByMonthDay) > 0 {
+			inMonthDays := make([]bool, last+1)
+			for _, md := range r.ByMonthDay {
+				if md < 0 {
+					md = last + md + 1
+				}
+				if md >= 1 && md <= last {
+					inMonthDays[md] = true
+				}
+			}
+			for day := range picked {
+				picked[day] = picked[day] && inMonthDays[day]
+			}
+		}
+	}
+
+	var days []time.Time
+	for day := 1; day <= last; day++ {
+		if picked[day] {
+			days = append(days, time.Date(year, month, day, 0, 0, 0, 0, time.UTC))
+		}
+	}
+	return days
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func containsMonth(months []time.Month, m time.Month) bool {
+	for _, month := range months {
+		if month == m {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRRuleErrors(t *testing.T) {
+	tests := []struct {
+		rule    string
+		wantErr string
+	}{
+		{"", "is empty"},
+		{"COUNT=3", "needs FREQ"},
+		{"FREQ=HOURLY", "FREQ must be DAILY, WEEKLY, MONTHLY or YEARLY"},
+		{"FREQ=DAILY;FREQ=DAILY", "has FREQ twice"},
+		{"FREQ=DAILY;COUNT", `"COUNT" isn't NAME=VALUE`},
+		{"FREQ=DAILY;COUNT=0", "COUNT must be a number"},
+		{"FREQ=DAILY;COUNT=3;UNTIL=20260201", "can't have both COUNT and UNTIL"},
+		{"FREQ=DAILY;UNTIL=tomorrow", "UNTIL must be a date"},
+		{"FREQ=WEEKLY;BYDAY=XX", "BYDAY has a bad day"},
+		{"FREQ=WEEKLY;BYDAY=1MO", "numbered BYDAY days need FREQ=MONTHLY or YEARLY"},
+		{"FREQ=WEEKLY;BYMONTHDAY=1", "BYMONTHDAY doesn't go with FREQ=WEEKLY"},
+		{"FREQ=MONTHLY;BYMONTHDAY=32", "BYMONTHDAY has a bad day"},
+		{"FREQ=YEARLY;BYMONTH=13", "BYMONTH has a bad month"},
+		{"FREQ=YEARLY;BYDAY=MO", "BYDAY in a YEARLY rule needs BYMONTH"},
+		{"FREQ=WEEKLY;WKST=SU", "only WKST=MO is supported"},
+		{"FREQ=DAILY;BYHOUR=9", "BYHOUR isn't supported"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			_, err := parseRRule(tt.rule, time.UTC)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseRRule(%q) error = %v, want %q", tt.rule, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRRuleEach(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone data:", err)
+	}
+	tests := []struct {
+		name  string
+		rule  string
+		start time.Time
+		want  []string
+	}{
+		{
+			// Clocks go forward on 8 March 2026; the wall-clock time stays put
+			"weekly across a DST change",
+			"FREQ=WEEKLY;BYDAY=TU,TH;COUNT=6",
+			time.Date(2026, 3, 3, 19, 0, 0, 0, ny),
+			[]string{
+				"2026-03-03T19:00:00-05:00", "2026-03-05T19:00:00-05:00",
+				"2026-03-10T19:00:00-04:00", "2026-03-12T19:00:00-04:00",
+				"2026-03-17T19:00:00-04:00", "2026-03-19T19:00:00-04:00",
+			},
+		},
+		{
+			"last Friday of the month",
+			"FREQ=MONTHLY;BYDAY=-1FR;COUNT=4",
+			time.Date(2026, 1, 30, 20, 0, 0, 0, ny),
+			[]string{
+				"2026-01-30T20:00:00-05:00", "2026-02-27T20:00:00-05:00",
+				"2026-03-27T20:00:00-04:00", "2026-04-24T20:00:00-04:00",
+			},
+		},
+		{
+			"the 31st skips short months",
+			"FREQ=MONTHLY;BYMONTHDAY=31;COUNT=4",
+			time.Date(2026, 1, 31, 18, 0, 0, 0, ny),
+			[]string{
+				"2026-01-31T18:00:00-05:00", "2026-03-31T18:00:00-04:00",
+				"2026-05-31T18:00:00-04:00", "2026-07-31T18:00:00-04:00",
+			},
+		},
+		{
+			"COUNT stops after that many",
+			"FREQ=DAILY;INTERVAL=10;COUNT=2",
+			time.Date(2026, 1, 1, 9, 0, 0, 0, ny),
+			[]string{"2026-01-01T09:00:00-05:00", "2026-01-11T09:00:00-05:00"},
+		},
+		{
+			"a date-only UNTIL takes in that whole day",
+			"FREQ=DAILY;INTERVAL=10;UNTIL=20260131",
+			time.Date(2026, 1, 1, 9, 0, 0, 0, ny),
+			[]string{
+				"2026-01-01T09:00:00-05:00", "2026-01-11T09:00:00-05:00",
+				"2026-01-21T09:00:00-05:00", "2026-01-31T09:00:00-05:00",
+			},
+		},
+		{
+			"a UTC UNTIL before the last time ends the rule a day early",
+			"FREQ=DAILY;INTERVAL=10;UNTIL=20260131T120000Z",
+			time.Date(2026, 1, 1, 9, 0, 0, 0, ny),
+			[]string{
+				"2026-01-01T09:00:00-05:00", "2026-01-11T09:00:00-05:00",
+				"2026-01-21T09:00:00-05:00",
+			},
+		},
+		{
+			"29 February only in leap years",
+			"FREQ=YEARLY;COUNT=2",
+			time.Date(2024, 2, 29, 12, 0, 0, 0, ny),
+			[]string{"2024-02-29T12:00:00-05:00", "2028-02-29T12:00:00-05:00"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := parseRRule(tt.rule, ny)
+			if err != nil {
+				t.Fatalf("parseRRule(%q): %v", tt.rule, err)
+			}
+			var got []string
+			r.each(tt.start, func(at time.Time) bool {
+				got = append(got, at.Format(time.RFC3339))
+				return len(got) < 2*len(tt.want)
+			})
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("%s from %s:\n got %v\nwant %v", tt.rule, tt.start.Format(time.RFC3339), got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Site-wide search. Events, places, users and merch are copied into a
+// SearchIndex as they are saved (see indexStores), and GET /api/search
+// looks through all of them at once. Both indexes rank by relevance and
+// forgive typos and unfinished words the same way: the words of a query
+// are first expanded to the indexed terms they could mean, and the index
+// then looks for documents holding, for every word, one of its terms.
+
+// SearchIndex stores SearchDocs and finds them again.
+type SearchIndex interface {
+	// Put adds doc, replacing any earlier version.
+	Put(ctx context.Context, doc SearchDoc) error
+	// Delete removes the document with doc's kind and IDs, if there is one.
+	Delete(ctx context.Context, doc SearchDoc) error
+	// Terms returns, in order, up to limit (0 for all) indexed terms that
+	// start with prefix and are from minLen to maxLen (0 for any) runes long.
+	Terms(ctx context.Context, prefix string, minLen, maxLen, limit int) ([]string, error)
+	// Search returns the best matches of q, best first.
+	Search(ctx context.Context, q SearchQuery) ([]SearchResult, error)
+	// Count returns how many documents the index holds.
+	Count(ctx context.Context) (int, error)
+}
+
+// SearchQuery is a query whose words have been expanded to indexed terms.
+type SearchQuery struct {
+	Words [][]SearchTerm // A document must hold a term of every word
+	Kinds []string       // Kinds of document wanted; all if empty
+	Limit int
+}
+
+// SearchTerm is an indexed term a query word may stand for, weighted by
+// how likely it is to be what was meant: 1 for the word itself, less for
+// completions and typo corrections.
+type SearchTerm struct {
+	Term   string
+	Weight float64
+}
+
+// SearchResult is a document found by a search.
+type SearchResult struct {
+	Doc   SearchDoc
+	Score float64
+}
+
+// searchIndex is the index in use; see newSearchIndex.
+var searchIndex SearchIndex
+
+// Search tuning
+const (
+	defaultSearchLimit  = 20
+	maxSearchLimit      = 50
+	maxPrefixExpansions = 20   // Completions tried for an unfinished word
+	maxTypoCandidates   = 2000 // Terms compared with a word that may be misspelt
+	snippetLength       = 160  // Bytes of body shown around the first match
+
+	prefixWeight = 0.5
+	typoWeight   = 0.5 // Per edit
+)
+
+// docKey identifies doc within an index.
+func docKey(doc SearchDoc) string {
+	return doc.Kind + "/" + doc.EventID + "/" + doc.ID
+}
+
+// tokenSpan is a word of a text, lowercased, and where it is.
+type tokenSpan struct {
+	term       string
+	start, end int // Byte offsets
+}
+
+// tokenSpans splits text into words: runs of letters and digits.
+func tokenSpans(text string) []tokenSpan {
+	var spans []tokenSpan
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if word && start < 0 {
+			start = i
+		}
+		if !word && start >= 0 {
+			spans = append(spans, tokenSpan{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, tokenSpan{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return spans
+}
+
+// tokenize returns the lowercased words of text.
+func tokenize(text string) []string {
+	spans := tokenSpans(text)
+	terms := make([]string, len(spans))
+	for i, span := range spans {
+		terms[i] = span.term
+	}
+	return terms
+}
+
+// docTerms returns every distinct term of doc.
+func docTerms(doc SearchDoc) []string {
+	seen := map[string]bool{}
+	var terms []string
+	for _, text := range append([]string{doc.Title, doc.Body}, doc.Keywords...) {
+		for _, term := range tokenize(text) {
+			if !seen[term] {
+				seen[term] = true
+				terms = append(terms, term)
+			}
+		}
+	}
+	return terms
+}
+
+// allowedTypos is how many edits a word of n runes may be off by.
+func allowedTypos(n int) int {
+	switch {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	}
+	return 0
+}
+
+// editDistance counts the insertions, deletions, substitutions and swaps of
+// neighbouring runes that turn a into b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
+
+// expandQuery turns text into the terms each of its words may stand for
+// in index. The last word is also completed unless text ends in a space,
+// so results can follow what is being typed, and words long enough to
+// misspell also stand for the indexed terms a typo or two away. Typo
+// candidates must start with the same letter, which keeps them few.
+func expandQuery(ctx context.Context, index SearchIndex, text string) ([][]SearchTerm, error) {
+	words := tokenize(text)
+	if len(words) > maxSearchWords {
+		words = words[:maxSearchWords]
+	}
+	complete := text != "" && !unicode.IsSpace(rune(text[len(text)-1]))
+
+	expanded := make([][]SearchTerm, len(words))
+	for i, word := range words {
+		weights := map[string]float64{word: 1}
+		n := utf8.RuneCountInString(word)
+
+		if complete && i == len(words)-1 {
+			completions, err := index.Terms(ctx, word, n+1, 0, maxPrefixExpansions)
+			if err != nil {
+				return nil, err
+			}
+			for _, term := range completions {
+				weights[term] = prefixWeight
+			}
+		}
+
+		if typos := allowedTypos(n); typos > 0 {
+			first, _ := utf8.DecodeRuneInString(word)
+			candidates, err := index.Terms(ctx, string(first), n-typos, n+typos, maxTypoCandidates)
+			if err != nil {
+				return nil, err
+			}
+			for _, term := range candidates {
+				if _, ok := weights[term]; ok {
+					continue
+				}
+				if d := editDistance(word, term); d <= typos {
+					weights[term] = 1 - typoWeight*float64(d)
+				}
+			}
+		}
+
+		for term, weight := range weights {
+			if weight > 0 {
+				expanded[i] = append(expanded[i], SearchTerm{term, weight})
+			}
+		}
+		sort.Slice(expanded[i], func(a, b int) bool { return expanded[i][a].Term < expanded[i][b].Term })
+	}
+	return expanded, nil
+}
+
+// highlight HTML escapes text and wraps the words in terms in <mark>.
+func highlight(text string, terms map[string]bool) string {
+	var b strings.Builder
+	last := 0
+	for _, span := range tokenSpans(text) {
+		if !terms[span.term] {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[last:span.start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(text[span.start:span.end]))
+		b.WriteString("</mark>")
+		last = span.end
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
+
+// snippet cuts text down to about snippetLength bytes around its first
+// word in terms, and highlights it.
+func snippet(text string, terms map[string]bool) string {
+	if len(text) <= snippetLength {
+		return highlight(text, terms)
+	}
+	start := 0
+	for _, span := range tokenSpans(text) {
+		if terms[span.term] {
+			start = span.start - snippetLength/4
+			break
+		}
+	}
+	start = max(0, min(start, len(text)-snippetLength))
+	end := start + snippetLength
+	// Don't cut words, or runes, in half
+	for start > 0 && !unicode.IsSpace(rune(text[start-1])) {
+		start--
+	}
+	for end < len(text) && !unicode.IsSpace(rune(text[end])) {
+		end++
+	}
+	out := highlight(strings.TrimSpace(text[start:end]), terms)
+	if start > 0 {
+		out = "…" + out
+	}
+	if end < len(text) {
+		out += "…"
+	}
+	return out
+}
+
+// SearchHit is one result of GET /api/search. Title and Snippet are HTML:
+// escaped text with the matching words in <mark>.
+type SearchHit struct {
+	Kind    string  `json:"kind"`
+	ID      string  `json:"id"`
+	EventID string  `json:"eventid,omitempty"`
+	Title   string  `json:"title"`
+	Snippet string  `json:"snippet,omitempty"`
+	Score   float64 `json:"score"`
+}
+
+var searchKinds = []string{SearchKindEvent, SearchKindPlace, SearchKindUser, SearchKindMerch}
+
+// search looks through events, places, users and merch for q, which is
+// searched as typed. Optional parameters are types, a comma separated list
+// of the kinds of result wanted, and limit.
+func search(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	values := r.URL.Query()
+	text := values.Get("q")
+	errs := FieldErrors{}
+	if strings.TrimSpace(text) == "" {
+		errs.add("q", "is required")
+	} else if len(text) > 200 {
+		errs.add("q", "must be at most 200 characters")
+	}
+	kinds := splitList(values.Get("types"))
+	for _, kind := range kinds {
+		if !contains(searchKinds, kind) {
+			errs.add("types", "must be a list of "+strings.Join(searchKinds, ", "))
+		}
+	}
+	limit := defaultSearchLimit
+	if s := values.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			errs.add("limit", fmt.Sprintf("must be a whole number from 1 to %d", maxSearchLimit))
+		}
+		limit = n
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	words, err := expandQuery(r.Context(), searchIndex, text)
+	if err != nil {
+		log.Printf("Failed to expand search %q: %v", text, err)
+		http.Error(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+	hits := []SearchHit{}
+	if len(words) > 0 {
+		results, err := searchIndex.Search(r.Context(), SearchQuery{Words: words, Kinds: kinds, Limit: limit})
+		if err != nil {
+			log.Printf("Failed to search for %q: %v", text, err)
+			http.Error(w, "Search failed", http.StatusInternalServerError)
+			return
+		}
+		matched := map[string]bool{}
+		for _, word := range words {
+			for _, t := range word {
+				matched[t.Term] = true
+			}
+		}
+		for _, res := range results {
+			hits = append(hits, SearchHit{
+				Kind:    res.Doc.Kind,
+				ID:      res.Doc.ID,
+				EventID: res.Doc.EventID,
+				Title:   highlight(res.Doc.Title, matched),
+				Snippet: snippet(res.Doc.Body, matched),
+				Score:   res.Score,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hits)
+}
+
+func eventSearchDoc(e Event) SearchDoc {
+	return SearchDoc{
+		Kind:     SearchKindEvent,
+		ID:       e.EventID,
+		Title:    e.Title,
+		Keywords: append(append([]string{e.Category}, e.Tags...), e.OrganizerName),
+		Body:     strings.TrimSpace(e.Description + "\n" + e.Location),
+	}
+}
+
+func placeSearchDoc(p Place) SearchDoc {
+	keywords := append([]string{p.City, p.Country, p.Category.MainCategory}, p.Category.SubCategories...)
+	return SearchDoc{
+		Kind:     SearchKindPlace,
+		ID:       p.PlaceID,
+		Title:    p.Name,
+		Keywords: append(keywords, p.Tags...),
+		Body:     strings.TrimSpace(p.Description + "\n" + p.Address),
+	}
+}
+
+// userSearchDoc holds only what a public profile shows.
+func userSearchDoc(u User) SearchDoc {
+	return SearchDoc{
+		Kind:     SearchKindUser,
+		ID:       u.UserID,
+		Title:    u.Username,
+		Keywords: []string{u.Name},
+		Body:     u.Bio,
+	}
+}
+
+// merchSearchDoc makes merch findable by the title of its event too.
+func merchSearchDoc(m Merch, eventTitle string) SearchDoc {
+	return SearchDoc{
+		Kind:    SearchKindMerch,
+		ID:      m.MerchID,
+		EventID: m.EventID,
+		Title:   m.Name,
+		Body:    eventTitle,
+	}
+}
+
+// indexDoc puts doc in the search index. Failures are only logged: the
+// record itself was saved, and a reindex puts it right.
+func indexDoc(ctx context.Context, doc SearchDoc) {
+	if err := searchIndex.Put(ctx, doc); err != nil {
+		log.Printf("Failed to index %s %s: %v", doc.Kind, doc.ID, err)
+	}
+}
+
+func unindexDoc(ctx context.Context, doc SearchDoc) {
+	if err := searchIndex.Delete(ctx, doc); err != nil {
+		log.Printf("Failed to remove %s %s from the search index: %v", doc.Kind, doc.ID, err)
+	}
+}
+
+// indexStores wraps the stores of searchable records so that every change
+// saved through them reaches searchIndex too.
+func indexStores(s *Stores) {
+	s.Events = indexedEventStore{EventStore: s.Events, merch: s.Merch}
+	s.Places = indexedPlaceStore{s.Places}
+	s.Users = indexedUserStore{s.Users}
+	s.Merch = indexedMerchStore{MerchStore: s.Merch, events: s.Events}
+}
+
+type indexedEventStore struct {
+	EventStore
+	merch MerchStore
+}
+
+// index puts event in the index, along with its merch, which is found by
+// the event's title too. Drafts are kept out, merch and all.
+func (s indexedEventStore) index(ctx context.Context, event Event) {
+	doc := eventSearchDoc(event)
+	if event.Status == EventDraft {
+		unindexDoc(ctx, doc)
+	} else {
+		indexDoc(ctx, doc)
+	}
+	merch, err := s.merch.ListByEvent(ctx, event.EventID)
+	if err != nil {
+		log.Printf("Failed to index the merch of event %s: %v", event.EventID, err)
+		return
+	}
+	for _, m := range merch {
+		if event.Status == EventDraft {
+			unindexDoc(ctx, merchSearchDoc(m, event.Title))
+		} else {
+			indexDoc(ctx, merchSearchDoc(m, event.Title))
+		}
+	}
+}
+
+func (s indexedEventStore) Create(ctx context.Context, event Event) error {
+	if err := s.EventStore.Create(ctx, event); err != nil {
+		return err
+	}
+	s.index(ctx, event)
+	return nil
+}
+
+func (s indexedEventStore) Update(ctx context.Context, event Event) error {
+	if err := s.EventStore.Update(ctx, event); err != nil {
+		return err
+	}
+	s.index(ctx, event)
+	return nil
+}
+
+func (s indexedEventStore) Transition(ctx context.Context, eventID, from, to string, at time.Time) (Event, error) {
+	event, err := s.EventStore.Transition(ctx, eventID, from, to, at)
+	if err != nil {
+		return event, err
+	}
+	s.index(ctx, event)
+	return event, nil
+}
+
+func (s indexedEventStore) Delete(ctx context.Context, eventID string) error {
+	if err := s.EventStore.Delete(ctx, eventID); err != nil {
+		return err
+	}
+	unindexDoc(ctx, SearchDoc{Kind: SearchKindEvent, ID: eventID})
+	return nil
+}
+
+type indexedPlaceStore struct{ PlaceStore }
+
+func (s indexedPlaceStore) Create(ctx context.Context, place Place) error {
+	if err := s.PlaceStore.Create(ctx, place); err != nil {
+		return err
+	}
+	indexDoc(ctx, placeSearchDoc(place))
+	return nil
+}
+
+func (s indexedPlaceStore) Update(ctx context.Context, place Place) error {
+	if err := s.PlaceStore.Update(ctx, place); err != nil {
+		return err
+	}
+	indexDoc(ctx, placeSearchDoc(place))
+	return nil
+}
+
+func (s indexedPlaceStore) Delete(ctx context.Context, placeID string) error {
+	if err := s.PlaceStore.Delete(ctx, placeID); err != nil {
+		return err
+	}
+	unindexDoc(ctx, SearchDoc{Kind: SearchKindPlace, ID: placeID})
+	return nil
+}
+
+type indexedUserStore struct{ UserStore }
+
+func (s indexedUserStore) Create(ctx context.Context, user User) error {
+	if err := s.UserStore.Create(ctx, user); err != nil {
+		return err
+	}
+	indexDoc(ctx, userSearchDoc(user))
+	return nil
+}
+
+func (s indexedUserStore) Update(ctx context.Context, user User) error {
+	if err := s.UserStore.Update(ctx, user); err != nil {
+		return err
+	}
+	indexDoc(ctx, userSearchDoc(user))
+	return nil
+}
+
+func (s indexedUserStore) Delete(ctx context.Context, userID string) error {
+	if err := s.UserStore.Delete(ctx, userID); err != nil {
+		return err
+	}
+	unindexDoc(ctx, SearchDoc{Kind: SearchKindUser, ID: userID})
+	return nil
+}
+
+type indexedMerchStore struct {
+	MerchStore
+	events EventStore
+}
+
+func (s indexedMerchStore) index(ctx context.Context, merch Merch) {
+	event, err := s.events.Get(ctx, merch.EventID)
+	if err != nil && err != ErrNotFound {
+		log.Printf("Failed to index merch %s: %v", merch.MerchID, err)
+		return
+	}
+	if event.Status == EventDraft {
+		return
+	}
+	indexDoc(ctx, merchSearchDoc(merch, event.Title))
+}
+
+func (s indexedMerchStore) Create(ctx context.Context, merch Merch) error {
+	if err := s.MerchStore.Create(ctx, merch); err != nil {
+		return err
+	}
+	s.index(ctx, merch)
+	return nil
+}
+
+func (s indexedMerchStore) Update(ctx context.Context, merch Merch) error {
+	if err := s.MerchStore.Update(ctx, merch); err != nil {
+		return err
+	}
+	s.index(ctx, merch)
+	return nil
+}
+
+func (s indexedMerchStore) Delete(ctx context.Context, eventID, merchID string) error {
+	if err := s.MerchStore.Delete(ctx, eventID, merchID); err != nil {
+		return err
+	}
+	unindexDoc(ctx, SearchDoc{Kind: SearchKindMerch, ID: merchID, EventID: eventID})
+	return nil
+}
+
+// rebuildSearchIndex puts every searchable record in the index again and
+// returns how many there were.
+func rebuildSearchIndex(ctx context.Context) (int, error) {
+	n := 0
+	put := func(doc SearchDoc) error {
+		n++
+		return searchIndex.Put(ctx, doc)
+	}
+
+	events, err := stores.Events.List(ctx)
+	if err != nil {
+		return n, err
+	}
+	for _, event := range events {
+		if event.Status == EventDraft {
+			continue
+		}
+		if err := put(eventSearchDoc(event)); err != nil {
+			return n, err
+		}
+		merch, err := stores.Merch.ListByEvent(ctx, event.EventID)
+		if err != nil {
+			return n, err
+		}
+		for _, m := range merch {
+			if err := put(merchSearchDoc(m, event.Title)); err != nil {
+				return n, err
+			}
+		}
+	}
+	places, err := stores.Places.List(ctx)
+	if err != nil {
+		return n, err
+	}
+	for _, place := range places {
+		if err := put(placeSearchDoc(place)); err != nil {
+			return n, err
+		}
+	}
+	users, err := stores.Users.List(ctx)
+	if err != nil {
+		return n, err
+	}
+	for _, user := range users {
+		if err := put(userSearchDoc(user)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// newSearchIndex returns the index config.Search picks.
+func newSearchIndex() SearchIndex {
+	if config.Store == StoreMongo && config.Search.Index != StoreMemory {
+		return &mongoSearchIndex{coll: client.Database(config.Database).Collection("search")}
+	}
+	return newMemorySearchIndex()
+}
+
+// fillSearchIndex builds the index at startup if it is empty, as the
+// memory index always is.
+func fillSearchIndex(ctx context.Context) {
+	if n, err := searchIndex.Count(ctx); err != nil || n > 0 {
+		return
+	}
+	start := time.Now()
+	n, err := rebuildSearchIndex(ctx)
+	if err != nil {
+		log.Printf("Failed to build the search index: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Indexed %d records for search in %s", n, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// reindexSearch lets an admin rebuild the search index from the stores
+func reindexSearch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	n, err := rebuildSearchIndex(r.Context())
+	if err != nil {
+		log.Printf("Failed to rebuild the search index: %v", err)
+		http.Error(w, "Failed to rebuild the search index", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, map[string]int{"indexed": n}, "Search index rebuilt", nil)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// memorySearchIndex is an inverted index held in process memory: for each
+// term, the documents holding it and how often. It ranks with BM25, which
+// favours rare terms and short fields, counting a term in a title three
+// times and in a keyword twice. It starts empty, so it is filled from the
+// stores at startup.
+type memorySearchIndex struct {
+	mu       sync.RWMutex
+	docs     map[string]*memorySearchDoc
+	postings map[string]map[string]float64 // Term, then doc key, to weighted frequency
+	length   float64                       // Sum of the weighted lengths of all docs
+	terms    []string                      // Every term, sorted; nil when it needs rebuilding
+}
+
+type memorySearchDoc struct {
+	doc    SearchDoc
+	freqs  map[string]float64
+	length float64
+}
+
+// Weights of the fields of a SearchDoc, and the BM25 parameters
+const (
+	titleWeight   = 3
+	keywordWeight = 2
+	bodyWeight    = 1
+
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+func newMemorySearchIndex() *memorySearchIndex {
+	return &memorySearchIndex{
+		docs:     make(map[string]*memorySearchDoc),
+		postings: make(map[string]map[string]float64),
+	}
+}
+
+func (x *memorySearchIndex) Put(_ context.Context, doc SearchDoc) error {
+	d := &memorySearchDoc{doc: doc, freqs: make(map[string]float64)}
+	add := func(text string, weight float64) {
+		for _, term := range tokenize(text) {
+			d.freqs[term] += weight
+			d.length += weight
+		}
+	}
+	add(doc.Title, titleWeight)
+	for _, keyword := range doc.Keywords {
+		add(keyword, keywordWeight)
+	}
+	add(doc.Body, bodyWeight)
+
+	key := docKey(doc)
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(key)
+	x.docs[key] = d
+	x.length += d.length
+	for term, freq := range d.freqs {
+		if x.postings[term] == nil {
+			x.postings[term] = make(map[string]float64)
+			x.terms = nil
+		}
+		x.postings[term][key] = freq
+	}
+	return nil
+}
+
+func (x *memorySearchIndex) Delete(_ context.Context, doc SearchDoc) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(docKey(doc))
+	return nil
+}
+
+// remove takes a document out of the index. The caller holds the lock.
+func (x *memorySearchIndex) remove(key string) {
+	d, ok := x.docs[key]
+	if !ok {
+		return
+	}
+	for term := range d.freqs {
+		delete(x.postings[term], key)
+		if len(x.postings[term]) == 0 {
+			delete(x.postings, term)
+			x.terms = nil
+		}
+	}
+	x.length -= d.length
+	delete(x.docs, key)
+}
+
+func (x *memorySearchIndex) Terms(_ context.Context, prefix string, minLen, maxLen, limit int) ([]string, error) {
+	terms := x.sortedTerms()
+	var out []string
+	for i := sort.SearchStrings(terms, prefix); i < len(terms) && strings.HasPrefix(terms[i], prefix); i++ {
+		n := utf8.RuneCountInString(terms[i])
+		if n < minLen || (maxLen > 0 && n > maxLen) {
+			continue
+		}
+		out = append(out, terms[i])
+		if limit > 0 && len(out) == limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+// sortedTerms returns every term in order, sorting them again if the
+// vocabulary has changed.
+func (x *memorySearchIndex) sortedTerms() []string {
+	x.mu.RLock()
+	terms := x.terms
+	x.mu.RUnlock()
+	if terms != nil {
+		return terms
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.terms == nil {
+		x.terms = make([]string, 0, len(x.postings))
+		for term := range x.postings {
+			x.terms = append(x.terms, term)
+		}
+		sort.Strings(x.terms)
+	}
+	return x.terms
+}
+
+func (x *memorySearchIndex) Search(_ context.Context, q SearchQuery) ([]SearchResult, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	if len(x.docs) == 0 || len(q.Words) == 0 {
+		return nil, nil
+	}
+	n := float64(len(x.docs))
+	avgLength := x.length / n
+
+	// Each word scores a document by its best term there; a document
+	// missing every term of a word is out
+	var scores map[string]float64
+	for _, word := range q.Words {
+		best := make(map[string]float64)
+		for _, t := range word {
+			docs := x.postings[t.Term]
+			idf := math.Log(1 + (n-float64(len(docs))+0.5)/(float64(len(docs))+0.5))
+			for key, freq := range docs {
+				d := x.docs[key]
+				if len(q.Kinds) > 0 && !contains(q.Kinds, d.doc.Kind) {
+					continue
+				}
+				norm := bm25K1 * (1 - bm25B + bm25B*d.length/avgLength)
+				score := t.Weight * idf * freq * (bm25K1 + 1) / (freq + norm)
+				best[key] = max(best[key], score)
+			}
+		}
+		if scores == nil {
+			scores = best
+			continue
+		}
+		for key, score := range scores {
+			if extra, ok := best[key]; ok {
+				scores[key] = score + extra
+			} else {
+				delete(scores, key)
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for key, score := range scores {
+		results = append(results, SearchResult{Doc: x.docs[key].doc, Score: score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return docKey(results[i].Doc) < docKey(results[j].Doc)
+	})
+	if len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	return results, nil
+}
+
+func (x *memorySearchIndex) Count(_ context.Context) (int, error) {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return len(x.docs), nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoSearchIndex keeps SearchDocs in a collection with a text index,
+// which does the ranking. Each document also lists its terms, which is
+// what completions and typo corrections are looked up in.
+type mongoSearchIndex struct {
+	coll *mongo.Collection
+}
+
+// mongoSearchCandidates is how many more documents than asked for are
+// fetched, to be ranked again with the weights of the terms they matched.
+const mongoSearchCandidates = 3
+
+type mongoSearchDoc struct {
+	Key       string `bson:"_id"`
+	SearchDoc `bson:",inline"`
+	Terms     []string `bson:"terms"`
+	Score     float64  `bson:"score,omitempty"` // Text score, when searching
+}
+
+func (x *mongoSearchIndex) Put(ctx context.Context, doc SearchDoc) error {
+	stored := mongoSearchDoc{Key: docKey(doc), SearchDoc: doc, Terms: docTerms(doc)}
+	_, err := x.coll.ReplaceOne(ctx, bson.M{"_id": stored.Key}, stored, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (x *mongoSearchIndex) Delete(ctx context.Context, doc SearchDoc) error {
+	_, err := x.coll.DeleteOne(ctx, bson.M{"_id": docKey(doc)})
+	return err
+}
+
+func (x *mongoSearchIndex) Terms(ctx context.Context, prefix string, minLen, maxLen, limit int) ([]string, error) {
+	prefixPattern := "^" + regexp.QuoteMeta(prefix)
+	rest := utf8.RuneCountInString(prefix)
+	length := fmt.Sprintf(".{%d,}$", max(0, minLen-rest))
+	if maxLen > 0 {
+		length = fmt.Sprintf(".{%d,%d}$", max(0, minLen-rest), max(0, maxLen-rest))
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"terms": bson.M{"$regex": prefixPattern}}}},
+		{{Key: "$unwind", Value: "$terms"}},
+		{{Key: "$match", Value: bson.M{"terms": bson.M{"$regex": prefixPattern + length}}}},
+		{{Key: "$group", Value: bson.M{"_id": "$terms"}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: limit}})
+	}
+	cursor, err := x.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var rows []struct {
+		Term string `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	terms := make([]string, len(rows))
+	for i, row := range rows {
+		terms[i] = row.Term
+	}
+	return terms, nil
+}
+
+func (x *mongoSearchIndex) Search(ctx context.Context, q SearchQuery) ([]SearchResult, error) {
+	if len(q.Words) == 0 {
+		return nil, nil
+	}
+	var all []string
+	var and bson.A
+	for _, word := range q.Words {
+		var terms []string
+		for _, t := range word {
+			terms = append(terms, t.Term)
+		}
+		all = append(all, terms...)
+		and = append(and, bson.M{"terms": bson.M{"$in": terms}})
+	}
+	filter := bson.M{"$text": bson.M{"$search": strings.Join(all, " ")}, "$and": and}
+	if len(q.Kinds) > 0 {
+		filter["kind"] = bson.M{"$in": q.Kinds}
+	}
+	score := bson.M{"$meta": "textScore"}
+	opts := options.Find().
+		SetProjection(bson.M{"score": score}).
+		SetSort(bson.M{"score": score}).
+		SetLimit(int64(q.Limit * mongoSearchCandidates))
+	cursor, err := x.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var docs []mongoSearchDoc
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+
+	// The text score treats every term alike, so scale it down by how far
+	// the terms a document matched are from what was typed
+	results := make([]SearchResult, len(docs))
+	for i, doc := range docs {
+		factor := 1.0
+		for _, word := range q.Words {
+			best := 0.0
+			for _, t := range word {
+				if contains(doc.Terms, t.Term) {
+					best = max(best, t.Weight)
+				}
+			}
+			factor *= best
+		}
+		results[i] = SearchResult{Doc: doc.SearchDoc, Score: doc.Score * factor}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	return results, nil
+}
+
+func (x *mongoSearchIndex) Count(ctx context.Context) (int, error) {
+	n, err := x.coll.EstimatedDocumentCount(ctx)
+	return int(n), err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// searchFor runs GET /api/search?q=text and returns the kind and ID of
+// each hit.
+func searchFor(t *testing.T, text string) []string {
+	t.Helper()
+	w := serveAs(search, "", http.MethodGet, "/api/search?q="+text, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("search for %q = %d %s", text, w.Code, w.Body)
+	}
+	var hits []SearchHit
+	if err := json.Unmarshal(w.Body.Bytes(), &hits); err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, hit := range hits {
+		found = append(found, hit.Kind+":"+hit.ID)
+	}
+	return found
+}
+
+func TestSearchLeavesOutDrafts(t *testing.T) {
+	useMemoryStores(t)
+	indexStores(stores)
+	ctx := context.Background()
+	if err := stores.Events.Create(ctx, Event{EventID: "e1", Title: "Secret gala", CreatorID: "organizer", Status: EventDraft}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Merch.Create(ctx, Merch{MerchID: "m1", EventID: "e1", Name: "Gala poster"}); err != nil {
+		t.Fatal(err)
+	}
+	if found := searchFor(t, "gala"); len(found) != 0 {
+		t.Errorf("search of drafts = %v, want nothing", found)
+	}
+	if n, err := rebuildSearchIndex(ctx); err != nil || n != 0 {
+		t.Errorf("rebuildSearchIndex() = %d, %v; want nothing indexed", n, err)
+	}
+
+	// Publishing brings the event and its merch in
+	if _, err := stores.Events.Transition(ctx, "e1", EventDraft, EventPublished, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if found := strings.Join(searchFor(t, "gala"), " "); found != "event:e1 merch:m1" && found != "merch:m1 event:e1" {
+		t.Errorf("search of a published event = %v, want the event and its merch", found)
+	}
+
+	// And going back to a draft takes them out again
+	event, err := stores.Events.Get(ctx, "e1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.Status = EventDraft
+	if err := stores.Events.Update(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if found := searchFor(t, "gala"); len(found) != 0 {
+		t.Errorf("search after unpublishing = %v, want nothing", found)
+	}
+}
+
+func TestEventListLeavesOutDrafts(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	for _, e := range []Event{
+		{EventID: "e1", Title: "Open", CreatorID: "organizer", Status: EventPublished},
+		{EventID: "e2", Title: "Mine", CreatorID: "organizer", Status: EventDraft},
+		{EventID: "e3", Title: "Theirs", CreatorID: "other", Status: EventDraft},
+	} {
+		if err := stores.Events.Create(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		viewer, query string
+		want          string
+	}{
+		{"", "sort=title", "e1"},
+		{"", "status=draft", ""},
+		{"u1", "sort=title", "e1"},
+		{"organizer", "sort=title", "e2 e1"},
+		{"organizer", "status=draft", "e2"},
+		{"organizer", "q=theirs", ""},
+	}
+	for _, tt := range tests {
+		ids, _ := listEvents(t, tt.viewer, tt.query)
+		if strings.Join(ids, " ") != tt.want {
+			t.Errorf("GET /api/events?%s as %q = %v, want %q", tt.query, tt.viewer, ids, tt.want)
+		}
+	}
+
+	for _, viewer := range []string{"", "u1"} {
+		if code := serveAs(getEvent, viewer, http.MethodGet, "/api/event/e2", "", "eventid", "e2").Code; code != http.StatusNotFound {
+			t.Errorf("GET a draft as %q = %d, want %d", viewer, code, http.StatusNotFound)
+		}
+	}
+}
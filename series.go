@@ -0,0 +1,850 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// An event series is a template for events and an RRule saying when they
+// happen. Its occurrences are made as ordinary events, each with its own
+// tickets, up to config.Series.Horizon ahead; the event scheduler keeps
+// that window filled. Everything else (selling, check-in, the lifecycle,
+// search) treats them as the events they are.
+//
+// Changing one occurrence on its own, through PUT /api/event/:eventid or
+// scope "this" below, records the fields changed in its SeriesOverrides,
+// and later changes to the series leave those fields alone. Scope "all"
+// changes the series and its upcoming occurrences; "following" ends the
+// series before the occurrence and starts a new one from it with the
+// changes. Occurrences that have started are never changed.
+
+// seriesFields are the fields of an occurrence that come from its series.
+var seriesFields = []string{"title", "description", "place", "location", "category", "tags", "start_date_time", "end_date_time"}
+
+// maxOccurrencesAhead bounds how many occurrences of a series are made at
+// once, whatever the horizon.
+const maxOccurrencesAhead = 500
+
+// location is the time zone the series recurs in.
+func (s EventSeries) location() *time.Location {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+func (s EventSeries) rule() (RRule, error) {
+	return parseRRule(s.RRule, s.location())
+}
+
+func (s EventSeries) checkFields(errs FieldErrors) {
+	for _, tag := range s.Tags {
+		if n := utf8.RuneCountInString(strings.TrimSpace(tag)); n == 0 || n > 30 {
+			errs.add("tags", "each tag must be 1 to 30 characters")
+		}
+	}
+	for _, ticket := range s.Tickets {
+		for field, problem := range validate(ticket) {
+			errs.add("tickets."+field, problem)
+		}
+	}
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		errs.add("time_zone", "must be a time zone such as Europe/Paris")
+		return
+	}
+	if s.RRule == "" || s.Start.IsZero() {
+		return
+	}
+	r, err := parseRRule(s.RRule, loc)
+	if err != nil {
+		errs.add("rrule", err.Error())
+		return
+	}
+	var first time.Time
+	r.each(s.Start.In(loc), func(t time.Time) bool {
+		first = t
+		return false
+	})
+	if !first.Equal(s.Start) {
+		errs.add("start", "must be an occurrence of rrule")
+	}
+}
+
+// isException reports whether the occurrence of s starting at t is skipped.
+func (s EventSeries) isException(t time.Time) bool {
+	for _, ex := range s.ExDates {
+		if ex.Equal(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// seriesStarts returns the starts of the occurrences of s from from up to
+// but not including to, but no more than maxOccurrencesAhead. until is how
+// far that got, which is to unless the limit was hit, and finished reports
+// whether the series has no occurrences after that.
+func seriesStarts(s EventSeries, from, to time.Time) (starts []time.Time, until time.Time, finished bool) {
+	r, err := s.rule()
+	if err != nil {
+		return nil, to, true
+	}
+	until, finished = to, true
+	r.each(s.Start.In(s.location()), func(t time.Time) bool {
+		if !t.Before(to) {
+			finished = false
+			return false
+		}
+		if t.Before(from) || s.isException(t) {
+			return true
+		}
+		starts = append(starts, t.UTC())
+		if len(starts) == maxOccurrencesAhead {
+			until, finished = t.Add(time.Second), false
+			return false
+		}
+		return true
+	})
+	return starts, until, finished
+}
+
+// newOccurrence makes the event for the occurrence of s starting at start.
+func newOccurrence(s EventSeries, start, now time.Time) Event {
+	start = start.UTC()
+	event := Event{
+		EventID:         generateID(14),
+		Title:           s.Title,
+		Description:     s.Description,
+		Place:           s.Place,
+		Location:        s.Location,
+		Category:        s.Category,
+		Tags:            append([]string(nil), s.Tags...),
+		CreatorID:       s.CreatorID,
+		StartDateTime:   start,
+		EndDateTime:     start.Add(time.Duration(s.Duration) * time.Minute),
+		Status:          s.Status,
+		StatusChangedAt: now,
+		SeriesID:        s.SeriesID,
+		OccurrenceStart: &start,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if event.Status == EventPublished {
+		event.PublishedAt = &now
+	}
+	return event
+}
+
+// createOccurrence saves the occurrence of s starting at start, with a
+// fresh stock of each of the series' tickets.
+func createOccurrence(ctx context.Context, s EventSeries, start, now time.Time) (Event, error) {
+	event := newOccurrence(s, start, now)
+	if err := stores.Events.Create(ctx, event); err != nil {
+		return Event{}, err
+	}
+	for _, t := range s.Tickets {
+		ticket := Ticket{TicketID: generateID(12), EventID: event.EventID, Name: t.Name, Price: t.Price, Quantity: t.Quantity}
+		if err := stores.Tickets.Create(ctx, ticket); err != nil {
+			return event, err
+		}
+	}
+	if len(s.Tickets) > 0 {
+		refreshTicketSummary(ctx, event.EventID)
+	}
+	return event, nil
+}
+
+// extendSeries makes the occurrences of s up to the horizon from now that
+// don't exist yet, and returns how many it made. It returns ErrConflict if
+// another caller got there first.
+func extendSeries(ctx context.Context, s EventSeries, now time.Time) (int, error) {
+	horizon := now.Add(config.Series.Horizon).Truncate(time.Second)
+	from := s.GeneratedUntil
+	if from.Before(now) {
+		from = now
+	}
+	starts, until, finished := seriesStarts(s, from, horizon)
+	if err := stores.Series.Extend(ctx, s.SeriesID, s.GeneratedUntil, until, finished); err != nil {
+		return 0, err
+	}
+	for i, start := range starts {
+		if _, err := createOccurrence(ctx, s, start, now); err != nil {
+			return i, err
+		}
+	}
+	return len(starts), nil
+}
+
+// extendAllSeries is the event scheduler's part in keeping occurrences
+// made ahead. It returns how many it made.
+func extendAllSeries(ctx context.Context, now time.Time) (int, error) {
+	const batch = 100
+	made := 0
+	horizon := now.Add(config.Series.Horizon).Truncate(time.Second)
+	for {
+		due, err := stores.Series.ListToExtend(ctx, horizon, batch)
+		if err != nil {
+			return made, err
+		}
+		for _, s := range due {
+			n, err := extendSeries(ctx, s, now)
+			made += n
+			if err == ErrConflict || err == ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return made, err
+			}
+		}
+		if len(due) < batch {
+			return made, nil
+		}
+	}
+}
+
+// removeOccurrence takes an upcoming occurrence out of its series. One
+// that has sold anything is cancelled, with reason, so buyers can be
+// refunded; the rest are deleted with their tickets and merch.
+func removeOccurrence(ctx context.Context, event Event, reason string, now time.Time) error {
+	orders, err := stores.Orders.ListByEvent(ctx, event.EventID)
+	if err != nil {
+		return err
+	}
+	if len(orders) > 0 {
+		if event.Status != EventCancelled {
+			if !canTransition(event.Status, EventCancelled) {
+				return nil // Too late to cancel; leave it be
+			}
+			_, err := stores.Events.Transition(ctx, event.EventID, event.Status, EventCancelled, now)
+			if err == ErrConflict || err == ErrNotFound {
+				return nil // It moved on meanwhile
+			}
+			if err != nil {
+				return err
+			}
+		}
+		_, err := stores.Events.Set(ctx, event.EventID, map[string]interface{}{"status_reason": reason, "updated_at": now})
+		return err
+	}
+
+	tickets, err := stores.Tickets.ListByEvent(ctx, event.EventID)
+	if err != nil {
+		return err
+	}
+	for _, ticket := range tickets {
+		if err := stores.Tickets.Delete(ctx, event.EventID, ticket.TicketID); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	merch, err := stores.Merch.ListByEvent(ctx, event.EventID)
+	if err != nil {
+		return err
+	}
+	for _, m := range merch {
+		if err := stores.Merch.Delete(ctx, event.EventID, m.MerchID); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	if err := stores.Events.Delete(ctx, event.EventID); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// overrideSeriesFields records that fields of the occurrence event were
+// changed on it alone.
+func overrideSeriesFields(event *Event, fields ...string) {
+	if event.SeriesID == "" {
+		return
+	}
+	for _, field := range fields {
+		if contains(seriesFields, field) && !contains(event.SeriesOverrides, field) {
+			event.SeriesOverrides = append(event.SeriesOverrides, field)
+		}
+	}
+}
+
+// copySeriesField sets field, one of seriesFields other than the times, of
+// an occurrence from its series.
+func copySeriesField(event *Event, s EventSeries, field string) {
+	switch field {
+	case "title":
+		event.Title = s.Title
+	case "description":
+		event.Description = s.Description
+	case "place":
+		event.Place = s.Place
+	case "location":
+		event.Location = s.Location
+	case "category":
+		event.Category = s.Category
+	case "tags":
+		event.Tags = append([]string(nil), s.Tags...)
+	}
+}
+
+// upcomingOccurrences returns the occurrences of a series a change to it
+// may still touch: those that haven't started.
+func upcomingOccurrences(ctx context.Context, seriesID string, now time.Time) ([]Event, error) {
+	events, err := stores.Events.ListBySeries(ctx, seriesID)
+	if err != nil {
+		return nil, err
+	}
+	var upcoming []Event
+	for _, event := range events {
+		if event.StartDateTime.After(now) && (event.Status == EventDraft || event.Status == EventPublished || event.Status == EventPostponed || event.Status == EventCancelled) {
+			upcoming = append(upcoming, event)
+		}
+	}
+	return upcoming, nil
+}
+
+// syncOccurrences brings the upcoming occurrences of s in line with it
+// after the fields in changed were changed on it. When its times changed,
+// occurrences keep their place where their start still occurs and are
+// otherwise moved, in order, to the new starts; those left over are
+// removed, and new starts left over get new occurrences.
+func syncOccurrences(ctx context.Context, s EventSeries, changed []string, now time.Time) error {
+	upcoming, err := upcomingOccurrences(ctx, s.SeriesID, now)
+	if err != nil {
+		return err
+	}
+	length := time.Duration(s.Duration) * time.Minute
+
+	if contains(changed, "start_date_time") {
+		starts, _, _ := seriesStarts(s, now, s.GeneratedUntil)
+		paired := make(map[int]time.Time) // Index in upcoming to new start
+		taken := make([]bool, len(starts))
+		for i, event := range upcoming {
+			for j, start := range starts {
+				if !taken[j] && event.OccurrenceStart != nil && event.OccurrenceStart.Equal(start) {
+					paired[i], taken[j] = start, true
+					break
+				}
+			}
+		}
+		j := 0
+		var kept []Event
+		for i, event := range upcoming {
+			if _, ok := paired[i]; !ok {
+				for j < len(starts) && taken[j] {
+					j++
+				}
+				if j == len(starts) {
+					if err := removeOccurrence(ctx, event, "No longer part of the series", now); err != nil {
+						return err
+					}
+					continue
+				}
+				paired[i], taken[j] = starts[j], true
+			}
+			start := paired[i]
+			event.OccurrenceStart = &start
+			if !contains(event.SeriesOverrides, "start_date_time") {
+				event.StartDateTime = start
+			}
+			kept = append(kept, event)
+		}
+		upcoming = kept
+		for j, start := range starts {
+			if !taken[j] {
+				if _, err := createOccurrence(ctx, s, start, now); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, event := range upcoming {
+		for _, field := range changed {
+			if !contains(event.SeriesOverrides, field) {
+				copySeriesField(&event, s, field)
+			}
+		}
+		if contains(changed, "end_date_time") && !contains(event.SeriesOverrides, "end_date_time") {
+			event.EndDateTime = event.StartDateTime.Add(length)
+		}
+		event.UpdatedAt = now
+		if err := stores.Events.Update(ctx, event); err != nil {
+			return err
+		}
+		if contains(changed, "status") && event.Status == EventDraft && s.Status == EventPublished {
+			_, err := stores.Events.Transition(ctx, event.EventID, EventDraft, EventPublished, now)
+			if err != nil && err != ErrConflict && err != ErrNotFound {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// splitSeries ends s before the occurrence starting at cut and returns
+// the rest of it as a new series starting there, which takes its share of
+// COUNT and the exceptions. Occurrences still have to be moved over.
+func splitSeries(s EventSeries, cut, now time.Time) (before, after EventSeries) {
+	r, _ := s.rule()
+	before, after = s, s
+	after.SeriesID = generateID(14)
+	after.Start = cut
+	after.CreatedAt, after.UpdatedAt = now, now
+	before.UpdatedAt = now
+
+	if r.Count > 0 {
+		n := 0
+		r.each(s.Start.In(s.location()), func(t time.Time) bool {
+			if !t.Before(cut) {
+				return false
+			}
+			n++
+			return true
+		})
+		rest := r
+		rest.Count -= n
+		after.RRule = rest.String()
+	}
+	r.Count, r.Until = 0, cut.Add(-time.Second)
+	before.RRule = r.String()
+
+	before.ExDates, after.ExDates = nil, nil
+	for _, ex := range s.ExDates {
+		if ex.Before(cut) {
+			before.ExDates = append(before.ExDates, ex)
+		} else {
+			after.ExDates = append(after.ExDates, ex)
+		}
+	}
+	return before, after
+}
+
+// seriesEdit is the body of PUT /api/series/:seriesid/events/:eventid.
+// Fields left out stay as they are. Start is the new start of the
+// occurrence named in the path; with scope "all" the others move as much
+// on the calendar.
+type seriesEdit struct {
+	Scope       string     `json:"scope"` // this, following or all
+	Title       *string    `json:"title"`
+	Description *string    `json:"description"`
+	Place       *string    `json:"place"`
+	Location    *string    `json:"location"`
+	Category    *string    `json:"category"`
+	Tags        *[]string  `json:"tags"`
+	Start       *time.Time `json:"start"`
+	Duration    *int       `json:"duration"`
+
+	// Only for scopes following and all
+	TimeZone *string         `json:"time_zone"`
+	RRule    *string         `json:"rrule"`
+	Tickets  *[]SeriesTicket `json:"tickets"` // For occurrences made from now on
+	Status   *string         `json:"status"`  // "published" publishes a draft series
+}
+
+// seriesOnly lists the fields set in edit that only apply to a series.
+func (edit seriesEdit) seriesOnly() []string {
+	var fields []string
+	if edit.TimeZone != nil {
+		fields = append(fields, "time_zone")
+	}
+	if edit.RRule != nil {
+		fields = append(fields, "rrule")
+	}
+	if edit.Tickets != nil {
+		fields = append(fields, "tickets")
+	}
+	if edit.Status != nil {
+		fields = append(fields, "status")
+	}
+	return fields
+}
+
+// applyToOccurrence makes edit to event alone.
+func (edit seriesEdit) applyToOccurrence(event *Event) {
+	strs := map[string]struct {
+		value  *string
+		target *string
+	}{
+		"title":       {edit.Title, &event.Title},
+		"description": {edit.Description, &event.Description},
+		"place":       {edit.Place, &event.Place},
+		"location":    {edit.Location, &event.Location},
+		"category":    {edit.Category, &event.Category},
+	}
+	for field, s := range strs {
+		if s.value != nil {
+			*s.target = *s.value
+			overrideSeriesFields(event, field)
+		}
+	}
+	if edit.Tags != nil {
+		event.Tags = *edit.Tags
+		overrideSeriesFields(event, "tags")
+	}
+	length := event.EndDateTime.Sub(event.StartDateTime)
+	if edit.Duration != nil {
+		length = time.Duration(*edit.Duration) * time.Minute
+	}
+	if edit.Start != nil {
+		event.StartDateTime = edit.Start.UTC().Truncate(time.Second)
+		overrideSeriesFields(event, "start_date_time")
+	}
+	if edit.Start != nil || edit.Duration != nil {
+		event.EndDateTime = event.StartDateTime.Add(length)
+		overrideSeriesFields(event, "end_date_time")
+	}
+}
+
+// applyToSeries makes edit to s, where occurrenceStart is the start s gave
+// the occurrence being edited, and returns the occurrence fields changed.
+func (edit seriesEdit) applyToSeries(s *EventSeries, occurrenceStart time.Time) []string {
+	var changed []string
+	strs := map[string]struct {
+		value  *string
+		target *string
+	}{
+		"title":       {edit.Title, &s.Title},
+		"description": {edit.Description, &s.Description},
+		"place":       {edit.Place, &s.Place},
+		"location":    {edit.Location, &s.Location},
+		"category":    {edit.Category, &s.Category},
+	}
+	for field, str := range strs {
+		if str.value != nil {
+			*str.target = *str.value
+			changed = append(changed, field)
+		}
+	}
+	if edit.Tags != nil {
+		s.Tags = *edit.Tags
+		changed = append(changed, "tags")
+	}
+	if edit.Tickets != nil {
+		s.Tickets = *edit.Tickets
+	}
+	if edit.Status != nil {
+		s.Status = *edit.Status
+		changed = append(changed, "status")
+	}
+	if edit.Duration != nil {
+		s.Duration = *edit.Duration
+		changed = append(changed, "end_date_time")
+	}
+	if edit.TimeZone != nil {
+		s.TimeZone = *edit.TimeZone
+	}
+	if edit.RRule != nil {
+		s.RRule = *edit.RRule
+	}
+	if edit.Start != nil {
+		// Move the start of the series by as many days as the occurrence
+		// moves, to the occurrence's new time of day
+		loc := s.location()
+		from, to := occurrenceStart.In(loc), edit.Start.In(loc)
+		days := civilDays(to) - civilDays(from)
+		move := func(t time.Time) time.Time {
+			y, m, d := t.In(loc).Date()
+			return time.Date(y, m, d+days, to.Hour(), to.Minute(), to.Second(), 0, loc).UTC()
+		}
+		s.Start = move(s.Start)
+		// The exceptions move with the occurrences they skip
+		exDates := make([]time.Time, len(s.ExDates))
+		for i, ex := range s.ExDates {
+			exDates[i] = move(ex)
+		}
+		s.ExDates = exDates
+	}
+	if edit.Start != nil || edit.TimeZone != nil || edit.RRule != nil {
+		changed = append(changed, "start_date_time", "end_date_time")
+	}
+	return changed
+}
+
+// civilDays numbers the calendar day of t, whatever its time zone.
+func civilDays(t time.Time) int {
+	y, m, d := t.Date()
+	return int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400)
+}
+
+// seriesVisibleTo reports whether the user viewerID may see s. Like draft
+// events, draft series are seen only by whoever manages them.
+func seriesVisibleTo(ctx context.Context, s EventSeries, viewerID string) bool {
+	if s.Status != EventDraft || (viewerID != "" && viewerID == s.CreatorID) {
+		return true
+	}
+	if viewerID == "" {
+		return false
+	}
+	viewer, err := stores.Users.GetByUserID(ctx, viewerID)
+	return err == nil && can(viewer.Role, PermManageAnyEvent)
+}
+
+// createSeries saves a series and makes its first occurrences.
+func createSeries(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+	var s EventSeries
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	stripReadOnly(&s)
+	s.CreatorID = userID
+	if s.Status == "" {
+		s.Status = EventPublished
+	}
+	s.Start = s.Start.UTC().Truncate(time.Second)
+	for i := range s.ExDates {
+		s.ExDates[i] = s.ExDates[i].UTC().Truncate(time.Second)
+	}
+	if errs := validate(s); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	now := time.Now().UTC()
+	s.SeriesID = generateID(14)
+	s.CreatedAt, s.UpdatedAt = now, now
+	s.GeneratedUntil = now.Truncate(time.Second)
+	if err := stores.Series.Create(r.Context(), s); err != nil {
+		http.Error(w, "Error saving series", http.StatusInternalServerError)
+		return
+	}
+	n, err := extendSeries(r.Context(), s, now)
+	if err != nil {
+		// The scheduler makes the rest
+		log.Printf("Failed to make the occurrences of series %s: %v", s.SeriesID, err)
+	}
+	if saved, err := stores.Series.Get(r.Context(), s.SeriesID); err == nil {
+		s = saved
+	}
+	sendResponse(w, http.StatusCreated, map[string]interface{}{"series": s, "occurrences": n}, "Series created", nil)
+}
+
+func getSeries(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	viewerID, _ := r.Context().Value(userIDKey).(string)
+	s, err := stores.Series.Get(r.Context(), ps.ByName("seriesid"))
+	if err != nil || !seriesVisibleTo(r.Context(), s, viewerID) {
+		http.Error(w, "Series not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// getSeriesEvents lists the occurrences of a series the caller may see,
+// earliest first. With upcoming=true only those yet to end are listed.
+func getSeriesEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	viewerID, _ := r.Context().Value(userIDKey).(string)
+	s, err := stores.Series.Get(r.Context(), ps.ByName("seriesid"))
+	if err != nil || !seriesVisibleTo(r.Context(), s, viewerID) {
+		http.Error(w, "Series not found", http.StatusNotFound)
+		return
+	}
+	events, err := stores.Events.ListBySeries(r.Context(), s.SeriesID)
+	if err != nil {
+		http.Error(w, "Failed to fetch events", http.StatusInternalServerError)
+		return
+	}
+	upcoming := r.URL.Query().Get("upcoming") == "true"
+	visible := []Event{}
+	for _, event := range events {
+		if upcoming && (event.Status == EventEnded || event.Status == EventCancelled) {
+			continue
+		}
+		if eventVisibleTo(r.Context(), event, viewerID) {
+			visible = append(visible, event)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visible)
+}
+
+// loadSeriesEvent loads the :seriesid series and its :eventid occurrence,
+// writing the error response itself if either is missing.
+func loadSeriesEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) (EventSeries, Event, bool) {
+	s, err := stores.Series.Get(r.Context(), ps.ByName("seriesid"))
+	if err != nil {
+		http.Error(w, "Series not found", http.StatusNotFound)
+		return s, Event{}, false
+	}
+	event, err := stores.Events.Get(r.Context(), ps.ByName("eventid"))
+	if err != nil || event.SeriesID != s.SeriesID || event.OccurrenceStart == nil {
+		http.Error(w, "Event not found in this series", http.StatusNotFound)
+		return s, event, false
+	}
+	return s, event, true
+}
+
+// editSeriesEvent changes the :eventid occurrence alone, it and those
+// after it, or the whole series, as the scope of the seriesEdit says.
+func editSeriesEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s, event, ok := loadSeriesEvent(w, r, ps)
+	if !ok {
+		return
+	}
+	var edit seriesEdit
+	if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UTC()
+	errs := FieldErrors{}
+	switch edit.Scope {
+	case "this", "following", "all":
+	default:
+		errs.add("scope", "must be one of this, following, all")
+	}
+	if edit.Scope == "this" {
+		for _, field := range edit.seriesOnly() {
+			errs.add(field, "needs scope following or all")
+		}
+	}
+	if edit.Status != nil && *edit.Status != EventPublished && *edit.Status != s.Status {
+		errs.add("status", "can only be published")
+	}
+	if edit.Scope != "this" && !event.StartDateTime.After(now) {
+		errs.add("scope", "this occurrence has started; only it can be changed")
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if edit.Scope == "this" {
+		edit.applyToOccurrence(&event)
+		event.UpdatedAt = now
+		if errs := validate(event); len(errs) > 0 {
+			writeValidationErrors(w, errs)
+			return
+		}
+		if err := stores.Events.Update(r.Context(), event); err != nil {
+			http.Error(w, "Error updating event", http.StatusInternalServerError)
+			return
+		}
+		sendResponse(w, http.StatusOK, event, "Occurrence updated", nil)
+		return
+	}
+
+	// "following" from the first occurrence is the same as "all"
+	cut := *event.OccurrenceStart
+	target := s
+	var before EventSeries
+	split := edit.Scope == "following" && cut.After(s.Start)
+	if split {
+		before, target = splitSeries(s, cut, now)
+	}
+	changed := edit.applyToSeries(&target, cut)
+	target.UpdatedAt = now
+	if edit.Start != nil {
+		target.Start = target.Start.Truncate(time.Second)
+	}
+	if errs := validate(target); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	if split {
+		if err := stores.Series.Create(r.Context(), target); err != nil {
+			http.Error(w, "Error saving series", http.StatusInternalServerError)
+			return
+		}
+		if err := stores.Series.Update(r.Context(), before); err != nil {
+			http.Error(w, "Error updating series", http.StatusInternalServerError)
+			return
+		}
+		// Hand the occurrences from the cut on to the new series
+		events, err := stores.Events.ListBySeries(r.Context(), s.SeriesID)
+		if err != nil {
+			http.Error(w, "Error updating series", http.StatusInternalServerError)
+			return
+		}
+		for _, e := range events {
+			if e.OccurrenceStart != nil && !e.OccurrenceStart.Before(cut) {
+				e.SeriesID = target.SeriesID
+				if err := stores.Events.Update(r.Context(), e); err != nil {
+					http.Error(w, "Error updating series", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+	} else if err := stores.Series.Update(r.Context(), target); err != nil {
+		http.Error(w, "Error updating series", http.StatusInternalServerError)
+		return
+	}
+
+	if err := syncOccurrences(r.Context(), target, changed, now); err != nil {
+		log.Printf("Failed to update the occurrences of series %s: %v", target.SeriesID, err)
+		http.Error(w, "Error updating the events of the series", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, target, "Series updated", nil)
+}
+
+// addSeriesException adds start to the exceptions of a series.
+func addSeriesException(ctx context.Context, seriesID string, start time.Time) error {
+	s, err := stores.Series.Get(ctx, seriesID)
+	if err != nil || s.isException(start) {
+		return err
+	}
+	s.ExDates = append(s.ExDates, start)
+	sort.Slice(s.ExDates, func(i, j int) bool { return s.ExDates[i].Before(s.ExDates[j]) })
+	s.UpdatedAt = time.Now().UTC()
+	return stores.Series.Update(ctx, s)
+}
+
+// deleteSeriesEvent drops one occurrence from its series as an exception,
+// so it isn't made again.
+func deleteSeriesEvent(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	s, event, ok := loadSeriesEvent(w, r, ps)
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	if !event.StartDateTime.After(now) {
+		http.Error(w, "This occurrence has already started", http.StatusConflict)
+		return
+	}
+	if err := addSeriesException(r.Context(), s.SeriesID, *event.OccurrenceStart); err != nil {
+		http.Error(w, "Error updating series", http.StatusInternalServerError)
+		return
+	}
+	if err := removeOccurrence(r.Context(), event, "Cancelled", now); err != nil {
+		http.Error(w, "Error removing event", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, nil, "Occurrence removed from the series", nil)
+}
+
+// deleteSeries deletes a series and its upcoming occurrences. Those that
+// have started are kept as events of their own.
+func deleteSeries(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	seriesID := ps.ByName("seriesid")
+	now := time.Now().UTC()
+	upcoming, err := upcomingOccurrences(r.Context(), seriesID, now)
+	if err != nil {
+		http.Error(w, "Error deleting series", http.StatusInternalServerError)
+		return
+	}
+	for _, event := range upcoming {
+		if err := removeOccurrence(r.Context(), event, "The series was cancelled", now); err != nil {
+			http.Error(w, "Error deleting series", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := stores.Series.Delete(r.Context(), seriesID); err != nil {
+		http.Error(w, "Error deleting series", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, nil, "Series deleted", nil)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// serve runs srv until ctx is cancelled, then stops accepting new
+// connections and waits up to drain for in-flight requests (including slow
+// multipart uploads and ticket purchases) to finish before returning.
+func serve(ctx context.Context, srv *http.Server, drain time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("Server listening on %s", srv.Addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		// The listener failed before we were asked to stop
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down gracefully (waiting up to %s for active requests)...", drain)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		// Deadline passed with requests still running; cut them off
+		srv.Close()
+		return err
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// runJob runs fn in its own goroutine and tracks it in jobs.
+func runJob(jobs *sync.WaitGroup, fn func()) {
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		fn()
+	}()
+}
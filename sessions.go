@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// sessionTouchInterval is how stale a session's last-seen time may get
+// before authenticate writes a new one. It keeps busy clients from
+// turning every request into a database write.
+const sessionTouchInterval = time.Minute
+
+// maxUserAgentLength bounds what we store from the User-Agent header.
+const maxUserAgentLength = 256
+
+// clientIP returns the address of the remote end of the connection.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// startSession records a new login of user from the device making r.
+func startSession(r *http.Request, user User) (Session, error) {
+	now := time.Now().UTC()
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	session := Session{
+		SessionID:  randomToken(12),
+		UserID:     user.UserID,
+		UserAgent:  userAgent,
+		IP:         clientIP(r),
+		CreatedAt:  now,
+		LastSeenAt: now,
+	}
+	if err := stores.Sessions.Create(r.Context(), session); err != nil {
+		return Session{}, err
+	}
+	if err := stores.Users.SetLastLogin(r.Context(), user.UserID, now); err != nil {
+		log.Printf("Failed to record login time of %s: %v", user.UserID, err)
+	}
+	return session, nil
+}
+
+// touchSession refreshes the last-seen time of session, and the user's
+// LastLogin with it, once it is older than sessionTouchInterval.
+func touchSession(r *http.Request, session Session) {
+	now := time.Now().UTC()
+	if now.Sub(session.LastSeenAt) < sessionTouchInterval {
+		return
+	}
+	if err := stores.Sessions.Touch(r.Context(), session.SessionID, clientIP(r), now); err != nil {
+		log.Printf("Failed to update session %s: %v", session.SessionID, err)
+		return
+	}
+	if err := stores.Users.SetLastLogin(r.Context(), session.UserID, now); err != nil {
+		log.Printf("Failed to record activity of %s: %v", session.UserID, err)
+	}
+}
+
+// getSessions lists the devices the caller is logged in on
+func getSessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	sessions, err := stores.Sessions.ListActive(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+		return
+	}
+	current := ""
+	if claims, ok := r.Context().Value(claimsKey).(*Claims); ok {
+		current = claims.SessionID
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].SessionID == current
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// deleteSession logs the caller out of one of their devices
+func deleteSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	// Someone else's session is reported as missing, not forbidden, so
+	// session IDs can't be probed
+	session, err := stores.Sessions.Get(r.Context(), ps.ByName("id"))
+	if err == ErrNotFound || (err == nil && (session.UserID != userID || session.EndedAt != nil)) {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch session", http.StatusInternalServerError)
+		return
+	}
+
+	if err := endSession(r.Context(), session.SessionID); err != nil {
+		http.Error(w, "Failed to end session", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, nil, "Session ended", nil)
+}
+
+// endSession ends a session and revokes its refresh tokens. Access tokens
+// of the session stop working because authenticate checks the session.
+func endSession(ctx context.Context, sessionID string) error {
+	if err := stores.RefreshTokens.RevokeSession(ctx, sessionID); err != nil {
+		log.Printf("Failed to revoke refresh tokens for session %s: %v", sessionID, err)
+		return err
+	}
+	if err := stores.Sessions.End(ctx, sessionID, time.Now().UTC()); err != nil && err != ErrNotFound {
+		log.Printf("Failed to end session %s: %v", sessionID, err)
+		return err
+	}
+	return nil
+}
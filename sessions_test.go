@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestSessions(t *testing.T) {
+	useMemoryStores(t)
+	router := newRouter(nil)
+	user := User{UserID: "u1", Username: "u1", Role: RoleUser}
+	laptop := startTestSession(t, user)
+	phone := startTestSession(t, user)
+	stranger := signIn(t, User{UserID: "u2", Username: "u2", Role: RoleUser})
+
+	list := func(pair tokenPair) []Session {
+		t.Helper()
+		w := serveRoute(router, "Bearer "+pair.Token, http.MethodGet, "/api/sessions", nil, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("sessions = %d, want %d", w.Code, http.StatusOK)
+		}
+		var sessions []Session
+		if err := json.Unmarshal(w.Body.Bytes(), &sessions); err != nil {
+			t.Fatal(err)
+		}
+		return sessions
+	}
+
+	sessions := list(laptop)
+	if len(sessions) != 2 {
+		t.Fatalf("%d sessions, want 2", len(sessions))
+	}
+	var phoneID string
+	for _, s := range sessions {
+		if !s.Current {
+			phoneID = s.SessionID
+		}
+	}
+	if phoneID == "" || sessions[0].Current == sessions[1].Current {
+		t.Fatalf("sessions = %+v, want exactly one marked current", sessions)
+	}
+
+	// Another user's session looks missing
+	if code := serveRoute(router, stranger, http.MethodDelete, "/api/sessions/"+phoneID, nil, "").Code; code != http.StatusNotFound {
+		t.Errorf("ending someone else's session = %d, want %d", code, http.StatusNotFound)
+	}
+
+	// Ending the phone's session from the laptop signs the phone out
+	if code := serveRoute(router, "Bearer "+laptop.Token, http.MethodDelete, "/api/sessions/"+phoneID, nil, "").Code; code != http.StatusOK {
+		t.Fatalf("ending the phone's session = %d, want %d", code, http.StatusOK)
+	}
+	if code := serveRoute(router, "Bearer "+phone.Token, http.MethodGet, "/api/sessions", nil, "").Code; code != http.StatusUnauthorized {
+		t.Errorf("phone's access token = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serveAs(refreshTokens, "", http.MethodPost, "/", `{"refresh_token": "`+phone.RefreshToken+`"}`).Code; code != http.StatusUnauthorized {
+		t.Errorf("phone's refresh token = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := serveRoute(router, "Bearer "+laptop.Token, http.MethodDelete, "/api/sessions/"+phoneID, nil, "").Code; code != http.StatusNotFound {
+		t.Errorf("ending it again = %d, want %d", code, http.StatusNotFound)
+	}
+	if sessions := list(laptop); len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("sessions left = %+v, want only the current one", sessions)
+	}
+
+	// Logging out ends the current session
+	if code := serveRoute(router, "Bearer "+laptop.Token, http.MethodPost, "/api/logout", nil, "").Code; code != http.StatusOK {
+		t.Fatalf("logout = %d, want %d", code, http.StatusOK)
+	}
+	if code := serveRoute(router, "Bearer "+laptop.Token, http.MethodGet, "/api/sessions", nil, "").Code; code != http.StatusUnauthorized {
+		t.Errorf("access token after logout = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Errors returned by every store implementation so handlers don't need to
+// know which backend they are talking to.
+var (
+	ErrNotFound  = errors.New("not found")
+	ErrDuplicate = errors.New("already exists")
+	ErrSoldOut   = errors.New("not enough stock available")
+	ErrConflict  = errors.New("record was changed concurrently")
+)
+
+// EventStore persists events.
+type EventStore interface {
+	Create(ctx context.Context, event Event) error
+	Get(ctx context.Context, eventID string) (Event, error)
+	List(ctx context.Context) ([]Event, error)
+	// Search returns up to q.Limit events matching q, in q.Sort order and
+	// after q.After, along with how many match in all.
+	Search(ctx context.Context, q EventQuery) ([]Event, int, error)
+	// Update saves an event but for its status, StatusChangedAt and
+	// PublishedAt, which only Transition changes.
+	Update(ctx context.Context, event Event) error
+	// Set changes only the given fields of an event, keyed by their bson
+	// names, and returns the event as saved. A nil value removes the field.
+	Set(ctx context.Context, eventID string, fields map[string]interface{}) (Event, error)
+	Delete(ctx context.Context, eventID string) error
+	// Transition moves an event from one status to another at the given
+	// time, failing with ErrConflict if it is no longer in the from status.
+	Transition(ctx context.Context, eventID, from, to string, at time.Time) (Event, error)
+	// ListDue returns up to limit events the scheduler should move on from
+	// their status at now (see scheduledStatus).
+	ListDue(ctx context.Context, now time.Time, limit int) ([]Event, error)
+	// ListBySeries returns the occurrences of a series, earliest first.
+	ListBySeries(ctx context.Context, seriesID string) ([]Event, error)
+	// SetTicketSummary stores the number of ticket types of an event and
+	// their price range.
+	SetTicketSummary(ctx context.Context, eventID string, types int, minPrice, maxPrice float64) error
+	AddReview(ctx context.Context, eventID string, review Review) error
+	// RemoveReview deletes one review, returning ErrNotFound if the event
+	// has no review with that ID.
+	RemoveReview(ctx context.Context, eventID, reviewID string) error
+}
+
+// SeriesStore persists event series. Their occurrences are in EventStore.
+type SeriesStore interface {
+	Create(ctx context.Context, series EventSeries) error
+	Get(ctx context.Context, seriesID string) (EventSeries, error)
+	// Update saves a series but for GeneratedUntil and Finished, which
+	// only Extend changes.
+	Update(ctx context.Context, series EventSeries) error
+	Delete(ctx context.Context, seriesID string) error
+	// Extend moves GeneratedUntil of a series from one time to another,
+	// failing with ErrConflict if it is no longer from, so only one caller
+	// makes the occurrences in between.
+	Extend(ctx context.Context, seriesID string, from, to time.Time, finished bool) error
+	// ListToExtend returns up to limit unfinished series whose occurrences
+	// have been made only up to before horizon.
+	ListToExtend(ctx context.Context, horizon time.Time, limit int) ([]EventSeries, error)
+}
+
+// PlaceStore persists places.
+type PlaceStore interface {
+	Create(ctx context.Context, place Place) error
+	Get(ctx context.Context, placeID string) (Place, error)
+	List(ctx context.Context) ([]Place, error)
+	// Search returns up to q.Limit places matching q, nearest first with
+	// Distance set when q.Near is.
+	Search(ctx context.Context, q GeoQuery) ([]Place, error)
+	Update(ctx context.Context, place Place) error
+	Delete(ctx context.Context, placeID string) error
+}
+
+// TicketStore persists ticket types belonging to an event.
+type TicketStore interface {
+	Create(ctx context.Context, ticket Ticket) error
+	Get(ctx context.Context, eventID, ticketID string) (Ticket, error)
+	ListByEvent(ctx context.Context, eventID string) ([]Ticket, error)
+	Update(ctx context.Context, ticket Ticket) error
+	Delete(ctx context.Context, eventID, ticketID string) error
+	AdjustQuantity(ctx context.Context, eventID, ticketID string, delta int) error
+	// Purchase atomically takes quantity units of the ticket, returning the
+	// ticket as it is after the purchase, or ErrSoldOut if fewer remain.
+	Purchase(ctx context.Context, eventID, ticketID string, quantity int) (Ticket, error)
+}
+
+// MerchStore persists merchandise belonging to an event.
+type MerchStore interface {
+	Create(ctx context.Context, merch Merch) error
+	Get(ctx context.Context, eventID, merchID string) (Merch, error)
+	ListByEvent(ctx context.Context, eventID string) ([]Merch, error)
+	Update(ctx context.Context, merch Merch) error
+	Delete(ctx context.Context, eventID, merchID string) error
+	AdjustStock(ctx context.Context, eventID, merchID string, delta int) error
+	// Purchase atomically takes quantity units of stock, returning the merch
+	// as it is after the purchase, or ErrSoldOut if fewer remain.
+	Purchase(ctx context.Context, eventID, merchID string, quantity int) (Merch, error)
+}
+
+// MediaStore persists media attached to an event.
+type MediaStore interface {
+	Create(ctx context.Context, media Media) error
+	Get(ctx context.Context, eventID, mediaID string) (Media, error)
+	ListByEvent(ctx context.Context, eventID string) ([]Media, error)
+	Delete(ctx context.Context, eventID, mediaID string) error
+}
+
+// UserStore persists user accounts and the follow graph.
+type UserStore interface {
+	Create(ctx context.Context, user User) error
+	GetByUsername(ctx context.Context, username string) (User, error)
+	GetByUserID(ctx context.Context, userID string) (User, error)
+	GetByEmail(ctx context.Context, email string) (User, error)
+	// GetByIdentity finds the user an external account is linked to.
+	GetByIdentity(ctx context.Context, issuer, subject string) (User, error)
+	List(ctx context.Context) ([]User, error)
+	// Update saves user, except for the failed sign-in count and time,
+	// which only change through the calls below.
+	Update(ctx context.Context, user User) error
+	Delete(ctx context.Context, userID string) error
+	// ClaimLoginAttempt counts a sign-in attempt made at at as a failure,
+	// until ResetLoginFailures says otherwise, and returns the number of
+	// failures since the last success. It returns ErrConflict unless the
+	// count is still seen, so two attempts can't both count as the same one.
+	ClaimLoginAttempt(ctx context.Context, userID string, seen int, at time.Time) (int, error)
+	// ResetLoginFailures clears the failure count after a success.
+	ResetLoginFailures(ctx context.Context, userID string) error
+	// UseTOTPStep records that a code for step was accepted. It returns
+	// ErrConflict unless two-factor authentication is on and step is later
+	// than the last step used, so a code is accepted once.
+	UseTOTPStep(ctx context.Context, userID string, step int64) error
+	// UseRecoveryCode removes the recovery code with the given hash,
+	// returning ErrConflict if it has already been used.
+	UseRecoveryCode(ctx context.Context, userID, hash string) error
+	// SetLastLogin records when the user was last active.
+	SetLastLogin(ctx context.Context, userID string, at time.Time) error
+	SetFollows(ctx context.Context, userID string, follows []string) error
+	AddFollower(ctx context.Context, userID, followerID string) error
+	RemoveFollower(ctx context.Context, userID, followerID string) error
+}
+
+// ActivityStore persists the per-user activity log.
+type ActivityStore interface {
+	Log(ctx context.Context, activity Activity) error
+	ListByUsername(ctx context.Context, username string) ([]Activity, error)
+}
+
+// OrderStore persists purchase records.
+type OrderStore interface {
+	Create(ctx context.Context, order Order) error
+	Get(ctx context.Context, orderID string) (Order, error)
+	ListByUser(ctx context.Context, userID string) ([]Order, error)
+	ListByEvent(ctx context.Context, eventID string) ([]Order, error)
+	// UpdateStatus moves an order from one status to another, failing with
+	// ErrConflict if it is no longer in the from status.
+	UpdateStatus(ctx context.Context, orderID, from, to string) error
+	// ListPending returns up to limit orders still pending that were
+	// created before cutoff.
+	ListPending(ctx context.Context, cutoff time.Time, limit int) ([]Order, error)
+}
+
+// ReservationStore persists checkout holds on tickets.
+type ReservationStore interface {
+	Create(ctx context.Context, reservation Reservation) error
+	Get(ctx context.Context, reservationID string) (Reservation, error)
+	ListByUser(ctx context.Context, userID string) ([]Reservation, error)
+	// Transition moves a reservation from one status to another, failing
+	// with ErrConflict if it is no longer in the from status. A non-empty
+	// orderID is stored alongside the new status.
+	Transition(ctx context.Context, reservationID, from, to, orderID string) (Reservation, error)
+	// ListExpired returns up to limit held reservations whose hold ended
+	// at or before now.
+	ListExpired(ctx context.Context, now time.Time, limit int) ([]Reservation, error)
+}
+
+// TicketInstanceStore persists the admissions issued for ticket orders.
+type TicketInstanceStore interface {
+	// Issue saves an instance unless one with the same ID already exists,
+	// so issuing the tickets of an order twice is harmless.
+	Issue(ctx context.Context, instance TicketInstance) error
+	Get(ctx context.Context, instanceID string) (TicketInstance, error)
+	ListByHolder(ctx context.Context, holderID string) ([]TicketInstance, error)
+	ListByOrder(ctx context.Context, orderID string) ([]TicketInstance, error)
+	// VoidByOrder marks every instance of an order void.
+	VoidByOrder(ctx context.Context, orderID string) error
+	// CheckIn records the earliest scan of a valid instance: the first
+	// scan checks it in, and one taken before the recorded scan (an
+	// offline scan uploaded late) replaces it. For any other scan, or a
+	// void instance, it returns the stored instance with ErrConflict.
+	CheckIn(ctx context.Context, instanceID, by, device string, at time.Time) (TicketInstance, error)
+	// CountByEvent reports how many valid instances an event has and how
+	// many of them have been checked in.
+	CountByEvent(ctx context.Context, eventID string) (issued, checkedIn int, err error)
+}
+
+// RefreshTokenStore persists refresh tokens.
+type RefreshTokenStore interface {
+	Create(ctx context.Context, token RefreshToken) error
+	Get(ctx context.Context, tokenID string) (RefreshToken, error)
+	// MarkUsed retires an active token, failing with ErrConflict if it was
+	// already used or revoked.
+	MarkUsed(ctx context.Context, tokenID string) error
+	// RevokeSession revokes every token of a session.
+	RevokeSession(ctx context.Context, sessionID string) error
+	// RevokeUser revokes every active token of a user and returns the IDs
+	// of the sessions they belonged to.
+	RevokeUser(ctx context.Context, userID string) ([]string, error)
+}
+
+// RevocationStore is the deny list checked by authenticate.
+type RevocationStore interface {
+	Revoke(ctx context.Context, revocation Revocation) error
+	// IsRevoked reports whether any of keys has an unexpired revocation.
+	IsRevoked(ctx context.Context, keys ...string) (bool, error)
+}
+
+// SessionStore persists login sessions.
+type SessionStore interface {
+	Create(ctx context.Context, session Session) error
+	Get(ctx context.Context, sessionID string) (Session, error)
+	// ListActive returns the sessions of a user that haven't ended, most
+	// recently seen first.
+	ListActive(ctx context.Context, userID string) ([]Session, error)
+	// Touch records activity on a session from ip.
+	Touch(ctx context.Context, sessionID, ip string, at time.Time) error
+	// End ends a session. Ending a session twice is not an error.
+	End(ctx context.Context, sessionID string, at time.Time) error
+	// EndUser ends every session of a user.
+	EndUser(ctx context.Context, userID string, at time.Time) error
+}
+
+// LoginFailureStore keeps the audit trail of rejected sign-ins.
+type LoginFailureStore interface {
+	Record(ctx context.Context, failure LoginFailure) error
+	// ListByUser returns up to limit of a user's most recent failures,
+	// newest first.
+	ListByUser(ctx context.Context, userID string, limit int) ([]LoginFailure, error)
+}
+
+// APIKeyStore persists API keys.
+type APIKeyStore interface {
+	Create(ctx context.Context, key APIKey) error
+	Get(ctx context.Context, keyID string) (APIKey, error)
+	// ListByUser returns every key of a user, revoked ones included,
+	// newest first.
+	ListByUser(ctx context.Context, userID string) ([]APIKey, error)
+	// Revoke revokes a key. Revoking a key twice is not an error.
+	Revoke(ctx context.Context, keyID string, at time.Time) error
+	// RevokeUser revokes every live key of a user.
+	RevokeUser(ctx context.Context, userID string, at time.Time) error
+	// Touch records that the key was used from ip.
+	Touch(ctx context.Context, keyID, ip string, at time.Time) error
+}
+
+// Stores groups every repository the handlers depend on.
+type Stores struct {
+	Events       EventStore
+	Series       SeriesStore
+	Places       PlaceStore
+	Tickets      TicketStore
+	Merch        MerchStore
+	Media        MediaStore
+	Users        UserStore
+	Activities   ActivityStore
+	Orders       OrderStore
+	Reservations ReservationStore
+
+	TicketInstances TicketInstanceStore
+	RefreshTokens   RefreshTokenStore
+	Revocations     RevocationStore
+	Sessions        SessionStore
+	LoginFailures   LoginFailureStore
+	APIKeys         APIKeyStore
+}
+
+// stores is the set of repositories used by the HTTP handlers. It is
+// assigned in main (or by tests) before the router starts serving.
+var stores *Stores
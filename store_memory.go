@@ -0,0 +1,1042 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// NewMemoryStores builds repositories that keep everything in process
+// memory. Data is lost on restart; useful for tests and local demos.
+func NewMemoryStores() *Stores {
+	return &Stores{
+		Events:     &memoryEventStore{table: newMemTable[Event]()},
+		Series:     &memorySeriesStore{table: newMemTable[EventSeries]()},
+		Places:     &memoryPlaceStore{table: newMemTable[Place]()},
+		Tickets:    &memoryTicketStore{table: newMemTable[Ticket]()},
+		Merch:      &memoryMerchStore{table: newMemTable[Merch]()},
+		Media:      &memoryMediaStore{table: newMemTable[Media]()},
+		Users:      &memoryUserStore{table: newMemTable[User]()},
+		Activities: &memoryActivityStore{},
+		Orders:     &memoryOrderStore{table: newMemTable[Order]()},
+
+		Reservations: &memoryReservationStore{table: newMemTable[Reservation]()},
+
+		TicketInstances: &memoryTicketInstanceStore{table: newMemTable[TicketInstance]()},
+		RefreshTokens:   &memoryRefreshTokenStore{table: newMemTable[RefreshToken]()},
+		Revocations:     &memoryRevocationStore{table: newMemTable[Revocation]()},
+		Sessions:        &memorySessionStore{table: newMemTable[Session]()},
+		APIKeys:         &memoryAPIKeyStore{table: newMemTable[APIKey]()},
+		LoginFailures:   &memoryLoginFailureStore{table: newMemTable[LoginFailure]()},
+	}
+}
+
+// cloneDoc returns a deep copy of v by round-tripping it through BSON, so
+// callers can never mutate the stored value through shared slices or maps.
+// This also mirrors what a real MongoDB round trip does to the document.
+func cloneDoc[T any](v T) T {
+	var out T
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return v
+	}
+	if err := bson.Unmarshal(raw, &out); err != nil {
+		return v
+	}
+	return out
+}
+
+// setFields does to doc what a MongoDB $set of fields, by their bson names,
+// would, with nil values removed as by $unset.
+func setFields[T any](doc *T, fields map[string]interface{}) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var m bson.M
+	if err := bson.Unmarshal(raw, &m); err != nil {
+		return err
+	}
+	for key, value := range fields {
+		if value == nil {
+			delete(m, key)
+		} else {
+			m[key] = value
+		}
+	}
+	if raw, err = bson.Marshal(m); err != nil {
+		return err
+	}
+	var out T
+	if err := bson.Unmarshal(raw, &out); err != nil {
+		return err
+	}
+	*doc = out
+	return nil
+}
+
+// memTable is a mutex guarded map that remembers insertion order so List
+// results are stable between calls.
+type memTable[T any] struct {
+	mu   sync.RWMutex
+	rows map[string]T
+	seq  map[string]int
+	next int
+}
+
+func newMemTable[T any]() *memTable[T] {
+	return &memTable[T]{rows: make(map[string]T), seq: make(map[string]int)}
+}
+
+func (t *memTable[T]) insert(key string, v T) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, exists := t.rows[key]; exists {
+		return ErrDuplicate
+	}
+	t.rows[key] = cloneDoc(v)
+	t.seq[key] = t.next
+	t.next++
+	return nil
+}
+
+func (t *memTable[T]) get(key string) (T, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	v, ok := t.rows[key]
+	if !ok {
+		var zero T
+		return zero, ErrNotFound
+	}
+	return cloneDoc(v), nil
+}
+
+func (t *memTable[T]) replace(key string, v T) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.rows[key]; !ok {
+		return ErrNotFound
+	}
+	t.rows[key] = cloneDoc(v)
+	return nil
+}
+
+// modify applies fn to the stored value under the write lock. If fn
+// returns an error the stored value is left untouched.
+func (t *memTable[T]) modify(key string, fn func(v *T) error) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.rows[key]
+	if !ok {
+		return ErrNotFound
+	}
+	v = cloneDoc(v)
+	if err := fn(&v); err != nil {
+		return err
+	}
+	t.rows[key] = v
+	return nil
+}
+
+func (t *memTable[T]) remove(key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.rows[key]; !ok {
+		return ErrNotFound
+	}
+	delete(t.rows, key)
+	delete(t.seq, key)
+	return nil
+}
+
+// filter returns copies of every row matching keep, in insertion order.
+func (t *memTable[T]) filter(keep func(v T) bool) []T {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	keys := make([]string, 0, len(t.rows))
+	for k, v := range t.rows {
+		if keep == nil || keep(v) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return t.seq[keys[i]] < t.seq[keys[j]] })
+	out := make([]T, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, cloneDoc(t.rows[k]))
+	}
+	return out
+}
+
+// compositeKey joins a parent and child ID into a single table key.
+func compositeKey(parentID, childID string) string {
+	return parentID + "\x00" + childID
+}
+
+type memoryEventStore struct {
+	table *memTable[Event]
+}
+
+func (s *memoryEventStore) Create(_ context.Context, event Event) error {
+	return s.table.insert(event.EventID, event)
+}
+
+func (s *memoryEventStore) Get(_ context.Context, eventID string) (Event, error) {
+	return s.table.get(eventID)
+}
+
+func (s *memoryEventStore) List(_ context.Context) ([]Event, error) {
+	return s.table.filter(nil), nil
+}
+
+func (s *memoryEventStore) Search(_ context.Context, q EventQuery) ([]Event, int, error) {
+	events := s.table.filter(func(e Event) bool { return eventMatches(e, q) })
+	total := len(events)
+
+	order := eventSorts[q.Sort]
+	// before reports whether a comes first in the listing
+	before := func(aValue interface{}, aID string, bValue interface{}, bID string) bool {
+		c := compareSortValues(aValue, bValue)
+		if c == 0 {
+			c = strings.Compare(aID, bID)
+		}
+		if order.desc {
+			return c > 0
+		}
+		return c < 0
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return before(order.key(events[i]), events[i].EventID, order.key(events[j]), events[j].EventID)
+	})
+	if q.After != nil {
+		i := sort.Search(len(events), func(i int) bool {
+			return before(q.After.Value, q.After.EventID, order.key(events[i]), events[i].EventID)
+		})
+		events = events[i:]
+	}
+	if len(events) > q.Limit {
+		events = events[:q.Limit]
+	}
+	return events, total, nil
+}
+
+// eventMatches reports whether e is one of the events q selects.
+func eventMatches(e Event, q EventQuery) bool {
+	for _, word := range searchWords(q.Text) {
+		found := strings.Contains(strings.ToLower(e.Title), word) || strings.Contains(strings.ToLower(e.Description), word)
+		for _, tag := range e.Tags {
+			found = found || strings.Contains(strings.ToLower(tag), word)
+		}
+		if !found {
+			return false
+		}
+	}
+	if (len(q.Categories) > 0 && !contains(q.Categories, e.Category)) ||
+		(len(q.Statuses) > 0 && !contains(q.Statuses, e.Status)) ||
+		(len(q.PlaceIDs) > 0 && !contains(q.PlaceIDs, e.Place)) {
+		return false
+	}
+	if e.Status == EventDraft && (q.Viewer == "" || (e.CreatorID != q.Viewer && !contains(e.CoOrganizers, q.Viewer))) {
+		return false
+	}
+	end := e.EndDateTime
+	if end.IsZero() {
+		end = e.StartDateTime
+	}
+	if (!q.From.IsZero() && end.Before(q.From)) || (!q.To.IsZero() && e.StartDateTime.After(q.To)) {
+		return false
+	}
+	if (q.MinPrice != nil || q.MaxPrice != nil) && e.TicketTypes == 0 {
+		return false
+	}
+	if (q.MinPrice != nil && e.MaxPrice < *q.MinPrice) || (q.MaxPrice != nil && e.MinPrice > *q.MaxPrice) {
+		return false
+	}
+	return true
+}
+
+func (s *memoryEventStore) Transition(_ context.Context, eventID, from, to string, at time.Time) (Event, error) {
+	var out Event
+	err := s.table.modify(eventID, func(e *Event) error {
+		if e.Status != from {
+			return ErrConflict
+		}
+		e.Status, e.StatusChangedAt, e.UpdatedAt = to, at, at
+		if to == EventPublished {
+			e.PublishedAt, e.PublishAt = &at, nil
+		}
+		out = *e
+		return nil
+	})
+	return out, err
+}
+
+func (s *memoryEventStore) ListDue(_ context.Context, now time.Time, limit int) ([]Event, error) {
+	due := s.table.filter(func(e Event) bool { return scheduledStatus(e, now) != "" })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (s *memoryEventStore) ListBySeries(_ context.Context, seriesID string) ([]Event, error) {
+	events := s.table.filter(func(e Event) bool { return e.SeriesID == seriesID })
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].StartDateTime.Equal(events[j].StartDateTime) {
+			return events[i].StartDateTime.Before(events[j].StartDateTime)
+		}
+		return events[i].EventID < events[j].EventID
+	})
+	return events, nil
+}
+
+func (s *memoryEventStore) SetTicketSummary(_ context.Context, eventID string, types int, minPrice, maxPrice float64) error {
+	return s.table.modify(eventID, func(e *Event) error {
+		e.TicketTypes, e.MinPrice, e.MaxPrice = types, minPrice, maxPrice
+		return nil
+	})
+}
+
+func (s *memoryEventStore) Update(_ context.Context, event Event) error {
+	return s.table.modify(event.EventID, func(stored *Event) error {
+		event.Status, event.StatusChangedAt, event.PublishedAt = stored.Status, stored.StatusChangedAt, stored.PublishedAt
+		*stored = event
+		return nil
+	})
+}
+
+func (s *memoryEventStore) Set(_ context.Context, eventID string, fields map[string]interface{}) (Event, error) {
+	var out Event
+	err := s.table.modify(eventID, func(e *Event) error {
+		if err := setFields(e, fields); err != nil {
+			return err
+		}
+		out = *e
+		return nil
+	})
+	return out, err
+}
+
+func (s *memoryEventStore) Delete(_ context.Context, eventID string) error {
+	return s.table.remove(eventID)
+}
+
+func (s *memoryEventStore) AddReview(_ context.Context, eventID string, review Review) error {
+	return s.table.modify(eventID, func(e *Event) error {
+		e.Reviews = append(e.Reviews, review)
+		return nil
+	})
+}
+
+func (s *memoryEventStore) RemoveReview(_ context.Context, eventID, reviewID string) error {
+	return s.table.modify(eventID, func(e *Event) error {
+		for i, review := range e.Reviews {
+			if review.ReviewID == reviewID {
+				e.Reviews = append(e.Reviews[:i], e.Reviews[i+1:]...)
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+type memorySeriesStore struct {
+	table *memTable[EventSeries]
+}
+
+func (s *memorySeriesStore) Create(_ context.Context, series EventSeries) error {
+	return s.table.insert(series.SeriesID, series)
+}
+
+func (s *memorySeriesStore) Get(_ context.Context, seriesID string) (EventSeries, error) {
+	return s.table.get(seriesID)
+}
+
+func (s *memorySeriesStore) Update(_ context.Context, series EventSeries) error {
+	return s.table.modify(series.SeriesID, func(stored *EventSeries) error {
+		series.GeneratedUntil, series.Finished = stored.GeneratedUntil, stored.Finished
+		*stored = series
+		return nil
+	})
+}
+
+func (s *memorySeriesStore) Delete(_ context.Context, seriesID string) error {
+	return s.table.remove(seriesID)
+}
+
+func (s *memorySeriesStore) Extend(_ context.Context, seriesID string, from, to time.Time, finished bool) error {
+	return s.table.modify(seriesID, func(series *EventSeries) error {
+		if !series.GeneratedUntil.Equal(from) {
+			return ErrConflict
+		}
+		series.GeneratedUntil, series.Finished = to, finished
+		return nil
+	})
+}
+
+func (s *memorySeriesStore) ListToExtend(_ context.Context, horizon time.Time, limit int) ([]EventSeries, error) {
+	series := s.table.filter(func(s EventSeries) bool { return !s.Finished && s.GeneratedUntil.Before(horizon) })
+	if len(series) > limit {
+		series = series[:limit]
+	}
+	return series, nil
+}
+
+type memoryPlaceStore struct {
+	table *memTable[Place]
+}
+
+func (s *memoryPlaceStore) Create(_ context.Context, place Place) error {
+	return s.table.insert(place.PlaceID, place)
+}
+
+func (s *memoryPlaceStore) Get(_ context.Context, placeID string) (Place, error) {
+	return s.table.get(placeID)
+}
+
+func (s *memoryPlaceStore) List(_ context.Context) ([]Place, error) {
+	return s.table.filter(nil), nil
+}
+
+func (s *memoryPlaceStore) Search(_ context.Context, q GeoQuery) ([]Place, error) {
+	return placesWithin(s.table.filter(nil), q), nil
+}
+
+func (s *memoryPlaceStore) Update(_ context.Context, place Place) error {
+	return s.table.replace(place.PlaceID, place)
+}
+
+func (s *memoryPlaceStore) Delete(_ context.Context, placeID string) error {
+	return s.table.remove(placeID)
+}
+
+type memoryTicketStore struct {
+	table *memTable[Ticket]
+}
+
+func (s *memoryTicketStore) Create(_ context.Context, ticket Ticket) error {
+	return s.table.insert(compositeKey(ticket.EventID, ticket.TicketID), ticket)
+}
+
+func (s *memoryTicketStore) Get(_ context.Context, eventID, ticketID string) (Ticket, error) {
+	return s.table.get(compositeKey(eventID, ticketID))
+}
+
+func (s *memoryTicketStore) ListByEvent(_ context.Context, eventID string) ([]Ticket, error) {
+	return s.table.filter(func(t Ticket) bool { return t.EventID == eventID }), nil
+}
+
+func (s *memoryTicketStore) Update(_ context.Context, ticket Ticket) error {
+	return s.table.replace(compositeKey(ticket.EventID, ticket.TicketID), ticket)
+}
+
+func (s *memoryTicketStore) Delete(_ context.Context, eventID, ticketID string) error {
+	return s.table.remove(compositeKey(eventID, ticketID))
+}
+
+func (s *memoryTicketStore) AdjustQuantity(_ context.Context, eventID, ticketID string, delta int) error {
+	return s.table.modify(compositeKey(eventID, ticketID), func(t *Ticket) error {
+		t.Quantity += delta
+		return nil
+	})
+}
+
+func (s *memoryTicketStore) Purchase(_ context.Context, eventID, ticketID string, quantity int) (Ticket, error) {
+	var bought Ticket
+	err := s.table.modify(compositeKey(eventID, ticketID), func(t *Ticket) error {
+		if t.Quantity < quantity {
+			return ErrSoldOut
+		}
+		t.Quantity -= quantity
+		bought = *t
+		return nil
+	})
+	return bought, err
+}
+
+type memoryMerchStore struct {
+	table *memTable[Merch]
+}
+
+func (s *memoryMerchStore) Create(_ context.Context, merch Merch) error {
+	return s.table.insert(compositeKey(merch.EventID, merch.MerchID), merch)
+}
+
+func (s *memoryMerchStore) Get(_ context.Context, eventID, merchID string) (Merch, error) {
+	return s.table.get(compositeKey(eventID, merchID))
+}
+
+func (s *memoryMerchStore) ListByEvent(_ context.Context, eventID string) ([]Merch, error) {
+	return s.table.filter(func(m Merch) bool { return m.EventID == eventID }), nil
+}
+
+func (s *memoryMerchStore) Update(_ context.Context, merch Merch) error {
+	return s.table.replace(compositeKey(merch.EventID, merch.MerchID), merch)
+}
+
+func (s *memoryMerchStore) Delete(_ context.Context, eventID, merchID string) error {
+	return s.table.remove(compositeKey(eventID, merchID))
+}
+
+func (s *memoryMerchStore) AdjustStock(_ context.Context, eventID, merchID string, delta int) error {
+	return s.table.modify(compositeKey(eventID, merchID), func(m *Merch) error {
+		m.Stock += delta
+		return nil
+	})
+}
+
+func (s *memoryMerchStore) Purchase(_ context.Context, eventID, merchID string, quantity int) (Merch, error) {
+	var bought Merch
+	err := s.table.modify(compositeKey(eventID, merchID), func(m *Merch) error {
+		if m.Stock < quantity {
+			return ErrSoldOut
+		}
+		m.Stock -= quantity
+		bought = *m
+		return nil
+	})
+	return bought, err
+}
+
+type memoryMediaStore struct {
+	table *memTable[Media]
+}
+
+func (s *memoryMediaStore) Create(_ context.Context, media Media) error {
+	return s.table.insert(compositeKey(media.EventID, media.ID), media)
+}
+
+func (s *memoryMediaStore) Get(_ context.Context, eventID, mediaID string) (Media, error) {
+	return s.table.get(compositeKey(eventID, mediaID))
+}
+
+func (s *memoryMediaStore) ListByEvent(_ context.Context, eventID string) ([]Media, error) {
+	return s.table.filter(func(m Media) bool { return m.EventID == eventID }), nil
+}
+
+func (s *memoryMediaStore) Delete(_ context.Context, eventID, mediaID string) error {
+	return s.table.remove(compositeKey(eventID, mediaID))
+}
+
+// memoryUserStore is keyed by UserID; usernames are kept unique by scanning
+// on insert, which is fine for the data sizes this backend is meant for.
+type memoryUserStore struct {
+	table *memTable[User]
+	mu    sync.Mutex // serialises uniqueness checks with inserts
+}
+
+func (s *memoryUserStore) Create(_ context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	taken := s.table.filter(func(u User) bool {
+		return u.Username == user.Username || (user.Email != "" && u.Email == user.Email)
+	})
+	if len(taken) > 0 {
+		return ErrDuplicate
+	}
+	return s.table.insert(user.UserID, user)
+}
+
+func (s *memoryUserStore) GetByUsername(_ context.Context, username string) (User, error) {
+	found := s.table.filter(func(u User) bool { return u.Username == username })
+	if len(found) == 0 {
+		return User{}, ErrNotFound
+	}
+	return found[0], nil
+}
+
+func (s *memoryUserStore) GetByEmail(_ context.Context, email string) (User, error) {
+	found := s.table.filter(func(u User) bool { return u.Email == email })
+	if len(found) == 0 {
+		return User{}, ErrNotFound
+	}
+	return found[0], nil
+}
+
+func (s *memoryUserStore) GetByIdentity(_ context.Context, issuer, subject string) (User, error) {
+	found := s.table.filter(func(u User) bool {
+		for _, id := range u.Identities {
+			if id.Issuer == issuer && id.Subject == subject {
+				return true
+			}
+		}
+		return false
+	})
+	if len(found) == 0 {
+		return User{}, ErrNotFound
+	}
+	return found[0], nil
+}
+
+func (s *memoryUserStore) GetByUserID(_ context.Context, userID string) (User, error) {
+	return s.table.get(userID)
+}
+
+func (s *memoryUserStore) List(_ context.Context) ([]User, error) {
+	return s.table.filter(nil), nil
+}
+
+func (s *memoryUserStore) Update(_ context.Context, user User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	taken := s.table.filter(func(u User) bool {
+		return u.UserID != user.UserID && (u.Username == user.Username || (user.Email != "" && u.Email == user.Email))
+	})
+	if len(taken) > 0 {
+		return ErrDuplicate
+	}
+	return s.table.modify(user.UserID, func(stored *User) error {
+		user.FailedLogins, user.LastFailedLogin = stored.FailedLogins, stored.LastFailedLogin
+		*stored = user
+		return nil
+	})
+}
+
+func (s *memoryUserStore) Delete(_ context.Context, userID string) error {
+	return s.table.remove(userID)
+}
+
+func (s *memoryUserStore) ClaimLoginAttempt(_ context.Context, userID string, seen int, at time.Time) (int, error) {
+	count := 0
+	err := s.table.modify(userID, func(u *User) error {
+		if u.FailedLogins != seen {
+			return ErrConflict
+		}
+		u.FailedLogins++
+		u.LastFailedLogin = at
+		count = u.FailedLogins
+		return nil
+	})
+	return count, err
+}
+
+func (s *memoryUserStore) ResetLoginFailures(_ context.Context, userID string) error {
+	return s.table.modify(userID, func(u *User) error {
+		u.FailedLogins = 0
+		u.LastFailedLogin = time.Time{}
+		return nil
+	})
+}
+
+func (s *memoryUserStore) UseTOTPStep(_ context.Context, userID string, step int64) error {
+	return s.table.modify(userID, func(u *User) error {
+		if !u.TOTPEnabled || u.TOTPLastStep >= step {
+			return ErrConflict
+		}
+		u.TOTPLastStep = step
+		return nil
+	})
+}
+
+func (s *memoryUserStore) UseRecoveryCode(_ context.Context, userID, hash string) error {
+	return s.table.modify(userID, func(u *User) error {
+		for i, stored := range u.RecoveryCodes {
+			if stored == hash {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return ErrConflict
+	})
+}
+
+func (s *memoryUserStore) SetLastLogin(_ context.Context, userID string, at time.Time) error {
+	return s.table.modify(userID, func(u *User) error {
+		u.LastLogin = at
+		return nil
+	})
+}
+
+func (s *memoryUserStore) SetFollows(_ context.Context, userID string, follows []string) error {
+	return s.table.modify(userID, func(u *User) error {
+		u.Follows = append([]string(nil), follows...)
+		return nil
+	})
+}
+
+func (s *memoryUserStore) AddFollower(_ context.Context, userID, followerID string) error {
+	err := s.table.modify(userID, func(u *User) error {
+		if !contains(u.Followers, followerID) {
+			u.Followers = append(u.Followers, followerID)
+		}
+		return nil
+	})
+	// Mirror MongoDB: updating a missing user is not an error.
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *memoryUserStore) RemoveFollower(_ context.Context, userID, followerID string) error {
+	err := s.table.modify(userID, func(u *User) error {
+		u.Followers = removeString(u.Followers, followerID)
+		return nil
+	})
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+type memoryActivityStore struct {
+	mu         sync.RWMutex
+	activities []Activity
+}
+
+func (s *memoryActivityStore) Log(_ context.Context, activity Activity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.activities = append(s.activities, activity)
+	return nil
+}
+
+func (s *memoryActivityStore) ListByUsername(_ context.Context, username string) ([]Activity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []Activity
+	for _, a := range s.activities {
+		if a.Username == username {
+			out = append(out, a)
+		}
+	}
+	return out, nil
+}
+
+type memoryOrderStore struct {
+	table *memTable[Order]
+}
+
+func (s *memoryOrderStore) Create(_ context.Context, order Order) error {
+	return s.table.insert(order.OrderID, order)
+}
+
+func (s *memoryOrderStore) Get(_ context.Context, orderID string) (Order, error) {
+	return s.table.get(orderID)
+}
+
+func (s *memoryOrderStore) ListByUser(_ context.Context, userID string) ([]Order, error) {
+	return newestFirst(s.table.filter(func(o Order) bool { return o.UserID == userID })), nil
+}
+
+func (s *memoryOrderStore) ListByEvent(_ context.Context, eventID string) ([]Order, error) {
+	return newestFirst(s.table.filter(func(o Order) bool { return o.EventID == eventID })), nil
+}
+
+func (s *memoryOrderStore) UpdateStatus(_ context.Context, orderID, from, to string) error {
+	return s.table.modify(orderID, func(o *Order) error {
+		if o.Status != from {
+			return ErrConflict
+		}
+		o.Status = to
+		o.UpdatedAt = time.Now()
+		return nil
+	})
+}
+
+func (s *memoryOrderStore) ListPending(_ context.Context, cutoff time.Time, limit int) ([]Order, error) {
+	pending := s.table.filter(func(o Order) bool {
+		return o.Status == OrderStatusPending && o.CreatedAt.Before(cutoff)
+	})
+	if len(pending) > limit {
+		pending = pending[:limit]
+	}
+	return pending, nil
+}
+
+// newestFirst reverses insertion order, matching the created_at descending
+// sort the Mongo store uses.
+func newestFirst(orders []Order) []Order {
+	for i, j := 0, len(orders)-1; i < j; i, j = i+1, j-1 {
+		orders[i], orders[j] = orders[j], orders[i]
+	}
+	return orders
+}
+
+type memoryReservationStore struct {
+	table *memTable[Reservation]
+}
+
+func (s *memoryReservationStore) Create(_ context.Context, reservation Reservation) error {
+	return s.table.insert(reservation.ReservationID, reservation)
+}
+
+func (s *memoryReservationStore) Get(_ context.Context, reservationID string) (Reservation, error) {
+	return s.table.get(reservationID)
+}
+
+func (s *memoryReservationStore) ListByUser(_ context.Context, userID string) ([]Reservation, error) {
+	found := s.table.filter(func(r Reservation) bool { return r.UserID == userID })
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found, nil
+}
+
+func (s *memoryReservationStore) Transition(_ context.Context, reservationID, from, to, orderID string) (Reservation, error) {
+	var updated Reservation
+	err := s.table.modify(reservationID, func(r *Reservation) error {
+		if r.Status != from {
+			return ErrConflict
+		}
+		r.Status = to
+		r.UpdatedAt = time.Now()
+		if orderID != "" {
+			r.OrderID = orderID
+		}
+		updated = *r
+		return nil
+	})
+	return updated, err
+}
+
+func (s *memoryReservationStore) ListExpired(_ context.Context, now time.Time, limit int) ([]Reservation, error) {
+	expired := s.table.filter(func(r Reservation) bool {
+		return r.Status == ReservationHeld && !r.ExpiresAt.After(now)
+	})
+	if len(expired) > limit {
+		expired = expired[:limit]
+	}
+	return expired, nil
+}
+
+type memoryTicketInstanceStore struct {
+	table *memTable[TicketInstance]
+}
+
+func (s *memoryTicketInstanceStore) Issue(_ context.Context, instance TicketInstance) error {
+	if err := s.table.insert(instance.InstanceID, instance); err != nil && err != ErrDuplicate {
+		return err
+	}
+	return nil
+}
+
+func (s *memoryTicketInstanceStore) Get(_ context.Context, instanceID string) (TicketInstance, error) {
+	return s.table.get(instanceID)
+}
+
+func (s *memoryTicketInstanceStore) ListByHolder(_ context.Context, holderID string) ([]TicketInstance, error) {
+	found := s.table.filter(func(t TicketInstance) bool { return t.HolderID == holderID })
+	sort.SliceStable(found, func(i, j int) bool { return found[i].IssuedAt.After(found[j].IssuedAt) })
+	return found, nil
+}
+
+func (s *memoryTicketInstanceStore) ListByOrder(_ context.Context, orderID string) ([]TicketInstance, error) {
+	return s.table.filter(func(t TicketInstance) bool { return t.OrderID == orderID }), nil
+}
+
+func (s *memoryTicketInstanceStore) VoidByOrder(_ context.Context, orderID string) error {
+	for _, instance := range s.table.filter(func(t TicketInstance) bool { return t.OrderID == orderID }) {
+		err := s.table.modify(instance.InstanceID, func(t *TicketInstance) error {
+			t.Status = TicketInstanceVoid
+			return nil
+		})
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryTicketInstanceStore) CheckIn(_ context.Context, instanceID, by, device string, at time.Time) (TicketInstance, error) {
+	var current TicketInstance
+	err := s.table.modify(instanceID, func(t *TicketInstance) error {
+		if t.Status != TicketInstanceValid || (t.CheckedInAt != nil && !at.Before(*t.CheckedInAt)) {
+			current = *t
+			return ErrConflict
+		}
+		t.CheckedInAt = &at
+		t.CheckedInBy = by
+		t.CheckInDevice = device
+		current = *t
+		return nil
+	})
+	return current, err
+}
+
+func (s *memoryTicketInstanceStore) CountByEvent(_ context.Context, eventID string) (int, int, error) {
+	issued, checkedIn := 0, 0
+	for _, t := range s.table.filter(func(t TicketInstance) bool {
+		return t.EventID == eventID && t.Status == TicketInstanceValid
+	}) {
+		issued++
+		if t.CheckedInAt != nil {
+			checkedIn++
+		}
+	}
+	return issued, checkedIn, nil
+}
+
+type memoryRefreshTokenStore struct {
+	table *memTable[RefreshToken]
+}
+
+func (s *memoryRefreshTokenStore) Create(_ context.Context, token RefreshToken) error {
+	return s.table.insert(token.TokenID, token)
+}
+
+func (s *memoryRefreshTokenStore) Get(_ context.Context, tokenID string) (RefreshToken, error) {
+	return s.table.get(tokenID)
+}
+
+func (s *memoryRefreshTokenStore) MarkUsed(_ context.Context, tokenID string) error {
+	return s.table.modify(tokenID, func(t *RefreshToken) error {
+		if t.Status != RefreshTokenActive {
+			return ErrConflict
+		}
+		t.Status = RefreshTokenUsed
+		return nil
+	})
+}
+
+func (s *memoryRefreshTokenStore) RevokeSession(_ context.Context, sessionID string) error {
+	for _, token := range s.table.filter(func(t RefreshToken) bool { return t.SessionID == sessionID }) {
+		s.revoke(token.TokenID)
+	}
+	return nil
+}
+
+func (s *memoryRefreshTokenStore) RevokeUser(_ context.Context, userID string) ([]string, error) {
+	var sessions []string
+	for _, token := range s.table.filter(func(t RefreshToken) bool { return t.UserID == userID }) {
+		if token.Status == RefreshTokenActive {
+			sessions = append(sessions, token.SessionID)
+		}
+		s.revoke(token.TokenID)
+	}
+	return sessions, nil
+}
+
+func (s *memoryRefreshTokenStore) revoke(tokenID string) {
+	s.table.modify(tokenID, func(t *RefreshToken) error {
+		t.Status = RefreshTokenRevoked
+		return nil
+	})
+}
+
+type memoryRevocationStore struct {
+	table *memTable[Revocation]
+}
+
+func (s *memoryRevocationStore) Revoke(_ context.Context, revocation Revocation) error {
+	if err := s.table.insert(revocation.Key, revocation); err == ErrDuplicate {
+		return s.table.replace(revocation.Key, revocation)
+	}
+	return nil
+}
+
+func (s *memoryRevocationStore) IsRevoked(_ context.Context, keys ...string) (bool, error) {
+	now := time.Now()
+	for _, key := range keys {
+		if revocation, err := s.table.get(key); err == nil && revocation.ExpiresAt.After(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type memorySessionStore struct {
+	table *memTable[Session]
+}
+
+func (s *memorySessionStore) Create(_ context.Context, session Session) error {
+	return s.table.insert(session.SessionID, session)
+}
+
+func (s *memorySessionStore) Get(_ context.Context, sessionID string) (Session, error) {
+	return s.table.get(sessionID)
+}
+
+func (s *memorySessionStore) ListActive(_ context.Context, userID string) ([]Session, error) {
+	sessions := s.table.filter(func(session Session) bool {
+		return session.UserID == userID && session.EndedAt == nil
+	})
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt) })
+	return sessions, nil
+}
+
+func (s *memorySessionStore) Touch(_ context.Context, sessionID, ip string, at time.Time) error {
+	return s.table.modify(sessionID, func(session *Session) error {
+		session.IP = ip
+		session.LastSeenAt = at
+		return nil
+	})
+}
+
+func (s *memorySessionStore) End(_ context.Context, sessionID string, at time.Time) error {
+	return s.table.modify(sessionID, func(session *Session) error {
+		if session.EndedAt == nil {
+			session.EndedAt = &at
+		}
+		return nil
+	})
+}
+
+func (s *memorySessionStore) EndUser(ctx context.Context, userID string, at time.Time) error {
+	for _, session := range s.table.filter(func(session Session) bool { return session.UserID == userID }) {
+		s.End(ctx, session.SessionID, at)
+	}
+	return nil
+}
+
+type memoryLoginFailureStore struct {
+	table *memTable[LoginFailure]
+}
+
+func (s *memoryLoginFailureStore) Record(_ context.Context, failure LoginFailure) error {
+	return s.table.insert(failure.FailureID, failure)
+}
+
+func (s *memoryLoginFailureStore) ListByUser(_ context.Context, userID string, limit int) ([]LoginFailure, error) {
+	failures := s.table.filter(func(f LoginFailure) bool { return f.UserID == userID })
+	sort.SliceStable(failures, func(i, j int) bool { return failures[i].At.After(failures[j].At) })
+	if len(failures) > limit {
+		failures = failures[:limit]
+	}
+	return failures, nil
+}
+
+type memoryAPIKeyStore struct {
+	table *memTable[APIKey]
+}
+
+func (s *memoryAPIKeyStore) Create(_ context.Context, key APIKey) error {
+	return s.table.insert(key.KeyID, key)
+}
+
+func (s *memoryAPIKeyStore) Get(_ context.Context, keyID string) (APIKey, error) {
+	return s.table.get(keyID)
+}
+
+func (s *memoryAPIKeyStore) ListByUser(_ context.Context, userID string) ([]APIKey, error) {
+	keys := s.table.filter(func(k APIKey) bool { return k.UserID == userID })
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *memoryAPIKeyStore) Revoke(_ context.Context, keyID string, at time.Time) error {
+	return s.table.modify(keyID, func(k *APIKey) error {
+		if k.RevokedAt == nil {
+			k.RevokedAt = &at
+		}
+		return nil
+	})
+}
+
+func (s *memoryAPIKeyStore) RevokeUser(ctx context.Context, userID string, at time.Time) error {
+	for _, key := range s.table.filter(func(k APIKey) bool { return k.UserID == userID }) {
+		s.Revoke(ctx, key.KeyID, at)
+	}
+	return nil
+}
+
+func (s *memoryAPIKeyStore) Touch(_ context.Context, keyID, ip string, at time.Time) error {
+	return s.table.modify(keyID, func(k *APIKey) error {
+		k.LastUsedAt = &at
+		k.LastUsedIP = ip
+		return nil
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// useMemoryStores points the package globals at fresh in-memory stores, the
+// default configuration and a fake payment provider that always succeeds,
+// and puts the old ones back when the test ends. Tests using it must not
+// run in parallel.
+func useMemoryStores(t *testing.T) {
+	t.Helper()
+	oldConfig, oldStores, oldPayments, oldSearch, oldMailer := config, stores, payments, searchIndex, mailer
+	t.Cleanup(func() {
+		config, stores, payments, searchIndex, mailer = oldConfig, oldStores, oldPayments, oldSearch, oldMailer
+	})
+
+	config = defaultConfig()
+	config.Store = StoreMemory
+	stores = NewMemoryStores()
+	searchIndex = newMemorySearchIndex()
+	payments = NewFakePaymentProvider(FakePaymentSucceed, config.Payments.WebhookSecret)
+	mailer = &FileMailer{From: config.Mail.From}
+}
+
+// serveAs runs handler as userID, or anonymously if it is empty, with body
+// and the route parameters given as name, value pairs.
+func serveAs(handler httprouter.Handle, userID, method, target, body string, params ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if userID != "" {
+		r = r.WithContext(context.WithValue(r.Context(), userIDKey, userID))
+	}
+	var ps httprouter.Params
+	for i := 0; i+1 < len(params); i += 2 {
+		ps = append(ps, httprouter.Param{Key: params[i], Value: params[i+1]})
+	}
+	w := httptest.NewRecorder()
+	handler(w, r, ps)
+	return w
+}
+
+// responseData decodes the data field of a sendResponse body into out.
+func responseData(t *testing.T, w *httptest.ResponseRecorder, out interface{}) {
+	t.Helper()
+	body := struct {
+		Data interface{} `json:"data"`
+	}{Data: out}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+}
+
+// seedTicket creates event e1 in status with ticket t1 of stock units.
+func seedTicket(t *testing.T, status string, stock int) {
+	t.Helper()
+	ctx := context.Background()
+	if err := stores.Events.Create(ctx, Event{EventID: "e1", Title: "Show", CreatorID: "organizer", Status: status}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Tickets.Create(ctx, Ticket{TicketID: "t1", EventID: "e1", Name: "GA", Price: 10, Quantity: stock}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryTicketPurchase(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	if err := stores.Tickets.Create(ctx, Ticket{TicketID: "t1", EventID: "e1", Name: "GA", Quantity: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		eventID   string
+		ticketID  string
+		quantity  int
+		wantErr   error
+		remaining int
+	}{
+		{"takes what is asked", "e1", "t1", 2, nil, 1},
+		{"refuses more than is left", "e1", "t1", 2, ErrSoldOut, 1},
+		{"takes the last one", "e1", "t1", 1, nil, 0},
+		{"is sold out at zero", "e1", "t1", 1, ErrSoldOut, 0},
+		{"needs the right event", "e2", "t1", 1, ErrNotFound, 0},
+		{"needs the ticket to exist", "e1", "t2", 1, ErrNotFound, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := stores.Tickets.Purchase(ctx, tt.eventID, tt.ticketID, tt.quantity)
+			if err != tt.wantErr {
+				t.Fatalf("Purchase() error = %v, want %v", err, tt.wantErr)
+			}
+			ticket, err := stores.Tickets.Get(ctx, "e1", "t1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ticket.Quantity != tt.remaining {
+				t.Errorf("quantity = %d, want %d", ticket.Quantity, tt.remaining)
+			}
+		})
+	}
+}
+
+func TestMemoryEventUpdateKeepsStatus(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	event := Event{EventID: "e1", Title: "Old", Status: EventDraft, CreatedAt: now}
+	if err := stores.Events.Create(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	// The scheduler publishes the event while an edit holds the old copy
+	if _, err := stores.Events.Transition(ctx, "e1", EventDraft, EventPublished, now); err != nil {
+		t.Fatal(err)
+	}
+	event.Title = "New"
+	if err := stores.Events.Update(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	got, err := stores.Events.Get(ctx, "e1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "New" || got.Status != EventPublished || got.PublishedAt == nil {
+		t.Errorf("after Update: title %q, status %q, published_at %v; want New, published and set", got.Title, got.Status, got.PublishedAt)
+	}
+
+	if _, err := stores.Events.Transition(ctx, "e1", EventDraft, EventPublished, now); err != ErrConflict {
+		t.Errorf("Transition from a stale status: error = %v, want ErrConflict", err)
+	}
+
+	publishAt := now.Add(time.Hour)
+	got, err = stores.Events.Set(ctx, "e1", map[string]interface{}{"description": "d", "publish_at": publishAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Description != "d" || got.Title != "New" || got.PublishAt == nil || !got.PublishAt.Equal(publishAt) {
+		t.Errorf("after Set: %+v", got)
+	}
+	got, err = stores.Events.Set(ctx, "e1", map[string]interface{}{"publish_at": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.PublishAt != nil || got.Description != "d" {
+		t.Errorf("Set of nil: publish_at %v, description %q; want it removed and the rest kept", got.PublishAt, got.Description)
+	}
+	if _, err := stores.Events.Set(ctx, "e2", map[string]interface{}{"title": "x"}); err != ErrNotFound {
+		t.Errorf("Set on a missing event: error = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,1037 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// NewMongoStores builds the MongoDB backed repositories.
+func NewMongoStores(db *mongo.Database) *Stores {
+	return &Stores{
+		Events:     &mongoEventStore{coll: db.Collection("events")},
+		Series:     &mongoSeriesStore{coll: db.Collection("series")},
+		Places:     &mongoPlaceStore{coll: db.Collection("places")},
+		Tickets:    &mongoTicketStore{coll: db.Collection("ticks")},
+		Merch:      &mongoMerchStore{coll: db.Collection("merch")},
+		Media:      &mongoMediaStore{coll: db.Collection("media")},
+		Users:      &mongoUserStore{coll: db.Collection("users")},
+		Activities: &mongoActivityStore{coll: db.Collection("activities")},
+		Orders:     &mongoOrderStore{coll: db.Collection("orders")},
+
+		Reservations: &mongoReservationStore{coll: db.Collection("reservations")},
+
+		TicketInstances: &mongoTicketInstanceStore{coll: db.Collection("ticket_instances")},
+		RefreshTokens:   &mongoRefreshTokenStore{coll: db.Collection("refresh_tokens")},
+		Revocations:     &mongoRevocationStore{coll: db.Collection("revocations")},
+		Sessions:        &mongoSessionStore{coll: db.Collection("sessions")},
+		LoginFailures:   &mongoLoginFailureStore{coll: db.Collection("login_failures")},
+		APIKeys:         &mongoAPIKeyStore{coll: db.Collection("api_keys")},
+	}
+}
+
+// mongoErr translates driver errors into the store sentinel errors.
+func mongoErr(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// findAll runs a query and decodes every matching document into out.
+func findAll(ctx context.Context, coll *mongo.Collection, filter interface{}, out interface{}) error {
+	cursor, err := coll.Find(ctx, filter)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	return cursor.All(ctx, out)
+}
+
+// findAllSorted is findAll with a sort order.
+func findAllSorted(ctx context.Context, coll *mongo.Collection, filter interface{}, sort bson.D, out interface{}) error {
+	cursor, err := coll.Find(ctx, filter, options.Find().SetSort(sort))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	return cursor.All(ctx, out)
+}
+
+// matchedOrNotFound turns an update that matched nothing into ErrNotFound.
+func matchedOrNotFound(res *mongo.UpdateResult, err error) error {
+	if err != nil {
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// replaceKeeping replaces the document filter matches with doc, except for
+// _id and the fields in keep, which stay as they are stored.
+func replaceKeeping(ctx context.Context, coll *mongo.Collection, filter bson.M, doc interface{}, keep ...string) error {
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var replacement bson.M
+	if err := bson.Unmarshal(raw, &replacement); err != nil {
+		return err
+	}
+	kept := bson.M{"_id": "$_id"}
+	delete(replacement, "_id")
+	for _, field := range keep {
+		delete(replacement, field)
+		kept[field] = "$" + field
+	}
+	// $literal keeps values that start with $ from reading as field paths
+	update := mongo.Pipeline{{{Key: "$replaceWith", Value: bson.M{"$mergeObjects": bson.A{bson.M{"$literal": replacement}, kept}}}}}
+	return matchedOrNotFound(coll.UpdateOne(ctx, filter, update))
+}
+
+// deletedOrNotFound turns a delete that removed nothing into ErrNotFound.
+func deletedOrNotFound(res *mongo.DeleteResult, err error) error {
+	if err != nil {
+		return mongoErr(err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoEventStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoEventStore) Create(ctx context.Context, event Event) error {
+	_, err := s.coll.InsertOne(ctx, event)
+	return mongoErr(err)
+}
+
+func (s *mongoEventStore) Get(ctx context.Context, eventID string) (Event, error) {
+	var event Event
+	err := s.coll.FindOne(ctx, bson.M{"eventid": eventID}).Decode(&event)
+	return event, mongoErr(err)
+}
+
+func (s *mongoEventStore) List(ctx context.Context) ([]Event, error) {
+	var events []Event
+	err := findAll(ctx, s.coll, bson.M{}, &events)
+	return events, err
+}
+
+func (s *mongoEventStore) Search(ctx context.Context, q EventQuery) ([]Event, int, error) {
+	filter := eventFilter(q)
+	total, err := s.coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	order := eventSorts[q.Sort]
+	dir, op := 1, "$gt"
+	if order.desc {
+		dir, op = -1, "$lt"
+	}
+	if q.After != nil {
+		filter = bson.M{"$and": bson.A{filter, bson.M{"$or": bson.A{
+			bson.M{order.field: bson.M{op: q.After.Value}},
+			bson.M{order.field: q.After.Value, "eventid": bson.M{op: q.After.EventID}},
+		}}}}
+	}
+	opts := options.Find().
+		SetSort(bson.D{{Key: order.field, Value: dir}, {Key: "eventid", Value: dir}}).
+		SetLimit(int64(q.Limit))
+	cursor, err := s.coll.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+	var events []Event
+	err = cursor.All(ctx, &events)
+	return events, int(total), err
+}
+
+// eventFilter is the query selecting the events q matches, paging aside.
+func eventFilter(q EventQuery) bson.M {
+	var and bson.A
+	for _, word := range searchWords(q.Text) {
+		pattern := primitive.Regex{Pattern: regexp.QuoteMeta(word), Options: "i"}
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{"title": pattern},
+			bson.M{"description": pattern},
+			bson.M{"tags": pattern},
+		}})
+	}
+	for field, values := range map[string][]string{"category": q.Categories, "status": q.Statuses, "place": q.PlaceIDs} {
+		if len(values) > 0 {
+			and = append(and, bson.M{field: bson.M{"$in": values}})
+		}
+	}
+	drafts := bson.A{bson.M{"status": bson.M{"$ne": EventDraft}}}
+	if q.Viewer != "" {
+		drafts = append(drafts, bson.M{"creatorid": q.Viewer}, bson.M{"co_organizers": q.Viewer})
+	}
+	and = append(and, bson.M{"$or": drafts})
+	if !q.From.IsZero() {
+		// Events without an end time are taken to end when they start
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{"end_date_time": bson.M{"$gte": q.From}},
+			bson.M{"end_date_time": time.Time{}, "start_date_time": bson.M{"$gte": q.From}},
+		}})
+	}
+	if !q.To.IsZero() {
+		and = append(and, bson.M{"start_date_time": bson.M{"$lte": q.To}})
+	}
+	if q.MinPrice != nil || q.MaxPrice != nil {
+		and = append(and, bson.M{"ticket_types": bson.M{"$gt": 0}})
+	}
+	if q.MinPrice != nil {
+		and = append(and, bson.M{"max_price": bson.M{"$gte": *q.MinPrice}})
+	}
+	if q.MaxPrice != nil {
+		and = append(and, bson.M{"min_price": bson.M{"$lte": *q.MaxPrice}})
+	}
+	if len(and) == 0 {
+		return bson.M{}
+	}
+	return bson.M{"$and": and}
+}
+
+func (s *mongoEventStore) Transition(ctx context.Context, eventID, from, to string, at time.Time) (Event, error) {
+	set := bson.M{"status": to, "status_changed_at": at, "updated_at": at}
+	update := bson.M{"$set": set}
+	if to == EventPublished {
+		set["published_at"] = at
+		update["$unset"] = bson.M{"publish_at": ""}
+	}
+	var event Event
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := s.coll.FindOneAndUpdate(ctx, bson.M{"eventid": eventID, "status": from}, update, opts).Decode(&event)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Tell a missing event from one that has moved on
+		if _, err := s.Get(ctx, eventID); err != nil {
+			return Event{}, err
+		}
+		return Event{}, ErrConflict
+	}
+	return event, mongoErr(err)
+}
+
+func (s *mongoEventStore) ListDue(ctx context.Context, now time.Time, limit int) ([]Event, error) {
+	filter := bson.M{"$or": bson.A{
+		bson.M{"status": EventDraft, "publish_at": bson.M{"$lte": now}},
+		bson.M{"status": EventPublished, "start_date_time": bson.M{"$gt": time.Time{}, "$lte": now}},
+		bson.M{"status": EventLive, "end_date_time": bson.M{"$gt": time.Time{}, "$lte": now}},
+		bson.M{"status": EventLive, "end_date_time": time.Time{}, "start_date_time": bson.M{"$lte": now.Add(-assumedEventLength)}},
+	}}
+	cursor, err := s.coll.Find(ctx, filter, options.Find().SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var events []Event
+	err = cursor.All(ctx, &events)
+	return events, err
+}
+
+func (s *mongoEventStore) ListBySeries(ctx context.Context, seriesID string) ([]Event, error) {
+	var events []Event
+	sort := bson.D{{Key: "start_date_time", Value: 1}, {Key: "eventid", Value: 1}}
+	err := findAllSorted(ctx, s.coll, bson.M{"seriesid": seriesID}, sort, &events)
+	return events, err
+}
+
+func (s *mongoEventStore) SetTicketSummary(ctx context.Context, eventID string, types int, minPrice, maxPrice float64) error {
+	update := bson.M{"$set": bson.M{"ticket_types": types, "min_price": minPrice, "max_price": maxPrice}}
+	return matchedOrNotFound(s.coll.UpdateOne(ctx, bson.M{"eventid": eventID}, update))
+}
+
+func (s *mongoEventStore) Update(ctx context.Context, event Event) error {
+	return replaceKeeping(ctx, s.coll, bson.M{"eventid": event.EventID}, event, "status", "status_changed_at", "published_at")
+}
+
+func (s *mongoEventStore) Set(ctx context.Context, eventID string, fields map[string]interface{}) (Event, error) {
+	set, unset := bson.M{}, bson.M{}
+	for key, value := range fields {
+		if value == nil {
+			unset[key] = ""
+		} else {
+			set[key] = value
+		}
+	}
+	update := bson.M{}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	var event Event
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := s.coll.FindOneAndUpdate(ctx, bson.M{"eventid": eventID}, update, opts).Decode(&event)
+	return event, mongoErr(err)
+}
+
+func (s *mongoEventStore) Delete(ctx context.Context, eventID string) error {
+	return deletedOrNotFound(s.coll.DeleteOne(ctx, bson.M{"eventid": eventID}))
+}
+
+func (s *mongoEventStore) AddReview(ctx context.Context, eventID string, review Review) error {
+	return matchedOrNotFound(s.coll.UpdateOne(ctx, bson.M{"eventid": eventID}, bson.M{"$push": bson.M{"reviews": review}}))
+}
+
+func (s *mongoEventStore) RemoveReview(ctx context.Context, eventID, reviewID string) error {
+	filter := bson.M{"eventid": eventID, "reviews.reviewid": reviewID}
+	return matchedOrNotFound(s.coll.UpdateOne(ctx, filter, bson.M{"$pull": bson.M{"reviews": bson.M{"reviewid": reviewID}}}))
+}
+
+type mongoSeriesStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoSeriesStore) Create(ctx context.Context, series EventSeries) error {
+	_, err := s.coll.InsertOne(ctx, series)
+	return mongoErr(err)
+}
+
+func (s *mongoSeriesStore) Get(ctx context.Context, seriesID string) (EventSeries, error) {
+	var series EventSeries
+	err := s.coll.FindOne(ctx, bson.M{"seriesid": seriesID}).Decode(&series)
+	return series, mongoErr(err)
+}
+
+func (s *mongoSeriesStore) Update(ctx context.Context, series EventSeries) error {
+	doc, err := bson.Marshal(series)
+	if err != nil {
+		return err
+	}
+	var set bson.M
+	if err := bson.Unmarshal(doc, &set); err != nil {
+		return err
+	}
+	delete(set, "generated_until")
+	delete(set, "finished")
+	return matchedOrNotFound(s.coll.UpdateOne(ctx, bson.M{"seriesid": series.SeriesID}, bson.M{"$set": set}))
+}
+
+func (s *mongoSeriesStore) Delete(ctx context.Context, seriesID string) error {
+	return deletedOrNotFound(s.coll.DeleteOne(ctx, bson.M{"seriesid": seriesID}))
+}
+
+func (s *mongoSeriesStore) Extend(ctx context.Context, seriesID string, from, to time.Time, finished bool) error {
+	filter := bson.M{"seriesid": seriesID, "generated_until": from}
+	update := bson.M{"$set": bson.M{"generated_until": to, "finished": finished}}
+	res, err := s.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		if _, err := s.Get(ctx, seriesID); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	return nil
+}
+
+func (s *mongoSeriesStore) ListToExtend(ctx context.Context, horizon time.Time, limit int) ([]EventSeries, error) {
+	filter := bson.M{"finished": false, "generated_until": bson.M{"$lt": horizon}}
+	cursor, err := s.coll.Find(ctx, filter, options.Find().SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var series []EventSeries
+	err = cursor.All(ctx, &series)
+	return series, err
+}
+
+type mongoPlaceStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoPlaceStore) Create(ctx context.Context, place Place) error {
+	_, err := s.coll.InsertOne(ctx, place)
+	return mongoErr(err)
+}
+
+func (s *mongoPlaceStore) Get(ctx context.Context, placeID string) (Place, error) {
+	var place Place
+	err := s.coll.FindOne(ctx, bson.M{"placeid": placeID}).Decode(&place)
+	return place, mongoErr(err)
+}
+
+func (s *mongoPlaceStore) List(ctx context.Context) ([]Place, error) {
+	var places []Place
+	err := findAll(ctx, s.coll, bson.M{}, &places)
+	return places, err
+}
+
+func (s *mongoPlaceStore) Search(ctx context.Context, q GeoQuery) ([]Place, error) {
+	filter := bson.M{"location": bson.M{"$exists": true}}
+	if q.Box != nil {
+		var within bson.A
+		for _, polygon := range q.Box.polygons() {
+			geometry := bson.M{"type": "Polygon", "coordinates": bson.A{polygon}}
+			within = append(within, bson.M{"location": bson.M{"$geoWithin": bson.M{"$geometry": geometry}}})
+		}
+		filter = bson.M{"$or": within}
+	}
+
+	var pipeline mongo.Pipeline
+	if q.Near != nil {
+		pipeline = append(pipeline, bson.D{{Key: "$geoNear", Value: bson.M{
+			"near":          q.Near,
+			"key":           "location",
+			"distanceField": "distance",
+			"maxDistance":   q.Radius,
+			"spherical":     true,
+			"query":         filter,
+		}}})
+	} else {
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: filter}})
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$limit", Value: q.Limit}})
+
+	cursor, err := s.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var places []Place
+	err = cursor.All(ctx, &places)
+	return places, err
+}
+
+func (s *mongoPlaceStore) Update(ctx context.Context, place Place) error {
+	return matchedOrNotFound(s.coll.ReplaceOne(ctx, bson.M{"placeid": place.PlaceID}, place))
+}
+
+func (s *mongoPlaceStore) Delete(ctx context.Context, placeID string) error {
+	return deletedOrNotFound(s.coll.DeleteOne(ctx, bson.M{"placeid": placeID}))
+}
+
+type mongoTicketStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoTicketStore) Create(ctx context.Context, ticket Ticket) error {
+	_, err := s.coll.InsertOne(ctx, ticket)
+	return mongoErr(err)
+}
+
+func (s *mongoTicketStore) Get(ctx context.Context, eventID, ticketID string) (Ticket, error) {
+	var ticket Ticket
+	err := s.coll.FindOne(ctx, bson.M{"eventid": eventID, "ticketid": ticketID}).Decode(&ticket)
+	return ticket, mongoErr(err)
+}
+
+func (s *mongoTicketStore) ListByEvent(ctx context.Context, eventID string) ([]Ticket, error) {
+	var tickets []Ticket
+	err := findAll(ctx, s.coll, bson.M{"eventid": eventID}, &tickets)
+	return tickets, err
+}
+
+func (s *mongoTicketStore) Update(ctx context.Context, ticket Ticket) error {
+	filter := bson.M{"eventid": ticket.EventID, "ticketid": ticket.TicketID}
+	return matchedOrNotFound(s.coll.ReplaceOne(ctx, filter, ticket))
+}
+
+func (s *mongoTicketStore) Delete(ctx context.Context, eventID, ticketID string) error {
+	return deletedOrNotFound(s.coll.DeleteOne(ctx, bson.M{"eventid": eventID, "ticketid": ticketID}))
+}
+
+func (s *mongoTicketStore) AdjustQuantity(ctx context.Context, eventID, ticketID string, delta int) error {
+	filter := bson.M{"eventid": eventID, "ticketid": ticketID}
+	return matchedOrNotFound(s.coll.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"quantity": delta}}))
+}
+
+func (s *mongoTicketStore) Purchase(ctx context.Context, eventID, ticketID string, quantity int) (Ticket, error) {
+	// Match only while enough units remain so the check and the decrement
+	// happen in one server-side operation.
+	filter := bson.M{"eventid": eventID, "ticketid": ticketID, "quantity": bson.M{"$gte": quantity}}
+	update := bson.M{"$inc": bson.M{"quantity": -quantity}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var ticket Ticket
+	err := s.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&ticket)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Either the ticket doesn't exist or there aren't enough left
+		if _, getErr := s.Get(ctx, eventID, ticketID); getErr != nil {
+			return Ticket{}, getErr
+		}
+		return Ticket{}, ErrSoldOut
+	}
+	return ticket, mongoErr(err)
+}
+
+type mongoMerchStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoMerchStore) Create(ctx context.Context, merch Merch) error {
+	_, err := s.coll.InsertOne(ctx, merch)
+	return mongoErr(err)
+}
+
+func (s *mongoMerchStore) Get(ctx context.Context, eventID, merchID string) (Merch, error) {
+	var merch Merch
+	err := s.coll.FindOne(ctx, bson.M{"eventid": eventID, "merchid": merchID}).Decode(&merch)
+	return merch, mongoErr(err)
+}
+
+func (s *mongoMerchStore) ListByEvent(ctx context.Context, eventID string) ([]Merch, error) {
+	var merch []Merch
+	err := findAll(ctx, s.coll, bson.M{"eventid": eventID}, &merch)
+	return merch, err
+}
+
+func (s *mongoMerchStore) Update(ctx context.Context, merch Merch) error {
+	filter := bson.M{"eventid": merch.EventID, "merchid": merch.MerchID}
+	return matchedOrNotFound(s.coll.ReplaceOne(ctx, filter, merch))
+}
+
+func (s *mongoMerchStore) Delete(ctx context.Context, eventID, merchID string) error {
+	return deletedOrNotFound(s.coll.DeleteOne(ctx, bson.M{"eventid": eventID, "merchid": merchID}))
+}
+
+func (s *mongoMerchStore) AdjustStock(ctx context.Context, eventID, merchID string, delta int) error {
+	filter := bson.M{"eventid": eventID, "merchid": merchID}
+	return matchedOrNotFound(s.coll.UpdateOne(ctx, filter, bson.M{"$inc": bson.M{"stock": delta}}))
+}
+
+func (s *mongoMerchStore) Purchase(ctx context.Context, eventID, merchID string, quantity int) (Merch, error) {
+	filter := bson.M{"eventid": eventID, "merchid": merchID, "stock": bson.M{"$gte": quantity}}
+	update := bson.M{"$inc": bson.M{"stock": -quantity}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var merch Merch
+	err := s.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&merch)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, getErr := s.Get(ctx, eventID, merchID); getErr != nil {
+			return Merch{}, getErr
+		}
+		return Merch{}, ErrSoldOut
+	}
+	return merch, mongoErr(err)
+}
+
+type mongoMediaStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoMediaStore) Create(ctx context.Context, media Media) error {
+	_, err := s.coll.InsertOne(ctx, media)
+	return mongoErr(err)
+}
+
+func (s *mongoMediaStore) Get(ctx context.Context, eventID, mediaID string) (Media, error) {
+	var media Media
+	err := s.coll.FindOne(ctx, bson.M{"eventid": eventID, "id": mediaID}).Decode(&media)
+	return media, mongoErr(err)
+}
+
+func (s *mongoMediaStore) ListByEvent(ctx context.Context, eventID string) ([]Media, error) {
+	var medias []Media
+	err := findAll(ctx, s.coll, bson.M{"eventid": eventID}, &medias)
+	return medias, err
+}
+
+func (s *mongoMediaStore) Delete(ctx context.Context, eventID, mediaID string) error {
+	return deletedOrNotFound(s.coll.DeleteOne(ctx, bson.M{"eventid": eventID, "id": mediaID}))
+}
+
+type mongoUserStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoUserStore) Create(ctx context.Context, user User) error {
+	_, err := s.coll.InsertOne(ctx, user)
+	return mongoErr(err)
+}
+
+func (s *mongoUserStore) GetByUsername(ctx context.Context, username string) (User, error) {
+	var user User
+	err := s.coll.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	return user, mongoErr(err)
+}
+
+func (s *mongoUserStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	var user User
+	err := s.coll.FindOne(ctx, bson.M{"email": email}).Decode(&user)
+	return user, mongoErr(err)
+}
+
+func (s *mongoUserStore) GetByIdentity(ctx context.Context, issuer, subject string) (User, error) {
+	var user User
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{"issuer": issuer, "subject": subject}}}
+	err := s.coll.FindOne(ctx, filter).Decode(&user)
+	return user, mongoErr(err)
+}
+
+func (s *mongoUserStore) GetByUserID(ctx context.Context, userID string) (User, error) {
+	var user User
+	err := s.coll.FindOne(ctx, bson.M{"userid": userID}).Decode(&user)
+	return user, mongoErr(err)
+}
+
+func (s *mongoUserStore) List(ctx context.Context) ([]User, error) {
+	var users []User
+	err := findAll(ctx, s.coll, bson.M{}, &users)
+	return users, err
+}
+
+func (s *mongoUserStore) Update(ctx context.Context, user User) error {
+	// The sign-in counters may have moved on since user was read
+	return replaceKeeping(ctx, s.coll, bson.M{"userid": user.UserID}, user, "failed_logins", "last_failed_login")
+}
+
+func (s *mongoUserStore) Delete(ctx context.Context, userID string) error {
+	return deletedOrNotFound(s.coll.DeleteOne(ctx, bson.M{"userid": userID}))
+}
+
+func (s *mongoUserStore) ClaimLoginAttempt(ctx context.Context, userID string, seen int, at time.Time) (int, error) {
+	// A count of zero is stored as no count at all
+	filter := bson.M{"userid": userID, "failed_logins": seen}
+	if seen == 0 {
+		filter["failed_logins"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	update := bson.M{"$inc": bson.M{"failed_logins": 1}, "$set": bson.M{"last_failed_login": at}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var user User
+	err := s.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, ErrConflict
+	}
+	return user.FailedLogins, mongoErr(err)
+}
+
+func (s *mongoUserStore) ResetLoginFailures(ctx context.Context, userID string) error {
+	update := bson.M{"$unset": bson.M{"failed_logins": "", "last_failed_login": ""}}
+	return matchedOrNotFound(s.coll.UpdateOne(ctx, bson.M{"userid": userID}, update))
+}
+
+func (s *mongoUserStore) UseTOTPStep(ctx context.Context, userID string, step int64) error {
+	// A last step of zero is stored as no step at all
+	filter := bson.M{
+		"userid":       userID,
+		"totp_enabled": true,
+		"$or": bson.A{
+			bson.M{"totp_last_step": bson.M{"$lt": step}},
+			bson.M{"totp_last_step": nil},
+		},
+	}
+	res, err := s.coll.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"totp_last_step": step}})
+	if err != nil {
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (s *mongoUserStore) UseRecoveryCode(ctx context.Context, userID, hash string) error {
+	filter := bson.M{"userid": userID, "recovery_codes": hash}
+	res, err := s.coll.UpdateOne(ctx, filter, bson.M{"$pull": bson.M{"recovery_codes": hash}})
+	if err != nil {
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		return ErrConflict
+	}
+	return nil
+}
+
+func (s *mongoUserStore) SetLastLogin(ctx context.Context, userID string, at time.Time) error {
+	return matchedOrNotFound(s.coll.UpdateOne(ctx, bson.M{"userid": userID}, bson.M{"$set": bson.M{"last_login": at}}))
+}
+
+func (s *mongoUserStore) SetFollows(ctx context.Context, userID string, follows []string) error {
+	return matchedOrNotFound(s.coll.UpdateOne(ctx, bson.M{"userid": userID}, bson.M{"$set": bson.M{"follows": follows}}))
+}
+
+func (s *mongoUserStore) AddFollower(ctx context.Context, userID, followerID string) error {
+	_, err := s.coll.UpdateOne(ctx, bson.M{"userid": userID}, bson.M{"$addToSet": bson.M{"followers": followerID}})
+	return mongoErr(err)
+}
+
+func (s *mongoUserStore) RemoveFollower(ctx context.Context, userID, followerID string) error {
+	_, err := s.coll.UpdateOne(ctx, bson.M{"userid": userID}, bson.M{"$pull": bson.M{"followers": followerID}})
+	return mongoErr(err)
+}
+
+type mongoActivityStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoActivityStore) Log(ctx context.Context, activity Activity) error {
+	_, err := s.coll.InsertOne(ctx, activity)
+	return mongoErr(err)
+}
+
+func (s *mongoActivityStore) ListByUsername(ctx context.Context, username string) ([]Activity, error) {
+	var activities []Activity
+	err := findAll(ctx, s.coll, bson.M{"username": username}, &activities)
+	return activities, err
+}
+
+type mongoOrderStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoOrderStore) Create(ctx context.Context, order Order) error {
+	_, err := s.coll.InsertOne(ctx, order)
+	return mongoErr(err)
+}
+
+func (s *mongoOrderStore) Get(ctx context.Context, orderID string) (Order, error) {
+	var order Order
+	err := s.coll.FindOne(ctx, bson.M{"orderid": orderID}).Decode(&order)
+	return order, mongoErr(err)
+}
+
+func (s *mongoOrderStore) ListByUser(ctx context.Context, userID string) ([]Order, error) {
+	var orders []Order
+	err := findAllSorted(ctx, s.coll, bson.M{"userid": userID}, bson.D{{Key: "created_at", Value: -1}}, &orders)
+	return orders, err
+}
+
+func (s *mongoOrderStore) ListByEvent(ctx context.Context, eventID string) ([]Order, error) {
+	var orders []Order
+	err := findAllSorted(ctx, s.coll, bson.M{"eventid": eventID}, bson.D{{Key: "created_at", Value: -1}}, &orders)
+	return orders, err
+}
+
+func (s *mongoOrderStore) UpdateStatus(ctx context.Context, orderID, from, to string) error {
+	update := bson.M{"$set": bson.M{"status": to, "updated_at": time.Now()}}
+	res, err := s.coll.UpdateOne(ctx, bson.M{"orderid": orderID, "status": from}, update)
+	if err != nil {
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		if _, err := s.Get(ctx, orderID); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	return nil
+}
+
+func (s *mongoOrderStore) ListPending(ctx context.Context, cutoff time.Time, limit int) ([]Order, error) {
+	filter := bson.M{"status": OrderStatusPending, "created_at": bson.M{"$lt": cutoff}}
+	cursor, err := s.coll.Find(ctx, filter, options.Find().SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var orders []Order
+	err = cursor.All(ctx, &orders)
+	return orders, err
+}
+
+type mongoReservationStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoReservationStore) Create(ctx context.Context, reservation Reservation) error {
+	_, err := s.coll.InsertOne(ctx, reservation)
+	return mongoErr(err)
+}
+
+func (s *mongoReservationStore) Get(ctx context.Context, reservationID string) (Reservation, error) {
+	var reservation Reservation
+	err := s.coll.FindOne(ctx, bson.M{"reservationid": reservationID}).Decode(&reservation)
+	return reservation, mongoErr(err)
+}
+
+func (s *mongoReservationStore) ListByUser(ctx context.Context, userID string) ([]Reservation, error) {
+	var reservations []Reservation
+	err := findAllSorted(ctx, s.coll, bson.M{"userid": userID}, bson.D{{Key: "created_at", Value: -1}}, &reservations)
+	return reservations, err
+}
+
+func (s *mongoReservationStore) Transition(ctx context.Context, reservationID, from, to, orderID string) (Reservation, error) {
+	set := bson.M{"status": to, "updated_at": time.Now()}
+	if orderID != "" {
+		set["orderid"] = orderID
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var reservation Reservation
+	err := s.coll.FindOneAndUpdate(ctx, bson.M{"reservationid": reservationID, "status": from}, bson.M{"$set": set}, opts).Decode(&reservation)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, getErr := s.Get(ctx, reservationID); getErr != nil {
+			return Reservation{}, getErr
+		}
+		return Reservation{}, ErrConflict
+	}
+	return reservation, mongoErr(err)
+}
+
+func (s *mongoReservationStore) ListExpired(ctx context.Context, now time.Time, limit int) ([]Reservation, error) {
+	filter := bson.M{"status": ReservationHeld, "expires_at": bson.M{"$lte": now}}
+	cursor, err := s.coll.Find(ctx, filter, options.Find().SetLimit(int64(limit)))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var reservations []Reservation
+	err = cursor.All(ctx, &reservations)
+	return reservations, err
+}
+
+type mongoTicketInstanceStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoTicketInstanceStore) Issue(ctx context.Context, instance TicketInstance) error {
+	opts := options.Update().SetUpsert(true)
+	_, err := s.coll.UpdateOne(ctx, bson.M{"instanceid": instance.InstanceID}, bson.M{"$setOnInsert": instance}, opts)
+	return mongoErr(err)
+}
+
+func (s *mongoTicketInstanceStore) Get(ctx context.Context, instanceID string) (TicketInstance, error) {
+	var instance TicketInstance
+	err := s.coll.FindOne(ctx, bson.M{"instanceid": instanceID}).Decode(&instance)
+	return instance, mongoErr(err)
+}
+
+func (s *mongoTicketInstanceStore) ListByHolder(ctx context.Context, holderID string) ([]TicketInstance, error) {
+	var instances []TicketInstance
+	err := findAllSorted(ctx, s.coll, bson.M{"holderid": holderID}, bson.D{{Key: "issued_at", Value: -1}, {Key: "instanceid", Value: 1}}, &instances)
+	return instances, err
+}
+
+func (s *mongoTicketInstanceStore) ListByOrder(ctx context.Context, orderID string) ([]TicketInstance, error) {
+	var instances []TicketInstance
+	err := findAllSorted(ctx, s.coll, bson.M{"orderid": orderID}, bson.D{{Key: "instanceid", Value: 1}}, &instances)
+	return instances, err
+}
+
+func (s *mongoTicketInstanceStore) VoidByOrder(ctx context.Context, orderID string) error {
+	_, err := s.coll.UpdateMany(ctx, bson.M{"orderid": orderID}, bson.M{"$set": bson.M{"status": TicketInstanceVoid}})
+	return err
+}
+
+func (s *mongoTicketInstanceStore) CheckIn(ctx context.Context, instanceID, by, device string, at time.Time) (TicketInstance, error) {
+	filter := bson.M{
+		"instanceid": instanceID,
+		"status":     TicketInstanceValid,
+		"$or":        bson.A{bson.M{"checked_in_at": nil}, bson.M{"checked_in_at": bson.M{"$gt": at}}},
+	}
+	update := bson.M{"$set": bson.M{"checked_in_at": at, "checked_in_by": by, "checkin_device": device}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var instance TicketInstance
+	err := s.coll.FindOneAndUpdate(ctx, filter, update, opts).Decode(&instance)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		existing, getErr := s.Get(ctx, instanceID)
+		if getErr != nil {
+			return TicketInstance{}, getErr
+		}
+		return existing, ErrConflict
+	}
+	return instance, mongoErr(err)
+}
+
+func (s *mongoTicketInstanceStore) CountByEvent(ctx context.Context, eventID string) (int, int, error) {
+	filter := bson.M{"eventid": eventID, "status": TicketInstanceValid}
+	issued, err := s.coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, 0, err
+	}
+	filter["checked_in_at"] = bson.M{"$ne": nil}
+	checkedIn, err := s.coll.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(issued), int(checkedIn), nil
+}
+
+type mongoRefreshTokenStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoRefreshTokenStore) Create(ctx context.Context, token RefreshToken) error {
+	_, err := s.coll.InsertOne(ctx, token)
+	return mongoErr(err)
+}
+
+func (s *mongoRefreshTokenStore) Get(ctx context.Context, tokenID string) (RefreshToken, error) {
+	var token RefreshToken
+	err := s.coll.FindOne(ctx, bson.M{"tokenid": tokenID}).Decode(&token)
+	return token, mongoErr(err)
+}
+
+func (s *mongoRefreshTokenStore) MarkUsed(ctx context.Context, tokenID string) error {
+	filter := bson.M{"tokenid": tokenID, "status": RefreshTokenActive}
+	res, err := s.coll.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"status": RefreshTokenUsed}})
+	if err != nil {
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		if _, err := s.Get(ctx, tokenID); err != nil {
+			return err
+		}
+		return ErrConflict
+	}
+	return nil
+}
+
+func (s *mongoRefreshTokenStore) RevokeSession(ctx context.Context, sessionID string) error {
+	_, err := s.coll.UpdateMany(ctx, bson.M{"sessionid": sessionID}, bson.M{"$set": bson.M{"status": RefreshTokenRevoked}})
+	return err
+}
+
+func (s *mongoRefreshTokenStore) RevokeUser(ctx context.Context, userID string) ([]string, error) {
+	filter := bson.M{"userid": userID, "status": RefreshTokenActive}
+	var active []RefreshToken
+	if err := findAll(ctx, s.coll, filter, &active); err != nil {
+		return nil, err
+	}
+	if _, err := s.coll.UpdateMany(ctx, bson.M{"userid": userID}, bson.M{"$set": bson.M{"status": RefreshTokenRevoked}}); err != nil {
+		return nil, err
+	}
+	sessions := make([]string, 0, len(active))
+	for _, token := range active {
+		sessions = append(sessions, token.SessionID)
+	}
+	return sessions, nil
+}
+
+type mongoRevocationStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoRevocationStore) Revoke(ctx context.Context, revocation Revocation) error {
+	opts := options.Replace().SetUpsert(true)
+	_, err := s.coll.ReplaceOne(ctx, bson.M{"key": revocation.Key}, revocation, opts)
+	return err
+}
+
+func (s *mongoRevocationStore) IsRevoked(ctx context.Context, keys ...string) (bool, error) {
+	filter := bson.M{"key": bson.M{"$in": keys}, "expires_at": bson.M{"$gt": time.Now()}}
+	n, err := s.coll.CountDocuments(ctx, filter, options.Count().SetLimit(1))
+	return n > 0, err
+}
+
+type mongoSessionStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoSessionStore) Create(ctx context.Context, session Session) error {
+	_, err := s.coll.InsertOne(ctx, session)
+	return mongoErr(err)
+}
+
+func (s *mongoSessionStore) Get(ctx context.Context, sessionID string) (Session, error) {
+	var session Session
+	err := s.coll.FindOne(ctx, bson.M{"sessionid": sessionID}).Decode(&session)
+	return session, mongoErr(err)
+}
+
+func (s *mongoSessionStore) ListActive(ctx context.Context, userID string) ([]Session, error) {
+	var sessions []Session
+	filter := bson.M{"userid": userID, "ended_at": nil}
+	err := findAllSorted(ctx, s.coll, filter, bson.D{{Key: "last_seen_at", Value: -1}}, &sessions)
+	return sessions, err
+}
+
+func (s *mongoSessionStore) Touch(ctx context.Context, sessionID, ip string, at time.Time) error {
+	update := bson.M{"$set": bson.M{"ip": ip, "last_seen_at": at}}
+	return matchedOrNotFound(s.coll.UpdateOne(ctx, bson.M{"sessionid": sessionID}, update))
+}
+
+func (s *mongoSessionStore) End(ctx context.Context, sessionID string, at time.Time) error {
+	res, err := s.coll.UpdateOne(ctx, bson.M{"sessionid": sessionID, "ended_at": nil}, bson.M{"$set": bson.M{"ended_at": at}})
+	if err != nil {
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		_, err := s.Get(ctx, sessionID)
+		return err
+	}
+	return nil
+}
+
+func (s *mongoSessionStore) EndUser(ctx context.Context, userID string, at time.Time) error {
+	_, err := s.coll.UpdateMany(ctx, bson.M{"userid": userID, "ended_at": nil}, bson.M{"$set": bson.M{"ended_at": at}})
+	return err
+}
+
+type mongoLoginFailureStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoLoginFailureStore) Record(ctx context.Context, failure LoginFailure) error {
+	_, err := s.coll.InsertOne(ctx, failure)
+	return mongoErr(err)
+}
+
+func (s *mongoLoginFailureStore) ListByUser(ctx context.Context, userID string, limit int) ([]LoginFailure, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "at", Value: -1}}).SetLimit(int64(limit))
+	cursor, err := s.coll.Find(ctx, bson.M{"userid": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	var failures []LoginFailure
+	err = cursor.All(ctx, &failures)
+	return failures, err
+}
+
+type mongoAPIKeyStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoAPIKeyStore) Create(ctx context.Context, key APIKey) error {
+	_, err := s.coll.InsertOne(ctx, key)
+	return mongoErr(err)
+}
+
+func (s *mongoAPIKeyStore) Get(ctx context.Context, keyID string) (APIKey, error) {
+	var key APIKey
+	err := s.coll.FindOne(ctx, bson.M{"keyid": keyID}).Decode(&key)
+	return key, mongoErr(err)
+}
+
+func (s *mongoAPIKeyStore) ListByUser(ctx context.Context, userID string) ([]APIKey, error) {
+	var keys []APIKey
+	err := findAllSorted(ctx, s.coll, bson.M{"userid": userID}, bson.D{{Key: "created_at", Value: -1}}, &keys)
+	return keys, err
+}
+
+func (s *mongoAPIKeyStore) Revoke(ctx context.Context, keyID string, at time.Time) error {
+	res, err := s.coll.UpdateOne(ctx, bson.M{"keyid": keyID, "revoked_at": nil}, bson.M{"$set": bson.M{"revoked_at": at}})
+	if err != nil {
+		return mongoErr(err)
+	}
+	if res.MatchedCount == 0 {
+		_, err := s.Get(ctx, keyID)
+		return err
+	}
+	return nil
+}
+
+func (s *mongoAPIKeyStore) RevokeUser(ctx context.Context, userID string, at time.Time) error {
+	_, err := s.coll.UpdateMany(ctx, bson.M{"userid": userID, "revoked_at": nil}, bson.M{"$set": bson.M{"revoked_at": at}})
+	return mongoErr(err)
+}
+
+func (s *mongoAPIKeyStore) Touch(ctx context.Context, keyID, ip string, at time.Time) error {
+	update := bson.M{"$set": bson.M{"last_used_at": at, "last_used_ip": ip}}
+	return matchedOrNotFound(s.coll.UpdateOne(ctx, bson.M{"keyid": keyID}, update))
+}
@@ -6,117 +6,212 @@ import (
 
 type User struct {
 	ID          string    `json:"-" bson:"_id,omitempty"`
-	UserID      string    `json:"userid" bson:"userid"`
-	Username    string    `json:"username" bson:"username"`
-	Email       string    `json:"email" bson:"email"`
+	UserID      string    `json:"userid" bson:"userid" validate:"readonly"`
+	Username    string    `json:"username" bson:"username" validate:"required,username"`
+	Email       string    `json:"email" bson:"email" validate:"required,max=254,email"`
 	Password    string    `json:"-" bson:"password"`
-	Role        string    `json:"role" bson:"role"`
-	Name        string    `json:"name,omitempty" bson:"name,omitempty"`
-	CreatedAt   time.Time `json:"created_at" bson:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at" bson:"updated_at"`
-	PhoneNumber string    `json:"phone_number,omitempty" bson:"phone_number,omitempty"`
-	Bio         string    `json:"bio,omitempty" bson:"bio,omitempty"`
+	Role        string    `json:"role" bson:"role" validate:"readonly"`
+	Name        string    `json:"name,omitempty" bson:"name,omitempty" validate:"max=100"`
+	CreatedAt   time.Time `json:"created_at" bson:"created_at" validate:"readonly"`
+	UpdatedAt   time.Time `json:"updated_at" bson:"updated_at" validate:"readonly"`
+	PhoneNumber string    `json:"phone_number,omitempty" bson:"phone_number,omitempty" validate:"phone"`
+	Bio         string    `json:"bio,omitempty" bson:"bio,omitempty" validate:"max=500"`
 
 	Preferences Preferences `json:"preferences,omitempty" bson:"preferences,omitempty"`
 
-	IsActive       bool              `json:"is_active" bson:"is_active"`
-	LastLogin      time.Time         `json:"last_login,omitempty" bson:"last_login,omitempty"`
-	ProfilePicture string            `json:"profile_picture" bson:"profile_picture"`
-	ProfileViews   int               `json:"profile_views,omitempty" bson:"profile_views,omitempty"`
-	Address        string            `json:"address,omitempty" bson:"address,omitempty"`
+	IsActive       bool              `json:"is_active" bson:"is_active" validate:"readonly"`
+	LastLogin      time.Time         `json:"last_login,omitempty" bson:"last_login,omitempty" validate:"readonly"`
+	ProfilePicture string            `json:"profile_picture" bson:"profile_picture" validate:"readonly"`
+	ProfileViews   int               `json:"profile_views,omitempty" bson:"profile_views,omitempty" validate:"readonly"`
+	Address        string            `json:"address,omitempty" bson:"address,omitempty" validate:"max=200"`
 	DateOfBirth    time.Time         `json:"date_of_birth,omitempty" bson:"date_of_birth,omitempty"`
-	SocialLinks    map[string]string `json:"social_links,omitempty" bson:"social_links,omitempty"`
-	IsVerified     bool              `json:"is_verified" bson:"is_verified"`
-	Follows        []string          `json:"follows,omitempty" bson:"follows,omitempty"`
-	Followers      []string          `json:"followers,omitempty" bson:"followers,omitempty"`
+	SocialLinks    map[string]string `json:"social_links,omitempty" bson:"social_links,omitempty" validate:"max=10"`
+	IsVerified     bool              `json:"is_verified" bson:"is_verified" validate:"readonly"`
+	Follows        []string          `json:"follows,omitempty" bson:"follows,omitempty" validate:"readonly"`
+	Followers      []string          `json:"followers,omitempty" bson:"followers,omitempty" validate:"readonly"`
+
+	// Two-factor authentication. The secret is saved at enrollment but only
+	// enforced once a first code has confirmed it.
+	TOTPEnabled   bool     `json:"totp_enabled" bson:"totp_enabled" validate:"readonly"`
+	TOTPSecret    string   `json:"-" bson:"totp_secret,omitempty"`
+	TOTPLastStep  int64    `json:"-" bson:"totp_last_step,omitempty"` // Time step of the last accepted code, so codes can't be replayed
+	RecoveryCodes []string `json:"-" bson:"recovery_codes,omitempty"` // SHA-256 hashes of the unused recovery codes
+
+	Identities []Identity `json:"identities,omitempty" bson:"identities,omitempty" validate:"readonly"` // External accounts the user can sign in with
+
+	// Failed sign-in attempts since the last successful one; see lockout.go
+	FailedLogins    int       `json:"-" bson:"failed_logins,omitempty"`
+	LastFailedLogin time.Time `json:"-" bson:"last_failed_login,omitempty"`
+}
+
+// Identity links a user to an account at an OpenID Connect provider. The
+// issuer and subject together identify the external account for good;
+// the email is informational.
+type Identity struct {
+	Provider string    `json:"provider" bson:"provider"`
+	Issuer   string    `json:"issuer" bson:"issuer"`
+	Subject  string    `json:"subject" bson:"subject"`
+	Email    string    `json:"email,omitempty" bson:"email,omitempty"`
+	LinkedAt time.Time `json:"linked_at" bson:"linked_at"`
 }
 
 type Preferences struct {
-	Theme             string `json:"theme" bson:"theme"`
+	Theme             string `json:"theme" bson:"theme" validate:"max=20"`
 	NotificationEmail bool   `json:"notification_email" bson:"notification_email"`
 	// other preference fields
 }
 
 type Merch struct {
-	MerchID    string  `json:"merchid" bson:"merchid"`
-	EventID    string  `json:"eventid" bson:"eventid"` // Reference to Event ID
-	Name       string  `json:"name" bson:"name"`
-	Price      float64 `json:"price" bson:"price"`
-	Stock      int     `json:"stock" bson:"stock"` // Number of items available
-	MerchPhoto string  `json:"merch_pic" bson:"merch_pic"`
+	MerchID    string  `json:"merchid" bson:"merchid" validate:"readonly"`
+	EventID    string  `json:"eventid" bson:"eventid" validate:"readonly"` // Reference to Event ID
+	Name       string  `json:"name" bson:"name" validate:"required,max=100"`
+	Price      float64 `json:"price" bson:"price" validate:"min=0,max=100000"`
+	Stock      int     `json:"stock" bson:"stock" validate:"min=0,max=1000000"` // Number of items available
+	MerchPhoto string  `json:"merch_pic" bson:"merch_pic" validate:"readonly"`
 }
 
 type Event struct {
-	EventID     string `json:"eventid" bson:"eventid"`
-	Title       string `json:"title" bson:"title"`
-	Description string `json:"description" bson:"description"`
-	Place       string `json:"place" bson:"place"`
-	Date        string `json:"date" bson:"date"`
+	EventID     string `json:"eventid" bson:"eventid" validate:"readonly"`
+	Title       string `json:"title" bson:"title" validate:"required,max=200"`
+	Description string `json:"description" bson:"description" validate:"required,max=5000"`
+	Place       string `json:"place" bson:"place" validate:"max=64"`
+	Date        string `json:"date" bson:"date" validate:"max=50"`
 	// Date        time.Time `json:"date" bson:"date"`
 
-	Location string `json:"location" bson:"location"`
+	Location string `json:"location" bson:"location" validate:"required,max=200"`
 	// Address   string `json:"address" bson:"address"`
-	CreatorID string `json:"creatorid" bson:"creatorid"`
+	CreatorID string `json:"creatorid" bson:"creatorid" validate:"readonly"`
+	// UserIDs who may manage the event alongside its creator
+	CoOrganizers []string `json:"co_organizers,omitempty" bson:"co_organizers,omitempty" validate:"readonly"`
 
-	OrganizerName    string `json:"organizer_name" bson:"organizer_name"`
-	OrganizerContact string `json:"organizer_contact" bson:"organizer_contact"`
+	OrganizerName    string `json:"organizer_name" bson:"organizer_name" validate:"max=100"`
+	OrganizerContact string `json:"organizer_contact" bson:"organizer_contact" validate:"max=200"`
 
-	Tickets []Ticket `json:"tickets" bson:"tickets"`
-	Media   []Media  `json:"media" bson:"media"`
-	Merch   []Merch  `json:"merch" bson:"merch"`
+	Tickets []Ticket `json:"tickets" bson:"tickets" validate:"readonly"`
+	Media   []Media  `json:"media" bson:"media" validate:"readonly"`
+	Merch   []Merch  `json:"merch" bson:"merch" validate:"readonly"`
 
 	StartDateTime time.Time `json:"start_date_time" bson:"start_date_time"`
 	EndDateTime   time.Time `json:"end_date_time" bson:"end_date_time"`
 
-	Category          string `json:"category" bson:"category"`
-	BannerImage       string `json:"banner_image" bson:"banner_image"`
-	WebsiteURL        string `json:"website_url" bson:"website_url"`
-	Status            string `json:"status" bson:"status"`
-	AccessibilityInfo string `json:"accessibility_info" bson:"accessibility_info"`
+	Category          string `json:"category" bson:"category" validate:"max=50"`
+	BannerImage       string `json:"banner_image" bson:"banner_image" validate:"readonly"`
+	WebsiteURL        string `json:"website_url" bson:"website_url" validate:"url"`
+	Status            string `json:"status" bson:"status" validate:"oneof=draft published live ended cancelled postponed"`
+	AccessibilityInfo string `json:"accessibility_info" bson:"accessibility_info" validate:"max=1000"`
 
-	Reviews          []Review               `json:"reviews" bson:"reviews"`
-	SocialMediaLinks []string               `json:"social_media_links" bson:"social_media_links"`
-	Tags             []string               `json:"tags" bson:"tags"`
-	CustomFields     map[string]interface{} `json:"custom_fields" bson:"custom_fields"`
+	Reviews          []Review               `json:"reviews" bson:"reviews" validate:"readonly"`
+	SocialMediaLinks []string               `json:"social_media_links" bson:"social_media_links" validate:"max=10"`
+	Tags             []string               `json:"tags" bson:"tags" validate:"max=20"`
+	CustomFields     map[string]interface{} `json:"custom_fields" bson:"custom_fields" validate:"max=20"`
 
-	CreatedAt time.Time `json:"created_at" bson:"created_at"`
-	UpdatedAt time.Time `json:"updated_at" bson:"updated_at"`
+	// Summary of the event's tickets, kept up to date as tickets change so
+	// events can be filtered and sorted by price
+	TicketTypes int     `json:"ticket_types" bson:"ticket_types" validate:"readonly"`
+	MinPrice    float64 `json:"min_price" bson:"min_price" validate:"readonly"`
+	MaxPrice    float64 `json:"max_price" bson:"max_price" validate:"readonly"`
+
+	// Lifecycle; see lifecycle.go
+	StatusReason    string     `json:"status_reason,omitempty" bson:"status_reason,omitempty" validate:"max=500"` // Why it was cancelled or postponed
+	PublishAt       *time.Time `json:"publish_at,omitempty" bson:"publish_at,omitempty"`                          // When a draft publishes itself
+	PublishedAt     *time.Time `json:"published_at,omitempty" bson:"published_at,omitempty" validate:"readonly"`
+	StatusChangedAt time.Time  `json:"status_changed_at,omitempty" bson:"status_changed_at,omitempty" validate:"readonly"`
+
+	// Set on the occurrences of an EventSeries; see series.go
+	SeriesID        string     `json:"seriesid,omitempty" bson:"seriesid,omitempty" validate:"readonly"`
+	OccurrenceStart *time.Time `json:"occurrence_start,omitempty" bson:"occurrence_start,omitempty" validate:"readonly"` // Start the series gave it
+	SeriesOverrides []string   `json:"series_overrides,omitempty" bson:"series_overrides,omitempty" validate:"readonly"` // Fields changed on this occurrence alone
+
+	CreatedAt time.Time `json:"created_at" bson:"created_at" validate:"readonly"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at" validate:"readonly"`
+}
+
+// EventSeries is a recurring event, such as a weekly show. Its occurrences
+// are ordinary events made from it ahead of time, each with its own tickets.
+type EventSeries struct {
+	SeriesID  string `json:"seriesid" bson:"seriesid" validate:"readonly"`
+	CreatorID string `json:"creatorid" bson:"creatorid" validate:"readonly"`
+
+	// What every occurrence starts out with
+	Title       string         `json:"title" bson:"title" validate:"required,max=200"`
+	Description string         `json:"description" bson:"description" validate:"required,max=5000"`
+	Place       string         `json:"place" bson:"place" validate:"max=64"`
+	Location    string         `json:"location" bson:"location" validate:"required,max=200"`
+	Category    string         `json:"category" bson:"category" validate:"max=50"`
+	Tags        []string       `json:"tags" bson:"tags" validate:"max=20"`
+	Status      string         `json:"status" bson:"status" validate:"oneof=draft published"`
+	Tickets     []SeriesTicket `json:"tickets" bson:"tickets" validate:"max=20"`
+
+	// When: RRule repeats Start, in TimeZone, and each occurrence lasts
+	// Duration minutes. Occurrences starting at an ExDate are skipped.
+	Start    time.Time   `json:"start" bson:"start" validate:"required"`
+	Duration int         `json:"duration" bson:"duration" validate:"required,min=1,max=10080"`
+	TimeZone string      `json:"time_zone" bson:"time_zone" validate:"max=64"`
+	RRule    string      `json:"rrule" bson:"rrule" validate:"required,max=500"`
+	ExDates  []time.Time `json:"exdates,omitempty" bson:"exdates,omitempty" validate:"max=1000"`
+
+	GeneratedUntil time.Time `json:"generated_until" bson:"generated_until" validate:"readonly"` // Occurrences before this exist
+	Finished       bool      `json:"finished" bson:"finished" validate:"readonly"`               // Every occurrence exists
+
+	CreatedAt time.Time `json:"created_at" bson:"created_at" validate:"readonly"`
+	UpdatedAt time.Time `json:"updated_at" bson:"updated_at" validate:"readonly"`
+}
+
+// SeriesTicket is a ticket type every occurrence of a series gets, with
+// Quantity of its own.
+type SeriesTicket struct {
+	Name     string  `json:"name" bson:"name" validate:"required,max=100"`
+	Price    float64 `json:"price" bson:"price" validate:"min=0,max=100000"`
+	Quantity int     `json:"quantity" bson:"quantity" validate:"min=0,max=1000000"`
 }
 
+// Event statuses. An event starts as a draft, seen only by its organizers,
+// or published; the scheduler takes published events live when they start
+// and ends them when they finish.
+const (
+	EventDraft     = "draft"
+	EventPublished = "published"
+	EventLive      = "live"
+	EventEnded     = "ended"
+	EventCancelled = "cancelled"
+	EventPostponed = "postponed"
+)
+
 type Place struct {
-	PlaceID     string `json:"placeid" bson:"placeid"`
-	Name        string `json:"name,omitempty" bson:"name,omitempty"`
-	Description string `json:"description,omitempty" bson:"description,omitempty"`
-	Banner      string `json:"banner,omitempty" bson:"banner,omitempty"`
-	Address     string `json:"address,omitempty" bson:"address,omitempty"`
-	City        string `json:"city,omitempty" bson:"city,omitempty"`
+	PlaceID     string `json:"placeid" bson:"placeid" validate:"readonly"`
+	Name        string `json:"name,omitempty" bson:"name,omitempty" validate:"required,max=100"`
+	Description string `json:"description,omitempty" bson:"description,omitempty" validate:"required,max=2000"`
+	Banner      string `json:"banner,omitempty" bson:"banner,omitempty" validate:"readonly"`
+	Address     string `json:"address,omitempty" bson:"address,omitempty" validate:"required,max=200"`
+	City        string `json:"city,omitempty" bson:"city,omitempty" validate:"max=100"`
 	// Location    string      `json:"location,omitempty" bson:"location,omitempty"`
-	Country        string            `json:"country,omitempty" bson:"country,omitempty"`
-	ZipCode        string            `json:"zipCode,omitempty" bson:"zipCode,omitempty"`
+	Country        string            `json:"country,omitempty" bson:"country,omitempty" validate:"max=100"`
+	ZipCode        string            `json:"zipCode,omitempty" bson:"zipCode,omitempty" validate:"max=20"`
 	Coordinates    Coordinates       `json:"coordinates,omitempty" bson:"coordinates,omitempty"`
-	Capacity       int               `json:"capacity" bson:"capacity"`
-	Phone          string            `json:"phone,omitempty" bson:"phone,omitempty"`
-	Website        string            `json:"website,omitempty" bson:"website,omitempty"`
+	Location       *GeoPoint         `json:"-" bson:"location,omitempty"` // Coordinates again, for geo queries
+	Capacity       int               `json:"capacity" bson:"capacity" validate:"min=0"`
+	Phone          string            `json:"phone,omitempty" bson:"phone,omitempty" validate:"phone"`
+	Website        string            `json:"website,omitempty" bson:"website,omitempty" validate:"url"`
 	Category       Category          `json:"category,omitempty" bson:"category,omitempty"`
 	IsOpen         bool              `json:"isopen,omitempty" bson:"isopen,omitempty"`
-	Distance       float64           `json:"distance,omitempty" bson:"distance,omitempty"`
-	Status         PlaceStatus       `json:"status,omitempty" bson:"status,omitempty"`
-	Views          int               `json:"views,omitempty" bson:"views,omitempty"`
-	ReviewCount    int               `json:"reviewCount,omitempty" bson:"reviewCount,omitempty"`
-	SocialLinks    map[string]string `json:"socialLinks,omitempty" bson:"socialLinks,omitempty"`
-	CreatedBy      string            `json:"createdBy,omitempty" bson:"createdBy,omitempty"`
-	UpdatedBy      string            `json:"updatedBy,omitempty" bson:"updatedBy,omitempty"`
-	CreatedAt      time.Time         `json:"created,omitempty" bson:"created,omitempty"`
-	UpdatedAt      time.Time         `json:"updated,omitempty" bson:"updated,omitempty"`
-	DeletedAt      *time.Time        `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
-	Reviews        []Review          `json:"reviews,omitempty" bson:"reviews,omitempty"`
-	Merch          []Merch           `json:"merch,omitempty" bson:"merch,omitempty"`
-	Amenities      []string          `json:"amenities,omitempty" bson:"amenities,omitempty"`
-	Events         []Event           `json:"events,omitempty" bson:"events,omitempty"`
-	Tags           []string          `json:"tags,omitempty" bson:"tags,omitempty"`
-	Medias         []Media           `json:"media,omitempty" bson:"media,omitempty"`
-	OperatingHours []string          `json:"operatinghours,omitempty" bson:"operatinghours,omitempty"`
-	Keywords       []string          `json:"keywords,omitempty" bson:"keywords,omitempty"`
+	Distance       float64           `json:"distance,omitempty" bson:"distance,omitempty" validate:"readonly"`
+	Status         PlaceStatus       `json:"status,omitempty" bson:"status,omitempty" validate:"oneof=active inactive closed"`
+	Views          int               `json:"views,omitempty" bson:"views,omitempty" validate:"readonly"`
+	ReviewCount    int               `json:"reviewCount,omitempty" bson:"reviewCount,omitempty" validate:"readonly"`
+	SocialLinks    map[string]string `json:"socialLinks,omitempty" bson:"socialLinks,omitempty" validate:"max=10"`
+	CreatedBy      string            `json:"createdBy,omitempty" bson:"createdBy,omitempty" validate:"readonly"`
+	UpdatedBy      string            `json:"updatedBy,omitempty" bson:"updatedBy,omitempty" validate:"readonly"`
+	CreatedAt      time.Time         `json:"created,omitempty" bson:"created,omitempty" validate:"readonly"`
+	UpdatedAt      time.Time         `json:"updated,omitempty" bson:"updated,omitempty" validate:"readonly"`
+	DeletedAt      *time.Time        `json:"deletedAt,omitempty" bson:"deletedAt,omitempty" validate:"readonly"`
+	Reviews        []Review          `json:"reviews,omitempty" bson:"reviews,omitempty" validate:"readonly"`
+	Merch          []Merch           `json:"merch,omitempty" bson:"merch,omitempty" validate:"readonly"`
+	Amenities      []string          `json:"amenities,omitempty" bson:"amenities,omitempty" validate:"max=30"`
+	Events         []Event           `json:"events,omitempty" bson:"events,omitempty" validate:"readonly"`
+	Tags           []string          `json:"tags,omitempty" bson:"tags,omitempty" validate:"max=20"`
+	Medias         []Media           `json:"media,omitempty" bson:"media,omitempty" validate:"readonly"`
+	OperatingHours []string          `json:"operatinghours,omitempty" bson:"operatinghours,omitempty" validate:"max=14"`
+	Keywords       []string          `json:"keywords,omitempty" bson:"keywords,omitempty" validate:"max=20"`
 }
 
 type PlaceStatus string
@@ -180,13 +275,19 @@ type Media struct {
 }
 
 type Category struct {
-	MainCategory  string   `json:"mainCategory,omitempty" bson:"mainCategory,omitempty"`
-	SubCategories []string `json:"subCategories,omitempty" bson:"subCategories,omitempty"`
+	MainCategory  string   `json:"mainCategory,omitempty" bson:"mainCategory,omitempty" validate:"max=50"`
+	SubCategories []string `json:"subCategories,omitempty" bson:"subCategories,omitempty" validate:"max=20"`
 }
 
 type Coordinates struct {
-	Latitude  float64 `json:"latitude,omitempty" bson:"latitude,omitempty"`
-	Longitude float64 `json:"longitude,omitempty" bson:"longitude,omitempty"`
+	Latitude  float64 `json:"latitude,omitempty" bson:"latitude,omitempty" validate:"min=-90,max=90"`
+	Longitude float64 `json:"longitude,omitempty" bson:"longitude,omitempty" validate:"min=-180,max=180"`
+}
+
+// GeoPoint is a GeoJSON point, the form MongoDB's geo queries work on.
+type GeoPoint struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"` // Longitude, latitude
 }
 
 type CheckIn struct {
@@ -221,13 +322,196 @@ type Tag struct {
 }
 
 type Ticket struct {
-	TicketID string  `json:"ticketid" bson:"ticketid"`
-	EventID  string  `json:"eventid" bson:"eventid"`
-	Name     string  `json:"name" bson:"name"`
-	Price    float64 `json:"price" bson:"price"`
-	Quantity int     `json:"quantity" bson:"quantity"`
+	TicketID string  `json:"ticketid" bson:"ticketid" validate:"readonly"`
+	EventID  string  `json:"eventid" bson:"eventid" validate:"readonly"`
+	Name     string  `json:"name" bson:"name" validate:"required,max=100"`
+	Price    float64 `json:"price" bson:"price" validate:"min=0,max=100000"`
+	Quantity int     `json:"quantity" bson:"quantity" validate:"min=0,max=1000000"`
+}
+
+// Order records a single purchase of tickets or merch by a user.
+type Order struct {
+	OrderID   string      `json:"orderid" bson:"orderid"`
+	UserID    string      `json:"userid" bson:"userid"`   // Buyer
+	EventID   string      `json:"eventid" bson:"eventid"` // Event the items belong to
+	Items     []OrderItem `json:"items" bson:"items"`
+	Total     float64     `json:"total" bson:"total"`
+	Currency  string      `json:"currency,omitempty" bson:"currency,omitempty"`
+	PaymentID string      `json:"paymentid,omitempty" bson:"paymentid,omitempty"` // Provider payment intent
+	Status    string      `json:"status" bson:"status"`
+	CreatedAt time.Time   `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at" bson:"updated_at"`
+}
+
+// OrderItem is one line of an order. ItemID refers to a Ticket or Merch
+// depending on Type.
+type OrderItem struct {
+	Type      string  `json:"type" bson:"type"`
+	ItemID    string  `json:"itemid" bson:"itemid"`
+	Name      string  `json:"name" bson:"name"`
+	UnitPrice float64 `json:"unit_price" bson:"unit_price"`
+	Quantity  int     `json:"quantity" bson:"quantity"`
+	Subtotal  float64 `json:"subtotal" bson:"subtotal"`
+}
+
+const (
+	OrderItemTicket = "ticket"
+	OrderItemMerch  = "merch"
+)
+
+const (
+	OrderStatusPending   = "pending"
+	OrderStatusCompleted = "completed"
+	OrderStatusFailed    = "failed"
+	OrderStatusCancelled = "cancelled"
+	OrderStatusRefunded  = "refunded"
+)
+
+// Reservation is a time-limited hold on some units of a ticket type while
+// the user completes checkout. Held units are already taken out of the
+// ticket's quantity and are returned if the hold is released or expires.
+type Reservation struct {
+	ReservationID string    `json:"reservationid" bson:"reservationid"`
+	UserID        string    `json:"userid" bson:"userid"`
+	EventID       string    `json:"eventid" bson:"eventid"`
+	TicketID      string    `json:"ticketid" bson:"ticketid"`
+	Quantity      int       `json:"quantity" bson:"quantity"`
+	Status        string    `json:"status" bson:"status"`
+	OrderID       string    `json:"orderid,omitempty" bson:"orderid,omitempty"` // Set once confirmed
+	ExpiresAt     time.Time `json:"expires_at" bson:"expires_at"`
+	CreatedAt     time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at" bson:"updated_at"`
+}
+
+const (
+	ReservationHeld      = "held"
+	ReservationConfirmed = "confirmed"
+	ReservationReleased  = "released"
+	ReservationExpired   = "expired"
+)
+
+// TicketInstance is a single admission issued for one unit of a completed
+// ticket order. Token is the signed credential encoded into its QR code.
+type TicketInstance struct {
+	InstanceID string    `json:"instanceid" bson:"instanceid"`
+	OrderID    string    `json:"orderid" bson:"orderid"`
+	EventID    string    `json:"eventid" bson:"eventid"`
+	TicketID   string    `json:"ticketid" bson:"ticketid"`
+	TicketName string    `json:"ticket_name" bson:"ticket_name"`
+	HolderID   string    `json:"holderid" bson:"holderid"`
+	Token      string    `json:"token" bson:"token"`
+	Status     string    `json:"status" bson:"status"`
+	IssuedAt   time.Time `json:"issued_at" bson:"issued_at"`
+
+	// Set by the first successful door scan
+	CheckedInAt   *time.Time `json:"checked_in_at,omitempty" bson:"checked_in_at,omitempty"`
+	CheckedInBy   string     `json:"checked_in_by,omitempty" bson:"checked_in_by,omitempty"` // UserID of the scanning organizer
+	CheckInDevice string     `json:"checkin_device,omitempty" bson:"checkin_device,omitempty"`
+}
+
+const (
+	TicketInstanceValid = "valid"
+	TicketInstanceVoid  = "void" // Refunded; no longer admits anyone
+)
+
+// RefreshToken is the server-side record of a refresh token. Only a hash
+// of the secret half is stored. Each use replaces the token with a new one
+// in the same session, so a token seen twice means it was stolen.
+type RefreshToken struct {
+	TokenID   string    `json:"tokenid" bson:"tokenid"`
+	SessionID string    `json:"sessionid" bson:"sessionid"` // Shared by every rotation of one login
+	UserID    string    `json:"userid" bson:"userid"`
+	Hash      string    `json:"-" bson:"hash"`
+	Status    string    `json:"status" bson:"status"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+const (
+	RefreshTokenActive  = "active"
+	RefreshTokenUsed    = "used"
+	RefreshTokenRevoked = "revoked"
+)
+
+// Revocation marks an access token (by its ID) or a whole session as no
+// longer valid. Entries can be dropped once ExpiresAt passes, since every
+// access token they cover has expired by then.
+type Revocation struct {
+	Key       string    `json:"key" bson:"key"` // "jti:<id>"
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+}
+
+// LoginFailure is the audit record of one rejected sign-in attempt.
+type LoginFailure struct {
+	FailureID string    `json:"failureid" bson:"failureid"`
+	UserID    string    `json:"userid,omitempty" bson:"userid,omitempty"` // Empty when the username doesn't exist
+	Username  string    `json:"username" bson:"username"`
+	Reason    string    `json:"reason" bson:"reason"`
+	IP        string    `json:"ip" bson:"ip"`
+	UserAgent string    `json:"user_agent" bson:"user_agent"`
+	At        time.Time `json:"at" bson:"at"`
 }
 
+const (
+	LoginFailureUnknownUser  = "unknown_user"
+	LoginFailurePassword     = "bad_password"
+	LoginFailureSecondFactor = "bad_second_factor"
+	LoginFailureThrottled    = "throttled"
+)
+
+// Session is one login on one device. Every access and refresh token
+// carries the ID of the session it was issued for; ending the session
+// invalidates all of them.
+type Session struct {
+	SessionID  string     `json:"sessionid" bson:"sessionid"`
+	UserID     string     `json:"userid" bson:"userid"`
+	UserAgent  string     `json:"user_agent" bson:"user_agent"`
+	IP         string     `json:"ip" bson:"ip"`
+	CreatedAt  time.Time  `json:"created_at" bson:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at" bson:"last_seen_at"`
+	EndedAt    *time.Time `json:"ended_at,omitempty" bson:"ended_at,omitempty"`
+	Current    bool       `json:"current" bson:"-"` // Set when listing for the session making the request
+}
+
+// APIKey lets a server call the API as the user who created it, limited
+// to its scopes. Only a hash of the secret is stored; the key itself is
+// shown once, when it is created.
+type APIKey struct {
+	KeyID      string     `json:"keyid" bson:"keyid"`
+	UserID     string     `json:"userid" bson:"userid"`
+	Name       string     `json:"name" bson:"name"`
+	Hash       string     `json:"-" bson:"hash"`    // SHA-256 of the full key
+	Hint       string     `json:"hint" bson:"hint"` // Last characters of the key, to tell keys apart
+	Scopes     []string   `json:"scopes" bson:"scopes"`
+	EventIDs   []string   `json:"event_ids,omitempty" bson:"event_ids,omitempty"` // If set, the only events the key may act on
+	RateLimit  float64    `json:"rate_limit" bson:"rate_limit"`                   // Requests per second
+	Burst      int        `json:"burst" bson:"burst"`
+	CreatedAt  time.Time  `json:"created_at" bson:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty" bson:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+// SearchDoc is what the search index holds about an event, place, user or
+// merch item. Title matters most to ranking, then Keywords, then Body.
+type SearchDoc struct {
+	Kind     string   `json:"kind" bson:"kind"` // One of the SearchKind constants
+	ID       string   `json:"id" bson:"id"`
+	EventID  string   `json:"eventid,omitempty" bson:"eventid,omitempty"` // Event a merch item belongs to
+	Title    string   `json:"title" bson:"title"`
+	Keywords []string `json:"keywords,omitempty" bson:"keywords,omitempty"`
+	Body     string   `json:"body,omitempty" bson:"body,omitempty"`
+}
+
+// Kinds of SearchDoc
+const (
+	SearchKindEvent = "event"
+	SearchKindPlace = "place"
+	SearchKindUser  = "user"
+	SearchKindMerch = "merch"
+)
+
 const (
 	PlaceStatusActive     = "active"
 	PlaceStatusClosed     = "closed"
@@ -3,12 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
 
 	"github.com/julienschmidt/httprouter"
-	"go.mongodb.org/mongo-driver/bson"
 )
 
 // Create Ticket
@@ -18,7 +19,6 @@ func createTick(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	// Retrieve form values
 	name := r.FormValue("name")
 	priceStr := r.FormValue("price")
-	log.Println("\n\n\n\npriceStr : \n\n ", priceStr)
 	// Convert the string to float64
 	price, err := strconv.ParseFloat(priceStr, 64)
 	if err != nil {
@@ -39,16 +39,20 @@ func createTick(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		Price:    price,
 		Quantity: quantity,
 	}
+	if errs := validate(tick); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
 
 	tick.TicketID = generateID(12)
 
-	// Insert ticket into MongoDB
-	collection := client.Database("eventdb").Collection("ticks")
-	_, err = collection.InsertOne(context.TODO(), tick)
+	// Save the ticket
+	err = stores.Tickets.Create(r.Context(), tick)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	refreshTicketSummary(r.Context(), eventID)
 
 	// Respond with the created ticket
 	w.Header().Set("Content-Type", "application/json")
@@ -59,34 +63,12 @@ func createTick(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 func getTicks(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 
-	collection := client.Database("eventdb").Collection("ticks")
-
-	var tickList []Ticket
-	filter := bson.M{"eventid": eventID}
-
-	// Query the database
-	cursor, err := collection.Find(context.Background(), filter)
+	// Query the tickets for the event
+	tickList, err := stores.Tickets.ListByEvent(r.Context(), eventID)
 	if err != nil {
 		http.Error(w, "Failed to fetch tickets", http.StatusInternalServerError)
 		return
 	}
-	defer cursor.Close(context.Background())
-
-	// Iterate through the cursor and decode each document into the ticketList
-	for cursor.Next(context.Background()) {
-		var tick Ticket
-		if err := cursor.Decode(&tick); err != nil {
-			http.Error(w, "Failed to decode ticket", http.StatusInternalServerError)
-			return
-		}
-		tickList = append(tickList, tick)
-	}
-
-	// Check for cursor errors
-	if err := cursor.Err(); err != nil {
-		http.Error(w, "Cursor error", http.StatusInternalServerError)
-		return
-	}
 	if len(tickList) == 0 {
 		tickList = []Ticket{}
 	}
@@ -103,15 +85,28 @@ func editTick(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 	tickID := ps.ByName("ticketid")
 	var tick Ticket
-	json.NewDecoder(r.Body).Decode(&tick)
+	if err := json.NewDecoder(r.Body).Decode(&tick); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if errs := validate(tick); len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	tick.EventID = eventID
+	tick.TicketID = tickID
 
-	// Update the ticket in MongoDB
-	collection := client.Database("eventdb").Collection("ticks")
-	_, err := collection.UpdateOne(context.TODO(), bson.M{"eventid": eventID, "ticketid": tickID}, bson.M{"$set": tick})
+	// Update the ticket
+	err := stores.Tickets.Update(r.Context(), tick)
+	if err == ErrNotFound {
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	refreshTicketSummary(r.Context(), eventID)
 	json.NewEncoder(w).Encode(tick)
 }
 
@@ -120,13 +115,13 @@ func deleteTick(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 	tickID := ps.ByName("ticketid")
 
-	// Delete the ticket from MongoDB
-	collection := client.Database("eventdb").Collection("ticks")
-	_, err := collection.DeleteOne(context.TODO(), bson.M{"eventid": eventID, "ticketid": tickID})
-	if err != nil {
+	// Delete the ticket
+	err := stores.Tickets.Delete(r.Context(), eventID, tickID)
+	if err != nil && err != ErrNotFound {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	refreshTicketSummary(r.Context(), eventID)
 	// w.WriteHeader(http.StatusNoContent)
 	// Respond with success
 	w.Header().Set("Content-Type", "application/json")
@@ -137,39 +132,102 @@ func deleteTick(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	})
 }
 
+// refreshTicketSummary recounts the ticket types of an event and their
+// price range, which event searches filter and sort on.
+func refreshTicketSummary(ctx context.Context, eventID string) {
+	tickets, err := stores.Tickets.ListByEvent(ctx, eventID)
+	if err != nil {
+		log.Printf("Failed to summarize tickets of event %s: %v", eventID, err)
+		return
+	}
+	minPrice, maxPrice := priceRange(tickets)
+	err = stores.Events.SetTicketSummary(ctx, eventID, len(tickets), minPrice, maxPrice)
+	if err != nil && err != ErrNotFound {
+		log.Printf("Failed to summarize tickets of event %s: %v", eventID, err)
+	}
+}
+
+// priceRange returns the lowest and highest price of tickets.
+func priceRange(tickets []Ticket) (minPrice, maxPrice float64) {
+	for i, t := range tickets {
+		if i == 0 || t.Price < minPrice {
+			minPrice = t.Price
+		}
+		if t.Price > maxPrice {
+			maxPrice = t.Price
+		}
+	}
+	return minPrice, maxPrice
+}
+
+// maxTicketsPerPurchase caps how many tickets a single request may buy.
+const maxTicketsPerPurchase = 20
+
+// purchaseRequest is the optional JSON body accepted by buyTicket.
+type purchaseRequest struct {
+	Quantity int `json:"quantity"`
+}
+
 // Buy Ticket
 func buyTicket(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	eventID := ps.ByName("eventid")
 	ticketID := ps.ByName("ticketid")
 
-	// Find the ticket in the database
-	collection := client.Database("eventdb").Collection("ticks")
-	var ticket Ticket // Define the Ticket struct based on your schema
-	err := collection.FindOne(context.TODO(), bson.M{"eventid": eventID, "ticketid": ticketID}).Decode(&ticket)
-	if err != nil {
-		http.Error(w, "Ticket not found or other error", http.StatusNotFound)
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+
+	// Read the requested quantity; an empty body buys a single ticket
+	req := purchaseRequest{Quantity: 1}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if req.Quantity < 1 || req.Quantity > maxTicketsPerPurchase {
+		http.Error(w, fmt.Sprintf("Quantity must be between 1 and %d", maxTicketsPerPurchase), http.StatusBadRequest)
 		return
 	}
 
-	// Check if there are tickets available
-	if ticket.Quantity <= 0 {
-		http.Error(w, "No tickets available for purchase", http.StatusBadRequest)
+	// Take the tickets in a single conditional update so concurrent buyers
+	// can never drive the quantity below zero
+	ticket, err := stores.Tickets.Purchase(r.Context(), eventID, ticketID, req.Quantity)
+	switch {
+	case err == ErrNotFound:
+		http.Error(w, "Ticket not found", http.StatusNotFound)
+		return
+	case err == ErrSoldOut:
+		sendResponse(w, http.StatusConflict, nil, "Not enough tickets available", err)
+		return
+	case err != nil:
+		http.Error(w, "Failed to purchase ticket", http.StatusInternalServerError)
 		return
 	}
 
-	// Decrease the ticket quantity
-	update := bson.M{"$inc": bson.M{"quantity": -1}}
-	_, err = collection.UpdateOne(context.TODO(), bson.M{"eventid": eventID, "ticketid": ticketID}, update)
+	// Record who bought what at the price charged, and take payment
+	item := newOrderItem(OrderItemTicket, ticket.TicketID, ticket.Name, ticket.Price, req.Quantity)
+	order, err := chargeOrder(r.Context(), buildOrder(userID, eventID, OrderStatusPending, item))
 	if err != nil {
-		http.Error(w, "Failed to update ticket quantity", http.StatusInternalServerError)
+		log.Printf("Failed to complete order for ticket %s: %v", ticketID, err)
+		// Put the tickets back so the failed purchase doesn't leak stock
+		if ownsStock(err) {
+			restoreTickets(r.Context(), eventID, ticketID, req.Quantity)
+		}
+		writePaymentError(w, err)
 		return
 	}
+	tickets := issueOrderTickets(r.Context(), order)
 
 	// Respond with success
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"message": "Ticket purchased successfully",
+		"success":   true,
+		"message":   "Ticket purchased successfully",
+		"quantity":  req.Quantity,
+		"remaining": ticket.Quantity,
+		"order":     order,
+		"tickets":   tickets,
 	})
 }
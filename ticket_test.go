@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// buyTicketAs runs buyTicket for userID and returns the response code.
+func buyTicketAs(userID, eventID, ticketID string, quantity int) int {
+	body := strings.NewReader(fmt.Sprintf(`{"quantity": %d}`, quantity))
+	r := httptest.NewRequest(http.MethodPost, "/api/event/"+eventID+"/tickets/"+ticketID+"/buy", body)
+	r = r.WithContext(context.WithValue(r.Context(), userIDKey, userID))
+	w := httptest.NewRecorder()
+	buyTicket(w, r, httprouter.Params{{Key: "eventid", Value: eventID}, {Key: "ticketid", Value: ticketID}})
+	return w.Code
+}
+
+func TestBuyTicketNeverOversells(t *testing.T) {
+	const buyers, stock = 50, 7
+	useMemoryStores(t)
+	ctx := context.Background()
+	if err := stores.Events.Create(ctx, Event{EventID: "e1", Title: "Show", Status: EventPublished}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Tickets.Create(ctx, Ticket{TicketID: "t1", EventID: "e1", Name: "GA", Price: 10, Quantity: stock}); err != nil {
+		t.Fatal(err)
+	}
+
+	codes := make(chan int, buyers)
+	var wg sync.WaitGroup
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes <- buyTicketAs(fmt.Sprintf("u%d", i), "e1", "t1", 1)
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusOK] != stock || counts[http.StatusConflict] != buyers-stock {
+		t.Errorf("responses = %v, want %d OK and %d Conflict", counts, stock, buyers-stock)
+	}
+	ticket, err := stores.Tickets.Get(ctx, "e1", "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.Quantity != 0 {
+		t.Errorf("quantity left = %d, want 0", ticket.Quantity)
+	}
+	orders, err := stores.Orders.ListByEvent(ctx, "e1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != stock {
+		t.Errorf("%d orders, want %d", len(orders), stock)
+	}
+}
+
+func TestPurchaseNeverOversells(t *testing.T) {
+	const buyers, stock = 100, 13
+	useMemoryStores(t)
+	ctx := context.Background()
+	if err := stores.Tickets.Create(ctx, Ticket{TicketID: "t1", EventID: "e1", Name: "GA", Quantity: stock}); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	bought, soldOut := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := stores.Tickets.Purchase(ctx, "e1", "t1", 1)
+			mu.Lock()
+			defer mu.Unlock()
+			switch err {
+			case nil:
+				bought++
+			case ErrSoldOut:
+				soldOut++
+			default:
+				t.Errorf("Purchase() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if bought != stock || soldOut != buyers-stock {
+		t.Errorf("%d bought and %d sold out, want %d and %d", bought, soldOut, stock, buyers-stock)
+	}
+	ticket, err := stores.Tickets.Get(ctx, "e1", "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.Quantity != 0 {
+		t.Errorf("quantity left = %d, want 0", ticket.Quantity)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
+)
+
+// tokenPair is what login and refresh hand back to the client.
+type tokenPair struct {
+	Token        string `json:"token"` // Access token
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // Access token lifetime in seconds
+	UserID       string `json:"userid"`
+}
+
+// randomToken returns n bytes from crypto/rand, base64url encoded. Use it
+// for anything that must not be guessable; generateID is not.
+func randomToken(n int) string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(n))
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return b
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens returns a fresh access and refresh token for one of user's
+// sessions.
+func issueTokens(ctx context.Context, user User, sessionID string) (tokenPair, error) {
+	now := time.Now()
+
+	claims := &Claims{
+		Username:  user.Username,
+		UserID:    user.UserID,
+		Role:      normalizeRole(user.Role),
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        randomToken(12),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(config.AccessTokenTTL)),
+		},
+	}
+	access, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	secret := randomToken(32)
+	refresh := RefreshToken{
+		TokenID:   randomToken(12),
+		SessionID: sessionID,
+		UserID:    user.UserID,
+		Hash:      hashSecret(secret),
+		Status:    RefreshTokenActive,
+		ExpiresAt: now.Add(config.RefreshTokenTTL),
+		CreatedAt: now,
+	}
+	if err := stores.RefreshTokens.Create(ctx, refresh); err != nil {
+		return tokenPair{}, err
+	}
+
+	return tokenPair{
+		Token:        access,
+		RefreshToken: refresh.TokenID + "." + secret,
+		ExpiresIn:    int(config.AccessTokenTTL / time.Second),
+		UserID:       user.UserID,
+	}, nil
+}
+
+// refreshTokens swaps a refresh token for a new token pair. Each refresh
+// token works once; presenting a used one revokes the whole session, since
+// either the client or an attacker is replaying a stolen token.
+func refreshTokens(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	tokenID, secret, ok := strings.Cut(req.RefreshToken, ".")
+	if !ok {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	stored, err := stores.RefreshTokens.Get(r.Context(), tokenID)
+	if err != nil || subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hashSecret(secret))) != 1 {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if stored.Status == RefreshTokenUsed {
+		log.Printf("Refresh token reuse detected for user %s; revoking session", stored.UserID)
+		endSession(r.Context(), stored.SessionID)
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if stored.Status != RefreshTokenActive {
+		http.Error(w, "Refresh token has been revoked", http.StatusUnauthorized)
+		return
+	}
+	if !time.Now().Before(stored.ExpiresAt) {
+		http.Error(w, "Refresh token has expired", http.StatusUnauthorized)
+		return
+	}
+
+	// Retire the token before issuing its replacement so a concurrent
+	// replay loses the race instead of minting a second session
+	if err := stores.RefreshTokens.MarkUsed(r.Context(), tokenID); err != nil {
+		if err == ErrConflict {
+			endSession(r.Context(), stored.SessionID)
+		}
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := stores.Users.GetByUserID(r.Context(), stored.UserID)
+	if err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	pair, err := issueTokens(r.Context(), user, stored.SessionID)
+	if err != nil {
+		log.Printf("Failed to issue tokens for %s: %v", user.UserID, err)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, pair, "Token refreshed", nil)
+}
+
+// logout ends the caller's current session
+func logout(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	claims, ok := r.Context().Value(claimsKey).(*Claims)
+	if !ok {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	// Older tokens may lack an ID
+	if claims.ID != "" && claims.ExpiresAt != nil {
+		revoke(r.Context(), "jti:"+claims.ID, claims.ExpiresAt.Time)
+	}
+	endSession(r.Context(), claims.SessionID)
+	sendResponse(w, http.StatusOK, nil, "Logged out", nil)
+}
+
+// logoutAll ends every session of the caller, on every device
+func logoutAll(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return
+	}
+	if err := revokeUserSessions(r.Context(), userID); err != nil {
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, nil, "Logged out of all devices", nil)
+}
+
+// revokeUserSessions ends every session a user has and revokes their API
+// keys. It is used for logout everywhere, password changes and resets, and
+// account deletion.
+func revokeUserSessions(ctx context.Context, userID string) error {
+	// A key would outlive a password change or a logout everywhere
+	if err := stores.APIKeys.RevokeUser(ctx, userID, time.Now().UTC()); err != nil {
+		log.Printf("Failed to revoke API keys of %s: %v", userID, err)
+		return err
+	}
+	if _, err := stores.RefreshTokens.RevokeUser(ctx, userID); err != nil {
+		log.Printf("Failed to revoke refresh tokens of %s: %v", userID, err)
+		return err
+	}
+	if err := stores.Sessions.EndUser(ctx, userID, time.Now().UTC()); err != nil {
+		log.Printf("Failed to end sessions of %s: %v", userID, err)
+		return err
+	}
+	return nil
+}
+
+func revoke(ctx context.Context, key string, expires time.Time) {
+	if err := stores.Revocations.Revoke(ctx, Revocation{Key: key, ExpiresAt: expires}); err != nil {
+		log.Printf("Failed to revoke %s: %v", key, err)
+	}
+}
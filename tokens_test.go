@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAuthenticateNeedsLiveSession(t *testing.T) {
+	useMemoryStores(t)
+	router := newRouter(nil)
+	user := User{UserID: "u1", Username: "u1", Role: RoleUser}
+	auth := signIn(t, user)
+
+	listSessions := func(auth string) int {
+		return serveRoute(router, auth, http.MethodGet, "/api/sessions", nil, "").Code
+	}
+	if code := listSessions(auth); code != http.StatusOK {
+		t.Fatalf("with a session = %d, want %d", code, http.StatusOK)
+	}
+
+	// A well-signed token that names no session can't be ended, so it
+	// isn't accepted
+	now := time.Now()
+	claims := &Claims{
+		Username: user.Username,
+		UserID:   user.UserID,
+		Role:     RoleUser,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        randomToken(12),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := listSessions("Bearer " + token); code != http.StatusUnauthorized {
+		t.Errorf("without a session = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	if err := revokeUserSessions(context.Background(), user.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if code := listSessions(auth); code != http.StatusUnauthorized {
+		t.Errorf("after logging out everywhere = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	useMemoryStores(t)
+	router := newRouter(nil)
+	user := User{UserID: "u1", Username: "u1", Role: RoleUser}
+	first := startTestSession(t, user)
+	other := startTestSession(t, user)
+
+	// Called directly, past the rate limit
+	refresh := func(token string) (int, tokenPair) {
+		w := serveAs(refreshTokens, "", http.MethodPost, "/api/token/refresh", `{"refresh_token": "`+token+`"}`)
+		var pair tokenPair
+		if w.Code == http.StatusOK {
+			responseData(t, w, &pair)
+		}
+		return w.Code, pair
+	}
+	listSessions := func(pair tokenPair) int {
+		return serveRoute(router, "Bearer "+pair.Token, http.MethodGet, "/api/sessions", nil, "").Code
+	}
+
+	code, second := refresh(first.RefreshToken)
+	if code != http.StatusOK || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh = %d with %q, want a new refresh token", code, second.RefreshToken)
+	}
+	if code := listSessions(second); code != http.StatusOK {
+		t.Fatalf("new access token = %d, want %d", code, http.StatusOK)
+	}
+
+	// Replaying the spent token ends the session it belongs to, so the
+	// tokens issued in its place stop working too
+	if code, _ := refresh(first.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("replayed refresh = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code, _ := refresh(second.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh after a replay = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := listSessions(second); code != http.StatusUnauthorized {
+		t.Errorf("access token after a replay = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// The user's other devices stay signed in
+	if code := listSessions(other); code != http.StatusOK {
+		t.Errorf("other session after a replay = %d, want %d", code, http.StatusOK)
+	}
+	if code, _ := refresh(other.RefreshToken); code != http.StatusOK {
+		t.Errorf("other session's refresh = %d, want %d", code, http.StatusOK)
+	}
+
+	// Forged and malformed tokens are refused
+	for _, token := range []string{"", "nodot", strings.Split(other.RefreshToken, ".")[0] + ".forged"} {
+		if code, _ := refresh(token); code != http.StatusUnauthorized {
+			t.Errorf("refresh with %q = %d, want %d", token, code, http.StatusUnauthorized)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP parameters (RFC 6238). These are the defaults every authenticator
+// app supports, so the otpauth URI states them only for completeness.
+const (
+	totpPeriod = 30 // Seconds per time step
+	totpDigits = 6
+	totpSkew   = 1 // Steps of clock drift accepted either side of now
+	totpIssuer = "Naevis"
+)
+
+// recoveryCodeCount is how many single-use recovery codes a user gets.
+const recoveryCodeCount = 10
+
+// mfaTokenTTL is how long a password-verified login waits for its code.
+const mfaTokenTTL = 5 * time.Minute
+
+// mfaAudience marks the pending tokens handed out by login.
+const mfaAudience = "mfa"
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random 160-bit secret, base32 encoded as
+// authenticator apps expect.
+func newTOTPSecret() string {
+	return totpEncoding.EncodeToString(randomBytes(20))
+}
+
+// totpCode computes the code for one time step (RFC 4226 HOTP with the step
+// as the counter).
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// checkTOTP reports whether code is valid for secret at now, and the time
+// step it matched. Steps at or before lastStep are refused so a code that
+// was already used can't be replayed.
+func checkTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth:// URI authenticator apps import, usually from a
+// QR code.
+func totpURI(username, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + v.Encode()
+}
+
+// newRecoveryCodes returns fresh recovery codes to show the user once, and
+// the hashes to store.
+func newRecoveryCodes() (codes, hashes []string) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := strings.ToLower(totpEncoding.EncodeToString(randomBytes(7)))[:10]
+		code := raw[:5] + "-" + raw[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashSecret(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes
+}
+
+// normalizeRecoveryCode forgives case, spaces and dashes in typed codes.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// useSecondFactor checks a TOTP code or, failing that, a recovery code
+// against user, and retires it in the store. The store only retires a code
+// that is still unused, so of two requests racing with the same code one
+// fails. user is updated to match.
+func useSecondFactor(ctx context.Context, user *User, code string) bool {
+	code = strings.TrimSpace(code)
+	if step, ok := checkTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep); ok {
+		if err := stores.Users.UseTOTPStep(ctx, user.UserID, step); err != nil {
+			if err != ErrConflict {
+				log.Printf("Failed to retire TOTP code of %s: %v", user.UserID, err)
+			}
+			return false
+		}
+		user.TOTPLastStep = step
+		return true
+	}
+
+	hash := hashSecret(normalizeRecoveryCode(code))
+	for i, stored := range user.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) != 1 {
+			continue
+		}
+		if err := stores.Users.UseRecoveryCode(ctx, user.UserID, hash); err != nil {
+			if err != ErrConflict {
+				log.Printf("Failed to retire recovery code of %s: %v", user.UserID, err)
+			}
+			return false
+		}
+		user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+		return true
+	}
+	return false
+}
+
+// mfaSigningKey keeps pending tokens from being accepted by authenticate,
+// which verifies with the plain JWT secret.
+func mfaSigningKey() []byte {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("mfa pending"))
+	return mac.Sum(nil)
+}
+
+// signMFAToken returns the token login hands out when a password was
+// right but a second factor is still needed.
+func signMFAToken(user User) (string, error) {
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		ID:        randomToken(12),
+		Subject:   user.UserID,
+		Audience:  jwt.ClaimStrings{mfaAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(mfaTokenTTL)),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(mfaSigningKey())
+}
+
+func parseMFAToken(token string) (*jwt.RegisteredClaims, error) {
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return mfaSigningKey(), nil
+	}, jwt.WithAudience(mfaAudience), jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	return claims, err
+}
+
+// loginMFA completes a login started with a password by checking a TOTP or
+// recovery code
+func loginMFA(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := parseMFAToken(req.MFAToken)
+	if err != nil {
+		http.Error(w, "Login has expired, please start again", http.StatusUnauthorized)
+		return
+	}
+	revoked, err := stores.Revocations.IsRevoked(r.Context(), "jti:"+claims.ID)
+	if err != nil {
+		http.Error(w, "Failed to validate token", http.StatusInternalServerError)
+		return
+	}
+	if revoked {
+		http.Error(w, "Login has expired, please start again", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := stores.Users.GetByUserID(r.Context(), claims.Subject)
+	if err != nil || !user.TOTPEnabled {
+		http.Error(w, "Login has expired, please start again", http.StatusUnauthorized)
+		return
+	}
+	user, ok := claimLoginAttempt(w, r, user)
+	if !ok {
+		return
+	}
+	if !useSecondFactor(r.Context(), &user, req.Code) {
+		recordLoginFailure(r, user, LoginFailureSecondFactor)
+		http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		return
+	}
+
+	// A pending token completes one login only
+	revoke(r.Context(), "jti:"+claims.ID, claims.ExpiresAt.Time)
+	finishLogin(w, r, user)
+}
+
+// loadCurrentUser fetches the caller's account, writing an error response
+// and returning false if that fails.
+func loadCurrentUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	userID, ok := r.Context().Value(userIDKey).(string)
+	if !ok {
+		http.Error(w, "Invalid user", http.StatusBadRequest)
+		return User{}, false
+	}
+	user, err := stores.Users.GetByUserID(r.Context(), userID)
+	if err == ErrNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return User{}, false
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return User{}, false
+	}
+	return user, true
+}
+
+// enrollTOTP generates a new secret for the caller. It takes effect once
+// confirmTOTP has seen a code from it, so a botched scan can't lock anyone
+// out.
+func enrollTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, ok := loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	user.TOTPSecret = newTOTPSecret()
+	user.TOTPLastStep = 0
+	user.UpdatedAt = time.Now()
+	if err := stores.Users.Update(r.Context(), user); err != nil {
+		http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	uri := totpURI(user.Username, user.TOTPSecret)
+	qr, err := encodeQR([]byte(uri), qrLevelM)
+	if err != nil {
+		log.Printf("Failed to encode TOTP QR code for %s: %v", user.UserID, err)
+		http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+	var png bytes.Buffer
+	if err := writeQRPNG(&png, qr, 6); err != nil {
+		http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, map[string]string{
+		"secret":      user.TOTPSecret,
+		"otpauth_uri": uri,
+		"qr":          "data:image/png;base64," + base64.StdEncoding.EncodeToString(png.Bytes()),
+	}, "Scan the code with an authenticator app, then confirm with a code", nil)
+}
+
+// confirmTOTP turns on two-factor authentication once the caller proves
+// their app produces valid codes, and returns their recovery codes.
+func confirmTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	user, ok := loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "Start enrollment first", http.StatusBadRequest)
+		return
+	}
+
+	step, valid := checkTOTP(user.TOTPSecret, strings.TrimSpace(req.Code), time.Now(), 0)
+	if !valid {
+		http.Error(w, "Invalid two-factor code", http.StatusBadRequest)
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	user.RecoveryCodes = hashes
+	user.UpdatedAt = time.Now()
+	if err := stores.Users.Update(r.Context(), user); err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	sendResponse(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes}, "Two-factor authentication enabled; store the recovery codes somewhere safe", nil)
+}
+
+// regenerateRecoveryCodes replaces the caller's recovery codes
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	user, ok := loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	user, ok = claimLoginAttempt(w, r, user)
+	if !ok {
+		return
+	}
+	if !useSecondFactor(r.Context(), &user, req.Code) {
+		recordLoginFailure(r, user, LoginFailureSecondFactor)
+		http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		return
+	}
+
+	recordLoginSuccess(r.Context(), user)
+
+	codes, hashes := newRecoveryCodes()
+	user.RecoveryCodes = hashes
+	user.UpdatedAt = time.Now()
+	if err := stores.Users.Update(r.Context(), user); err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, map[string]interface{}{"recovery_codes": codes}, "Recovery codes replaced", nil)
+}
+
+// disableTOTP turns two-factor authentication off. It needs both the
+// password and a current code, so a stolen session alone can't do it, and
+// wrong guesses count towards the sign-in lockout.
+func disableTOTP(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var req struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" || req.Code == "" {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	user, ok := loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
+	if !user.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	user, ok = claimLoginAttempt(w, r, user)
+	if !ok {
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)) != nil {
+		recordLoginFailure(r, user, LoginFailurePassword)
+		http.Error(w, "Invalid password or two-factor code", http.StatusUnauthorized)
+		return
+	}
+	if !useSecondFactor(r.Context(), &user, req.Code) {
+		recordLoginFailure(r, user, LoginFailureSecondFactor)
+		http.Error(w, "Invalid password or two-factor code", http.StatusUnauthorized)
+		return
+	}
+
+	recordLoginSuccess(r.Context(), user)
+
+	clearTOTP(&user)
+	if err := stores.Users.Update(r.Context(), user); err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	sendResponse(w, http.StatusOK, nil, "Two-factor authentication disabled", nil)
+}
+
+// resetUserTOTP lets an admin turn off two-factor authentication for a
+// user who lost both their device and their recovery codes. The user's
+// sessions are ended and they are told by email.
+func resetUserTOTP(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user, err := stores.Users.GetByUserID(r.Context(), ps.ByName("userid"))
+	if err == ErrNotFound {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		return
+	}
+
+	clearTOTP(&user)
+	if err := stores.Users.Update(r.Context(), user); err != nil {
+		http.Error(w, "Failed to reset two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	revokeUserSessions(r.Context(), user.UserID)
+
+	adminID, _ := r.Context().Value(userIDKey).(string)
+	log.Printf("Two-factor authentication of %s reset by %s", user.UserID, adminID)
+	if user.Email != "" {
+		sendMail(Message{
+			To:      user.Email,
+			Subject: "Two-factor authentication was turned off",
+			Body: fmt.Sprintf("Hi %s,\n\nAn administrator turned off two-factor authentication on your account and signed you out everywhere. You can log in with your password and enroll a new device.\n\nIf you didn't ask for this, reset your password and contact support.\n",
+				user.Username),
+		})
+	}
+	sendResponse(w, http.StatusOK, map[string]string{"userid": user.UserID}, "Two-factor authentication reset", nil)
+}
+
+func clearTOTP(user *User) {
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+	user.UpdatedAt = time.Now()
+}
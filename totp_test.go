@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedTOTPAccount stores user u1 with password and two-factor
+// authentication on, and returns it with its recovery codes.
+func seedTOTPAccount(t *testing.T, password string) (User, []string) {
+	t.Helper()
+	user := seedAccount(t, password)
+	codes, hashes := newRecoveryCodes()
+	user.TOTPSecret = newTOTPSecret()
+	user.TOTPEnabled = true
+	user.RecoveryCodes = hashes
+	if err := stores.Users.Update(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user, codes
+}
+
+// currentTOTP returns the code user's app shows now.
+func currentTOTP(t *testing.T, user User) string {
+	t.Helper()
+	key, err := totpEncoding.DecodeString(user.TOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return totpCode(key, time.Now().Unix()/totpPeriod)
+}
+
+func TestSecondFactorIsSingleUse(t *testing.T) {
+	useMemoryStores(t)
+	ctx := context.Background()
+	user, recovery := seedTOTPAccount(t, "old password 1")
+
+	loginWith := func(code string) int {
+		token, err := signMFAToken(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return serveAs(loginMFA, "", http.MethodPost, "/", `{"mfa_token": "`+token+`", "code": "`+code+`"}`).Code
+	}
+
+	code := currentTOTP(t, user)
+	if got := loginWith(code); got != http.StatusOK {
+		t.Fatalf("login = %d, want %d", got, http.StatusOK)
+	}
+	if got := loginWith(code); got != http.StatusUnauthorized {
+		t.Errorf("login replaying the code = %d, want %d", got, http.StatusUnauthorized)
+	}
+	if got := loginWith(strings.ToUpper(recovery[0])); got != http.StatusOK {
+		t.Errorf("login with a recovery code = %d, want %d", got, http.StatusOK)
+	}
+	if got := loginWith(recovery[0]); got != http.StatusUnauthorized {
+		t.Errorf("login reusing the recovery code = %d, want %d", got, http.StatusUnauthorized)
+	}
+
+	// Two requests that read the account before either used a code: only
+	// one gets in
+	stored, err := stores.Users.GetByUserID(ctx, user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.TOTPLastStep = 0 // Forget the login above
+	if err := stores.Users.Update(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+	for name, code := range map[string]string{"TOTP": currentTOTP(t, user), "recovery": recovery[1]} {
+		first, err := stores.Users.GetByUserID(ctx, user.UserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second := first
+		if !useSecondFactor(ctx, &first, code) {
+			t.Fatalf("%s: first use failed", name)
+		}
+		if useSecondFactor(ctx, &second, code) {
+			t.Errorf("%s: a racing second use succeeded", name)
+		}
+	}
+	stored, err = stores.Users.GetByUserID(ctx, user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.RecoveryCodes) != recoveryCodeCount-2 {
+		t.Errorf("%d recovery codes left, want %d", len(stored.RecoveryCodes), recoveryCodeCount-2)
+	}
+}
+
+func TestDisableTOTPCountsFailures(t *testing.T) {
+	useMemoryStores(t)
+	config.Lockout.BackoffAfter = 100 // Only the lock itself
+	config.Lockout.Threshold = 3
+	ctx := context.Background()
+	user, recovery := seedTOTPAccount(t, "old password 1")
+
+	disable := func(password, code string) int {
+		return serveAs(disableTOTP, user.UserID, http.MethodPost, "/", `{"password": "`+password+`", "code": "`+code+`"}`).Code
+	}
+	if code := disable("wrong password", recovery[0]); code != http.StatusUnauthorized {
+		t.Errorf("wrong password = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := disable("old password 1", "000000"); code != http.StatusUnauthorized {
+		t.Errorf("wrong code = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := disable("wrong password", recovery[0]); code != http.StatusUnauthorized {
+		t.Errorf("wrong password = %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	// Locked now, even with the right answers
+	if code := disable("old password 1", recovery[0]); code != http.StatusTooManyRequests {
+		t.Fatalf("after %d failures = %d, want %d", config.Lockout.Threshold, code, http.StatusTooManyRequests)
+	}
+	stored, err := stores.Users.GetByUserID(ctx, user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.TOTPEnabled || len(stored.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("locked attempts changed the account: enabled %v, %d codes", stored.TOTPEnabled, len(stored.RecoveryCodes))
+	}
+
+	if err := stores.Users.ResetLoginFailures(ctx, user.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if code := disable("old password 1", recovery[0]); code != http.StatusOK {
+		t.Fatalf("disable = %d, want %d", code, http.StatusOK)
+	}
+	stored, err = stores.Users.GetByUserID(ctx, user.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.TOTPEnabled || stored.FailedLogins != 0 {
+		t.Errorf("after disabling: enabled %v with %d failures, want off and none", stored.TOTPEnabled, stored.FailedLogins)
+	}
+}
@@ -1,29 +1,23 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"io"
 	"log"
 	"net/http"
 	"os"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/julienschmidt/httprouter"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // Handle retrieving another user's profile
 func getUserProfile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	username := ps.ByName("username")
-	var user User
-
+	username := normalizeUsername(ps.ByName("username"))
 	// Retrieve the user by username
-	err := userCollection.FindOne(context.TODO(), bson.M{"username": username}).Decode(&user)
+	user, err := stores.Users.GetByUsername(r.Context(), username)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if err == ErrNotFound {
 			http.Error(w, "User not found", http.StatusNotFound)
 			log.Printf("User not found: %s", username)
 			return
@@ -45,79 +39,94 @@ func getUserProfile(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 	// Get the ID of the requesting user from the context
 	requestingUserID, ok := r.Context().Value(userIDKey).(string)
 	if ok {
-		log.Println("Requesting User ID:", requestingUserID)
-
 		// Check if the requesting user is following the target user
 		userProfile.IsFollowing = contains(user.Followers, requestingUserID)
 	}
 
-	log.Println("User Profile Response:", userProfile)
-
 	// Send the response
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(userProfile)
 }
 
 func editProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	tokenString := r.Header.Get("Authorization")
-	claims := &Claims{}
-
-	// Validate JWT token
-	_, err := jwt.ParseWithClaims(tokenString[7:], claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
 	// Parse the multipart form
 	if err := r.ParseMultipartForm(10 << 20); err != nil {
 		http.Error(w, "Unable to parse form", http.StatusBadRequest)
 		return
 	}
 
-	// Prepare an update document
-	update := bson.M{}
+	// Load the current profile
+	userProfile, ok := loadCurrentUser(w, r)
+	if !ok {
+		return
+	}
 
 	// Retrieve and update fields from the form
-	if username := r.FormValue("username"); username != "" {
-		update["username"] = username
+	errs := FieldErrors{}
+	if username := normalizeUsername(r.FormValue("username")); username != "" && username != userProfile.Username {
+		if _, err := stores.Users.GetByUsername(r.Context(), username); err == nil {
+			errs.add("username", "is already taken")
+		}
+		userProfile.Username = username
 	}
-	if email := r.FormValue("email"); email != "" {
-		update["email"] = email
+	emailChanged := false
+	if email := normalizeEmail(r.FormValue("email")); email != "" && email != userProfile.Email {
+		if _, err := stores.Users.GetByEmail(r.Context(), email); err == nil {
+			errs.add("email", "is already registered")
+		}
+		userProfile.Email = email
+		userProfile.IsVerified = false // The new address has to be confirmed
+		emailChanged = true
 	}
 	if bio := r.FormValue("bio"); bio != "" {
-		update["bio"] = bio
+		userProfile.Bio = bio
 	}
 	if phoneNumber := r.FormValue("phone_number"); phoneNumber != "" {
-		update["phone_number"] = phoneNumber
+		userProfile.PhoneNumber = phoneNumber
 	}
 
 	// Handle social links
 	if socialLinks := r.FormValue("social_links"); socialLinks != "" {
 		var links map[string]string
-		if err := json.Unmarshal([]byte(socialLinks), &links); err == nil {
-			update["social_links"] = links
+		if err := json.Unmarshal([]byte(socialLinks), &links); err != nil {
+			errs.add("social_links", "must be a JSON object of names to URLs")
+		} else {
+			userProfile.SocialLinks = links
 		}
 	}
 
 	// Optional: handle password update
-	if password := r.FormValue("password"); password != "" {
+	password := r.FormValue("password")
+	if password != "" {
+		if problem := passwordProblem(password, userProfile); problem != "" {
+			errs.add("password", problem)
+		}
+	}
+	for field, problem := range validate(userProfile) {
+		errs.add(field, problem)
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	passwordChanged := false
+	if password != "" {
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 		if err != nil {
 			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
 			return
 		}
-		update["password"] = string(hashedPassword)
+		userProfile.Password = string(hashedPassword)
+		passwordChanged = true
 	}
 
 	// Handle profile picture upload
 	if file, _, err := r.FormFile("profile_picture"); err == nil {
 		defer file.Close()
 
-		// Save the file to a predefined location (adjust path and filename handling)
-		out, err := os.Create("./userpic/" + claims.Username + ".jpg")
+		// Named after the user ID, which unlike the username never changes
+		out, err := os.Create(uploadPath(config.Uploads.UserPics, userProfile.UserID+".jpg"))
 		if err != nil {
 			log.Printf("Error creating file: %v", err)
 			http.Error(w, "Failed to save profile picture", http.StatusInternalServerError)
@@ -131,29 +140,27 @@ func editProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 			return
 		}
 
-		// Update the profile picture field in the update document
-		update["profile_picture"] = "/" + claims.Username + ".jpg"
+		// Update the profile picture field
+		userProfile.ProfilePicture = "/" + userProfile.UserID + ".jpg"
 	}
 
 	// Update the user in the database
-	_, err = userCollection.UpdateOne(context.TODO(), bson.M{"username": claims.Username}, bson.M{"$set": update})
+	err := stores.Users.Update(r.Context(), userProfile)
+	if err == ErrDuplicate {
+		http.Error(w, "Username or email already taken", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
 		return
 	}
-	var userProfile User
 
-	// Retrieve the user by username
-	err = userCollection.FindOne(context.TODO(), bson.M{"username": claims.Username}).Decode(&userProfile)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "User not found", http.StatusNotFound)
-			log.Printf("User not found: %s", claims.Username)
-			return
-		}
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		log.Printf("Error retrieving user: %v", err)
-		return
+	// A new password signs out every device, including this one
+	if passwordChanged {
+		revokeUserSessions(r.Context(), userProfile.UserID)
+	}
+	if emailChanged {
+		sendVerificationEmail(userProfile)
 	}
 	w.WriteHeader(http.StatusOK) // Send 204 No Content
 	w.Header().Set("Content-Type", "application/json")
@@ -162,17 +169,8 @@ func editProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
 // Handle profile retrieval
 func getProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	tokenString := r.Header.Get("Authorization")
-	claims := &Claims{}
-	jwt.ParseWithClaims(tokenString[7:], claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-
-	var user User
-	err := userCollection.FindOne(context.TODO(), bson.M{"username": claims.Username}).Decode(&user)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		log.Printf("User not found: %s", claims.Username)
+	user, ok := loadCurrentUser(w, r)
+	if !ok {
 		return
 	}
 
@@ -183,9 +181,8 @@ func getProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 // Handle deleting the user's profile
 func deleteProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	userID := r.Context().Value(userIDKey).(string) // Get the user ID from context
-	log.Println("beep: ", userID)
-	_, err := userCollection.DeleteOne(context.TODO(), bson.M{"userid": userID})
-	if err != nil {
+	err := stores.Users.Delete(r.Context(), userID)
+	if err != nil && err != ErrNotFound {
 		http.Error(w, "Error deleting profile", http.StatusInternalServerError)
 		log.Printf("Error deleting user profile: %v", err)
 		return
@@ -193,6 +190,7 @@ func deleteProfile(w http.ResponseWriter, r *http.Request, _ httprouter.Params)
 
 	// w.WriteHeader(http.StatusNoContent) // No Content response
 	log.Printf("User profile deleted: %s", userID)
+	revokeUserSessions(r.Context(), userID)
 
 	sendResponse(w, http.StatusOK, map[string]string{"": ""}, "Deletion successful", nil)
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEditProfileByUserID(t *testing.T) {
+	useMemoryStores(t)
+	config.Uploads.UserPics = t.TempDir()
+	seedAccount(t, "old password 1")
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("username", "alice2")
+	form.WriteField("bio", "Hello")
+	part, _ := form.CreateFormFile("profile_picture", "me.jpg")
+	part.Write([]byte("jpeg"))
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPut, "/api/profile", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	r = r.WithContext(context.WithValue(r.Context(), userIDKey, "u1"))
+	w := httptest.NewRecorder()
+	editProfile(w, r, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("edit = %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+
+	// The picture is named after the ID, which survives the rename
+	if _, err := os.Stat(filepath.Join(config.Uploads.UserPics, "u1.jpg")); err != nil {
+		t.Errorf("profile picture: %v", err)
+	}
+
+	// The renamed user still finds their profile
+	w = serveAs(getProfile, "u1", http.MethodGet, "/api/profile", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("profile = %d, want %d", w.Code, http.StatusOK)
+	}
+	var user User
+	if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice2" || user.Bio != "Hello" || user.ProfilePicture != "/u1.jpg" {
+		t.Errorf("profile = %s, %q, %s; want alice2, Hello, /u1.jpg", user.Username, user.Bio, user.ProfilePicture)
+	}
+
+	if code := serveAs(getProfile, "gone", http.MethodGet, "/api/profile", "").Code; code != http.StatusNotFound {
+		t.Errorf("profile of a deleted user = %d, want %d", code, http.StatusNotFound)
+	}
+}
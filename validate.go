@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Models declare what a valid value looks like in `validate` struct tags,
+// for example
+//
+//	Title string `json:"title" validate:"required,max=200"`
+//
+// and validate reports every field that breaks its rules, keyed by JSON
+// name. The rules are:
+//
+//	required      must not be empty
+//	min=N, max=N  length of a string in characters, number of entries in a
+//	              slice or map, or value of a number
+//	email, url, phone, username
+//	              format checks
+//	oneof=a b c   must be one of the listed values
+//	readonly      set by the server only; stripReadOnly clears it in
+//	              client input
+//
+// Rules other than required pass on empty values, so optional fields only
+// need checking when they are set. Nested structs are checked too, as
+// "outer.inner". Checks involving more than one field go in a checkFields
+// method.
+
+// FieldErrors maps a JSON field name to what is wrong with it.
+type FieldErrors map[string]string
+
+func (e FieldErrors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return "invalid " + strings.Join(fields, ", ")
+}
+
+// add records a problem with field, keeping the first one reported.
+func (e FieldErrors) add(field, problem string) {
+	if _, ok := e[field]; !ok {
+		e[field] = problem
+	}
+}
+
+// only returns the problems with the fields in keep.
+func (e FieldErrors) only(keep map[string]bool) FieldErrors {
+	kept := FieldErrors{}
+	for field, problem := range e {
+		if keep[field] {
+			kept[field] = problem
+		}
+	}
+	return kept
+}
+
+// fieldChecker is implemented by models with rules tags can't express.
+type fieldChecker interface {
+	checkFields(errs FieldErrors)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// validate checks v, a struct or pointer to one, against its tags.
+func validate(v interface{}) FieldErrors {
+	errs := FieldErrors{}
+	validateStruct(reflect.Indirect(reflect.ValueOf(v)), "", errs)
+	if c, ok := v.(fieldChecker); ok {
+		c.checkFields(errs)
+	}
+	return errs
+}
+
+func validateStruct(v reflect.Value, prefix string, errs FieldErrors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := jsonName(f)
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct && fv.Type() != timeType {
+			validateStruct(fv, prefix+name+".", errs)
+		}
+		for _, rule := range strings.Split(f.Tag.Get("validate"), ",") {
+			if rule == "" {
+				continue
+			}
+			if problem := checkRule(fv, rule); problem != "" {
+				errs.add(prefix+name, problem)
+				break
+			}
+		}
+	}
+}
+
+// jsonName is the name f has in JSON.
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// checkRule returns what is wrong with v under rule, or "".
+func checkRule(v reflect.Value, rule string) string {
+	rule, arg, _ := strings.Cut(rule, "=")
+	if rule == "required" {
+		if v.IsZero() || (v.Kind() == reflect.String && strings.TrimSpace(v.String()) == "") {
+			return "is required"
+		}
+		return ""
+	}
+	if v.IsZero() {
+		return ""
+	}
+
+	switch rule {
+	case "readonly":
+		return ""
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			panic(fmt.Sprintf("validate: bad limit in %s=%s", rule, arg))
+		}
+		var n float64
+		var unit string
+		switch v.Kind() {
+		case reflect.String:
+			n, unit = float64(utf8.RuneCountInString(v.String())), " characters"
+		case reflect.Slice, reflect.Map:
+			n, unit = float64(v.Len()), " entries"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = float64(v.Int())
+		case reflect.Float32, reflect.Float64:
+			n = v.Float()
+		default:
+			panic(fmt.Sprintf("validate: %s doesn't apply to %s", rule, v.Kind()))
+		}
+		if rule == "min" && n < limit {
+			return "must be at least " + arg + unit
+		}
+		if rule == "max" && n > limit {
+			return "must be at most " + arg + unit
+		}
+	case "email":
+		if !validEmail(v.String()) {
+			return "must be a valid email address"
+		}
+	case "url":
+		if !validURL(v.String()) {
+			return "must be an http or https URL"
+		}
+	case "phone":
+		if !validPhone(v.String()) {
+			return "must be a valid phone number"
+		}
+	case "username":
+		if !validUsername(v.String()) {
+			return "must be 3 to 30 lowercase letters, digits, '.', '_' or '-', starting with a letter or digit"
+		}
+	case "oneof":
+		options := strings.Fields(arg)
+		if !contains(options, v.String()) {
+			return "must be one of " + strings.Join(options, ", ")
+		}
+	default:
+		panic(fmt.Sprintf("validate: unknown rule %q", rule))
+	}
+	return ""
+}
+
+// stripReadOnly clears the fields of *v tagged readonly, so client input
+// can't set them.
+func stripReadOnly(v interface{}) {
+	rv := reflect.ValueOf(v).Elem()
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		for _, rule := range strings.Split(t.Field(i).Tag.Get("validate"), ",") {
+			if rule == "readonly" {
+				rv.Field(i).Set(reflect.Zero(t.Field(i).Type))
+			}
+		}
+	}
+}
+
+// writeValidationErrors answers 422 with the problems found.
+func writeValidationErrors(w http.ResponseWriter, errs FieldErrors) {
+	sendResponse(w, http.StatusUnprocessableEntity, map[string]interface{}{"fields": errs}, "Some fields are invalid", nil)
+}
+
+var (
+	usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{2,29}$`)
+	phonePattern    = regexp.MustCompile(`^\+?[0-9 ().-]{7,24}$`)
+)
+
+// normalizeUsername puts a username in its stored form. Usernames are
+// case-insensitive, so "Bob" and "bob" are the same account.
+func normalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// normalizeEmail puts an email address in its stored form.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func validUsername(s string) bool {
+	return usernamePattern.MatchString(s)
+}
+
+// validEmail accepts a bare address (no display name) whose domain has a dot.
+func validEmail(s string) bool {
+	if len(s) > 254 {
+		return false
+	}
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s || addr.Name != "" {
+		return false
+	}
+	_, domain, _ := strings.Cut(s, "@")
+	return strings.Contains(strings.Trim(domain, "."), ".")
+}
+
+func validURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func validPhone(s string) bool {
+	if !phonePattern.MatchString(s) {
+		return false
+	}
+	digits := 0
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	return digits >= 7 && digits <= 15
+}
+
+// maxPasswordBytes is as much of a password as bcrypt looks at.
+const maxPasswordBytes = 72
+
+// commonPasswords are refused outright however long they are.
+var commonPasswords = map[string]bool{
+	"1234567890": true, "12345678910": true, "123456789012": true, "0987654321": true,
+	"1q2w3e4r5t": true, "1qaz2wsx3edc": true, "qwertyuiop": true, "qwerty123456": true,
+	"password123": true, "password1234": true, "password12": true, "passw0rd123": true,
+	"iloveyou123": true, "letmein123": true, "welcome123": true, "sunshine123": true,
+	"football123": true, "baseball123": true, "superman123": true, "princess123": true,
+	"qwertyuiop123": true, "administrator": true, "changeme123": true, "trustno1234": true,
+}
+
+// passwordProblem returns what is wrong with password as the password of
+// user, or "". Length matters most; beyond that it only refuses passwords
+// that are trivially guessed.
+func passwordProblem(password string, user User) string {
+	if n := utf8.RuneCountInString(password); n < config.PasswordMinLength {
+		return fmt.Sprintf("must be at least %d characters", config.PasswordMinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Sprintf("must be at most %d bytes", maxPasswordBytes)
+	}
+	distinct := map[rune]bool{}
+	for _, r := range password {
+		distinct[r] = true
+	}
+	if len(distinct) < 5 {
+		return "must use at least 5 different characters"
+	}
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return "is too common"
+	}
+	local, _, _ := strings.Cut(user.Email, "@")
+	for _, personal := range []string{user.Username, local} {
+		if len(personal) >= 3 && strings.Contains(lower, strings.ToLower(personal)) {
+			return "must not contain your username or email address"
+		}
+	}
+	return ""
+}
+
+func (u User) checkFields(errs FieldErrors) {
+	for name, link := range u.SocialLinks {
+		if !validURL(link) {
+			errs.add("social_links."+name, "must be an http or https URL")
+		}
+	}
+	if u.DateOfBirth.After(time.Now()) {
+		errs.add("date_of_birth", "must be in the past")
+	}
+}
+
+func (e Event) checkFields(errs FieldErrors) {
+	if !e.StartDateTime.IsZero() && !e.EndDateTime.IsZero() && e.EndDateTime.Before(e.StartDateTime) {
+		errs.add("end_date_time", "must not be before start_date_time")
+	}
+	for _, tag := range e.Tags {
+		if n := utf8.RuneCountInString(strings.TrimSpace(tag)); n == 0 || n > 30 {
+			errs.add("tags", "each tag must be 1 to 30 characters")
+		}
+	}
+	for _, link := range e.SocialMediaLinks {
+		if !validURL(link) {
+			errs.add("social_media_links", "must all be http or https URLs")
+		}
+	}
+}
+
+func (p Place) checkFields(errs FieldErrors) {
+	for name, link := range p.SocialLinks {
+		if !validURL(link) {
+			errs.add("socialLinks."+name, "must be an http or https URL")
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+type validateInner struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type validateSample struct {
+	Name    string            `json:"name" validate:"required,max=5"`
+	Nick    string            `json:"nick" validate:"min=3"`
+	Email   string            `json:"email" validate:"email"`
+	Site    string            `json:"site" validate:"url"`
+	Phone   string            `json:"phone" validate:"phone"`
+	User    string            `json:"user" validate:"username"`
+	Kind    string            `json:"kind" validate:"oneof=a b"`
+	Count   int               `json:"count" validate:"max=10"`
+	Tags    []string          `json:"tags" validate:"max=2"`
+	Extra   map[string]string `json:"extra" validate:"max=1"`
+	ID      string            `json:"id" validate:"readonly"`
+	Inner   validateInner     `json:"inner"`
+	Ignored string            `json:"-" validate:"required"`
+}
+
+// validSample passes every rule of validateSample.
+func validSample() validateSample {
+	return validateSample{Name: "Ann", Inner: validateInner{Code: "x"}}
+}
+
+func TestValidateRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*validateSample)
+		field  string // The field with a problem, or "" for none
+	}{
+		{"a valid value", func(*validateSample) {}, ""},
+		{"empty optional fields", func(s *validateSample) { s.Nick, s.Email, s.Kind = "", "", "" }, ""},
+		{"a missing required field", func(s *validateSample) { s.Name = "" }, "name"},
+		{"a blank required field", func(s *validateSample) { s.Name = "  " }, "name"},
+		{"a string over max, in characters", func(s *validateSample) { s.Name = "ééééééé" }, "name"},
+		{"a string at max, in characters", func(s *validateSample) { s.Name = "ééééé" }, ""},
+		{"a string under min", func(s *validateSample) { s.Nick = "ab" }, "nick"},
+		{"a bad email", func(s *validateSample) { s.Email = "Ann <ann@example.com>" }, "email"},
+		{"an email without a dotted domain", func(s *validateSample) { s.Email = "ann@localhost" }, "email"},
+		{"a good email", func(s *validateSample) { s.Email = "ann@example.com" }, ""},
+		{"a non-http URL", func(s *validateSample) { s.Site = "javascript:alert(1)" }, "site"},
+		{"a good URL", func(s *validateSample) { s.Site = "https://example.com/x" }, ""},
+		{"a short phone number", func(s *validateSample) { s.Phone = "12345" }, "phone"},
+		{"a good phone number", func(s *validateSample) { s.Phone = "+1 (555) 010-0000" }, ""},
+		{"an uppercase username", func(s *validateSample) { s.User = "Ann" }, "user"},
+		{"a username starting with a dot", func(s *validateSample) { s.User = ".ann" }, "user"},
+		{"a good username", func(s *validateSample) { s.User = "ann_1" }, ""},
+		{"a value not in oneof", func(s *validateSample) { s.Kind = "c" }, "kind"},
+		{"a number over max", func(s *validateSample) { s.Count = 11 }, "count"},
+		{"a slice over max", func(s *validateSample) { s.Tags = []string{"a", "b", "c"} }, "tags"},
+		{"a map over max", func(s *validateSample) { s.Extra = map[string]string{"a": "", "b": ""} }, "extra"},
+		{"a readonly field", func(s *validateSample) { s.ID = "set" }, ""},
+		{"a nested field", func(s *validateSample) { s.Inner.Code = "" }, "inner.code"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := validSample()
+			tt.change(&s)
+			errs := validate(s)
+			if tt.field == "" {
+				if len(errs) != 0 {
+					t.Errorf("validate() = %v, want no problems", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || errs[tt.field] == "" {
+				t.Errorf("validate() = %v, want one problem with %s", errs, tt.field)
+			}
+		})
+	}
+}
+
+func TestValidateEventFields(t *testing.T) {
+	event := Event{Title: "Show", Description: "A show", Location: "Hall", Status: EventDraft}
+	if errs := validate(event); len(errs) != 0 {
+		t.Fatalf("validate() = %v, want no problems", errs)
+	}
+	event.EndDateTime = event.StartDateTime.AddDate(0, 0, 1)
+	event.StartDateTime = event.EndDateTime.AddDate(0, 0, 1)
+	event.Tags = []string{"ok", " "}
+	event.SocialMediaLinks = []string{"ftp://example.com"}
+	errs := validate(event)
+	for _, field := range []string{"end_date_time", "tags", "social_media_links"} {
+		if errs[field] == "" {
+			t.Errorf("validate() = %v, want a problem with %s", errs, field)
+		}
+	}
+}
+
+func TestStripReadOnly(t *testing.T) {
+	s := validSample()
+	s.ID = "client-chosen"
+	stripReadOnly(&s)
+	if s.ID != "" || s.Name != "Ann" {
+		t.Errorf("after stripReadOnly: id %q, name %q; want only the id cleared", s.ID, s.Name)
+	}
+}
+
+func TestPasswordProblem(t *testing.T) {
+	useMemoryStores(t)
+	user := User{Username: "alice", Email: "ally@example.com"}
+	tests := []struct {
+		password string
+		want     string
+	}{
+		{"correct horse", ""},
+		{"short", "at least"},
+		{strings.Repeat("abcdef", 13), "at most"},
+		{"aaaabbbbcccc", "different characters"},
+		{"Password123", "too common"},
+		{"hi alice 2024", "username or email"},
+		{"dear ally 2024", "username or email"},
+	}
+	for _, tt := range tests {
+		got := passwordProblem(tt.password, user)
+		if (tt.want == "") != (got == "") || !strings.Contains(got, tt.want) {
+			t.Errorf("passwordProblem(%q) = %q, want %q", tt.password, got, tt.want)
+		}
+	}
+}